@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/fallenkarma/wasatext/internal/logging"
+)
+
+// setupLogging makes the structured logger configured by LOG_LEVEL (debug, info,
+// warn or error) and LOG_FORMAT (text or json) the default one. Output of the
+// log package goes through it too.
+func setupLogging() {
+	level, err := logging.ParseLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger, err := logging.New(os.Stderr, level, os.Getenv("LOG_FORMAT"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+}
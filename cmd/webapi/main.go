@@ -3,27 +3,40 @@ package main
 import (
 	"context"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strconv"
+	"syscall"
 	"time"
 
-	handlers "github.com/fallenkarma/wasatext/service/api"
-	"github.com/fallenkarma/wasatext/service/repository"
-	"github.com/fallenkarma/wasatext/service/repository/sqlite"
-	"github.com/fallenkarma/wasatext/service/service"
+	"github.com/fallenkarma/wasatext/internal/handlers"
+	"github.com/fallenkarma/wasatext/internal/health"
+	"github.com/fallenkarma/wasatext/internal/logging"
+	"github.com/fallenkarma/wasatext/internal/metrics"
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/ratelimit"
+	"github.com/fallenkarma/wasatext/internal/repository/instrumented"
+	"github.com/fallenkarma/wasatext/internal/service"
+	"github.com/fallenkarma/wasatext/internal/storage"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	"github.com/rs/cors"
 )
 
 func main() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Println("Warning: Error loading .env file:", err)
+	envErr := godotenv.Load()
+	setupLogging()
+	if envErr != nil {
+		slog.Warn("No .env file loaded", "error", envErr)
 	} else {
-		log.Println("Successfully loaded .env file")
+		slog.Info("Loaded .env file")
+	}
+
+	// Schema maintenance: webapi migrate up|down|status
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
 	}
 
     // Get environment variables
@@ -32,95 +45,204 @@ func main() {
         port = "8080" 
     }
 
-	ex, err := os.Executable()
+	repo, err := openRepository()
 	if err != nil {
-		log.Fatalf("Failed to get executable path: %v", err)
+		log.Fatalf("Connection to database failed: %v", err)
 	}
-	exPath := filepath.Dir(ex)
-    
-    dbConnectionString := os.Getenv("DB_CONNECTION_STRING")
-	log.Print("DB_CONNECTION_STRING: ", dbConnectionString)
+	repo = instrumented.New(repo, storageBackend())
 
-	const UPLOADS_BASE_PATH = "/app/uploads"
-/* 	repo,err := postgres.NewPostgresRepository(dbConnectionString,UPLOADS_BASE_PATH)
-	if err != nil {
-		log.Fatalf("Connection to database failed: %v", err)
-	} */
-    var repo repository.Repository
-	dbPath := filepath.Join(exPath, "wasatext.db") // SQLite database file
-	sqliteRepo, err := sqlite.NewSqliteRepository(dbPath, UPLOADS_BASE_PATH)
+	blobs, err := openBlobStore()
 	if err != nil {
-		log.Fatalf("Failed to create SQLite repository: %v", err)
+		log.Fatalf("Failed to open blob store: %v", err)
+	}
+
+	// Service settings, overridable from the environment
+	config := service.DefaultConfig()
+	config.Blobs = blobs
+	if ttl := os.Getenv("SESSION_TTL"); ttl != "" {
+		config.SessionTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("Invalid SESSION_TTL: %v", err)
+		}
+	}
+	if os.Getenv("REQUIRE_PASSWORD") == "true" {
+		config.AllowPasswordlessLogin = false
+	}
+	if window := os.Getenv("EDIT_WINDOW"); window != "" {
+		config.EditWindow, err = time.ParseDuration(window)
+		if err != nil {
+			log.Fatalf("Invalid EDIT_WINDOW: %v", err)
+		}
+	}
+	if window := os.Getenv("DELETE_WINDOW"); window != "" {
+		config.DeleteWindow, err = time.ParseDuration(window)
+		if err != nil {
+			log.Fatalf("Invalid DELETE_WINDOW: %v", err)
+		}
+	}
+	if dimension := os.Getenv("MAX_IMAGE_DIMENSION"); dimension != "" {
+		config.Media.MaxDimension, err = strconv.Atoi(dimension)
+		if err != nil || config.Media.MaxDimension <= 0 {
+			log.Fatalf("Invalid MAX_IMAGE_DIMENSION: %q", dimension)
+		}
+	}
+
+	// Size limits of attachments, in bytes
+	for msgType, name := range map[models.MessageType]string{
+		models.FileMessage:  "MAX_FILE_SIZE",
+		models.AudioMessage: "MAX_AUDIO_SIZE",
+		models.VideoMessage: "MAX_VIDEO_SIZE",
+	} {
+		if value := os.Getenv(name); value != "" {
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				log.Fatalf("Invalid %s: %q", name, value)
+			}
+			config.AttachmentLimits[msgType] = size
+		}
+	}
+
+	ttl := time.Hour
+	if value := os.Getenv("MEDIA_URL_TTL"); value != "" {
+		ttl, err = time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			log.Fatalf("Invalid MEDIA_URL_TTL: %q", value)
+		}
+	}
+	secret := os.Getenv("MEDIA_URL_SECRET")
+	if secret == "" {
+		slog.Warn("MEDIA_URL_SECRET is not set: links to message photos stop working on restart")
 	}
-	repo = sqliteRepo
-	log.Printf("Using SQLite repository at %s.", dbPath)
+	config.MediaSigner = storage.NewURLSigner([]byte(secret), ttl)
 
 	// Initialize service with repository
-	svc := service.New(repo)
+	svc := service.NewWithConfig(repo, config)
 
 	// Initialize handlers with service
-	handler := handlers.New(svc)
+	handler := handlers.New(svc, svc, svc)
+
+	// Throttle the routes that create accounts, messages and files.
+	// Buckets are kept in memory, so each instance of the server enforces its own limits.
+	limits := loadRateLimits()
+	limitStore := ratelimit.NewMemoryStore()
+	loginLimit := ratelimit.Middleware(limitStore, ratelimit.Rule{Class: "login", Limit: limits.login, Key: ratelimit.RemoteIP})
+	messageLimit := ratelimit.Middleware(limitStore, ratelimit.Rule{Class: "messages", Limit: limits.messages, Key: handlers.RateLimitKey})
+	uploadLimit := ratelimit.Middleware(limitStore, ratelimit.Rule{Class: "uploads", Limit: limits.uploads, Key: handlers.RateLimitKey, Match: handlers.IsUpload})
+	slog.Info("Rate limits", "login", limits.login, "messages", limits.messages, "uploads", limits.uploads)
 
 	// Initialize router
 	r := mux.NewRouter()
+	r.Use(metrics.Middleware)
+
+	// Metrics are served on the admin address when there is one, and on the API port otherwise
+	metricsAddr := os.Getenv("METRICS_ADDR")
+	if metricsAddr == "" {
+		r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	}
 
 
-    // This serves files from the UPLOADS_BASE_PATH on the /uploads/ endpoint.
-    // So if a file is saved at /uploads/user_photos/user123_12345.jpg
-    // it will be accessible at http://your-backend-ip:port/uploads/user_photos/user123_12345.jpg
-    fileServer := http.FileServer(http.Dir(UPLOADS_BASE_PATH))
-    r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", fileServer))
+	// Uploaded media is served from the blob store on the /uploads/ endpoint, so the
+	// blob stored under user_photos/<name>.jpg is at /uploads/user_photos/<name>.jpg.
+	// Message photos are only served on the signed URLs messages carry.
+	r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", storage.Handler(blobs, config.MediaSigner, service.PrivateMedia)))
 
 	
 	// Add API prefix
 	apiRouter := r.PathPrefix("/api").Subrouter()
 
 	// Public routes (no auth required)
-	apiRouter.HandleFunc("/session", handler.Login).Methods("POST")
+	apiRouter.Handle("/session", loginLimit(http.HandlerFunc(handler.Login))).Methods("POST")
+
+	// Real-time event stream, authenticated by the handler itself since
+	// WebSocket and EventSource clients may pass the token as a query parameter
+	apiRouter.HandleFunc("/events", handler.Events).Methods("GET")
 
 	// Protected routes (auth required)
 	protected := apiRouter.NewRoute().Subrouter()
 	protected.Use(handler.AuthMiddleware)
 
+	// Session routes
+	protected.HandleFunc("/session", handler.Logout).Methods("DELETE")
+
 	// User routes
 	protected.HandleFunc("/users", handler.GetUsers).Methods("GET")
 	protected.HandleFunc("/users/me", handler.GetMyUser).Methods("GET")
 	protected.HandleFunc("/users/me/username", handler.SetMyUserName).Methods("PUT")
-	protected.HandleFunc("/users/me/photo", handler.SetMyPhoto).Methods("PUT")
+	protected.Handle("/users/me/photo", uploadLimit(http.HandlerFunc(handler.SetMyPhoto))).Methods("PUT")
+	protected.HandleFunc("/users/me/password", handler.SetMyPassword).Methods("PUT")
 
 	// Conversation routes
 	protected.HandleFunc("/conversations", handler.CreateConversation).Methods("POST")
 	protected.HandleFunc("/conversations", handler.GetMyConversations).Methods("GET")
 	protected.HandleFunc("/conversations/{id}", handler.GetConversation).Methods("GET")
+	protected.HandleFunc("/conversations/{id}/messages", handler.GetConversationMessages).Methods("GET")
+	protected.HandleFunc("/conversations/{id}/received", handler.MarkMessagesReceived).Methods("POST")
+	protected.HandleFunc("/conversations/{id}/read", handler.MarkMessagesRead).Methods("POST")
 
 	// Message routes
-	protected.HandleFunc("/messages", handler.SendMessage).Methods("POST")
-	protected.HandleFunc("/messages/forward", handler.ForwardMessage).Methods("POST")
+	protected.Handle("/messages", messageLimit(uploadLimit(http.HandlerFunc(handler.SendMessage)))).Methods("POST")
+	protected.Handle("/messages/forward", messageLimit(http.HandlerFunc(handler.ForwardMessage))).Methods("POST")
+	protected.HandleFunc("/messages/{id}/receipts", handler.GetMessageReceipts).Methods("GET")
+	protected.HandleFunc("/messages/{id}/history", handler.GetMessageHistory).Methods("GET")
+	protected.HandleFunc("/messages/{id}/replies", handler.GetReplies).Methods("GET")
 	protected.HandleFunc("/messages/{id}/reaction", handler.CommentMessage).Methods("POST")
 	protected.HandleFunc("/messages/{id}/reaction", handler.UncommentMessage).Methods("DELETE")
 	protected.HandleFunc("/messages/{id}", handler.DeleteMessage).Methods("DELETE")
 	protected.HandleFunc("/messages/{id}", handler.UpdateMessage).Methods("PUT")
 
+	// Search routes
+	protected.HandleFunc("/search/messages", handler.SearchMessages).Methods("GET")
+
 	// Group routes
 	protected.HandleFunc("/groups/{id}/members", handler.AddToGroup).Methods("POST")
 	protected.HandleFunc("/groups/{id}/leave", handler.LeaveGroup).Methods("POST")
 	protected.HandleFunc("/groups/{id}/name", handler.SetGroupName).Methods("PUT")
-	protected.HandleFunc("/groups/{id}/photo", handler.SetGroupPhoto).Methods("PUT")
+	protected.Handle("/groups/{id}/photo", uploadLimit(http.HandlerFunc(handler.SetGroupPhoto))).Methods("PUT")
+	protected.HandleFunc("/groups/{id}/members/{userId}", handler.RemoveFromGroup).Methods("DELETE")
+	protected.HandleFunc("/groups/{id}/admins", handler.PromoteMember).Methods("POST")
+	protected.HandleFunc("/groups/{id}/admins/{userId}", handler.DemoteAdmin).Methods("DELETE")
+	protected.HandleFunc("/groups/{id}/policy", handler.SetGroupPolicy).Methods("PUT")
 
 	crs := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:4173"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", logging.RequestIDHeader},
+		ExposedHeaders:   []string{"Retry-After", logging.RequestIDHeader},
 		AllowCredentials: true,
 	})
 
-	// Wrap the router with CORS handler
-	handlerWithCORS := crs.Handler(r)	
+	// Wrap the router with CORS handler, inside the logging middleware so that
+	// every response carries a request ID
+	handlerWithCORS := logging.Middleware(crs.Handler(r))
+
+	// Health probes are answered outside the API's middleware, keeping them out of
+	// the access logs and the metrics. The blob probe writes a file, so it runs at
+	// most every 10 seconds however often the public endpoint is hit.
+	checker := health.NewChecker(map[string]health.Check{
+		"repository": repo.Ping,
+		"blobs": health.Cached(func(ctx context.Context) error {
+			return storage.Probe(ctx, blobs)
+		}, 10*time.Second),
+	})
+	root := http.NewServeMux()
+	root.HandleFunc("GET /healthz", checker.Live)
+	root.HandleFunc("GET /readyz", checker.Ready)
+	root.Handle("/", handlerWithCORS)
+
+	// How long readiness fails before the server stops accepting requests on shutdown,
+	// leaving load balancers time to notice
+	var shutdownDelay time.Duration
+	if value := os.Getenv("SHUTDOWN_DELAY"); value != "" {
+		shutdownDelay, err = time.ParseDuration(value)
+		if err != nil || shutdownDelay < 0 {
+			log.Fatalf("Invalid SHUTDOWN_DELAY: %q", value)
+		}
+	}
 
 	// Create server
 	srv := &http.Server{
 		Addr:         ":" + port,
-		Handler:      handlerWithCORS,
+		Handler:      root,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
@@ -128,25 +250,53 @@ func main() {
 
 	// Start server in a goroutine
 	go func() {
-		log.Println("Starting server on :" + port)
+		slog.Info("Starting server", "port", port)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed: %v", err)
 		}
 	}()
 
+	var adminSrv *http.Server
+	if metricsAddr != "" {
+		admin := http.NewServeMux()
+		admin.Handle("GET /metrics", metrics.Handler())
+		adminSrv = &http.Server{
+			Addr:         metricsAddr,
+			Handler:      admin,
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 15 * time.Second,
+		}
+		go func() {
+			slog.Info("Serving metrics", "addr", metricsAddr)
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Metrics server failed: %v", err)
+			}
+		}()
+	}
+
 	// Wait for interrupt signal
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 
+	// Fail readiness first, so that traffic drains away before the listener closes
+	checker.Drain()
+	if shutdownDelay > 0 {
+		slog.Info("Draining before shutdown", "delay", shutdownDelay)
+		time.Sleep(shutdownDelay)
+	}
+
 	// Create a deadline to wait for
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 
 	// Gracefully shutdown the server
-	log.Println("Shutting down server...")
+	slog.Info("Shutting down server")
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatalf("Server shutdown failed: %v", err)
 	}
-	log.Println("Server gracefully stopped")
+	if adminSrv != nil {
+		adminSrv.Shutdown(ctx)
+	}
+	slog.Info("Server gracefully stopped")
 }
\ No newline at end of file
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/ratelimit"
+)
+
+// rateLimits are the limits of each class of routes
+type rateLimits struct {
+	login    ratelimit.Limit // Logins, which create accounts on the fly, per IP address
+	messages ratelimit.Limit // Messages sent and forwarded, per user
+	uploads  ratelimit.Limit // Photos and files uploaded, per user
+}
+
+// loadRateLimits reads the rate limits from the environment, as requests/period
+// such as 10/1m, or off
+func loadRateLimits() rateLimits {
+	return rateLimits{
+		login:    rateLimit("RATE_LIMIT_LOGIN", ratelimit.Limit{Requests: 10, Per: time.Minute}),
+		messages: rateLimit("RATE_LIMIT_MESSAGES", ratelimit.Limit{Requests: 60, Per: time.Minute}),
+		uploads:  rateLimit("RATE_LIMIT_UPLOADS", ratelimit.Limit{Requests: 20, Per: time.Minute}),
+	}
+}
+
+func rateLimit(name string, fallback ratelimit.Limit) ratelimit.Limit {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	limit, err := ratelimit.ParseLimit(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return limit
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/fallenkarma/wasatext/internal/migrate"
+	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/repository/memory"
+	"github.com/fallenkarma/wasatext/internal/repository/postgres"
+	"github.com/fallenkarma/wasatext/internal/repository/sqlite"
+	"github.com/fallenkarma/wasatext/internal/storage"
+)
+
+// storageBackend returns the configured storage backend (postgres, sqlite or memory).
+// It defaults to Postgres when a connection string is set, otherwise to an
+// embedded SQLite database so the server runs as a single binary
+func storageBackend() string {
+	if storage := os.Getenv("STORAGE"); storage != "" {
+		return storage
+	}
+	if os.Getenv("DB_CONNECTION_STRING") != "" {
+		return "postgres"
+	}
+	return "sqlite"
+}
+
+// sqlitePath returns the location of the SQLite database file
+func sqlitePath() string {
+	if path := os.Getenv("SQLITE_PATH"); path != "" {
+		return path
+	}
+	return "wasatext.db"
+}
+
+// openRepository opens the configured storage backend, migrating it to the latest schema
+func openRepository() (repository.Repository, error) {
+	storage := storageBackend()
+	slog.Info("Opening storage backend", "storage", storage)
+
+	switch storage {
+	case "postgres":
+		return postgres.NewPostgresRepository(os.Getenv("DB_CONNECTION_STRING"))
+	case "sqlite":
+		slog.Info("Opening SQLite database", "path", sqlitePath())
+		return sqlite.NewSqliteRepository(sqlitePath())
+	case "memory":
+		slog.Warn("Using in-memory storage: all data is lost on restart")
+		return memory.NewMemoryRepository(), nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE %q: expected postgres, sqlite or memory", storage)
+	}
+}
+
+// uploadPath returns the directory the local blob store keeps uploaded media in
+func uploadPath() string {
+	if path := os.Getenv("UPLOAD_PATH"); path != "" {
+		return path
+	}
+	return "uploads"
+}
+
+// openBlobStore opens the configured store for uploaded media (local or s3).
+// Blobs are served under /uploads unless the bucket has a public URL of its own.
+func openBlobStore() (storage.BlobStore, error) {
+	switch store := os.Getenv("BLOB_STORE"); store {
+	case "", "local":
+		slog.Info("Opening blob store", "store", "local", "path", uploadPath())
+		return storage.NewLocalStore(uploadPath(), "/uploads"), nil
+	case "s3":
+		baseURL := os.Getenv("S3_PUBLIC_URL")
+		if baseURL == "" {
+			baseURL = "/uploads"
+		}
+		slog.Info("Opening blob store", "store", "s3", "bucket", os.Getenv("S3_BUCKET"), "endpoint", os.Getenv("S3_ENDPOINT"))
+		return storage.NewS3Store(storage.S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			BaseURL:         baseURL,
+		}, nil)
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q: expected local or s3", store)
+	}
+}
+
+// openMigrator connects to the configured storage backend without migrating it
+func openMigrator() (*migrate.Migrator, *sql.DB, error) {
+	var db *sql.DB
+	var newMigrator func(*sql.DB) (*migrate.Migrator, error)
+	var err error
+
+	switch storage := storageBackend(); storage {
+	case "postgres":
+		db, err = postgres.Open(os.Getenv("DB_CONNECTION_STRING"))
+		newMigrator = postgres.NewMigrator
+	case "sqlite":
+		db, err = sqlite.Open(sqlitePath())
+		newMigrator = sqlite.NewMigrator
+	case "memory":
+		return nil, nil, errors.New("in-memory storage has no schema to migrate")
+	default:
+		return nil, nil, fmt.Errorf("unknown STORAGE %q: expected postgres or sqlite", storage)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	migrator, err := newMigrator(db)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return migrator, db, nil
+}
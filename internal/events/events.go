@@ -0,0 +1,163 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+)
+
+// Type identifies the kind of change an event describes
+type Type string
+
+const (
+	ConversationCreated Type = "conversation.created"
+	MessageCreated      Type = "message.created"
+	MessageEdited       Type = "message.edited"
+	MessageDeleted      Type = "message.deleted"
+	MessageHidden       Type = "message.hidden"
+	ReceiptsUpdated     Type = "receipts.updated"
+	ReactionAdded       Type = "reaction.added"
+	ReactionRemoved     Type = "reaction.removed"
+	ParticipantJoined   Type = "participant.joined"
+	ParticipantLeft     Type = "participant.left"
+	ParticipantRole     Type = "participant.role"
+	GroupRenamed        Type = "group.renamed"
+	GroupPolicyChanged  Type = "group.policy"
+)
+
+// Event is a change pushed to connected clients
+type Event struct {
+	Type           Type        `json:"type"`
+	ConversationID string      `json:"conversationId"`
+	Timestamp      time.Time   `json:"timestamp"`
+	Payload        interface{} `json:"payload"`
+
+	// Recipients are the IDs of the users allowed to receive the event
+	Recipients []string `json:"-"`
+}
+
+// MessageRef is the payload of events about a message that is no longer available in full
+type MessageRef struct {
+	MessageID string `json:"messageId"`
+}
+
+// MessageEdit is the payload of MessageEdited events
+type MessageEdit struct {
+	MessageID string    `json:"messageId"`
+	Content   string    `json:"content"`
+	EditedAt  time.Time `json:"editedAt"`
+}
+
+// ReceiptUpdate is the payload of ReceiptsUpdated events: the user received,
+// or read, every message of the conversation up to and including MessageID
+type ReceiptUpdate struct {
+	UserID    string `json:"userId"`
+	MessageID string `json:"messageId"`
+	Read      bool   `json:"read"`
+}
+
+// ReactionRemoval is the payload of ReactionRemoved events
+type ReactionRemoval struct {
+	MessageID string `json:"messageId"`
+	UserID    string `json:"user"`
+}
+
+// ParticipantChange is the payload of ParticipantJoined and ParticipantLeft events
+type ParticipantChange struct {
+	UserID    string `json:"userId"`
+	RemovedBy string `json:"removedBy,omitempty"` // Set when the participant was removed by someone else
+}
+
+// RoleChange is the payload of ParticipantRole events
+type RoleChange struct {
+	UserID string                 `json:"userId"`
+	Role   models.ParticipantRole `json:"role"`
+}
+
+// GroupRename is the payload of GroupRenamed events
+type GroupRename struct {
+	Name string `json:"name"`
+}
+
+// subscriptionBuffer is how many events a slow subscriber may fall behind before events are dropped
+const subscriptionBuffer = 64
+
+// Bus is an in-process publish/subscribe hub for events
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers map[*Subscription]struct{}
+}
+
+// NewBus creates a new event bus
+func NewBus() *Bus {
+	return &Bus{
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscription receives the events addressed to a single user
+type Subscription struct {
+	UserID string
+
+	bus    *Bus
+	events chan Event
+	once   sync.Once
+}
+
+// Subscribe registers a subscription for the given user
+func (b *Bus) Subscribe(userID string) *Subscription {
+	sub := &Subscription{
+		UserID: userID,
+		bus:    b,
+		events: make(chan Event, subscriptionBuffer),
+	}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+
+	return sub
+}
+
+// Events returns the channel events are delivered on.
+// It is closed when the subscription is closed.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Close unregisters the subscription
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subscribers, s)
+		s.bus.mu.Unlock()
+		close(s.events)
+	})
+}
+
+// Publish delivers an event to every subscriber listed among its recipients.
+// It never blocks: subscribers whose buffer is full miss the event.
+func (b *Bus) Publish(event Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	recipients := make(map[string]struct{}, len(event.Recipients))
+	for _, userID := range event.Recipients {
+		recipients[userID] = struct{}{}
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subscribers {
+		if _, ok := recipients[sub.UserID]; !ok {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+		}
+	}
+}
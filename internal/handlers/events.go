@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/events"
+	"github.com/fallenkarma/wasatext/internal/metrics"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// eventWriteTimeout bounds how long a single event may take to reach a client
+	eventWriteTimeout = 10 * time.Second
+
+	// eventPingInterval is how often idle connections are pinged to keep them alive
+	eventPingInterval = 30 * time.Second
+
+	// eventPongTimeout is how long a WebSocket client may stay silent before it is dropped
+	eventPongTimeout = 2 * eventPingInterval
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// The stream is authenticated with an explicit token, not cookies,
+	// so cross-origin connections cannot ride on a browser session
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Events streams real-time events for the user's conversations.
+// It upgrades to a WebSocket when requested and falls back to Server-Sent Events otherwise.
+// Browsers cannot set headers on either transport, so the token may also be passed as ?token=.
+func (h *Handler) Events(w http.ResponseWriter, r *http.Request) {
+	handlerName := "Events"
+
+	token := extractToken(r)
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		slog.WarnContext(r.Context(), "No token provided", "handler", handlerName, "remote_addr", r.RemoteAddr)
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	user, err := h.users.Authenticate(r.Context(), token)
+	if err != nil || user == nil {
+		slog.WarnContext(r.Context(), "Invalid token", "handler", handlerName, "remote_addr", r.RemoteAddr, "error", err)
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	logRequest(handlerName, r, user.ID)
+
+	sub := h.conversations.SubscribeEvents(user.ID)
+	defer sub.Close()
+
+	if websocket.IsWebSocketUpgrade(r) {
+		h.streamWebSocket(w, r, user.ID, sub)
+	} else {
+		h.streamSSE(w, r, user.ID, sub)
+	}
+
+	slog.DebugContext(r.Context(), "Event stream closed", "handler", handlerName, "user_id", user.ID)
+}
+
+// streamWebSocket pushes events as JSON text frames until the client goes away
+func (h *Handler) streamWebSocket(w http.ResponseWriter, r *http.Request, userID string, sub *events.Subscription) {
+	handlerName := "Events"
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied to the client
+		logError(handlerName, r, userID, err, "WebSocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+
+	metrics.EventClients.WithLabelValues("websocket").Inc()
+	defer metrics.EventClients.WithLabelValues("websocket").Dec()
+
+	// Clients never send anything meaningful; reading is only needed to process
+	// pongs and close frames, and to notice when the connection drops
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(eventPongTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(eventPongTimeout))
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(eventPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case event, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if err := conn.WriteJSON(event); err != nil {
+				logError(handlerName, r, userID, err, "Failed to write event")
+				return
+			}
+		case <-ping.C:
+			deadline := time.Now().Add(eventWriteTimeout)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// streamSSE pushes events as Server-Sent Events until the client goes away
+func (h *Handler) streamSSE(w http.ResponseWriter, r *http.Request, userID string, sub *events.Subscription) {
+	handlerName := "Events"
+
+	rc := http.NewResponseController(w)
+
+	// The server's write timeout is meant for regular requests, not long-lived streams
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		logError(handlerName, r, userID, err, "Streaming not supported")
+		respondWithError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	metrics.EventClients.WithLabelValues("sse").Inc()
+	defer metrics.EventClients.WithLabelValues("sse").Dec()
+
+	ping := time.NewTicker(eventPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				logError(handlerName, r, userID, err, "Failed to encode event")
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-ping.C:
+			// Comment lines keep intermediaries from closing an idle stream
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -5,25 +5,35 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/fallenkarma/wasatext/internal/media"
+	"github.com/fallenkarma/wasatext/internal/metrics"
 	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/ratelimit"
 	"github.com/fallenkarma/wasatext/internal/service"
 	"github.com/gorilla/mux"
 )
 
-// Handler defines the HTTP handlers for the API
+// Handler defines the HTTP handlers for the API.
+// The services it calls decide what users may do; handlers only translate requests.
 type Handler struct {
-	service *service.Service
+	users         service.UserService
+	conversations service.ConversationService
+	messages      service.MessageService
 }
 
-func New(svc *service.Service) *Handler {
-	log.Println("Initializing API handlers")
+// New creates the handlers on top of the services they call
+func New(users service.UserService, conversations service.ConversationService, messages service.MessageService) *Handler {
 	return &Handler{
-		service: svc,
+		users:         users,
+		conversations: conversations,
+		messages:      messages,
 	}
 }
 
@@ -38,96 +48,187 @@ func extractToken(r *http.Request) string {
 	return strings.TrimPrefix(bearerToken, "Bearer ")
 }
 
-// logs information about an incoming request
+// logRequest logs that a handler is serving a request; the logging middleware
+// logs the outcome
 func logRequest(handler string, r *http.Request, userID string) {
-	log.Printf("[%s] %s %s | UserID: %s | IP: %s | User-Agent: %s", 
-		handler, 
-		r.Method, 
-		r.URL.Path, 
-		userID,
-		r.RemoteAddr,
-		r.UserAgent(),
+	slog.DebugContext(r.Context(), "Serving request",
+		"handler", handler,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"user_id", userID,
 	)
 }
 
-// logRequestWithDuration logs information about a request and its duration
+// logRequestWithDuration logs a request once it has been served
 func logRequestWithDuration(handler string, r *http.Request, userID string, start time.Time, statusCode int) {
-	duration := time.Since(start)
-	log.Printf("[%s] %s %s | UserID: %s | Status: %d | Duration: %s | IP: %s", 
-		handler, 
-		r.Method, 
-		r.URL.Path, 
-		userID,
-		statusCode,
-		duration,
-		r.RemoteAddr,
+	slog.InfoContext(r.Context(), "Request handled",
+		"handler", handler,
+		"user_id", userID,
+		"status", statusCode,
+		"duration", time.Since(start),
 	)
 }
 
-// logError logs an error with request context
+// logError logs an error with request context. Errors the client caused are
+// logged as warnings, the others, which answer with 500, as errors.
 func logError(handler string, r *http.Request, userID string, err error, msg string) {
-	log.Printf("[ERROR][%s] %s %s | UserID: %s | %s: %v",
-		handler,
-		r.Method,
-		r.URL.Path,
-		userID,
-		msg,
-		err,
+	level := slog.LevelWarn
+	if err != nil && !isClientError(err) {
+		level = slog.LevelError
+	}
+	slog.Log(r.Context(), level, msg,
+		"handler", handler,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"user_id", userID,
+		"error", err,
 	)
 }
 
+// isClientError reports whether err comes from the request rather than the server
+func isClientError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	status, _ := serviceError(err)
+	return status < http.StatusInternalServerError
+}
+
 // handles authentication for protected endpoints
 func (h *Handler) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Extract token from request
 		token := extractToken(r)
 		if token == "" {
-			log.Printf("[AuthMiddleware] %s %s | No token provided | IP: %s", r.Method, r.URL.Path, r.RemoteAddr)
-			http.Error(w, "Unauthorized: No token provided", http.StatusUnauthorized)
+			slog.WarnContext(r.Context(), "No token provided", "handler", "AuthMiddleware", "remote_addr", r.RemoteAddr)
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized: No token provided")
 			return
 		}
 
-		// Verify token by checking if the user exists
+		// Resolve the session token to its user
 		start := time.Now()
-		user, err := h.service.GetUser(r.Context(), token)
+		user, err := h.users.Authenticate(r.Context(), token)
+		if err != nil && !errors.Is(err, service.ErrUnauthorized) {
+			slog.ErrorContext(r.Context(), "Authentication failed", "handler", "AuthMiddleware", "remote_addr", r.RemoteAddr, "error", err)
+			respondWithServiceError(w, err)
+			return
+		}
 		if err != nil || user == nil {
-			log.Printf("[AuthMiddleware] %s %s | Invalid token | Token: %s | IP: %s | Error: %v", 
-				r.Method, r.URL.Path, token, r.RemoteAddr, err)
-			http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+			slog.WarnContext(r.Context(), "Invalid token", "handler", "AuthMiddleware", "remote_addr", r.RemoteAddr, "error", err)
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized: Invalid token")
 			return
 		}
 		
-		log.Printf("[AuthMiddleware] %s %s | User authenticated | UserID: %s | Duration: %s", 
-			r.Method, r.URL.Path, token, time.Since(start))
+		slog.DebugContext(r.Context(), "User authenticated", "handler", "AuthMiddleware", "user_id", user.ID, "duration", time.Since(start))
 
 		// Add user ID to context for use in handlers
-		ctx := context.WithValue(r.Context(), "userID", token)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r.WithContext(withUserID(r.Context(), user.ID)))
 	})
 }
 
+// contextKey is the type of the request context keys set by this package,
+// so that they cannot collide with the keys of other packages
+type contextKey int
+
+const userIDKey contextKey = iota
+
+// withUserID returns a copy of ctx carrying the ID of the authenticated user
+func withUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDKey, userID)
+}
+
 // getUserIDFromContext extracts the user ID from the request context
 func getUserIDFromContext(r *http.Request) string {
-	if userID, ok := r.Context().Value("userID").(string); ok {
+	if userID, ok := r.Context().Value(userIDKey).(string); ok {
 		return userID
 	}
 	return ""
 }
 
+// RateLimitKey identifies the client of a request for rate limiting: the authenticated
+// user on routes behind AuthMiddleware, and the remote address elsewhere
+func RateLimitKey(r *http.Request) string {
+	if userID := getUserIDFromContext(r); userID != "" {
+		return "user:" + userID
+	}
+	return "ip:" + ratelimit.RemoteIP(r)
+}
+
+// IsUpload reports whether a request carries a file
+func IsUpload(r *http.Request) bool {
+	return isMultipartFormData(r.Header.Get("Content-Type"))
+}
+
 // respondWithJSON writes a JSON response
 func respondWithJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	if data != nil {
 		if err := json.NewEncoder(w).Encode(data); err != nil {
-			log.Printf("Error encoding JSON response: %v", err)
+			slog.Error("Failed to encode JSON response", "error", err)
 		}
 	}
 }
 
+// errorResponse is the body of error responses. Code is a machine-readable
+// version of the error, which does not change with the wording of the message.
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// errorCodes are the codes of errors that are not returned by the service, by status
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal_error",
+}
+
 // respondWithError writes an error response
 func respondWithError(w http.ResponseWriter, status int, message string) {
-	respondWithJSON(w, status, map[string]string{"error": message})
+	code, ok := errorCodes[status]
+	if !ok {
+		code = "error"
+	}
+	respondWithJSON(w, status, errorResponse{Error: message, Code: code})
+}
+
+// respondWithServiceError writes the error response for an error returned by the service.
+// The message of unexpected errors is not passed on, as it may reveal internals;
+// handlers log it instead.
+func respondWithServiceError(w http.ResponseWriter, err error) {
+	status, code := serviceError(err)
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		message = "Internal server error"
+	}
+	respondWithJSON(w, status, errorResponse{Error: message, Code: code})
+}
+
+// serviceError picks the status code and the error code for an error returned by the service
+func serviceError(err error) (int, string) {
+	switch {
+	case errors.Is(err, service.ErrValidation), errors.Is(err, media.ErrUnsupportedFormat), errors.Is(err, media.ErrInvalidImage):
+		return http.StatusBadRequest, "validation_failed"
+	case errors.Is(err, service.ErrUnauthorized):
+		return http.StatusUnauthorized, "unauthorized"
+	case errors.Is(err, service.ErrForbidden):
+		return http.StatusForbidden, "forbidden"
+	case errors.Is(err, service.ErrNotFound):
+		return http.StatusNotFound, "not_found"
+	case errors.Is(err, service.ErrConflict):
+		return http.StatusConflict, "conflict"
+	case errors.Is(err, media.ErrTooLarge), errors.Is(err, service.ErrAttachmentTooLarge):
+		return http.StatusRequestEntityTooLarge, "too_large"
+	}
+	return http.StatusInternalServerError, "internal_error"
 }
 
 // Login handles user login/creation
@@ -142,43 +243,65 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("[%s] Login attempt | Username: %s | IP: %s", handlerName, req.Name, r.RemoteAddr)
+	slog.DebugContext(r.Context(), "Login attempt", "handler", handlerName, "remote_addr", r.RemoteAddr)
 	
-	response, err := h.service.Login(r.Context(), req.Name)
+	response, err := h.users.Login(r.Context(), req.Name, req.Password)
 	if err != nil {
 		logError(handlerName, r, "", err, "Login failed")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Login successful | UserID: %s | Username: %s | Duration: %s", 
-		handlerName, response.Id, req.Name, time.Since(start))
+	slog.InfoContext(r.Context(), "Login successful", "handler", handlerName, "user_id", response.Id, "duration", time.Since(start))
 	
 	respondWithJSON(w, http.StatusCreated, response)
 }
 
+// Logout revokes the session used to authenticate the request
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	handlerName := "Logout"
+	start := time.Now()
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	logRequest(handlerName, r, userID)
+
+	if err := h.users.Logout(r.Context(), extractToken(r)); err != nil {
+		logError(handlerName, r, userID, err, "Logout failed")
+		respondWithServiceError(w, err)
+		return
+	}
+
+	logRequestWithDuration(handlerName, r, userID, start, http.StatusNoContent)
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
 func (h *Handler) GetUsers(w http.ResponseWriter, r *http.Request) {
 	handlerName := "GetUsers"
 	start := time.Now()
 	
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
 	logRequest(handlerName, r, userID)
 
-	users, err := h.service.GetAllUsers(r.Context())
+	users, err := h.users.GetAllUsers(r.Context())
 	if err != nil {
 		logError(handlerName, r, userID, err, "Failed to get users")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Retrieved users | UserID: %s | Count: %d | Duration: %s", 
-		handlerName, userID, len(users), time.Since(start))
+	slog.InfoContext(r.Context(), "Retrieved users", "handler", handlerName, "user_id", userID, "count", len(users), "duration", time.Since(start))
 	
 	respondWithJSON(w, http.StatusOK, users)
 }
@@ -189,22 +312,21 @@ func (h *Handler) GetMyUser(w http.ResponseWriter, r *http.Request) {
 	
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
 	logRequest(handlerName, r, userID)
 
-	users, err := h.service.GetUser(r.Context(), userID)
+	users, err := h.users.GetUser(r.Context(), userID)
 	if err != nil {
 		logError(handlerName, r, userID, err, "Failed to get users")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Retrieved user | UserID: %s | Duration: %s", 
-		handlerName, userID, time.Since(start))
+	slog.InfoContext(r.Context(), "Retrieved user", "handler", handlerName, "user_id", userID, "duration", time.Since(start))
 	
 	respondWithJSON(w, http.StatusOK, users)
 }
@@ -217,7 +339,7 @@ func (h *Handler) SetMyUserName(w http.ResponseWriter, r *http.Request) {
 	
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
@@ -231,11 +353,11 @@ func (h *Handler) SetMyUserName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("[%s] Username update | UserID: %s | New name: %s", handlerName, userID, req.Name)
+	slog.DebugContext(r.Context(), "Username update", "handler", handlerName, "user_id", userID)
 	
-	if err := h.service.UpdateUsername(r.Context(), userID, req.Name); err != nil {
+	if err := h.users.UpdateUsername(r.Context(), userID, req.Name); err != nil {
 		logError(handlerName, r, userID, err, "Failed to update username")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
@@ -243,6 +365,37 @@ func (h *Handler) SetMyUserName(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusNoContent, nil)
 }
 
+// SetMyPassword handles setting or changing the user's password
+func (h *Handler) SetMyPassword(w http.ResponseWriter, r *http.Request) {
+	handlerName := "SetMyPassword"
+	start := time.Now()
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	logRequest(handlerName, r, userID)
+
+	var req models.SetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logError(handlerName, r, userID, err, "Invalid request payload")
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if err := h.users.SetPassword(r.Context(), userID, req.CurrentPassword, req.NewPassword); err != nil {
+		logError(handlerName, r, userID, err, "Failed to set password")
+		respondWithServiceError(w, err)
+		return
+	}
+
+	logRequestWithDuration(handlerName, r, userID, start, http.StatusNoContent)
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
 // SetMyPhoto handles setting the user's profile photo
 func (h *Handler) SetMyPhoto(w http.ResponseWriter, r *http.Request) {
 	handlerName := "SetMyPhoto"
@@ -250,15 +403,23 @@ func (h *Handler) SetMyPhoto(w http.ResponseWriter, r *http.Request) {
 	
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
 	logRequest(handlerName, r, userID)
 
-	// Parse multipart form
-	if err := r.ParseMultipartForm(10 << 20); err != nil { // 10 MB max
+	// Parse multipart form, refusing bodies much larger than the photo limit
+	r.Body = http.MaxBytesReader(w, r.Body, h.users.PhotoLimit()+1<<20)
+	err := r.ParseMultipartForm(10 << 20) // 10 MB in memory
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		logError(handlerName, r, userID, err, "Upload too large")
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Upload too large")
+		return
+	}
+	if err != nil {
 		logError(handlerName, r, userID, err, "Could not parse multipart form")
 		respondWithError(w, http.StatusBadRequest, "Could not parse multipart form")
 		return
@@ -273,21 +434,20 @@ func (h *Handler) SetMyPhoto(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	log.Printf("[%s] Processing profile photo | UserID: %s | File size: %d bytes | File name: %s", 
-		handlerName, userID, fileHeader.Size, fileHeader.Filename)
+	slog.DebugContext(r.Context(), "Processing profile photo", "handler", handlerName, "user_id", userID, "size", fileHeader.Size)
 
 	// Save photo
-	photoURL, err := h.service.SetUserPhoto(r.Context(), userID, file)
+	photo, err := h.users.SetUserPhoto(r.Context(), userID, file)
 	if err != nil {
 		logError(handlerName, r, userID, err, "Failed to save profile photo")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Profile photo updated | UserID: %s | Photo URL: %s | Duration: %s", 
-		handlerName, userID, photoURL, time.Since(start))
+	metrics.UploadBytes.WithLabelValues("user_photo").Add(float64(fileHeader.Size))
+	slog.InfoContext(r.Context(), "Profile photo updated", "handler", handlerName, "user_id", userID, "duration", time.Since(start))
 		
-	respondWithJSON(w, http.StatusOK, map[string]string{"photo": photoURL})
+	respondWithJSON(w, http.StatusOK, photo)
 }
 
 // CreateConversation handles creating a new conversation
@@ -297,7 +457,7 @@ func (h *Handler) CreateConversation(w http.ResponseWriter, r *http.Request) {
 	
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
@@ -310,28 +470,25 @@ func (h *Handler) CreateConversation(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
-	log.Printf("type: %s", req.Type)
 
 	// Validate request
 	if len(req.Participants) == 0 {
-		log.Printf("[%s] Invalid request: no participants | UserID: %s", handlerName, userID)
+		slog.WarnContext(r.Context(), "Invalid request: no participants", "handler", handlerName, "user_id", userID)
 		respondWithError(w, http.StatusBadRequest, "At least one participant is required")
 		return
 	}
 
-	log.Printf("[%s] Creating conversation | Type: %s | UserID: %s | Participants: %d | Name: %s", 
-		handlerName, req.Type, userID, len(req.Participants), req.Name)
+	slog.DebugContext(r.Context(), "Creating conversation", "handler", handlerName, "type", req.Type, "user_id", userID, "participants", len(req.Participants))
 
 	// Create the conversation
-	conversation, err := h.service.CreateConversation(r.Context(), userID, req.Participants, req.Type, req.Name)
+	conversation, err := h.conversations.CreateConversation(r.Context(), userID, req.Participants, req.Type, req.Name)
 	if err != nil {
 		logError(handlerName, r, userID, err, "Failed to create conversation")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Conversation created | ConversationID: %s | UserID: %s | Type: %s | Participants: %d | Duration: %s", 
-		handlerName, conversation.ID, userID, req.Type, len(conversation.Participants), time.Since(start))
+	slog.InfoContext(r.Context(), "Conversation created", "handler", handlerName, "conversation_id", conversation.ID, "user_id", userID, "type", req.Type, "participants", len(conversation.Participants), "duration", time.Since(start))
 	
 	respondWithJSON(w, http.StatusCreated, conversation)
 }
@@ -343,22 +500,21 @@ func (h *Handler) GetMyConversations(w http.ResponseWriter, r *http.Request) {
 	
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
 	logRequest(handlerName, r, userID)
 
-	conversations, err := h.service.GetConversations(r.Context(), userID)
+	conversations, err := h.conversations.GetConversations(r.Context(), userID)
 	if err != nil {
 		logError(handlerName, r, userID, err, "Failed to get conversations")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Retrieved conversations | UserID: %s | Count: %d | Duration: %s", 
-		handlerName, userID, len(conversations), time.Since(start))
+	slog.InfoContext(r.Context(), "Retrieved conversations", "handler", handlerName, "user_id", userID, "count", len(conversations), "duration", time.Since(start))
 	
 	respondWithJSON(w, http.StatusOK, conversations)
 }
@@ -370,7 +526,7 @@ func (h *Handler) GetConversation(w http.ResponseWriter, r *http.Request) {
 	
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
@@ -379,36 +535,166 @@ func (h *Handler) GetConversation(w http.ResponseWriter, r *http.Request) {
 	conversationID := vars["id"]
 	
 	logRequest(handlerName, r, userID)
-	log.Printf("[%s] Retrieving conversation | UserID: %s | ConversationID: %s", 
-		handlerName, userID, conversationID)
+	slog.DebugContext(r.Context(), "Retrieving conversation", "handler", handlerName, "user_id", userID, "conversation_id", conversationID)
 
-	conversation, err := h.service.GetConversation(r.Context(), conversationID)
+	conversation, err := h.conversations.GetConversation(r.Context(), userID, conversationID)
 	if err != nil {
 		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to get conversation ID: %s", conversationID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
+		return
+	}
+
+	// Include the most recent page of the history; older pages come from GetConversationMessages
+	page, err := h.messages.GetConversationMessages(r.Context(), userID, conversationID, "", 0)
+	if err != nil {
+		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to get messages of conversation ID: %s", conversationID))
+		respondWithServiceError(w, err)
 		return
 	}
+	conversation.Messages = page.Messages
+	conversation.NextCursor = page.NextCursor
+
+	slog.InfoContext(r.Context(), "Conversation retrieved", "handler", handlerName, "user_id", userID, "conversation_id", conversationID, "participants", len(conversation.Participants), "messages", len(conversation.Messages), "duration", time.Since(start))
+	
+	respondWithJSON(w, http.StatusOK, conversation)
+}
+
+// GetConversationMessages returns a page of a conversation's history
+func (h *Handler) GetConversationMessages(w http.ResponseWriter, r *http.Request) {
+	handlerName := "GetConversationMessages"
+	start := time.Now()
 
-	// Check if user is a participant in this conversation
-	isParticipant := false
-	for _, participant := range conversation.Participants {
-		if participant.ID == userID {
-			isParticipant = true
-			break
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	vars := mux.Vars(r)
+	conversationID := vars["id"]
+
+	logRequest(handlerName, r, userID)
+
+	limit := 0
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit <= 0 {
+			logError(handlerName, r, userID, err, "Invalid limit")
+			respondWithError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
 		}
 	}
+	cursor := r.URL.Query().Get("before")
 
-	if !isParticipant {
-		log.Printf("[%s] Access denied | UserID: %s | ConversationID: %s | Not a participant", 
-			handlerName, userID, conversationID)
-		respondWithError(w, http.StatusForbidden, "Not a participant in this conversation")
+	page, err := h.messages.GetConversationMessages(r.Context(), userID, conversationID, cursor, limit)
+	if err != nil {
+		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to get messages of conversation ID: %s", conversationID))
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Conversation retrieved | UserID: %s | ConversationID: %s | Participants: %d | Messages: %d | Duration: %s", 
-		handlerName, userID, conversationID, len(conversation.Participants), len(conversation.Messages), time.Since(start))
-	
-	respondWithJSON(w, http.StatusOK, conversation)
+	slog.InfoContext(r.Context(), "Messages retrieved", "handler", handlerName, "user_id", userID, "conversation_id", conversationID, "count", len(page.Messages), "duration", time.Since(start))
+
+	respondWithJSON(w, http.StatusOK, page)
+}
+
+// SearchMessages searches the messages of the conversations the user takes part in
+func (h *Handler) SearchMessages(w http.ResponseWriter, r *http.Request) {
+	handlerName := "SearchMessages"
+	start := time.Now()
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	logRequest(handlerName, r, userID)
+
+	params := r.URL.Query()
+	query := params.Get("q")
+	if strings.TrimSpace(query) == "" {
+		respondWithError(w, http.StatusBadRequest, "q is required")
+		return
+	}
+
+	limit := 0
+	if rawLimit := params.Get("limit"); rawLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit <= 0 {
+			logError(handlerName, r, userID, err, "Invalid limit")
+			respondWithError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+	}
+
+	// The service checks that the user takes part in the conversation searched
+	conversationID := params.Get("conversation")
+
+	page, err := h.messages.SearchMessages(r.Context(), userID, query, conversationID, params.Get("from"), params.Get("before"), limit)
+	if err != nil {
+		logError(handlerName, r, userID, err, "Failed to search messages")
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Messages searched", "handler", handlerName, "user_id", userID, "count", len(page.Results), "duration", time.Since(start))
+
+	respondWithJSON(w, http.StatusOK, page)
+}
+
+// MarkMessagesReceived acknowledges delivery of a conversation's messages up to a given one
+func (h *Handler) MarkMessagesReceived(w http.ResponseWriter, r *http.Request) {
+	h.acknowledgeMessages(w, r, "MarkMessagesReceived", false)
+}
+
+// MarkMessagesRead acknowledges reading a conversation's messages up to a given one
+func (h *Handler) MarkMessagesRead(w http.ResponseWriter, r *http.Request) {
+	h.acknowledgeMessages(w, r, "MarkMessagesRead", true)
+}
+
+// acknowledgeMessages handles both delivery and read acknowledgements
+func (h *Handler) acknowledgeMessages(w http.ResponseWriter, r *http.Request, handlerName string, read bool) {
+	start := time.Now()
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	vars := mux.Vars(r)
+	conversationID := vars["id"]
+
+	logRequest(handlerName, r, userID)
+
+	var req models.AcknowledgeMessagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageID == "" {
+		logError(handlerName, r, userID, err, "Invalid request payload")
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	var err error
+	if read {
+		err = h.messages.MarkMessagesRead(r.Context(), userID, conversationID, req.MessageID)
+	} else {
+		err = h.messages.MarkMessagesReceived(r.Context(), userID, conversationID, req.MessageID)
+	}
+	if err != nil {
+		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to acknowledge messages of conversation: %s", conversationID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Messages acknowledged", "handler", handlerName, "user_id", userID, "conversation_id", conversationID, "up_to", req.MessageID, "duration", time.Since(start))
+
+	respondWithJSON(w, http.StatusNoContent, nil)
 }
 
 const MAX_PHOTO_SIZE = 10 * 1024 * 1024 // 10 MB
@@ -420,7 +706,7 @@ func (h *Handler) SendMessage(w http.ResponseWriter, r *http.Request) {
 
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
@@ -435,19 +721,30 @@ func (h *Handler) SendMessage(w http.ResponseWriter, r *http.Request) {
 	var conversationID string
 	var replyToID string
 	var messageType models.MessageType // To store the determined message type
+	var uploadSize int64               // Bytes of the files uploaded with the message
 
 	if isMultipartFormData(contentType) {
-		// Handle multipart/form-data (for photo messages)
-		messageType = models.PhotoMessage // Assume photo message if multipart
+		// Handle multipart/form-data (for photo, file, audio and video messages)
+		messageType = models.PhotoMessage // Photo messages predate the type field
 
-		// Parse the multipart form data
-		// Max memory 10MB for parsed form values and files
+		// Parse the multipart form data, keeping up to 10MB in memory; larger files are
+		// spooled to disk, up to the largest upload the service accepts
+		r.Body = http.MaxBytesReader(w, r.Body, h.messages.UploadLimit()+1<<20)
 		err = r.ParseMultipartForm(MAX_PHOTO_SIZE)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			logError(handlerName, r, userID, err, "Upload too large")
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Upload too large")
+			return
+		}
 		if err != nil {
 			logError(handlerName, r, userID, err, "Failed to parse multipart form")
-			respondWithError(w, http.StatusBadRequest, "Failed to parse multipart form: "+err.Error())
+			respondWithError(w, http.StatusBadRequest, "Could not parse multipart form")
 			return
 		}
+		if t := r.FormValue("type"); t != "" {
+			messageType = models.MessageType(t)
+		}
 
 		// Get conversation ID from form field
 		conversationID = r.FormValue("conversationId")
@@ -460,22 +757,47 @@ func (h *Handler) SendMessage(w http.ResponseWriter, r *http.Request) {
 		// Get replyTo ID from form field (optional)
 		replyToID = r.FormValue("replyTo") // This will be "" if not provided
 
-		// Get the photo file
-		file, _, fileErr := r.FormFile("photo") // "photo" is the expected field name for the file
+		// Get the file: "file" for any media type, "photo" as photo messages always sent it
+		fieldName := "file"
+		if _, ok := r.MultipartForm.File["file"]; !ok {
+			fieldName = "photo"
+		}
+		file, fileHeader, fileErr := r.FormFile(fieldName)
 		if fileErr != nil {
 			if fileErr == http.ErrMissingFile {
-				logError(handlerName, r, userID, fileErr, "Missing photo file in request")
-				respondWithError(w, http.StatusBadRequest, "Missing photo file")
+				logError(handlerName, r, userID, fileErr, "Missing file in request")
+				respondWithError(w, http.StatusBadRequest, "Missing file")
 			} else {
-				logError(handlerName, r, userID, fileErr, "Error getting photo file")
-				respondWithError(w, http.StatusInternalServerError, "Error getting photo file: "+fileErr.Error())
+				logError(handlerName, r, userID, fileErr, "Error getting file")
+				respondWithError(w, http.StatusBadRequest, "Invalid file")
 			}
 			return
 		}
 		defer file.Close() // Ensure the file is closed
+		uploadSize = fileHeader.Size
 
-		// Call the service to send the photo message
-		newMsg, err = h.service.SendPhotoMessage(r.Context(), userID, conversationID, file, replyToID)
+		upload := service.Upload{
+			Type:     messageType,
+			File:     file,
+			FileName: fileHeader.Filename,
+			Caption:  r.FormValue("caption"),
+		}
+		if duration := r.FormValue("duration"); duration != "" {
+			upload.Duration, err = strconv.ParseFloat(duration, 64)
+			if err != nil {
+				logError(handlerName, r, userID, err, "Invalid duration")
+				respondWithError(w, http.StatusBadRequest, "Invalid duration: expected a number of seconds")
+				return
+			}
+		}
+		if thumbnail, thumbHeader, thumbErr := r.FormFile("thumbnail"); thumbErr == nil {
+			defer thumbnail.Close()
+			upload.Thumbnail = thumbnail
+			uploadSize += thumbHeader.Size
+		}
+
+		// Call the service to send the media message
+		newMsg, err = h.messages.SendMediaMessage(r.Context(), userID, conversationID, upload, replyToID)
 
 	} else if isApplicationJSON(contentType) {
 		messageType = models.TextMessage
@@ -499,7 +821,7 @@ func (h *Handler) SendMessage(w http.ResponseWriter, r *http.Request) {
         }
 
 		// Call the service to send the text message
-		newMsg, err = h.service.SendTextMessage(r.Context(), userID, conversationID, content, &replyToID)
+		newMsg, err = h.messages.SendTextMessage(r.Context(), userID, conversationID, content, &replyToID)
 
 	} else {
 		// Unsupported content type
@@ -510,12 +832,14 @@ func (h *Handler) SendMessage(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to send %s message to conversation: %s", messageType, conversationID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] %s message sent | UserID: %s | ConvID: %s | MessageID: %s | Duration: %s",
-		handlerName, messageType, userID, conversationID, newMsg.ID, time.Since(start)) // Use newMsg.ID for the message ID
+	if uploadSize > 0 {
+		metrics.UploadBytes.WithLabelValues(string(messageType)).Add(float64(uploadSize))
+	}
+	slog.InfoContext(r.Context(), "Message sent", "handler", handlerName, "type", messageType, "user_id", userID, "conversation_id", conversationID, "message_id", newMsg.ID, "duration", time.Since(start))
 	respondWithJSON(w, http.StatusCreated, newMsg)
 }
 
@@ -535,7 +859,7 @@ func (h *Handler) ForwardMessage(w http.ResponseWriter, r *http.Request) {
 	
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
@@ -549,19 +873,127 @@ func (h *Handler) ForwardMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("[%s] Forwarding message | UserID: %s | MessageID: %s | TargetConvID: %s", 
-		handlerName, userID, req.MessageID, req.TargetConversationID)
+	targets := req.Targets()
+	if req.MessageID == "" || len(targets) == 0 {
+		logError(handlerName, r, userID, nil, "Missing message or target conversations")
+		respondWithError(w, http.StatusBadRequest, "messageId and at least one target conversation are required")
+		return
+	}
+
+	slog.DebugContext(r.Context(), "Forwarding message", "handler", handlerName, "user_id", userID, "message_id", req.MessageID, "targets", targets)
 
-	if err := h.service.ForwardMessage(r.Context(), userID, req.MessageID, req.TargetConversationID); err != nil {
+	forwarded, err := h.messages.ForwardMessage(r.Context(), userID, req.MessageID, targets)
+	if err != nil {
 		logError(handlerName, r, userID, err, "Failed to forward message")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Message forwarded | UserID: %s | MessageID: %s | TargetConvID: %s | Duration: %s", 
-		handlerName, userID, req.MessageID, req.TargetConversationID, time.Since(start))
+	slog.InfoContext(r.Context(), "Message forwarded", "handler", handlerName, "user_id", userID, "message_id", req.MessageID, "targets", targets, "duration", time.Since(start))
 	
-	respondWithJSON(w, http.StatusOK, nil)
+	respondWithJSON(w, http.StatusOK, forwarded)
+}
+
+// GetMessageReceipts lists the per-recipient receipts of a message
+func (h *Handler) GetMessageReceipts(w http.ResponseWriter, r *http.Request) {
+	handlerName := "GetMessageReceipts"
+	start := time.Now()
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	vars := mux.Vars(r)
+	messageID := vars["id"]
+
+	logRequest(handlerName, r, userID)
+
+	receipts, err := h.messages.GetMessageReceipts(r.Context(), userID, messageID)
+	if err != nil {
+		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to get receipts of message: %s", messageID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Receipts retrieved", "handler", handlerName, "user_id", userID, "message_id", messageID, "count", len(receipts), "duration", time.Since(start))
+
+	if receipts == nil {
+		receipts = []models.Receipt{}
+	}
+	respondWithJSON(w, http.StatusOK, receipts)
+}
+
+// GetMessageHistory returns every version of an edited message
+func (h *Handler) GetMessageHistory(w http.ResponseWriter, r *http.Request) {
+	handlerName := "GetMessageHistory"
+	start := time.Now()
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	vars := mux.Vars(r)
+	messageID := vars["id"]
+
+	logRequest(handlerName, r, userID)
+
+	history, err := h.messages.GetMessageHistory(r.Context(), userID, messageID)
+	if err != nil {
+		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to get history of message: %s", messageID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "History retrieved", "handler", handlerName, "user_id", userID, "message_id", messageID, "versions", len(history), "duration", time.Since(start))
+
+	respondWithJSON(w, http.StatusOK, history)
+}
+
+// GetReplies returns a page of the replies to a message
+func (h *Handler) GetReplies(w http.ResponseWriter, r *http.Request) {
+	handlerName := "GetReplies"
+	start := time.Now()
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	vars := mux.Vars(r)
+	messageID := vars["id"]
+
+	logRequest(handlerName, r, userID)
+
+	limit := 0
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit <= 0 {
+			logError(handlerName, r, userID, err, "Invalid limit")
+			respondWithError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+	}
+	cursor := r.URL.Query().Get("before")
+
+	page, err := h.messages.GetReplies(r.Context(), userID, messageID, cursor, limit)
+	if err != nil {
+		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to get replies to message: %s", messageID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Replies retrieved", "handler", handlerName, "user_id", userID, "message_id", messageID, "count", len(page.Messages), "duration", time.Since(start))
+
+	respondWithJSON(w, http.StatusOK, page)
 }
 
 // CommentMessage adds a reaction to a message
@@ -571,7 +1003,7 @@ func (h *Handler) CommentMessage(w http.ResponseWriter, r *http.Request) {
 	
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
@@ -588,17 +1020,15 @@ func (h *Handler) CommentMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("[%s] Adding reaction | UserID: %s | MessageID: %s | Emoji: %s", 
-		handlerName, userID, messageID, reaction.Emoji)
+	slog.DebugContext(r.Context(), "Adding reaction", "handler", handlerName, "user_id", userID, "message_id", messageID)
 
-	if err := h.service.AddReaction(r.Context(), userID, messageID, reaction.Emoji); err != nil {
+	if err := h.messages.AddReaction(r.Context(), userID, messageID, reaction.Emoji); err != nil {
 		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to add reaction to message: %s", messageID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Reaction added | UserID: %s | MessageID: %s | Emoji: %s | Duration: %s", 
-		handlerName, userID, messageID, reaction.Emoji, time.Since(start))
+	slog.InfoContext(r.Context(), "Reaction added", "handler", handlerName, "user_id", userID, "message_id", messageID, "duration", time.Since(start))
 	
 	respondWithJSON(w, http.StatusNoContent, nil)
 }
@@ -610,7 +1040,7 @@ func (h *Handler) UncommentMessage(w http.ResponseWriter, r *http.Request) {
 	
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
@@ -619,16 +1049,15 @@ func (h *Handler) UncommentMessage(w http.ResponseWriter, r *http.Request) {
 	messageID := vars["id"]
 	
 	logRequest(handlerName, r, userID)
-	log.Printf("[%s] Removing reaction | UserID: %s | MessageID: %s", handlerName, userID, messageID)
+	slog.DebugContext(r.Context(), "Removing reaction", "handler", handlerName, "user_id", userID, "message_id", messageID)
 
-	if err := h.service.RemoveReaction(r.Context(), userID, messageID); err != nil {
+	if err := h.messages.RemoveReaction(r.Context(), userID, messageID); err != nil {
 		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to remove reaction from message: %s", messageID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Reaction removed | UserID: %s | MessageID: %s | Duration: %s", 
-		handlerName, userID, messageID, time.Since(start))
+	slog.InfoContext(r.Context(), "Reaction removed", "handler", handlerName, "user_id", userID, "message_id", messageID, "duration", time.Since(start))
 	
 	respondWithJSON(w, http.StatusNoContent, nil)
 }
@@ -640,25 +1069,34 @@ func (h *Handler) DeleteMessage(w http.ResponseWriter, r *http.Request) {
 	
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
 	vars := mux.Vars(r)
 	messageID := vars["id"]
+
+	// Messages are deleted for everyone unless the user asks to delete them for themselves only
+	scope := models.DeleteForEveryone
+	if rawScope := r.URL.Query().Get("scope"); rawScope != "" {
+		scope = models.DeleteScope(rawScope)
+	}
+	if scope != models.DeleteForEveryone && scope != models.DeleteForMe {
+		respondWithError(w, http.StatusBadRequest, "scope must be everyone or me")
+		return
+	}
 	
 	logRequest(handlerName, r, userID)
-	log.Printf("[%s] Deleting message | UserID: %s | MessageID: %s", handlerName, userID, messageID)
+	slog.DebugContext(r.Context(), "Deleting message", "handler", handlerName, "user_id", userID, "message_id", messageID, "scope", scope)
 
-	if err := h.service.DeleteMessage(r.Context(), userID, messageID); err != nil {
+	if err := h.messages.DeleteMessage(r.Context(), userID, messageID, scope); err != nil {
 		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to delete message: %s", messageID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Message deleted | UserID: %s | MessageID: %s | Duration: %s", 
-		handlerName, userID, messageID, time.Since(start))
+	slog.InfoContext(r.Context(), "Message deleted", "handler", handlerName, "user_id", userID, "message_id", messageID, "duration", time.Since(start))
 	
 	respondWithJSON(w, http.StatusNoContent, nil)
 }
@@ -670,7 +1108,7 @@ func (h *Handler) UpdateMessage(w http.ResponseWriter, r *http.Request) {
 	
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
@@ -685,16 +1123,15 @@ func (h *Handler) UpdateMessage(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	logRequest(handlerName, r, userID)
-	log.Printf("[%s] Updating message | UserID: %s | MessageID: %s", handlerName, userID, messageID)
+	slog.DebugContext(r.Context(), "Updating message", "handler", handlerName, "user_id", userID, "message_id", messageID)
 
-	if err := h.service.UpdateMessage(r.Context(), userID, messageID, req.Content); err != nil {
+	if err := h.messages.UpdateMessage(r.Context(), userID, messageID, req.Content); err != nil {
 		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to update message: %s", messageID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Message updated | UserID: %s | MessageID: %s | Duration: %s", 
-		handlerName, userID, messageID, time.Since(start))
+	slog.InfoContext(r.Context(), "Message updated", "handler", handlerName, "user_id", userID, "message_id", messageID, "duration", time.Since(start))
 	
 	respondWithJSON(w, http.StatusNoContent, nil)
 }
@@ -706,7 +1143,7 @@ func (h *Handler) AddToGroup(w http.ResponseWriter, r *http.Request) {
 	
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
@@ -723,41 +1160,15 @@ func (h *Handler) AddToGroup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("[%s] Adding user to group | RequestedBy: %s | GroupID: %s | NewUserID: %s", 
-		handlerName, userID, groupID, req.UserID)
-
-	// Check if the user is in the group (to verify they have permission)
-	group, err := h.service.GetConversation(r.Context(), groupID)
-	if err != nil {
-		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to get group: %s", groupID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	// Verify user is in the group
-	isInGroup := false
-	for _, participant := range group.Participants {
-		if participant.ID == userID {
-			isInGroup = true
-			break
-		}
-	}
+	slog.DebugContext(r.Context(), "Adding user to group", "handler", handlerName, "user_id", userID, "group_id", groupID, "member_id", req.UserID)
 
-	if !isInGroup {
-		log.Printf("[%s] Permission denied | UserID: %s | GroupID: %s | Not in group", 
-			handlerName, userID, groupID)
-		respondWithError(w, http.StatusForbidden, "You must be in the group to add members")
-		return
-	}
-
-	if err := h.service.AddToGroup(r.Context(), groupID, req.UserID); err != nil {
+	if err := h.conversations.AddToGroup(r.Context(), userID, groupID, req.UserID); err != nil {
 		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to add user %s to group %s", req.UserID, groupID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] User added to group | RequestedBy: %s | GroupID: %s | AddedUserID: %s | Duration: %s", 
-		handlerName, userID, groupID, req.UserID, time.Since(start))
+	slog.InfoContext(r.Context(), "User added to group", "handler", handlerName, "user_id", userID, "group_id", groupID, "member_id", req.UserID, "duration", time.Since(start))
 	
 	respondWithJSON(w, http.StatusNoContent, nil)
 }
@@ -769,7 +1180,7 @@ func (h *Handler) LeaveGroup(w http.ResponseWriter, r *http.Request) {
 	
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
@@ -778,16 +1189,15 @@ func (h *Handler) LeaveGroup(w http.ResponseWriter, r *http.Request) {
 	groupID := vars["id"]
 	
 	logRequest(handlerName, r, userID)
-	log.Printf("[%s] User leaving group | UserID: %s | GroupID: %s", handlerName, userID, groupID)
+	slog.DebugContext(r.Context(), "User leaving group", "handler", handlerName, "user_id", userID, "group_id", groupID)
 
-	if err := h.service.LeaveGroup(r.Context(), groupID, userID); err != nil {
+	if err := h.conversations.LeaveGroup(r.Context(), groupID, userID); err != nil {
 		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to leave group: %s", groupID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] User left group | UserID: %s | GroupID: %s | Duration: %s", 
-		handlerName, userID, groupID, time.Since(start))
+	slog.InfoContext(r.Context(), "User left group", "handler", handlerName, "user_id", userID, "group_id", groupID, "duration", time.Since(start))
 	
 	respondWithJSON(w, http.StatusNoContent, nil)
 }
@@ -809,87 +1219,180 @@ func (h *Handler) SetGroupName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if the user is in the group (to verify they have permission)
-	group, err := h.service.GetConversation(r.Context(), groupID)
+	if err := h.conversations.SetGroupName(r.Context(), userID, groupID, req.Name); err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// SetGroupPhoto updates a group's photo
+func (h *Handler) SetGroupPhoto(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	vars := mux.Vars(r)
+	groupID := vars["id"]
+
+	// Parse multipart form, refusing bodies much larger than the photo limit
+	r.Body = http.MaxBytesReader(w, r.Body, h.conversations.PhotoLimit()+1<<20)
+	err := r.ParseMultipartForm(10 << 20) // 10 MB in memory
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Upload too large")
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithError(w, http.StatusBadRequest, "Could not parse multipart form")
 		return
 	}
 
-	// Verify user is in the group
-	isInGroup := false
-	for _, participant := range group.Participants {
-		if participant.ID == userID {
-			isInGroup = true
-			break
-		}
+	// Get file from form
+	file, fileHeader, err := r.FormFile("photo")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid file")
+		return
+	}
+	defer file.Close()
+
+	// Save photo
+	photo, err := h.conversations.SetGroupPhoto(r.Context(), userID, groupID, file)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	metrics.UploadBytes.WithLabelValues("group_photo").Add(float64(fileHeader.Size))
+
+	respondWithJSON(w, http.StatusOK, photo)
+}
+
+// PromoteMember makes a group member an admin
+func (h *Handler) PromoteMember(w http.ResponseWriter, r *http.Request) {
+	handlerName := "PromoteMember"
+	start := time.Now()
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
 	}
 
-	if !isInGroup {
-		respondWithError(w, http.StatusForbidden, "You must be in the group to change its name")
+	groupID := mux.Vars(r)["id"]
+
+	logRequest(handlerName, r, userID)
+
+	var req models.AddToGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logError(handlerName, r, userID, err, "Invalid request payload")
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	if err := h.service.SetGroupName(r.Context(), groupID, req.Name); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if err := h.conversations.PromoteMember(r.Context(), userID, groupID, req.UserID); err != nil {
+		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to promote user %s in group %s", req.UserID, groupID))
+		respondWithServiceError(w, err)
 		return
 	}
 
+	slog.InfoContext(r.Context(), "Member promoted", "handler", handlerName, "user_id", userID, "group_id", groupID, "member_id", req.UserID, "duration", time.Since(start))
+
 	respondWithJSON(w, http.StatusNoContent, nil)
 }
 
-// SetGroupPhoto updates a group's photo
-func (h *Handler) SetGroupPhoto(w http.ResponseWriter, r *http.Request) {
+// DemoteAdmin makes a group admin a regular member again
+func (h *Handler) DemoteAdmin(w http.ResponseWriter, r *http.Request) {
+	handlerName := "DemoteAdmin"
+	start := time.Now()
+
 	userID := getUserIDFromContext(r)
 	if userID == "" {
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
 	vars := mux.Vars(r)
 	groupID := vars["id"]
+	adminID := vars["userId"]
 
-	// Parse multipart form
-	if err := r.ParseMultipartForm(10 << 20); err != nil { // 10 MB max
-		respondWithError(w, http.StatusBadRequest, "Could not parse multipart form")
+	logRequest(handlerName, r, userID)
+
+	if err := h.conversations.DemoteAdmin(r.Context(), userID, groupID, adminID); err != nil {
+		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to demote user %s in group %s", adminID, groupID))
+		respondWithServiceError(w, err)
 		return
 	}
 
-	// Get file from form
-	file, _, err := r.FormFile("photo")
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid file")
+	slog.InfoContext(r.Context(), "Admin demoted", "handler", handlerName, "user_id", userID, "group_id", groupID, "member_id", adminID, "duration", time.Since(start))
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// RemoveFromGroup removes another member from a group
+func (h *Handler) RemoveFromGroup(w http.ResponseWriter, r *http.Request) {
+	handlerName := "RemoveFromGroup"
+	start := time.Now()
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
-	defer file.Close()
 
-	// Check if the user is in the group (to verify they have permission)
-	group, err := h.service.GetConversation(r.Context(), groupID)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	vars := mux.Vars(r)
+	groupID := vars["id"]
+	memberID := vars["userId"]
+
+	logRequest(handlerName, r, userID)
+
+	if err := h.conversations.RemoveFromGroup(r.Context(), userID, groupID, memberID); err != nil {
+		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to remove user %s from group %s", memberID, groupID))
+		respondWithServiceError(w, err)
 		return
 	}
 
-	// Verify user is in the group
-	isInGroup := false
-	for _, participant := range group.Participants {
-		if participant.ID == userID {
-			isInGroup = true
-			break
-		}
+	slog.InfoContext(r.Context(), "Member removed", "handler", handlerName, "user_id", userID, "group_id", groupID, "member_id", memberID, "duration", time.Since(start))
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// SetGroupPolicy changes who may add members, edit a group and post in it
+func (h *Handler) SetGroupPolicy(w http.ResponseWriter, r *http.Request) {
+	handlerName := "SetGroupPolicy"
+	start := time.Now()
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		slog.WarnContext(r.Context(), "Not authenticated", "handler", handlerName, "remote_addr", r.RemoteAddr)
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
 	}
 
-	if !isInGroup {
-		respondWithError(w, http.StatusForbidden, "You must be in the group to change its photo")
+	groupID := mux.Vars(r)["id"]
+
+	logRequest(handlerName, r, userID)
+
+	var req models.SetGroupPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logError(handlerName, r, userID, err, "Invalid request payload")
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	// Save photo
-	photoURL, err := h.service.SetGroupPhoto(r.Context(), groupID, file)
+	policy, err := h.conversations.SetGroupPolicy(r.Context(), userID, groupID, req)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to set policy of group %s", groupID))
+		respondWithServiceError(w, err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, map[string]string{"photo": photoURL})
-}
\ No newline at end of file
+	slog.InfoContext(r.Context(), "Group policy updated", "handler", handlerName, "user_id", userID, "group_id", groupID, "duration", time.Since(start))
+
+	respondWithJSON(w, http.StatusOK, policy)
+}
@@ -0,0 +1,1043 @@
+package handlers_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/handlers"
+	"github.com/fallenkarma/wasatext/internal/logging"
+	"github.com/fallenkarma/wasatext/internal/metrics"
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/repository/memory"
+	"github.com/fallenkarma/wasatext/internal/service"
+	"github.com/fallenkarma/wasatext/internal/storage"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/cors"
+)
+
+func TestMain(m *testing.M) {
+	// The handlers log every request; keep test output readable
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestServer serves the API, routed as in cmd/webapi, on top of an in-memory repository
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	blobs := storage.NewLocalStore(t.TempDir(), "/uploads")
+	config := service.DefaultConfig()
+	config.PasswordHasher = &service.PBKDF2Hasher{Iterations: 1000}
+	config.Blobs = blobs
+	svc := service.NewWithConfig(memory.NewMemoryRepository(), config)
+
+	r := mux.NewRouter()
+	r.Use(metrics.Middleware)
+	r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", storage.Handler(blobs, config.MediaSigner, service.PrivateMedia)))
+	routeAPI(r, handlers.New(svc, svc, svc))
+
+	// The same middleware as in cmd/webapi, so that streams and upgrades go through all of it
+	crs := cors.New(cors.Options{
+		AllowedOrigins:   []string{"http://localhost:4173"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", logging.RequestIDHeader},
+		AllowCredentials: true,
+	})
+	srv := httptest.NewServer(logging.Middleware(crs.Handler(r)))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// routeAPI registers the API routes served by h
+func routeAPI(r *mux.Router, h *handlers.Handler) {
+	api := r.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/session", h.Login).Methods("POST")
+	api.HandleFunc("/events", h.Events).Methods("GET")
+
+	protected := api.NewRoute().Subrouter()
+	protected.Use(h.AuthMiddleware)
+	protected.HandleFunc("/session", h.Logout).Methods("DELETE")
+	protected.HandleFunc("/users", h.GetUsers).Methods("GET")
+	protected.HandleFunc("/users/me", h.GetMyUser).Methods("GET")
+	protected.HandleFunc("/users/me/username", h.SetMyUserName).Methods("PUT")
+	protected.HandleFunc("/users/me/photo", h.SetMyPhoto).Methods("PUT")
+	protected.HandleFunc("/users/me/password", h.SetMyPassword).Methods("PUT")
+	protected.HandleFunc("/conversations", h.CreateConversation).Methods("POST")
+	protected.HandleFunc("/conversations", h.GetMyConversations).Methods("GET")
+	protected.HandleFunc("/conversations/{id}", h.GetConversation).Methods("GET")
+	protected.HandleFunc("/conversations/{id}/messages", h.GetConversationMessages).Methods("GET")
+	protected.HandleFunc("/conversations/{id}/received", h.MarkMessagesReceived).Methods("POST")
+	protected.HandleFunc("/conversations/{id}/read", h.MarkMessagesRead).Methods("POST")
+	protected.HandleFunc("/messages", h.SendMessage).Methods("POST")
+	protected.HandleFunc("/messages/forward", h.ForwardMessage).Methods("POST")
+	protected.HandleFunc("/messages/{id}/receipts", h.GetMessageReceipts).Methods("GET")
+	protected.HandleFunc("/messages/{id}/history", h.GetMessageHistory).Methods("GET")
+	protected.HandleFunc("/messages/{id}/replies", h.GetReplies).Methods("GET")
+	protected.HandleFunc("/messages/{id}/reaction", h.CommentMessage).Methods("POST")
+	protected.HandleFunc("/messages/{id}/reaction", h.UncommentMessage).Methods("DELETE")
+	protected.HandleFunc("/messages/{id}", h.DeleteMessage).Methods("DELETE")
+	protected.HandleFunc("/messages/{id}", h.UpdateMessage).Methods("PUT")
+	protected.HandleFunc("/search/messages", h.SearchMessages).Methods("GET")
+	protected.HandleFunc("/groups/{id}/members", h.AddToGroup).Methods("POST")
+	protected.HandleFunc("/groups/{id}/leave", h.LeaveGroup).Methods("POST")
+	protected.HandleFunc("/groups/{id}/name", h.SetGroupName).Methods("PUT")
+	protected.HandleFunc("/groups/{id}/photo", h.SetGroupPhoto).Methods("PUT")
+	protected.HandleFunc("/groups/{id}/members/{userId}", h.RemoveFromGroup).Methods("DELETE")
+	protected.HandleFunc("/groups/{id}/admins", h.PromoteMember).Methods("POST")
+	protected.HandleFunc("/groups/{id}/admins/{userId}", h.DemoteAdmin).Methods("DELETE")
+	protected.HandleFunc("/groups/{id}/policy", h.SetGroupPolicy).Methods("PUT")
+}
+
+// client performs API requests as one logged-in user
+type client struct {
+	t      *testing.T
+	srv    *httptest.Server
+	userID string
+	token  string
+}
+
+// loginAs logs a user in by name
+func loginAs(t *testing.T, srv *httptest.Server, name string) *client {
+	t.Helper()
+
+	c := &client{t: t, srv: srv}
+	var resp models.LoginResponse
+	c.expect(c.do("POST", "/api/session", models.LoginRequest{Name: name}), http.StatusCreated, &resp)
+	if resp.Token == "" || resp.Id == "" {
+		t.Fatalf("login response = %+v", resp)
+	}
+
+	c.userID = resp.Id
+	c.token = resp.Token
+	return c
+}
+
+// do sends a JSON request, with the client's token if it has one
+func (c *client) do(method, path string, body interface{}) *http.Response {
+	c.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatalf("encoding request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.srv.URL+path, reader)
+	if err != nil {
+		c.t.Fatalf("NewRequest: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp
+}
+
+// expect checks the response status and decodes the body into out, if given
+func (c *client) expect(resp *http.Response, status int, out interface{}) {
+	c.t.Helper()
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("reading response: %v", err)
+	}
+	if resp.StatusCode != status {
+		c.t.Fatalf("%s %s: status = %d, want %d (body: %s)",
+			resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, status, body)
+	}
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			c.t.Fatalf("decoding response %s: %v", body, err)
+		}
+	}
+}
+
+// directConversation creates a direct conversation with the other user
+func (c *client) directConversation(other *client) models.Conversation {
+	c.t.Helper()
+
+	var conv models.Conversation
+	req := models.CreateConversationRequest{Participants: []string{other.userID}, Type: models.DirectConversation}
+	c.expect(c.do("POST", "/api/conversations", req), http.StatusCreated, &conv)
+	return conv
+}
+
+// send sends a text message to a conversation
+func (c *client) send(conversationID, content string) models.Message {
+	c.t.Helper()
+
+	var msg models.Message
+	c.expect(c.do("POST", "/api/messages", models.Message{ConversationID: conversationID, Content: content}), http.StatusCreated, &msg)
+	// Keep timestamps distinct so the history has a well-defined order
+	time.Sleep(time.Millisecond)
+	return msg
+}
+
+func TestLogin(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+
+	again := loginAs(t, srv, "alice")
+	if again.userID != alice.userID {
+		t.Errorf("second login returned user %s, want %s", again.userID, alice.userID)
+	}
+
+	anonymous := &client{t: t, srv: srv}
+	resp := anonymous.do("POST", "/api/session", nil)
+	anonymous.expect(resp, http.StatusBadRequest, nil)
+}
+
+func TestAuthentication(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+
+	anonymous := &client{t: t, srv: srv}
+	resp := anonymous.do("GET", "/api/users/me", nil)
+	anonymous.expect(resp, http.StatusUnauthorized, nil)
+
+	forged := &client{t: t, srv: srv, token: "forged"}
+	forged.expect(forged.do("GET", "/api/users/me", nil), http.StatusUnauthorized, nil)
+
+	var me models.User
+	alice.expect(alice.do("GET", "/api/users/me", nil), http.StatusOK, &me)
+	if me.ID != alice.userID || me.Name != "alice" {
+		t.Errorf("me = %+v", me)
+	}
+
+	alice.expect(alice.do("DELETE", "/api/session", nil), http.StatusNoContent, nil)
+	alice.expect(alice.do("GET", "/api/users/me", nil), http.StatusUnauthorized, nil)
+}
+
+func TestSetMyUserName(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+
+	alice.expect(alice.do("PUT", "/api/users/me/username", models.UpdateUsernameRequest{Name: "alicia"}), http.StatusNoContent, nil)
+
+	var users []models.User
+	alice.expect(alice.do("GET", "/api/users", nil), http.StatusOK, &users)
+	if len(users) != 1 || users[0].Name != "alicia" {
+		t.Errorf("users = %+v", users)
+	}
+}
+
+func TestLogsCarryRequestIDWithoutSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, slog.LevelDebug, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(prev)
+
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+	conv := alice.directConversation(bob)
+
+	resp := alice.do("POST", "/api/messages", models.Message{ConversationID: conv.ID, Content: "meet me at the docks"})
+	id := resp.Header.Get(logging.RequestIDHeader)
+	alice.expect(resp, http.StatusCreated, nil)
+	if id == "" {
+		t.Fatal("response without a request ID")
+	}
+
+	out := buf.String()
+	for _, secret := range []string{"meet me at the docks", alice.token, "alice"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("logs contain %q", secret)
+		}
+	}
+	var sent bool
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid record %q: %v", line, err)
+		}
+		if record["handler"] == "SendMessage" && record["msg"] == "Message sent" {
+			sent = true
+			if record["request_id"] != id {
+				t.Errorf("record of the request has request_id %v, want %s", record["request_id"], id)
+			}
+		}
+	}
+	if !sent {
+		t.Errorf("no record of the message being sent in %s", out)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+
+	conv := alice.directConversation(bob)
+	msg := alice.send(conv.ID, "hello")
+
+	var group models.Conversation
+	req := models.CreateConversationRequest{Participants: []string{bob.userID}, Type: models.GroupConversation, Name: "friends"}
+	alice.expect(alice.do("POST", "/api/conversations", req), http.StatusCreated, &group)
+
+	tests := []struct {
+		name   string
+		resp   func() *http.Response
+		status int
+		code   string
+	}{
+		{"invalid username", func() *http.Response {
+			return alice.do("PUT", "/api/users/me/username", models.UpdateUsernameRequest{Name: "al"})
+		}, http.StatusBadRequest, "validation_failed"},
+		{"taken username", func() *http.Response {
+			return alice.do("PUT", "/api/users/me/username", models.UpdateUsernameRequest{Name: "bob"})
+		}, http.StatusConflict, "conflict"},
+		{"missing message", func() *http.Response {
+			return alice.do("GET", "/api/messages/missing/history", nil)
+		}, http.StatusNotFound, "not_found"},
+		{"editing another user's message", func() *http.Response {
+			return bob.do("PUT", "/api/messages/"+msg.ID, models.UpdateMessageRequest{Content: "hi"})
+		}, http.StatusForbidden, "forbidden"},
+		{"adding a member twice", func() *http.Response {
+			return alice.do("POST", "/api/groups/"+group.ID+"/members", models.AddToGroupRequest{UserID: bob.userID})
+		}, http.StatusConflict, "conflict"},
+		{"malformed request", func() *http.Response {
+			return alice.do("PUT", "/api/users/me/username", nil)
+		}, http.StatusBadRequest, "bad_request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body struct {
+				Error string `json:"error"`
+				Code  string `json:"code"`
+			}
+			alice.expect(tt.resp(), tt.status, &body)
+			if body.Code != tt.code || body.Error == "" {
+				t.Errorf("body = %+v, want code %q", body, tt.code)
+			}
+		})
+	}
+}
+
+// fakeUsers accepts every token as the session of the user with that ID
+type fakeUsers struct {
+	service.UserService
+}
+
+func (fakeUsers) Authenticate(ctx context.Context, token string) (*models.User, error) {
+	return &models.User{ID: token, Name: token}, nil
+}
+
+// fakeConversations serves a single conversation to its participants
+type fakeConversations struct {
+	service.ConversationService
+	conv models.Conversation
+}
+
+func (f fakeConversations) GetConversation(ctx context.Context, userID, conversationID string) (*models.Conversation, error) {
+	if conversationID != f.conv.ID {
+		return nil, models.NewError(models.ErrNotFound, "conversation not found")
+	}
+	for _, participant := range f.conv.Participants {
+		if participant.ID == userID {
+			conv := f.conv
+			return &conv, nil
+		}
+	}
+	return nil, models.NewError(models.ErrForbidden, "user is not a participant in the conversation")
+}
+
+// fakeMessages has empty histories and fails every deletion with err
+type fakeMessages struct {
+	service.MessageService
+	err error
+}
+
+func (fakeMessages) GetConversationMessages(ctx context.Context, userID, conversationID, cursor string, limit int) (*models.MessagePage, error) {
+	return &models.MessagePage{Messages: []models.Message{}}, nil
+}
+
+func (f fakeMessages) DeleteMessage(ctx context.Context, userID, messageID string, scope models.DeleteScope) error {
+	return f.err
+}
+
+func TestHandlersWithFakeServices(t *testing.T) {
+	conv := models.Conversation{ID: "c1", Type: models.DirectConversation, Participants: []models.Participant{{ID: "alice"}, {ID: "bob"}}}
+	newServer := func(deleteErr error) *httptest.Server {
+		r := mux.NewRouter()
+		routeAPI(r, handlers.New(fakeUsers{}, fakeConversations{conv: conv}, fakeMessages{err: deleteErr}))
+		srv := httptest.NewServer(r)
+		t.Cleanup(srv.Close)
+		return srv
+	}
+
+	srv := newServer(errors.New("database is locked"))
+	alice := &client{t: t, srv: srv, userID: "alice", token: "alice"}
+	carol := &client{t: t, srv: srv, userID: "carol", token: "carol"}
+
+	var got models.Conversation
+	alice.expect(alice.do("GET", "/api/conversations/c1", nil), http.StatusOK, &got)
+	if got.ID != "c1" {
+		t.Errorf("conversation = %+v", got)
+	}
+	carol.expect(carol.do("GET", "/api/conversations/c1", nil), http.StatusForbidden, nil)
+	carol.expect(carol.do("GET", "/api/conversations/c2", nil), http.StatusNotFound, nil)
+
+	// Unexpected errors are reported without their details
+	var body struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	alice.expect(alice.do("DELETE", "/api/messages/m1", nil), http.StatusInternalServerError, &body)
+	if body.Code != "internal_error" || strings.Contains(body.Error, "database") {
+		t.Errorf("body = %+v, want an internal error without details", body)
+	}
+
+	srv = newServer(models.NewError(models.ErrForbidden, "only the sender can delete a message for everyone"))
+	alice = &client{t: t, srv: srv, userID: "alice", token: "alice"}
+	alice.expect(alice.do("DELETE", "/api/messages/m1", nil), http.StatusForbidden, &body)
+	if body.Code != "forbidden" || body.Error != "only the sender can delete a message for everyone" {
+		t.Errorf("body = %+v", body)
+	}
+}
+
+// putPhoto uploads data as the user's profile photo
+func (c *client) putPhoto(data []byte) *http.Response {
+	c.t.Helper()
+	return c.upload("PUT", "/api/users/me/photo", "photo", "me.jpg", data, nil)
+}
+
+// upload sends data as a file of a multipart form, along with the given fields
+func (c *client) upload(method, path, field, fileName string, data []byte, fields map[string]string) *http.Response {
+	c.t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	part, err := form.CreateFormFile(field, fileName)
+	if err != nil {
+		c.t.Fatalf("CreateFormFile: %v", err)
+	}
+	part.Write(data)
+	form.Close()
+
+	req, _ := http.NewRequest(method, c.srv.URL+path, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp
+}
+
+func TestSetMyPhoto(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 64, 48))); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+
+	var result struct {
+		Photo         string            `json:"photo"`
+		PhotoVariants map[string]string `json:"photoVariants"`
+	}
+	alice.expect(alice.putPhoto(img.Bytes()), http.StatusOK, &result)
+	if !strings.HasPrefix(result.Photo, "/uploads/user_photos/") || !strings.HasSuffix(result.Photo, ".png") {
+		t.Errorf("photo = %q", result.Photo)
+	}
+	if result.PhotoVariants["original"] != result.Photo || result.PhotoVariants["small"] == "" {
+		t.Errorf("photoVariants = %v", result.PhotoVariants)
+	}
+
+	// The photo and its thumbnails are served from the blob store
+	for name, url := range result.PhotoVariants {
+		resp, err := http.Get(srv.URL + url)
+		if err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+			t.Errorf("GET %s photo = %d %s", name, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+	}
+
+	// Uploads are sniffed: a file name is not enough
+	alice.expect(alice.putPhoto([]byte("not really a jpeg")), http.StatusBadRequest, nil)
+
+	// Bodies well past the photo limit are cut short while parsing the form,
+	// before they reach the service, for profile and group photos alike
+	huge := make([]byte, 12<<20)
+	var body struct {
+		Error string `json:"error"`
+	}
+	alice.expect(alice.putPhoto(huge), http.StatusRequestEntityTooLarge, &body)
+	if body.Error != "Upload too large" {
+		t.Errorf("profile photo error = %q", body.Error)
+	}
+	bob := loginAs(t, srv, "bob")
+	var group models.Conversation
+	req := models.CreateConversationRequest{Participants: []string{bob.userID}, Type: models.GroupConversation, Name: "friends"}
+	alice.expect(alice.do("POST", "/api/conversations", req), http.StatusCreated, &group)
+	alice.expect(alice.upload("PUT", "/api/groups/"+group.ID+"/photo", "photo", "group.png", huge, nil), http.StatusRequestEntityTooLarge, &body)
+	if body.Error != "Upload too large" {
+		t.Errorf("group photo error = %q", body.Error)
+	}
+}
+
+func TestBusinessMetrics(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+	conv := alice.directConversation(bob)
+
+	texts := metrics.MessagesSent.WithLabelValues("text")
+	sent := testutil.ToFloat64(texts)
+	alice.send(conv.ID, "hello")
+	if got := testutil.ToFloat64(texts); got != sent+1 {
+		t.Errorf("text messages sent = %v, want %v", got, sent+1)
+	}
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 16, 16))); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+	photos := metrics.UploadBytes.WithLabelValues("user_photo")
+	uploaded := testutil.ToFloat64(photos)
+	alice.expect(alice.putPhoto(img.Bytes()), http.StatusOK, nil)
+	if got := testutil.ToFloat64(photos); got != uploaded+float64(img.Len()) {
+		t.Errorf("uploaded bytes = %v, want %v", got, uploaded+float64(img.Len()))
+	}
+}
+
+func TestMessagePhotosNeedSignedURLs(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+	conv := alice.directConversation(bob)
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 64, 48))); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+	var msg models.Message
+	alice.expect(alice.upload("POST", "/api/messages", "photo", "lunch.png", img.Bytes(), map[string]string{"conversationId": conv.ID}), http.StatusCreated, &msg)
+	if !strings.HasPrefix(msg.Content, "/uploads/message_photos/") || !strings.Contains(msg.Content, "sig=") {
+		t.Fatalf("photo message content = %q, want a signed URL", msg.Content)
+	}
+
+	get := func(url string, header map[string]string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+url, nil)
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get(msg.Content, nil)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Cache-Control"), "private") {
+		t.Errorf("GET signed URL = %d, Cache-Control %q", resp.StatusCode, resp.Header.Get("Cache-Control"))
+	}
+	if resp := get(msg.Content, map[string]string{"Range": "bytes=0-9"}); resp.StatusCode != http.StatusPartialContent || resp.ContentLength != 10 {
+		t.Errorf("GET range = %d, %d bytes", resp.StatusCode, resp.ContentLength)
+	}
+	if etag := resp.Header.Get("ETag"); etag == "" {
+		t.Error("no ETag")
+	} else if resp := get(msg.Content, map[string]string{"If-None-Match": etag}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET with matching ETag = %d, want 304", resp.StatusCode)
+	}
+
+	// Guessing the path is not enough, nor is reusing the signature of another photo
+	path, query, _ := strings.Cut(msg.Content, "?")
+	small, _, _ := strings.Cut(msg.Variants["small"], "?")
+	for _, url := range []string{path, path + "?expires=9999999999&sig=forged", small + "?" + query} {
+		if resp := get(url, nil); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("GET %s = %d, want 403", url, resp.StatusCode)
+		}
+	}
+}
+
+func TestSendFileMessage(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+	conv := alice.directConversation(bob)
+
+	var msg models.Message
+	alice.expect(alice.upload("POST", "/api/messages", "file", "page.html", []byte("<html><script>alert(1)</script></html>"), map[string]string{
+		"conversationId": conv.ID,
+		"type":           "file",
+		"caption":        "have a look",
+	}), http.StatusCreated, &msg)
+	if msg.Type != models.FileMessage || msg.Caption != "have a look" {
+		t.Errorf("message = %s, caption %q", msg.Type, msg.Caption)
+	}
+	if msg.Attachment == nil || msg.Attachment.FileName != "page.html" || !strings.HasPrefix(msg.Attachment.MimeType, "text/html") {
+		t.Fatalf("attachment = %+v", msg.Attachment)
+	}
+
+	// Files are downloaded rather than rendered by the browser
+	resp, err := http.Get(srv.URL + msg.Content)
+	if err != nil {
+		t.Fatalf("GET %s: %v", msg.Content, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Disposition") != "attachment" {
+		t.Errorf("GET file = %d, Content-Disposition %q", resp.StatusCode, resp.Header.Get("Content-Disposition"))
+	}
+
+	// A video must be a video, and durations are numbers
+	alice.expect(alice.upload("POST", "/api/messages", "file", "clip.mp4", []byte("not a video"), map[string]string{
+		"conversationId": conv.ID,
+		"type":           "video",
+	}), http.StatusBadRequest, nil)
+	alice.expect(alice.upload("POST", "/api/messages", "file", "voice.ogg", []byte("OggS\x00"), map[string]string{
+		"conversationId": conv.ID,
+		"type":           "audio",
+		"duration":       "long",
+	}), http.StatusBadRequest, nil)
+
+	// A malformed form is the client's mistake, answered without the parser's details
+	req, err := http.NewRequest("POST", srv.URL+"/api/messages", strings.NewReader("--x\r\nnot a header\r\n\r\ndata\r\n--x--\r\n"))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	req.Header.Set("Authorization", "Bearer "+alice.token)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST malformed form: %v", err)
+	}
+	var body struct{ Error string }
+	alice.expect(resp, http.StatusBadRequest, &body)
+	if body.Error != "Could not parse multipart form" {
+		t.Errorf("error = %q", body.Error)
+	}
+}
+
+func TestConversationAccess(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+	mallory := loginAs(t, srv, "mallory")
+
+	conv := alice.directConversation(bob)
+	msg := alice.send(conv.ID, "hello bob")
+
+	var got models.Conversation
+	bob.expect(bob.do("GET", "/api/conversations/"+conv.ID, nil), http.StatusOK, &got)
+	if len(got.Messages) != 1 || got.Messages[0].ID != msg.ID {
+		t.Errorf("messages = %+v, want [%s]", got.Messages, msg.ID)
+	}
+	if got.Name != "alice" {
+		t.Errorf("direct conversation name = %q, want the other participant", got.Name)
+	}
+
+	mallory.expect(mallory.do("GET", "/api/conversations/"+conv.ID, nil), http.StatusForbidden, nil)
+	alice.expect(alice.do("GET", "/api/conversations/missing", nil), http.StatusNotFound, nil)
+
+	var convs []models.Conversation
+	bob.expect(bob.do("GET", "/api/conversations", nil), http.StatusOK, &convs)
+	if len(convs) != 1 || convs[0].ID != conv.ID {
+		t.Errorf("conversations = %+v", convs)
+	}
+
+	alice.expect(alice.do("POST", "/api/conversations", models.CreateConversationRequest{Type: models.DirectConversation}), http.StatusBadRequest, nil)
+}
+
+func TestGetConversationMessages(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+
+	conv := alice.directConversation(bob)
+	first := alice.send(conv.ID, "one")
+	second := bob.send(conv.ID, "two")
+
+	var page models.MessagePage
+	alice.expect(alice.do("GET", "/api/conversations/"+conv.ID+"/messages?limit=1", nil), http.StatusOK, &page)
+	if len(page.Messages) != 1 || page.Messages[0].ID != second.ID || page.NextCursor == "" {
+		t.Fatalf("first page = %+v", page)
+	}
+
+	var older models.MessagePage
+	alice.expect(alice.do("GET", "/api/conversations/"+conv.ID+"/messages?limit=1&before="+page.NextCursor, nil), http.StatusOK, &older)
+	if len(older.Messages) != 1 || older.Messages[0].ID != first.ID || older.NextCursor != "" {
+		t.Errorf("second page = %+v", older)
+	}
+
+	alice.expect(alice.do("GET", "/api/conversations/"+conv.ID+"/messages?limit=zero", nil), http.StatusBadRequest, nil)
+	alice.expect(alice.do("GET", "/api/conversations/"+conv.ID+"/messages?before=garbage", nil), http.StatusBadRequest, nil)
+}
+
+func TestSearchMessages(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+	mallory := loginAs(t, srv, "mallory")
+
+	conv := alice.directConversation(bob)
+	first := alice.send(conv.ID, "see you at the station")
+	bob.send(conv.ID, "ok")
+	second := bob.send(conv.ID, "which Station?")
+
+	var page models.SearchResultPage
+	alice.expect(alice.do("GET", "/api/search/messages?q=station&limit=1", nil), http.StatusOK, &page)
+	if len(page.Results) != 1 || page.Results[0].MessageID != second.ID || page.NextCursor == "" {
+		t.Fatalf("first page = %+v", page)
+	}
+	if got := page.Results[0]; got.ConversationID != conv.ID || got.Snippet != "which <mark>Station</mark>?" {
+		t.Errorf("result = %+v", got)
+	}
+
+	var older models.SearchResultPage
+	alice.expect(alice.do("GET", "/api/search/messages?q=station&before="+page.NextCursor, nil), http.StatusOK, &older)
+	if len(older.Results) != 1 || older.Results[0].MessageID != first.ID || older.NextCursor != "" {
+		t.Errorf("second page = %+v", older)
+	}
+	alice.expect(alice.do("GET", "/api/search/messages?q=station&before=garbage", nil), http.StatusBadRequest, nil)
+
+	var fromAlice models.SearchResultPage
+	bob.expect(bob.do("GET", "/api/search/messages?q=station&conversation="+conv.ID+"&from="+alice.userID, nil), http.StatusOK, &fromAlice)
+	if len(fromAlice.Results) != 1 || fromAlice.Results[0].MessageID != first.ID {
+		t.Errorf("results from alice = %+v", fromAlice)
+	}
+
+	alice.expect(alice.do("GET", "/api/search/messages", nil), http.StatusBadRequest, nil)
+	alice.expect(alice.do("GET", "/api/search/messages?q=station&limit=zero", nil), http.StatusBadRequest, nil)
+	alice.expect(alice.do("GET", "/api/search/messages?q=station&conversation=missing", nil), http.StatusNotFound, nil)
+	mallory.expect(mallory.do("GET", "/api/search/messages?q=station&conversation="+conv.ID, nil), http.StatusForbidden, nil)
+}
+
+func TestReceipts(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+
+	conv := alice.directConversation(bob)
+	msg := alice.send(conv.ID, "did you read this?")
+
+	var receipts []models.Receipt
+	alice.expect(alice.do("GET", "/api/messages/"+msg.ID+"/receipts", nil), http.StatusOK, &receipts)
+	if len(receipts) != 1 || receipts[0].ReadAt != nil {
+		t.Fatalf("receipts before reading = %+v", receipts)
+	}
+
+	bob.expect(bob.do("POST", "/api/conversations/"+conv.ID+"/read", models.AcknowledgeMessagesRequest{MessageID: msg.ID}), http.StatusNoContent, nil)
+
+	alice.expect(alice.do("GET", "/api/messages/"+msg.ID+"/receipts", nil), http.StatusOK, &receipts)
+	if len(receipts) != 1 || receipts[0].UserID != bob.userID || receipts[0].ReadAt == nil {
+		t.Errorf("receipts after reading = %+v", receipts)
+	}
+
+	var page models.MessagePage
+	alice.expect(alice.do("GET", "/api/conversations/"+conv.ID+"/messages", nil), http.StatusOK, &page)
+	if page.Messages[0].Status != models.Read {
+		t.Errorf("status = %s, want read", page.Messages[0].Status)
+	}
+}
+
+func TestMessageLifecycle(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+
+	conv := alice.directConversation(bob)
+	msg := alice.send(conv.ID, "helo")
+
+	alice.expect(alice.do("PUT", "/api/messages/"+msg.ID, models.UpdateMessageRequest{Content: "hello"}), http.StatusNoContent, nil)
+	bob.expect(bob.do("POST", "/api/messages/"+msg.ID+"/reaction", map[string]string{"emoji": "👋"}), http.StatusNoContent, nil)
+
+	var page models.MessagePage
+	bob.expect(bob.do("GET", "/api/conversations/"+conv.ID+"/messages", nil), http.StatusOK, &page)
+	got := page.Messages[0]
+	if got.Content != "hello" || got.EditedAt == nil || len(got.Reactions) != 1 || got.Reactions[0].Emoji != "👋" {
+		t.Errorf("message = %+v", got)
+	}
+
+	var history []models.MessageRevision
+	bob.expect(bob.do("GET", "/api/messages/"+msg.ID+"/history", nil), http.StatusOK, &history)
+	if len(history) != 2 || history[0].Content != "helo" || history[1].Content != "hello" {
+		t.Errorf("history = %+v", history)
+	}
+
+	bob.expect(bob.do("DELETE", "/api/messages/"+msg.ID+"/reaction", nil), http.StatusNoContent, nil)
+	alice.expect(alice.do("DELETE", "/api/messages/"+msg.ID, nil), http.StatusNoContent, nil)
+
+	var after models.MessagePage
+	bob.expect(bob.do("GET", "/api/conversations/"+conv.ID+"/messages", nil), http.StatusOK, &after)
+	got = after.Messages[0]
+	if got.DeletedAt == nil || len(got.Reactions) != 0 {
+		t.Errorf("message = %+v, want deleted without reactions", got)
+	}
+}
+
+func TestReplies(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+
+	conv := alice.directConversation(bob)
+	original := alice.send(conv.ID, "pizza tonight?")
+
+	var reply models.Message
+	bob.expect(bob.do("POST", "/api/messages", models.Message{ConversationID: conv.ID, Content: "yes!", ReplyTo: &original.ID}), http.StatusCreated, &reply)
+	if reply.ReplyPreview == nil || reply.ReplyPreview.MessageID != original.ID || reply.ReplyPreview.Content != "pizza tonight?" {
+		t.Errorf("ReplyPreview = %+v, want a preview of %s", reply.ReplyPreview, original.ID)
+	}
+
+	var page models.MessagePage
+	alice.expect(alice.do("GET", "/api/messages/"+original.ID+"/replies?limit=10", nil), http.StatusOK, &page)
+	if len(page.Messages) != 1 || page.Messages[0].ID != reply.ID || page.Messages[0].ReplyPreview == nil {
+		t.Errorf("replies = %+v, want %s with its preview", page.Messages, reply.ID)
+	}
+	alice.expect(alice.do("GET", "/api/messages/"+original.ID+"/replies?limit=0", nil), http.StatusBadRequest, nil)
+}
+
+func TestDeleteMessageScopes(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+
+	conv := alice.directConversation(bob)
+	first := alice.send(conv.ID, "hello")
+	second := alice.send(conv.ID, "typo")
+
+	bob.expect(bob.do("DELETE", "/api/messages/"+first.ID+"?scope=all", nil), http.StatusBadRequest, nil)
+	bob.expect(bob.do("DELETE", "/api/messages/"+first.ID+"?scope=me", nil), http.StatusNoContent, nil)
+	alice.expect(alice.do("DELETE", "/api/messages/"+second.ID+"?scope=everyone", nil), http.StatusNoContent, nil)
+
+	var page models.MessagePage
+	bob.expect(bob.do("GET", "/api/conversations/"+conv.ID+"/messages", nil), http.StatusOK, &page)
+	if len(page.Messages) != 1 || page.Messages[0].ID != second.ID || page.Messages[0].DeletedAt == nil || page.Messages[0].Content != "" {
+		t.Errorf("bob's history = %+v, want only the tombstone of %s", page.Messages, second.ID)
+	}
+
+	alice.expect(alice.do("GET", "/api/conversations/"+conv.ID+"/messages", nil), http.StatusOK, &page)
+	if len(page.Messages) != 2 {
+		t.Errorf("alice's history = %+v, want both messages", page.Messages)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+	carol := loginAs(t, srv, "carol")
+
+	var group models.Conversation
+	req := models.CreateConversationRequest{Participants: []string{bob.userID}, Type: models.GroupConversation, Name: "friends"}
+	alice.expect(alice.do("POST", "/api/conversations", req), http.StatusCreated, &group)
+
+	// Only members may manage the group
+	carol.expect(carol.do("POST", "/api/groups/"+group.ID+"/members", models.AddToGroupRequest{UserID: carol.userID}), http.StatusForbidden, nil)
+	carol.expect(carol.do("PUT", "/api/groups/"+group.ID+"/name", models.SetGroupNameRequest{Name: "mine"}), http.StatusForbidden, nil)
+	carol.expect(carol.do("PUT", "/api/groups/missing/name", models.SetGroupNameRequest{Name: "mine"}), http.StatusNotFound, nil)
+
+	bob.expect(bob.do("POST", "/api/groups/"+group.ID+"/members", models.AddToGroupRequest{UserID: carol.userID}), http.StatusNoContent, nil)
+	carol.expect(carol.do("PUT", "/api/groups/"+group.ID+"/name", models.SetGroupNameRequest{Name: "best friends"}), http.StatusNoContent, nil)
+	bob.expect(bob.do("POST", "/api/groups/"+group.ID+"/leave", nil), http.StatusNoContent, nil)
+
+	var got models.Conversation
+	alice.expect(alice.do("GET", "/api/conversations/"+group.ID, nil), http.StatusOK, &got)
+	if got.Name != "best friends" || len(got.Participants) != 2 {
+		t.Errorf("group = %+v", got)
+	}
+	bob.expect(bob.do("GET", "/api/conversations/"+group.ID, nil), http.StatusForbidden, nil)
+}
+
+func TestGroupRoles(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+	carol := loginAs(t, srv, "carol")
+
+	var group models.Conversation
+	req := models.CreateConversationRequest{Participants: []string{bob.userID, carol.userID}, Type: models.GroupConversation, Name: "friends"}
+	alice.expect(alice.do("POST", "/api/conversations", req), http.StatusCreated, &group)
+
+	admins := "/api/groups/" + group.ID + "/admins"
+	bob.expect(bob.do("POST", admins, models.AddToGroupRequest{UserID: carol.userID}), http.StatusForbidden, nil)
+	alice.expect(alice.do("POST", admins, models.AddToGroupRequest{UserID: bob.userID}), http.StatusNoContent, nil)
+
+	// Admins-only posting
+	policy := models.SetGroupPolicyRequest{SendMessages: models.AdminsAllowed}
+	carol.expect(carol.do("PUT", "/api/groups/"+group.ID+"/policy", policy), http.StatusForbidden, nil)
+	var got models.GroupPolicy
+	bob.expect(bob.do("PUT", "/api/groups/"+group.ID+"/policy", policy), http.StatusOK, &got)
+	if got.SendMessages != models.AdminsAllowed || got.AddMembers != models.EveryoneAllowed {
+		t.Errorf("policy = %+v", got)
+	}
+	carol.expect(carol.do("POST", "/api/messages", models.Message{ConversationID: group.ID, Content: "hi"}), http.StatusForbidden, nil)
+	bob.send(group.ID, "announcement")
+
+	// Kicking and demoting
+	carol.expect(carol.do("DELETE", "/api/groups/"+group.ID+"/members/"+bob.userID, nil), http.StatusForbidden, nil)
+	bob.expect(bob.do("DELETE", "/api/groups/"+group.ID+"/members/"+carol.userID, nil), http.StatusNoContent, nil)
+	carol.expect(carol.do("DELETE", admins+"/"+bob.userID, nil), http.StatusForbidden, nil)
+	alice.expect(alice.do("DELETE", admins+"/"+bob.userID, nil), http.StatusNoContent, nil)
+
+	var conv models.Conversation
+	alice.expect(alice.do("GET", "/api/conversations/"+group.ID, nil), http.StatusOK, &conv)
+	if len(conv.Participants) != 2 || conv.Policy == nil || conv.Policy.SendMessages != models.AdminsAllowed {
+		t.Errorf("group = %+v", conv)
+	}
+	for _, p := range conv.Participants {
+		if want := map[string]models.ParticipantRole{alice.userID: models.RoleOwner, bob.userID: models.RoleMember}[p.ID]; p.Role != want {
+			t.Errorf("%s has role %s, want %s", p.Name, p.Role, want)
+		}
+	}
+}
+
+func TestForwardMessage(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+	carol := loginAs(t, srv, "carol")
+
+	withBob := alice.directConversation(bob)
+	withCarol := alice.directConversation(carol)
+	msg := bob.send(withBob.ID, "pass it on")
+
+	req := models.ForwardMessageRequest{MessageID: msg.ID, TargetConversationID: withCarol.ID}
+	alice.expect(alice.do("POST", "/api/messages/forward", req), http.StatusOK, nil)
+
+	var page models.MessagePage
+	carol.expect(carol.do("GET", "/api/conversations/"+withCarol.ID+"/messages", nil), http.StatusOK, &page)
+	if len(page.Messages) != 1 || page.Messages[0].Content != "pass it on" {
+		t.Errorf("messages = %+v", page.Messages)
+	}
+	if f := page.Messages[0].ForwardedFrom; f == nil || f.MessageID != msg.ID || f.Sender.ID != bob.userID {
+		t.Errorf("ForwardedFrom = %+v, want bob's %s", f, msg.ID)
+	}
+
+	var copies []models.Message
+	req = models.ForwardMessageRequest{MessageID: msg.ID, TargetConversationIDs: []string{withCarol.ID, withBob.ID}}
+	alice.expect(alice.do("POST", "/api/messages/forward", req), http.StatusOK, &copies)
+	if len(copies) != 2 {
+		t.Errorf("copies = %+v, want 2", copies)
+	}
+	alice.expect(alice.do("POST", "/api/messages/forward", models.ForwardMessageRequest{MessageID: msg.ID}), http.StatusBadRequest, nil)
+}
+
+func TestEventsOverSSE(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+	conv := alice.directConversation(bob)
+
+	anonymous := &client{t: t, srv: srv}
+	anonymous.expect(anonymous.do("GET", "/api/events", nil), http.StatusUnauthorized, nil)
+
+	resp, err := http.Get(srv.URL + "/api/events?token=" + bob.token)
+	if err != nil {
+		t.Fatalf("GET events: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	msg := alice.send(conv.ID, "ping")
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatal("stream closed before the event arrived")
+			}
+			data, found := strings.CutPrefix(line, "data: ")
+			if !found {
+				continue
+			}
+			var event struct {
+				Type    string         `json:"type"`
+				Payload models.Message `json:"payload"`
+			}
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Fatalf("decoding event %s: %v", data, err)
+			}
+			if event.Type != "message.created" || event.Payload.ID != msg.ID {
+				t.Errorf("event = %+v", event)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no event received")
+		}
+	}
+}
+
+func TestEventsOverWebSocket(t *testing.T) {
+	srv := newTestServer(t)
+	alice := loginAs(t, srv, "alice")
+	bob := loginAs(t, srv, "bob")
+	conv := alice.directConversation(bob)
+
+	// The upgrade goes through the logging, CORS and metrics middleware, which
+	// must all let the connection be hijacked
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/events?token=" + bob.token
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://localhost:4173"}})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	msg := alice.send(conv.ID, "ping")
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var event struct {
+		Type    string         `json:"type"`
+		Payload models.Message `json:"payload"`
+	}
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	if event.Type != "message.created" || event.Payload.ID != msg.ID {
+		t.Errorf("event = %+v", event)
+	}
+}
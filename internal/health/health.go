@@ -0,0 +1,117 @@
+// Package health serves the liveness and readiness endpoints of the server.
+//
+// Liveness (/healthz) only tells that the process answers. Readiness (/readyz)
+// runs a check on each dependency, such as the database and the blob store, and
+// fails once the server starts shutting down, so that load balancers stop
+// sending it traffic before it goes away.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// checkTimeout bounds each check, so that a hung dependency fails the probe
+// instead of stalling it
+var checkTimeout = 2 * time.Second
+
+// Check reports whether a dependency can serve requests
+type Check func(ctx context.Context) error
+
+// Cached returns a check that runs check at most once per ttl, and answers with
+// its last result in between. Use it for checks that cost something, such as
+// writing to a remote store, since anyone can hit the readiness endpoint.
+func Cached(check Check, ttl time.Duration) Check {
+	var mu sync.Mutex
+	var checkedAt time.Time
+	var result error
+	return func(ctx context.Context) error {
+		// Concurrent probes wait for the check in flight rather than start another
+		mu.Lock()
+		defer mu.Unlock()
+		if !checkedAt.IsZero() && time.Since(checkedAt) < ttl {
+			return result
+		}
+		result = check(ctx)
+		checkedAt = time.Now()
+		return result
+	}
+}
+
+// Checker runs the readiness checks of the server
+type Checker struct {
+	checks   map[string]Check
+	draining atomic.Bool
+}
+
+// NewChecker returns a checker running the given checks, by name
+func NewChecker(checks map[string]Check) *Checker {
+	return &Checker{checks: checks}
+}
+
+// Drain makes readiness fail from now on; call it when shutdown begins
+func (c *Checker) Drain() {
+	c.draining.Store(true)
+}
+
+// status is the body of both endpoints
+type status struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Live answers liveness probes: the process is up and serving requests
+func (c *Checker) Live(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, status{Status: "ok"})
+}
+
+// Ready answers readiness probes, with the outcome of each check. Error details
+// are logged rather than returned, as the endpoint is public.
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	if c.draining.Load() {
+		respond(w, http.StatusServiceUnavailable, status{Status: "shutting down"})
+		return
+	}
+
+	results := make(map[string]string, len(c.checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+			defer cancel()
+
+			result := "ok"
+			if err := check(ctx); err != nil {
+				slog.WarnContext(r.Context(), "Readiness check failed", "check", name, "error", err)
+				result = "failed"
+			}
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	code, body := http.StatusOK, status{Status: "ok", Checks: results}
+	for _, result := range results {
+		if result != "ok" {
+			code, body.Status = http.StatusServiceUnavailable, "unavailable"
+		}
+	}
+	respond(w, code, body)
+}
+
+func respond(w http.ResponseWriter, code int, body status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
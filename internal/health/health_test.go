@@ -0,0 +1,91 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func probe(t *testing.T, handler http.HandlerFunc) (int, status) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/", nil))
+	var body status
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %s: %v", rec.Body, err)
+	}
+	return rec.Code, body
+}
+
+func TestReadiness(t *testing.T) {
+	var dbErr error
+	c := NewChecker(map[string]Check{
+		"repository": func(ctx context.Context) error { return dbErr },
+		"blobs":      func(ctx context.Context) error { return nil },
+	})
+
+	if code, body := probe(t, c.Ready); code != http.StatusOK || body.Checks["repository"] != "ok" || body.Checks["blobs"] != "ok" {
+		t.Errorf("ready = %d %+v, want 200 with every check ok", code, body)
+	}
+
+	// A failing dependency fails readiness, not liveness
+	dbErr = errors.New("connection refused")
+	if code, body := probe(t, c.Ready); code != http.StatusServiceUnavailable || body.Checks["repository"] != "failed" || body.Checks["blobs"] != "ok" {
+		t.Errorf("ready with the database down = %d %+v", code, body)
+	}
+	if code, _ := probe(t, c.Live); code != http.StatusOK {
+		t.Errorf("live with the database down = %d, want 200", code)
+	}
+
+	// Once draining, readiness fails even with healthy dependencies
+	dbErr = nil
+	c.Drain()
+	if code, body := probe(t, c.Ready); code != http.StatusServiceUnavailable || body.Status != "shutting down" {
+		t.Errorf("ready while draining = %d %+v", code, body)
+	}
+	if code, _ := probe(t, c.Live); code != http.StatusOK {
+		t.Errorf("live while draining = %d, want 200", code)
+	}
+}
+
+func TestReadinessTimesOut(t *testing.T) {
+	defer func(d time.Duration) { checkTimeout = d }(checkTimeout)
+	checkTimeout = 10 * time.Millisecond
+
+	c := NewChecker(map[string]Check{
+		"stuck": func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+	if code, _ := probe(t, c.Ready); code != http.StatusServiceUnavailable {
+		t.Errorf("ready with a stuck check = %d, want 503", code)
+	}
+}
+
+func TestCachedCheck(t *testing.T) {
+	calls := 0
+	check := Cached(func(ctx context.Context) error {
+		calls++
+		return errors.New("store down")
+	}, 50*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		if err := check(context.Background()); err == nil {
+			t.Error("cached check lost the failure")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("check ran %d times within its TTL, want 1", calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	check(context.Background())
+	if calls != 2 {
+		t.Errorf("check ran %d times after its TTL, want 2", calls)
+	}
+}
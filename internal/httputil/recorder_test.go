@@ -0,0 +1,50 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusRecorder(t *testing.T) {
+	rec := NewStatusRecorder(httptest.NewRecorder())
+	if rec.Status() != http.StatusOK {
+		t.Errorf("status before writing = %d, want 200", rec.Status())
+	}
+	rec.WriteHeader(http.StatusNotFound)
+	rec.WriteHeader(http.StatusInternalServerError)
+	if rec.Status() != http.StatusNotFound {
+		t.Errorf("status = %d, want the first one written, 404", rec.Status())
+	}
+
+	// An implicit 200 is not overridden by a later WriteHeader
+	rec = NewStatusRecorder(httptest.NewRecorder())
+	rec.Write([]byte("ok"))
+	rec.WriteHeader(http.StatusTeapot)
+	if rec.Status() != http.StatusOK {
+		t.Errorf("status after writing = %d, want 200", rec.Status())
+	}
+}
+
+func TestStatusRecorderHijack(t *testing.T) {
+	status := make(chan int, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := NewStatusRecorder(w)
+		conn, _, err := http.NewResponseController(rec).Hijack()
+		if err != nil {
+			t.Errorf("Hijack: %v", err)
+			status <- 0
+			return
+		}
+		conn.Close()
+		status <- rec.Status()
+	}))
+	defer srv.Close()
+
+	if resp, err := http.Get(srv.URL); err == nil {
+		resp.Body.Close()
+	}
+	if got := <-status; got != http.StatusSwitchingProtocols {
+		t.Errorf("status of a hijacked connection = %d, want 101", got)
+	}
+}
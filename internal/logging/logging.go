@@ -0,0 +1,85 @@
+// Package logging sets up the structured logger of the server.
+//
+// Records are written with log/slog. Each request gets an ID, returned in the
+// X-Request-ID header and attached to every record logged with the request's
+// context, from the handlers down to the repositories. Secrets and message
+// content are redacted before they reach the output.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Redacted replaces the value of sensitive attributes
+const Redacted = "[REDACTED]"
+
+// redactedKeys are the attributes that never reach the output: credentials, and
+// what users write or call themselves
+var redactedKeys = map[string]bool{
+	"authorization": true,
+	"caption":       true,
+	"content":       true,
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+	"username":      true,
+}
+
+// New returns a logger writing to w at the given level, as text or as JSON
+func New(w io.Writer, level slog.Level, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	var h slog.Handler
+	switch format {
+	case "", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q: expected text or json", format)
+	}
+	return slog.New(contextHandler{h}), nil
+}
+
+// ParseLevel parses a level name: debug, info, warn or error
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if strings.TrimSpace(s) == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return 0, fmt.Errorf("invalid log level %q: expected debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// redact hides the value of sensitive attributes, whatever group they are in
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if redactedKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+// contextHandler adds the request ID found in the context to each record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
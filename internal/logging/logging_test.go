@@ -0,0 +1,121 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, slog.LevelDebug, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("Message sent", "content", "hello there", "token", "secret-token", "Password", "hunter2", "message_id", "m1")
+
+	out := buf.String()
+	for _, secret := range []string{"hello there", "secret-token", "hunter2"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("output contains %q: %s", secret, out)
+		}
+	}
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["content"] != Redacted || record["message_id"] != "m1" {
+		t.Errorf("record = %v", record)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for in, want := range map[string]slog.Level{"": slog.LevelInfo, "debug": slog.LevelDebug, "WARN": slog.LevelWarn, "error": slog.LevelError} {
+		if got, err := ParseLevel(in); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel accepted an unknown level")
+	}
+	if _, err := New(&bytes.Buffer{}, slog.LevelInfo, "xml"); err == nil {
+		t.Error("New accepted an unknown format")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := New(&buf, slog.LevelInfo, "json")
+	prev := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(prev)
+
+	var seen string
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+		slog.InfoContext(r.Context(), "Handled")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	// A generated ID reaches the handler, the response and the logs
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/conversations", nil))
+	id := rec.Header().Get(RequestIDHeader)
+	if id == "" || id != seen {
+		t.Fatalf("header ID = %q, context ID = %q", id, seen)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want 2: %s", len(lines), buf.String())
+	}
+	for _, line := range lines {
+		var record map[string]any
+		json.Unmarshal([]byte(line), &record)
+		if record["request_id"] != id {
+			t.Errorf("record without the request ID: %s", line)
+		}
+	}
+	if !strings.Contains(lines[1], `"status":418`) {
+		t.Errorf("access log without the status: %s", lines[1])
+	}
+
+	// A well-formed incoming ID is kept, anything else is replaced
+	for in, keep := range map[string]bool{"abc-123.x_y": true, "bad id\n": false, strings.Repeat("a", 65): false} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(RequestIDHeader, in)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if got := rec.Header().Get(RequestIDHeader); (got == in) != keep || got == "" {
+			t.Errorf("incoming ID %q: response ID = %q", in, got)
+		}
+	}
+}
+
+func TestMiddlewareKeepsStreamingAndUpgrades(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("response is not an http.Flusher")
+		}
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Error("response is not an http.Hijacker")
+		}
+	}))
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestRequestIDWithoutMiddleware(t *testing.T) {
+	if id := RequestID(context.Background()); id != "" {
+		t.Errorf("RequestID = %q", id)
+	}
+}
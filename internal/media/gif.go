@@ -0,0 +1,73 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errTruncatedGIF = errors.New("gif: truncated file")
+
+// gifFramePixels adds up the areas of the frames of a GIF file, as declared by
+// their image descriptors, without decoding them. Decoding allocates a paletted
+// image of that many pixels for every frame.
+func gifFramePixels(data []byte) (int, error) {
+	// Header and logical screen descriptor, then the global color table if any
+	if len(data) < 13 {
+		return 0, errTruncatedGIF
+	}
+	i := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << (flags&0x07 + 1)
+	}
+
+	total := 0
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // Extension: label, then sub-blocks
+			if i+2 > len(data) {
+				return 0, errTruncatedGIF
+			}
+			end, err := skipSubBlocks(data, i+2)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		case 0x2C: // Image descriptor, local color table, LZW code size, then sub-blocks
+			if i+10 > len(data) {
+				return 0, errTruncatedGIF
+			}
+			width := int(binary.LittleEndian.Uint16(data[i+5:]))
+			height := int(binary.LittleEndian.Uint16(data[i+7:]))
+			total += width * height
+			next := i + 10
+			if flags := data[i+9]; flags&0x80 != 0 {
+				next += 3 << (flags&0x07 + 1)
+			}
+			end, err := skipSubBlocks(data, next+1)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		case 0x3B: // Trailer
+			return total, nil
+		default:
+			return 0, errors.New("gif: unknown block")
+		}
+	}
+	return 0, errTruncatedGIF
+}
+
+// skipSubBlocks returns the offset following the data sub-blocks starting at i
+func skipSubBlocks(data []byte, i int) (int, error) {
+	for {
+		if i >= len(data) {
+			return 0, errTruncatedGIF
+		}
+		size := int(data[i])
+		i++
+		if size == 0 {
+			return i, nil
+		}
+		i += size
+	}
+}
@@ -0,0 +1,332 @@
+// Package media validates and normalizes uploaded images.
+//
+// Every upload is sniffed, decoded and encoded again: this drops any metadata
+// the file carried (EXIF, GPS coordinates, comments), bounds its dimensions and
+// produces a fixed set of thumbnails. Files are named after the SHA-256 of the
+// stored image, so the same picture is always stored under the same name.
+package media
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+var (
+	// ErrUnsupportedFormat is returned for uploads that are not JPEG, PNG, GIF or WebP images
+	ErrUnsupportedFormat = errors.New("unsupported image format: use JPEG, PNG, GIF or WebP")
+
+	// ErrTooLarge is returned for uploads over the configured size or pixel count
+	ErrTooLarge = errors.New("image is too large")
+
+	// ErrInvalidImage is returned for files that claim an image format but cannot be decoded
+	ErrInvalidImage = errors.New("invalid image")
+)
+
+// Config bounds the images a Processor accepts
+type Config struct {
+	MaxBytes       int64 // Largest accepted upload
+	MaxPixels      int   // Largest accepted width × height, checked before decoding
+	MaxDimension   int   // Longest side of a stored image; larger still images are scaled down, animations rejected
+	MaxFramePixels int   // Largest accepted width × height summed over the frames of an animation, checked before decoding
+	JPEGQuality    int
+}
+
+// DefaultConfig returns the limits used unless configured otherwise
+func DefaultConfig() Config {
+	return Config{
+		MaxBytes:       10 << 20,
+		MaxPixels:      40_000_000,
+		MaxDimension:   2048,
+		MaxFramePixels: 50_000_000,
+		JPEGQuality:    85,
+	}
+}
+
+// Thumbnail is a square bounding box thumbnails are scaled to fit in
+type Thumbnail struct {
+	Name string
+	Size int
+}
+
+// Thumbnails are the thumbnail sizes generated for every image, smallest first
+var Thumbnails = []Thumbnail{
+	{Name: "small", Size: 96},
+	{Name: "medium", Size: 320},
+	{Name: "large", Size: 960},
+}
+
+// File is one encoded variant of an image
+type File struct {
+	Name        string // Content-addressed file name
+	ContentType string
+	Width       int
+	Height      int
+	Data        []byte
+}
+
+// Image is a processed upload: the normalized original and its thumbnails
+type Image struct {
+	Original   File
+	Thumbnails map[string]File // Keyed by Thumbnail.Name
+}
+
+// Files returns the original followed by the thumbnails, smallest first
+func (img *Image) Files() []File {
+	files := []File{img.Original}
+	for _, t := range Thumbnails {
+		if f, ok := img.Thumbnails[t.Name]; ok {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// Processor turns uploads into normalized images
+type Processor struct {
+	config Config
+}
+
+// NewProcessor returns a Processor enforcing the given limits
+func NewProcessor(config Config) *Processor {
+	return &Processor{config: config}
+}
+
+// Process reads an upload, validates it and returns the image to store
+func (p *Processor) Process(r io.Reader) (*Image, error) {
+	data, err := io.ReadAll(io.LimitReader(r, p.config.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > p.config.MaxBytes {
+		return nil, fmt.Errorf("%w: uploads are limited to %d bytes", ErrTooLarge, p.config.MaxBytes)
+	}
+
+	// Trust the content, not the file name or the declared type
+	format := http.DetectContentType(data)
+	switch format {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+
+	// Refuse decompression bombs before allocating their pixels
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, ErrInvalidImage
+	}
+	if cfg.Width*cfg.Height > p.config.MaxPixels {
+		return nil, fmt.Errorf("%w: images are limited to %d pixels", ErrTooLarge, p.config.MaxPixels)
+	}
+
+	if format == "image/gif" {
+		return p.processGIF(data)
+	}
+
+	var img image.Image
+	switch format {
+	case "image/jpeg":
+		img, err = jpeg.Decode(bytes.NewReader(data))
+		if err == nil {
+			img = orient(img, jpegOrientation(data))
+		}
+	case "image/png":
+		img, err = png.Decode(bytes.NewReader(data))
+	case "image/webp":
+		img, err = webp.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+
+	// JPEG stays JPEG; PNG stays lossless; WebP, which cannot be encoded here,
+	// becomes JPEG unless it needs transparency
+	encode := p.encodeJPEG
+	if format == "image/png" || (format == "image/webp" && !opaque(img)) {
+		encode = encodePNG
+	}
+
+	original, err := encode(fit(img, p.config.MaxDimension))
+	if err != nil {
+		return nil, err
+	}
+	return p.withThumbnails(original, img, encode)
+}
+
+// processGIF re-encodes every frame of a GIF, keeping its animation
+func (p *Processor) processGIF(data []byte) (*Image, error) {
+	// Every frame is decoded at once, so bound them all before decoding any
+	cfg, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	if cfg.Width > p.config.MaxDimension || cfg.Height > p.config.MaxDimension {
+		return nil, fmt.Errorf("%w: animated images are limited to %d pixels per side", ErrTooLarge, p.config.MaxDimension)
+	}
+	pixels, err := gifFramePixels(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	if pixels > p.config.MaxFramePixels {
+		return nil, fmt.Errorf("%w: animations are limited to %d pixels over all their frames", ErrTooLarge, p.config.MaxFramePixels)
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	if len(g.Image) == 0 {
+		return nil, ErrInvalidImage
+	}
+
+	// Only the frames and their timing survive; comments and other extensions are dropped
+	var buf bytes.Buffer
+	clean := &gif.GIF{
+		Image:     g.Image,
+		Delay:     g.Delay,
+		LoopCount: g.LoopCount,
+		Disposal:  g.Disposal,
+		Config:    g.Config,
+	}
+	if err := gif.EncodeAll(&buf, clean); err != nil {
+		return nil, err
+	}
+	original := newFile(buf.Bytes(), "image/gif", g.Config.Width, g.Config.Height)
+
+	// Thumbnails show the first frame
+	first := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	draw.Draw(first, g.Image[0].Bounds(), g.Image[0], g.Image[0].Bounds().Min, draw.Over)
+	return p.withThumbnails(original, first, encodePNG)
+}
+
+// withThumbnails completes an image with thumbnails of src, named after the original
+func (p *Processor) withThumbnails(original File, src image.Image, encode func(image.Image) (File, error)) (*Image, error) {
+	img := &Image{Original: original, Thumbnails: make(map[string]File, len(Thumbnails))}
+	hash := baseName(original.Name)
+	for _, t := range Thumbnails {
+		thumb, err := encode(fit(src, t.Size))
+		if err != nil {
+			return nil, err
+		}
+		thumb.Name = thumbnailName(hash, t.Name, thumb.ContentType)
+		img.Thumbnails[t.Name] = thumb
+	}
+	return img, nil
+}
+
+func (p *Processor) encodeJPEG(img image.Image) (File, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: p.config.JPEGQuality}); err != nil {
+		return File{}, err
+	}
+	b := img.Bounds()
+	return newFile(buf.Bytes(), "image/jpeg", b.Dx(), b.Dy()), nil
+}
+
+func encodePNG(img image.Image) (File, error) {
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		return File{}, err
+	}
+	b := img.Bounds()
+	return newFile(buf.Bytes(), "image/png", b.Dx(), b.Dy()), nil
+}
+
+// newFile names encoded data after its SHA-256
+func newFile(data []byte, contentType string, width, height int) File {
+	sum := sha256.Sum256(data)
+	return File{
+		Name:        hex.EncodeToString(sum[:]) + extensions[contentType],
+		ContentType: contentType,
+		Width:       width,
+		Height:      height,
+		Data:        data,
+	}
+}
+
+// fit scales an image down so that neither side exceeds size, keeping its aspect ratio
+func fit(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	if w >= h {
+		w, h = size, max(1, h*size/w)
+	} else {
+		w, h = max(1, w*size/h), size
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// opaque reports whether every pixel of an image is fully opaque
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// orient applies an EXIF orientation, since the tag itself does not survive re-encoding
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // Rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // Mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // Mirrored along the main diagonal
+				dx, dy = y, x
+			case 6: // Rotated 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // Mirrored along the anti-diagonal
+				dx, dy = h-1-y, w-1-x
+			case 8: // Rotated 90° counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, color.RGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,285 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func encodedPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// jpegWithExif encodes a w×h JPEG whose left half is black and right half white,
+// with an Exif segment carrying the given orientation and a fake GPS marker
+func jpegWithExif(t *testing.T, w, h, orientation int) []byte {
+	t.Helper()
+
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := w / 2; x < w; x++ {
+			img.SetGray(x, y, color.Gray{Y: 0xFF})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("jpeg.Encode: %v", err)
+	}
+
+	// Big-endian TIFF header with a single IFD entry: the orientation
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry[0:], 0x0112)
+	binary.BigEndian.PutUint16(entry[2:], 3)
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], uint16(orientation))
+	tiff = append(tiff, entry...)
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(tiff, "GPSLatitude 45.4642"...)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+func TestProcessRejectsNonImages(t *testing.T) {
+	p := NewProcessor(DefaultConfig())
+	for name, data := range map[string][]byte{
+		"text": []byte("hello, this is not an image"),
+		"html": []byte("<html><body><img src=x></body></html>"),
+		"pdf":  []byte("%PDF-1.4\n"),
+	} {
+		if _, err := p.Process(bytes.NewReader(data)); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("%s: error = %v, want ErrUnsupportedFormat", name, err)
+		}
+	}
+
+	// A PNG signature followed by garbage
+	if _, err := p.Process(strings.NewReader("\x89PNG\r\n\x1a\ngarbage")); !errors.Is(err, ErrInvalidImage) {
+		t.Errorf("truncated PNG: error = %v, want ErrInvalidImage", err)
+	}
+}
+
+func TestProcessEnforcesLimits(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxBytes = 100
+	if _, err := NewProcessor(config).Process(bytes.NewReader(encodedPNG(t, 200, 200))); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("oversized upload: error = %v, want ErrTooLarge", err)
+	}
+
+	config = DefaultConfig()
+	config.MaxPixels = 100 * 100
+	if _, err := NewProcessor(config).Process(bytes.NewReader(encodedPNG(t, 101, 100))); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("too many pixels: error = %v, want ErrTooLarge", err)
+	}
+}
+
+func TestProcessScalesAndThumbnails(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxDimension = 1000
+	img, err := NewProcessor(config).Process(bytes.NewReader(encodedPNG(t, 1500, 600)))
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+
+	if img.Original.ContentType != "image/png" || img.Original.Width != 1000 || img.Original.Height != 400 {
+		t.Errorf("original = %s %dx%d, want image/png 1000x400",
+			img.Original.ContentType, img.Original.Width, img.Original.Height)
+	}
+	decoded, err := png.Decode(bytes.NewReader(img.Original.Data))
+	if err != nil || decoded.Bounds().Dx() != 1000 {
+		t.Errorf("stored original does not decode to 1000 pixels wide: %v", err)
+	}
+
+	for _, thumb := range Thumbnails {
+		f, ok := img.Thumbnails[thumb.Name]
+		if !ok {
+			t.Errorf("no %s thumbnail", thumb.Name)
+			continue
+		}
+		if max(f.Width, f.Height) != min(thumb.Size, 1000) {
+			t.Errorf("%s thumbnail is %dx%d, want a longest side of %d", thumb.Name, f.Width, f.Height, thumb.Size)
+		}
+		want := baseName(img.Original.Name) + "_" + thumb.Name + ".png"
+		if f.Name != want {
+			t.Errorf("%s thumbnail name = %q, want %q", thumb.Name, f.Name, want)
+		}
+	}
+	if got := len(img.Files()); got != 1+len(Thumbnails) {
+		t.Errorf("Files() = %d files", got)
+	}
+}
+
+func TestProcessIsDeterministic(t *testing.T) {
+	p := NewProcessor(DefaultConfig())
+	a, err := p.Process(bytes.NewReader(encodedPNG(t, 50, 50)))
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	b, err := p.Process(bytes.NewReader(encodedPNG(t, 50, 50)))
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if a.Original.Name != b.Original.Name {
+		t.Errorf("same image named %q and %q", a.Original.Name, b.Original.Name)
+	}
+	if !isContentAddressed(a.Original.Name) {
+		t.Errorf("name %q is not content-addressed", a.Original.Name)
+	}
+}
+
+func TestProcessStripsExifAndAppliesOrientation(t *testing.T) {
+	data := jpegWithExif(t, 40, 20, 6)
+	if jpegOrientation(data) != 6 {
+		t.Fatalf("test image orientation = %d", jpegOrientation(data))
+	}
+
+	img, err := NewProcessor(DefaultConfig()).Process(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	out := img.Original.Data
+	if bytes.Contains(out, []byte("Exif")) || bytes.Contains(out, []byte("GPSLatitude")) {
+		t.Error("metadata survived processing")
+	}
+	if jpegOrientation(out) != 0 {
+		t.Errorf("orientation tag survived processing")
+	}
+
+	// Rotated 90° clockwise: the black left half is now on top
+	decoded, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("jpeg.Decode: %v", err)
+	}
+	if b := decoded.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Fatalf("oriented image is %dx%d, want 20x40", b.Dx(), b.Dy())
+	}
+	top, _, _, _ := decoded.At(10, 5).RGBA()
+	bottom, _, _, _ := decoded.At(10, 35).RGBA()
+	if top > 0x4000 || bottom < 0xC000 {
+		t.Errorf("top = %#x, bottom = %#x: image was not rotated", top, bottom)
+	}
+}
+
+func TestProcessKeepsGIFAnimation(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{LoopCount: 0}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 30, 20), palette)
+		frame.SetColorIndex(i, i, 1)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatalf("gif.EncodeAll: %v", err)
+	}
+
+	img, err := NewProcessor(DefaultConfig()).Process(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if img.Original.ContentType != "image/gif" || !strings.HasSuffix(img.Original.Name, ".gif") {
+		t.Errorf("original = %s %q", img.Original.ContentType, img.Original.Name)
+	}
+	decoded, err := gif.DecodeAll(bytes.NewReader(img.Original.Data))
+	if err != nil {
+		t.Fatalf("gif.DecodeAll: %v", err)
+	}
+	if len(decoded.Image) != 3 || decoded.Delay[2] != 10 {
+		t.Errorf("%d frames, delays %v: animation lost", len(decoded.Image), decoded.Delay)
+	}
+	if thumb := img.Thumbnails["small"]; thumb.ContentType != "image/png" || !strings.HasSuffix(thumb.Name, "_small.png") {
+		t.Errorf("small thumbnail = %s %q", thumb.ContentType, thumb.Name)
+	}
+
+	config := DefaultConfig()
+	config.MaxDimension = 25
+	if _, err := NewProcessor(config).Process(bytes.NewReader(buf.Bytes())); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("oversized animation: error = %v, want ErrTooLarge", err)
+	}
+}
+
+func TestProcessRejectsGIFBombs(t *testing.T) {
+	// 300 frames of 2000×2000 would take 1.2 GB once decoded, yet compress to
+	// a few hundred kilobytes. Encode one frame and repeat it.
+	palette := color.Palette{color.Black, color.White}
+	frame := image.NewPaletted(image.Rect(0, 0, 2000, 2000), palette)
+	var one bytes.Buffer
+	if err := gif.EncodeAll(&one, &gif.GIF{Image: []*image.Paletted{frame}, Delay: []int{1}}); err != nil {
+		t.Fatalf("gif.EncodeAll: %v", err)
+	}
+	data := one.Bytes()
+	header := 13 // Logical screen descriptor, then the global color table if any
+	if data[10]&0x80 != 0 {
+		header += 3 << (data[10]&0x07 + 1)
+	}
+	bomb := append([]byte{}, data[:header]...)
+	for i := 0; i < 300; i++ {
+		bomb = append(bomb, data[header:len(data)-1]...)
+	}
+	bomb = append(bomb, 0x3B)
+
+	if pixels, err := gifFramePixels(bomb); err != nil || pixels != 300*2000*2000 {
+		t.Errorf("gifFramePixels = %d, %v; want %d", pixels, err, 300*2000*2000)
+	}
+	if _, err := NewProcessor(DefaultConfig()).Process(bytes.NewReader(bomb)); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("GIF bomb: error = %v, want ErrTooLarge", err)
+	}
+}
+
+func TestVariants(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+
+	got := Variants("message_photos/" + hash + ".gif")
+	want := map[string]string{
+		"original": "message_photos/" + hash + ".gif",
+		"small":    "message_photos/" + hash + "_small.png",
+		"medium":   "message_photos/" + hash + "_medium.png",
+		"large":    "message_photos/" + hash + "_large.png",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Variants = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("Variants[%q] = %q, want %q", k, got[k], v)
+		}
+	}
+
+	// Photos stored before the pipeline only have their original
+	legacy := "user_photos/1234_photo.jpg"
+	if got := Variants(legacy); len(got) != 1 || got["original"] != legacy {
+		t.Errorf("Variants(legacy) = %v", got)
+	}
+	if got := VariantKeys(legacy); len(got) != 1 {
+		t.Errorf("VariantKeys(legacy) = %v", got)
+	}
+	if got := VariantKeys("message_photos/" + hash + ".gif"); len(got) != 4 || got[1] != want["small"] {
+		t.Errorf("VariantKeys = %v", got)
+	}
+	if got := Variants(""); got != nil {
+		t.Errorf("Variants(\"\") = %v", got)
+	}
+}
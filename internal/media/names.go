@@ -0,0 +1,84 @@
+package media
+
+import (
+	"path"
+	"strings"
+)
+
+// extensions maps the content types images are stored as to their file extensions
+var extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// baseName strips the extension from a file name
+func baseName(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// thumbnailName names a thumbnail after the hash of its original
+func thumbnailName(hash, size, contentType string) string {
+	return hash + "_" + size + extensions[contentType]
+}
+
+// thumbnailExt returns the extension of the thumbnails of an original with the given extension:
+// GIF thumbnails are still PNG images of the first frame
+func thumbnailExt(ext string) string {
+	if ext == ".gif" {
+		return ".png"
+	}
+	return ext
+}
+
+// isContentAddressed reports whether a file name was produced by a Processor.
+// Files stored before the pipeline existed have no thumbnails.
+func isContentAddressed(name string) bool {
+	switch path.Ext(name) {
+	case ".jpg", ".png", ".gif":
+	default:
+		return false
+	}
+	hash := baseName(name)
+	if len(hash) != 64 {
+		return false
+	}
+	for _, c := range hash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Variants returns the storage keys of an image and its thumbnails, keyed by thumbnail
+// name plus "original", given the key of the original. Images stored before the
+// pipeline existed only have their original; an empty key has no variants.
+func Variants(key string) map[string]string {
+	if key == "" {
+		return nil
+	}
+	variants := map[string]string{"original": key}
+
+	dir, name := path.Split(key)
+	if !isContentAddressed(name) {
+		return variants
+	}
+	ext := thumbnailExt(path.Ext(name))
+	for _, t := range Thumbnails {
+		variants[t.Name] = dir + baseName(name) + "_" + t.Name + ext
+	}
+	return variants
+}
+
+// VariantKeys returns the storage keys of an original and of its thumbnails, smallest first
+func VariantKeys(key string) []string {
+	variants := Variants(key)
+	keys := []string{key}
+	for _, t := range Thumbnails {
+		if v, ok := variants[t.Name]; ok {
+			keys = append(keys, v)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/httputil"
+	"github.com/gorilla/mux"
+)
+
+// Middleware records the requests served by the routes of a mux router.
+// Use it with Router.Use, which runs it once the route is known.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := httputil.NewStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		HTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.Status())).Inc()
+		HTTPRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
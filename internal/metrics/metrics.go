@@ -0,0 +1,79 @@
+// Package metrics exposes the metrics of the server in the Prometheus text format.
+//
+// The metrics of the API are registered in Default: requests per route, the
+// queries of the repository, and business counters such as messages sent,
+// along with the metrics of the Go runtime and of the process.
+// Handler serves them, on the API port or on a separate admin port.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Default holds the metrics of the server
+var Default = prometheus.NewRegistry()
+
+// DurationBuckets are the upper bounds of duration histograms, in seconds
+var DurationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var factory = promauto.With(Default)
+
+func init() {
+	Default.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Metrics of the HTTP API, labelled with the route template rather than the
+// path, so that IDs do not each get their own series
+var (
+	HTTPRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "wasatext_http_requests_total",
+		Help: "HTTP requests served, by route, method and status code.",
+	}, []string{"route", "method", "status"})
+	HTTPRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wasatext_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by route and method.",
+		Buckets: DurationBuckets,
+	}, []string{"route", "method"})
+)
+
+// Metrics of the repository, by storage backend and repository method
+var (
+	RepositoryQueryDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wasatext_repository_query_duration_seconds",
+		Help:    "Time taken by repository calls, by backend and method.",
+		Buckets: DurationBuckets,
+	}, []string{"backend", "method"})
+	RepositoryErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "wasatext_repository_errors_total",
+		Help: "Repository calls that failed, by backend and method.",
+	}, []string{"backend", "method"})
+)
+
+// Business metrics
+var (
+	MessagesSent = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "wasatext_messages_sent_total",
+		Help: "Messages sent, forwarded copies included, by message type.",
+	}, []string{"type"})
+	EventClients = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "wasatext_event_clients",
+		Help: "Clients connected to the event stream, by transport (websocket or sse).",
+	}, []string{"transport"})
+	UploadBytes = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "wasatext_upload_bytes_total",
+		Help: "Bytes of files uploaded, by kind: user_photo, group_photo, or the type of the message.",
+	}, []string{"kind"})
+)
+
+// Handler serves the metrics of Default
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Default, promhttp.HandlerOpts{})
+}
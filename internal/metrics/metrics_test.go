@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddleware(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(Middleware)
+	r.HandleFunc("/api/messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}).Methods("DELETE")
+
+	requests := HTTPRequests.WithLabelValues("/api/messages/{id}", "DELETE", "404")
+	before := testutil.ToFloat64(requests)
+	for _, id := range []string{"m1", "m2"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/api/messages/"+id, nil))
+	}
+
+	// Requests are counted per route, not per path
+	if got := testutil.ToFloat64(requests); got != before+2 {
+		t.Errorf("requests = %v, want %v", got, before+2)
+	}
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`wasatext_http_requests_total{method="DELETE",route="/api/messages/{id}",status="404"}`,
+		`wasatext_http_request_duration_seconds_count{method="DELETE",route="/api/messages/{id}"}`,
+		"go_goroutines ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output lacks %s:\n%s", want, body)
+		}
+	}
+}
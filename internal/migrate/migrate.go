@@ -0,0 +1,296 @@
+// Package migrate applies versioned SQL schema migrations embedded in the binary.
+//
+// Migrations are files named NNNN_description.up.sql and NNNN_description.down.sql.
+// They are applied in version order, each one in its own transaction together with
+// the row that records it in the schema_migrations table.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Dialect describes the SQL differences between database backends
+type Dialect struct {
+	// Placeholder returns the bind parameter for the n-th argument, starting at 1
+	Placeholder func(n int) string
+
+	// LockStatement, if set, runs at the start of every migration transaction
+	// so that concurrently booting instances apply each migration only once
+	LockStatement string
+}
+
+// Postgres is the dialect of PostgreSQL databases
+var Postgres = Dialect{
+	Placeholder:   func(n int) string { return "$" + strconv.Itoa(n) },
+	LockStatement: "SELECT pg_advisory_xact_lock(72630143)",
+}
+
+// SQLite is the dialect of SQLite databases. Writers are serialized by the
+// database itself, provided transactions are opened with _txlock=immediate.
+var SQLite = Dialect{
+	Placeholder: func(int) string { return "?" },
+}
+
+// Migration is a single schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status reports whether a migration has been applied
+type Status struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Migrator applies migrations to a database
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load reads the migrations found at the root of fsys, sorted by version
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file name %q", entry.Name())
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, migration.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %d has no up script", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// New creates a Migrator for the migrations found at the root of fsys
+func New(db *sql.DB, fsys fs.FS, dialect Dialect) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		db:         db,
+		dialect:    dialect,
+		migrations: migrations,
+	}, nil
+}
+
+// Up applies every pending migration and returns how many were applied
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, migration := range m.migrations {
+		done, err := m.step(ctx, migration, true)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		if done {
+			applied++
+		}
+	}
+
+	return applied, nil
+}
+
+// Down reverts up to steps of the most recently applied migrations and returns how many were reverted
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return 0, err
+	}
+
+	appliedAt, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	reverted := 0
+	for i := len(m.migrations) - 1; i >= 0 && reverted < steps; i-- {
+		migration := m.migrations[i]
+		if _, ok := appliedAt[migration.Version]; !ok {
+			continue
+		}
+		if migration.Down == "" {
+			return reverted, fmt.Errorf("migration %d_%s has no down script", migration.Version, migration.Name)
+		}
+
+		done, err := m.step(ctx, migration, false)
+		if err != nil {
+			return reverted, fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		if done {
+			reverted++
+		}
+	}
+
+	return reverted, nil
+}
+
+// Status lists every known migration and when it was applied
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+
+	appliedAt, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := Status{Version: migration.Version, Name: migration.Name}
+		if at, ok := appliedAt[migration.Version]; ok {
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// ensureTable creates the table recording applied migrations
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	query := `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		)
+	`
+	_, err := m.db.ExecContext(ctx, query)
+	return err
+}
+
+// applied returns the application time of every applied migration, by version
+func (m *Migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+	rows, err := m.db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	appliedAt := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		appliedAt[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return appliedAt, nil
+}
+
+// step applies (up) or reverts (down) a single migration in a transaction.
+// It reports false when another migrator got there first.
+func (m *Migrator) step(ctx context.Context, migration Migration, up bool) (bool, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if m.dialect.LockStatement != "" {
+		if _, err := tx.ExecContext(ctx, m.dialect.LockStatement); err != nil {
+			return false, err
+		}
+	}
+
+	// Check again under the lock
+	var count int
+	checkQuery := "SELECT COUNT(*) FROM schema_migrations WHERE version = " + m.dialect.Placeholder(1)
+	if err := tx.QueryRowContext(ctx, checkQuery, migration.Version).Scan(&count); err != nil {
+		return false, err
+	}
+	if (count > 0) == up {
+		return false, nil
+	}
+
+	if up {
+		if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+			return false, err
+		}
+		insertQuery := fmt.Sprintf("INSERT INTO schema_migrations (version, name, applied_at) VALUES (%s, %s, %s)",
+			m.dialect.Placeholder(1), m.dialect.Placeholder(2), m.dialect.Placeholder(3))
+		if _, err := tx.ExecContext(ctx, insertQuery, migration.Version, migration.Name, time.Now().UTC()); err != nil {
+			return false, err
+		}
+	} else {
+		if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+			return false, err
+		}
+		deleteQuery := "DELETE FROM schema_migrations WHERE version = " + m.dialect.Placeholder(1)
+		if _, err := tx.ExecContext(ctx, deleteQuery, migration.Version); err != nil {
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
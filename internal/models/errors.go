@@ -0,0 +1,48 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of errors. The service and the repositories return errors of these kinds,
+// which handlers turn into status codes. They are declared here so that
+// repositories can return them without depending on the service.
+var (
+	// ErrValidation is returned for requests that are malformed or out of range
+	ErrValidation = errors.New("validation failed")
+
+	// ErrUnauthorized is returned for unknown credentials and invalid sessions
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrForbidden is returned when the user may not do what they asked
+	ErrForbidden = errors.New("forbidden")
+
+	// ErrNotFound is returned when something a request refers to does not exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict is returned when a request clashes with the current state,
+	// such as a name that is taken or a member that is already in a group
+	ErrConflict = errors.New("conflict")
+)
+
+// Error is an error of one of the kinds above. Its text is the message alone,
+// so that it can be shown to clients as it is.
+type Error struct {
+	Kind    error
+	Message string
+}
+
+// NewError returns an error of the given kind with a formatted message
+func NewError(kind error, format string, args ...any) error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the kind of the error, so that errors.Is matches it
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
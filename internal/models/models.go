@@ -1,14 +1,23 @@
 package models
 
 import (
+	"encoding/base64"
+	"strings"
 	"time"
 )
 
 // User represents a WASAText user
 type User struct {
-	ID       string `json:"id"`
-	Name     string `json:"name"`
-	PhotoURL string `json:"photo,omitempty"`
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	PhotoURL      string            `json:"photo,omitempty"`
+	PhotoVariants map[string]string `json:"photoVariants,omitempty"` // URLs of the photo and its thumbnails, keyed by size
+}
+
+// Photo is the URL of an uploaded photo and of its thumbnails
+type Photo struct {
+	URL      string            `json:"photo"`
+	Variants map[string]string `json:"photoVariants,omitempty"`
 }
 
 // MessageType defines the type of message
@@ -17,8 +26,26 @@ type MessageType string
 const (
 	TextMessage  MessageType = "text"
 	PhotoMessage MessageType = "photo"
+	FileMessage  MessageType = "file"
+	AudioMessage MessageType = "audio" // Voice notes and other recordings
+	VideoMessage MessageType = "video"
 )
 
+// HasAttachment reports whether messages of this type carry a file described by an Attachment
+func (t MessageType) HasAttachment() bool {
+	return t == FileMessage || t == AudioMessage || t == VideoMessage
+}
+
+// Attachment describes the file carried by a file, audio or video message.
+// The message content is the file's URL, like a photo message's.
+type Attachment struct {
+	FileName  string  `json:"fileName"`
+	MimeType  string  `json:"mimeType"`
+	Size      int64   `json:"size"`                // In bytes
+	Duration  float64 `json:"duration,omitempty"`  // Length of audio and video, in seconds
+	Thumbnail string  `json:"thumbnail,omitempty"` // URL of a still of a video
+}
+
 // MessageStatus defines the status of a message
 type MessageStatus string
 
@@ -36,10 +63,94 @@ type Message struct {
 	Timestamp 			  time.Time     `json:"timestamp"`
 	Content   			  string        `json:"content"`
 	Type      			  MessageType   `json:"type"`
-	Status    			  MessageStatus `json:"status"`
+	Status    			  MessageStatus `json:"status"` // Aggregate over all recipients: read only once everyone has read it
 	ReplyTo   			  *string       `json:"replyTo,omitempty"` // ID of message being replied to
+	ReplyPreview          *ReplyPreview `json:"replyPreview,omitempty"` // Summary of the message being replied to
+	ForwardedFrom         *ForwardedFrom `json:"forwardedFrom,omitempty"` // Origin of a forwarded message
+	EditedAt  			  *time.Time	`json:"editedAt,omitempty"` // Timestamp of the last edit, if the message was edited
 	DeletedAt 			  *time.Time	`json:"deletedAt,omitempty"` // Timestamp when the message was deleted
 	Reactions 			  []Reaction    `json:"reactions,omitempty"` // Reactions to the message
+	Variants              map[string]string `json:"variants,omitempty"` // URLs of a photo message's image and thumbnails, keyed by size
+	Caption               string        `json:"caption,omitempty"` // Text sent along with a photo, file, audio or video
+	Attachment            *Attachment   `json:"attachment,omitempty"` // The file of a file, audio or video message
+}
+
+// ForwardedFrom records where a forwarded message comes from.
+// Forwarding a forwarded message keeps pointing at the original and counts one more forward.
+type ForwardedFrom struct {
+	MessageID    string `json:"messageId"` // Empty if the original no longer exists
+	Sender       User   `json:"sender"`
+	ForwardCount int    `json:"forwardCount"`
+}
+
+// Forwarded returns the provenance of a copy of msg forwarded once more
+func (msg *Message) Forwarded() *ForwardedFrom {
+	if msg.ForwardedFrom != nil {
+		forwarded := *msg.ForwardedFrom
+		forwarded.ForwardCount++
+		return &forwarded
+	}
+	return &ForwardedFrom{MessageID: msg.ID, Sender: msg.Sender, ForwardCount: 1}
+}
+
+// replyPreviewLength is the number of characters of a text message a reply preview keeps
+const replyPreviewLength = 100
+
+// ReplyPreview summarizes the message a reply quotes, so clients can show it without loading it
+type ReplyPreview struct {
+	MessageID string      `json:"messageId"`
+	Sender    User        `json:"sender"`
+	Type      MessageType `json:"type"`
+	Content   string      `json:"content"` // Truncated text, the photo's URL or the attachment's file name; empty once deleted
+	Deleted   bool        `json:"deleted"`
+}
+
+// NewReplyPreview summarizes a message for the replies quoting it
+func NewReplyPreview(msg *Message) *ReplyPreview {
+	preview := &ReplyPreview{
+		MessageID: msg.ID,
+		Sender:    msg.Sender,
+		Type:      msg.Type,
+		Content:   msg.Content,
+		Deleted:   msg.DeletedAt != nil,
+	}
+	if msg.Type.HasAttachment() && msg.Attachment != nil {
+		preview.Content = msg.Attachment.FileName
+	}
+	if preview.Deleted {
+		preview.Content = ""
+	}
+	if msg.Type == TextMessage {
+		if content := []rune(preview.Content); len(content) > replyPreviewLength {
+			preview.Content = string(content[:replyPreviewLength]) + "…"
+		}
+	}
+	return preview
+}
+
+// DeleteScope says who a message is deleted for
+type DeleteScope string
+
+const (
+	// DeleteForEveryone replaces the message with a tombstone for all participants
+	DeleteForEveryone DeleteScope = "everyone"
+	// DeleteForMe hides the message from the requesting user only
+	DeleteForMe DeleteScope = "me"
+)
+
+// MessageRevision is one version of an edited message's content
+type MessageRevision struct {
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"` // When this version was written
+}
+
+// Receipt records when a recipient received and read a message
+type Receipt struct {
+	MessageID  string     `json:"messageId"`
+	UserID     string     `json:"userId"`
+	UserName   string     `json:"name"`
+	ReceivedAt *time.Time `json:"receivedAt,omitempty"`
+	ReadAt     *time.Time `json:"readAt,omitempty"`
 }
 
 // Reaction represents a user's reaction to a message
@@ -63,15 +174,116 @@ type Conversation struct {
 	Name         string          `json:"name"`
 	Type         ConversationType `json:"type"`
 	PhotoURL     string          `json:"photo,omitempty"`
+	PhotoVariants map[string]string `json:"photoVariants,omitempty"`
 	Participants []Participant        `json:"participants"`
 	LastMessage  *Message        `json:"lastMessage,omitempty"`
 	Messages     []Message       `json:"messages,omitempty"`
+	NextCursor   string          `json:"nextCursor,omitempty"` // Cursor for the messages older than Messages
+	Policy       *GroupPolicy    `json:"policy,omitempty"`     // Who may do what in a group; nil for direct conversations
+}
+
+// ParticipantRole defines a participant's role in a group
+type ParticipantRole string
+
+const (
+	RoleOwner  ParticipantRole = "owner"
+	RoleAdmin  ParticipantRole = "admin"
+	RoleMember ParticipantRole = "member"
+)
+
+// GroupPermission defines which participants of a group may perform an action
+type GroupPermission string
+
+const (
+	EveryoneAllowed GroupPermission = "everyone"
+	AdminsAllowed   GroupPermission = "admins" // The owner and the admins
+)
+
+// GroupPolicy defines who may change a group and post in it
+type GroupPolicy struct {
+	AddMembers   GroupPermission `json:"addMembers"`
+	EditInfo     GroupPermission `json:"editInfo"` // Name and photo
+	SendMessages GroupPermission `json:"sendMessages"`
+}
+
+// DefaultGroupPolicy returns the policy of newly created groups
+func DefaultGroupPolicy() GroupPolicy {
+	return GroupPolicy{
+		AddMembers:   EveryoneAllowed,
+		EditInfo:     EveryoneAllowed,
+		SendMessages: EveryoneAllowed,
+	}
+}
+
+// MessageCursor marks a position in a conversation's history for keyset pagination
+type MessageCursor struct {
+	Timestamp time.Time
+	ID        string
+}
+
+// Encode returns the opaque string form of the cursor handed to clients
+func (c MessageCursor) Encode() string {
+	raw := c.Timestamp.UTC().Format(time.RFC3339Nano) + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeMessageCursor parses a cursor produced by MessageCursor.Encode
+func DecodeMessageCursor(s string) (*MessageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, NewError(ErrValidation, "invalid cursor")
+	}
+
+	timestamp, id, found := strings.Cut(string(raw), "|")
+	if !found || id == "" {
+		return nil, NewError(ErrValidation, "invalid cursor")
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return nil, NewError(ErrValidation, "invalid cursor")
+	}
+
+	return &MessageCursor{Timestamp: t, ID: id}, nil
+}
+
+// MessagePage is a page of a conversation's history, oldest message first
+type MessagePage struct {
+	Messages   []Message `json:"messages"`
+	NextCursor string    `json:"nextCursor,omitempty"` // Cursor for the next, older page; empty on the last page
+}
+
+// MessageSearch describes a search of the messages a user can see
+type MessageSearch struct {
+	UserID         string         // Only conversations the user takes part in are searched
+	Query          string
+	ConversationID string         // Optional: restricts the search to one conversation
+	SenderID       string         // Optional: restricts the search to one sender's messages
+	Before         *MessageCursor // Optional: only messages sent before the cursor
+	Limit          int
+}
+
+// SearchResult is a message matching a search
+type SearchResult struct {
+	MessageID      string    `json:"messageId"`
+	ConversationID string    `json:"conversationId"`
+	Sender         User      `json:"sender"`
+	Timestamp      time.Time `json:"timestamp"`
+	Snippet        string    `json:"snippet"` // HTML excerpt of the message: escaped text with matches wrapped in <mark>
+}
+
+// SearchResultPage is a page of search results, newest message first
+type SearchResultPage struct {
+	Results    []SearchResult `json:"results"`
+	NextCursor string         `json:"nextCursor,omitempty"` // Cursor for the next, older page; empty on the last page
 }
 
 type Participant struct {
     ID   string `json:"id"`
     Name string `json:"name"`
 	PhotoURL string `json:"photo,omitempty"`
+	PhotoVariants map[string]string `json:"photoVariants,omitempty"`
+	Role     ParticipantRole `json:"role"`
 }
 
 // CreateConversationRequest represents the request to create a new conversation
@@ -83,12 +295,25 @@ type CreateConversationRequest struct {
 
 // LoginRequest represents the login request body
 type LoginRequest struct {
-	Name string `json:"name"`
+	Name     string `json:"name"`
+	Password string `json:"password,omitempty"`
 }
 
 // LoginResponse represents the login response
 type LoginResponse struct {
-	Id string `json:"id"`
+	Id        string    `json:"id"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Session represents an authenticated login session.
+// ID is the hash of the bearer token handed to the client, never the token itself.
+type Session struct {
+	ID        string
+	UserID    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	RevokedAt *time.Time
 }
 
 // UpdateUsernameRequest represents the update username request body
@@ -96,6 +321,12 @@ type UpdateUsernameRequest struct {
 	Name string `json:"name"`
 }
 
+// SetPasswordRequest represents the request to set or change the user's password
+type SetPasswordRequest struct {
+	CurrentPassword string `json:"currentPassword,omitempty"`
+	NewPassword     string `json:"newPassword"`
+}
+
 // AddToGroupRequest represents the request to add a user to a group
 type AddToGroupRequest struct {
 	UserID string `json:"userId"`
@@ -106,12 +337,39 @@ type SetGroupNameRequest struct {
 	Name string `json:"name"`
 }
 
+// SetGroupPolicyRequest represents the request to change a group's policy; omitted fields are left unchanged
+type SetGroupPolicyRequest struct {
+	AddMembers   GroupPermission `json:"addMembers,omitempty"`
+	EditInfo     GroupPermission `json:"editInfo,omitempty"`
+	SendMessages GroupPermission `json:"sendMessages,omitempty"`
+}
+
 type UpdateMessageRequest struct {
 	Content   string `json:"content"`
 }
 
-// ForwardMessageRequest represents the request to forward a message
+// AcknowledgeMessagesRequest represents the request to acknowledge delivery or reading
+// of every message of a conversation up to and including the given one
+type AcknowledgeMessagesRequest struct {
+	MessageID string `json:"messageId"`
+}
+
+// ForwardMessageRequest represents the request to forward a message to one or more conversations
 type ForwardMessageRequest struct {
-	MessageID            string `json:"messageId"`
-	TargetConversationID string `json:"targetConversationId"`
+	MessageID             string   `json:"messageId"`
+	TargetConversationID  string   `json:"targetConversationId,omitempty"` // Single target, kept for older clients
+	TargetConversationIDs []string `json:"targetConversationIds,omitempty"`
+}
+
+// Targets returns the conversations to forward to, without duplicates
+func (req ForwardMessageRequest) Targets() []string {
+	var targets []string
+	seen := make(map[string]bool)
+	for _, id := range append([]string{req.TargetConversationID}, req.TargetConversationIDs...) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			targets = append(targets, id)
+		}
+	}
+	return targets
 }
\ No newline at end of file
@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often buckets that have filled up again are dropped
+const sweepInterval = time.Minute
+
+// MemoryStore keeps buckets in memory, for a single instance of the server
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // When the bucket is full again if left alone
+}
+
+// NewMemoryStore returns an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Take implements Store.Take
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	capacity := float64(limit.Requests)
+	interval := limit.Per / time.Duration(limit.Requests) // Time to refill one token
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		s.buckets[key] = b
+	}
+
+	// Refill for the time elapsed since the last request
+	b.tokens = min(capacity, b.tokens+float64(now.Sub(b.updated))/float64(interval))
+	b.updated = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) * float64(interval))
+		return false, wait, nil
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((capacity - b.tokens) * float64(interval)))
+	return true, 0, nil
+}
+
+// sweep drops the buckets that are full, which behave like missing ones,
+// so that clients seen once do not take up memory forever
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Package ratelimit throttles requests with token buckets.
+//
+// Each client gets a bucket per class of routes, such as logins or uploads.
+// A bucket holds up to Limit.Requests tokens and refills at Limit.Requests per
+// Limit.Per; a request takes a token, and is turned away with 429 Too Many Requests
+// when the bucket is empty.
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is the rate requests are allowed at, with bursts of up to Requests
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// Enabled reports whether the limit throttles anything
+func (l Limit) Enabled() bool {
+	return l.Requests > 0 && l.Per > 0
+}
+
+func (l Limit) String() string {
+	if !l.Enabled() {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%s", l.Requests, l.Per)
+}
+
+// ParseLimit parses a limit written as requests/period, such as "10/1m".
+// "off" and "0" disable the limit.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "off" || s == "0" {
+		return Limit{}, nil
+	}
+
+	requests, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: expected requests/period, such as 10/1m", s)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: requests must be a positive integer", s)
+	}
+	per, err := time.ParseDuration(period)
+	if err != nil || per <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: period must be a positive duration", s)
+	}
+	return Limit{Requests: n, Per: per}, nil
+}
+
+// Store holds the buckets. MemoryStore keeps them in the process; a store shared
+// by several instances of the server, backed by Redis for instance, makes them
+// enforce a single limit between them.
+type Store interface {
+	// Take takes a token from the bucket of key. If the bucket is empty, it returns
+	// false and how long it takes for a token to become available.
+	Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error)
+}
+
+// Rule applies a limit to a class of routes
+type Rule struct {
+	// Class names the routes, keeping their buckets apart from those of other classes
+	Class string
+	Limit Limit
+
+	// Key identifies the client a request is counted against
+	Key func(r *http.Request) string
+
+	// Match selects the requests the rule applies to; nil selects them all
+	Match func(r *http.Request) bool
+}
+
+// Middleware returns middleware that enforces the rule. Requests over the limit
+// are answered with 429 and a Retry-After header. If the store fails, requests are
+// let through rather than blocked.
+func Middleware(store Store, rule Rule) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !rule.Limit.Enabled() {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rule.Match != nil && !rule.Match(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := rule.Class + ":" + rule.Key(r)
+			ok, retryAfter, err := store.Take(r.Context(), key, rule.Limit)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Rate limit store failed, letting the request through", "class", rule.Class, "error", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !ok {
+				slog.WarnContext(r.Context(), "Rate limit exceeded", "class", rule.Class, "limit", rule.Limit, "key", key)
+				tooManyRequests(w, retryAfter)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// tooManyRequests writes a 429 response in the format of the API's errors
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": "Too many requests, retry in " + strconv.Itoa(seconds) + "s",
+		"code":  "rate_limited",
+	})
+}
+
+// RemoteIP returns the IP address a request comes from
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Limit
+		wantErr bool
+	}{
+		{"10/1m", Limit{Requests: 10, Per: time.Minute}, false},
+		{" 3/30s ", Limit{Requests: 3, Per: 30 * time.Second}, false},
+		{"off", Limit{}, false},
+		{"0", Limit{}, false},
+		{"10", Limit{}, true},
+		{"-1/1m", Limit{}, true},
+		{"10/forever", Limit{}, true},
+		{"10/0s", Limit{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLimit(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseLimit(%q) = %v, %v; want %v, error %t", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	limit := Limit{Requests: 3, Per: 30 * time.Second}
+
+	// A full bucket allows a burst
+	for i := 0; i < 3; i++ {
+		if ok, _, _ := store.Take(ctx, "alice", limit); !ok {
+			t.Fatalf("request %d of the burst was limited", i+1)
+		}
+	}
+	ok, wait, err := store.Take(ctx, "alice", limit)
+	if err != nil || ok || wait != 10*time.Second {
+		t.Fatalf("Take on an empty bucket = %t, %s, %v; want false, 10s", ok, wait, err)
+	}
+
+	// Other keys have their own bucket
+	if ok, _, _ := store.Take(ctx, "bob", limit); !ok {
+		t.Error("another key was limited")
+	}
+
+	// Tokens come back over time
+	now = now.Add(4 * time.Second)
+	if _, wait, _ := store.Take(ctx, "alice", limit); wait != 6*time.Second {
+		t.Errorf("wait = %s, want 6s", wait)
+	}
+	now = now.Add(6 * time.Second)
+	if ok, _, _ := store.Take(ctx, "alice", limit); !ok {
+		t.Error("request limited after a token was refilled")
+	}
+
+	// Buckets that have filled up again are dropped
+	now = now.Add(time.Hour)
+	store.Take(ctx, "carol", limit)
+	if len(store.buckets) != 1 {
+		t.Errorf("buckets = %d after the sweep, want 1", len(store.buckets))
+	}
+}
+
+// failingStore fails every request
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	return false, 0, errors.New("store unavailable")
+}
+
+func TestMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	rule := Rule{
+		Class: "uploads",
+		Limit: Limit{Requests: 1, Per: time.Minute},
+		Key:   RemoteIP,
+		Match: func(r *http.Request) bool { return r.Method == "PUT" },
+	}
+	handler := Middleware(NewMemoryStore(), rule)(ok)
+
+	serve := func(method, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/users/me/photo", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve("PUT", "192.0.2.1:1234"); rec.Code != http.StatusNoContent {
+		t.Fatalf("first request: status = %d", rec.Code)
+	}
+	rec := serve("PUT", "192.0.2.1:5678")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("second request: status = %d, Retry-After = %q; want 429 after 60s", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := serve("PUT", "192.0.2.2:1234"); rec.Code != http.StatusNoContent {
+		t.Errorf("request from another address: status = %d", rec.Code)
+	}
+	if rec := serve("GET", "192.0.2.1:1234"); rec.Code != http.StatusNoContent {
+		t.Errorf("request outside the rule: status = %d", rec.Code)
+	}
+
+	// A failing store does not take the API down
+	handler = Middleware(failingStore{}, rule)(ok)
+	if rec := serve("PUT", "192.0.2.1:1234"); rec.Code != http.StatusNoContent {
+		t.Errorf("request with a failing store: status = %d", rec.Code)
+	}
+}
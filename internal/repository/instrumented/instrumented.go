@@ -0,0 +1,349 @@
+// Package instrumented wraps a repository to record the duration and failures
+// of its calls in the metrics of the server.
+package instrumented
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/metrics"
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/repository"
+)
+
+// Repository is a repository.Repository that records metrics of the calls it
+// passes on to the repository it wraps
+type Repository struct {
+	repo    repository.Repository
+	backend string
+}
+
+var _ repository.Repository = (*Repository)(nil)
+
+// New wraps repo, labelling its metrics with the name of its backend, such as postgres
+func New(repo repository.Repository, backend string) *Repository {
+	return &Repository{repo: repo, backend: backend}
+}
+
+// observe records a call. Errors of a known kind, such as a name that is taken,
+// are answers rather than failures and are not counted as errors.
+func (r *Repository) observe(method string, start time.Time, err error) {
+	metrics.RepositoryQueryDuration.WithLabelValues(r.backend, method).Observe(time.Since(start).Seconds())
+	var kind *models.Error
+	if err != nil && !errors.As(err, &kind) {
+		metrics.RepositoryErrors.WithLabelValues(r.backend, method).Inc()
+	}
+}
+
+// Ping implements repository.Repository.Ping
+func (r *Repository) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := r.repo.Ping(ctx)
+	r.observe("Ping", start, err)
+	return err
+}
+
+// CreateUser implements repository.UserRepository.CreateUser
+func (r *Repository) CreateUser(ctx context.Context, name string) (*models.User, error) {
+	start := time.Now()
+	result, err := r.repo.CreateUser(ctx, name)
+	r.observe("CreateUser", start, err)
+	return result, err
+}
+
+// CreateUserWithPasswordHash implements repository.UserRepository.CreateUserWithPasswordHash
+func (r *Repository) CreateUserWithPasswordHash(ctx context.Context, name string, hash string) (*models.User, error) {
+	start := time.Now()
+	result, err := r.repo.CreateUserWithPasswordHash(ctx, name, hash)
+	r.observe("CreateUserWithPasswordHash", start, err)
+	return result, err
+}
+
+// GetUserByID implements repository.UserRepository.GetUserByID
+func (r *Repository) GetUserByID(ctx context.Context, id string) (*models.User, error) {
+	start := time.Now()
+	result, err := r.repo.GetUserByID(ctx, id)
+	r.observe("GetUserByID", start, err)
+	return result, err
+}
+
+// GetUserByName implements repository.UserRepository.GetUserByName
+func (r *Repository) GetUserByName(ctx context.Context, name string) (*models.User, error) {
+	start := time.Now()
+	result, err := r.repo.GetUserByName(ctx, name)
+	r.observe("GetUserByName", start, err)
+	return result, err
+}
+
+// UpdateUsername implements repository.UserRepository.UpdateUsername
+func (r *Repository) UpdateUsername(ctx context.Context, userID string, newName string) error {
+	start := time.Now()
+	err := r.repo.UpdateUsername(ctx, userID, newName)
+	r.observe("UpdateUsername", start, err)
+	return err
+}
+
+// SetUserPhoto implements repository.UserRepository.SetUserPhoto
+func (r *Repository) SetUserPhoto(ctx context.Context, userID string, key string) error {
+	start := time.Now()
+	err := r.repo.SetUserPhoto(ctx, userID, key)
+	r.observe("SetUserPhoto", start, err)
+	return err
+}
+
+// GetAllUsers implements repository.UserRepository.GetAllUsers
+func (r *Repository) GetAllUsers(ctx context.Context) ([]models.User, error) {
+	start := time.Now()
+	result, err := r.repo.GetAllUsers(ctx)
+	r.observe("GetAllUsers", start, err)
+	return result, err
+}
+
+// GetUserPasswordHash implements repository.UserRepository.GetUserPasswordHash
+func (r *Repository) GetUserPasswordHash(ctx context.Context, userID string) (string, error) {
+	start := time.Now()
+	result, err := r.repo.GetUserPasswordHash(ctx, userID)
+	r.observe("GetUserPasswordHash", start, err)
+	return result, err
+}
+
+// SetUserPasswordHash implements repository.UserRepository.SetUserPasswordHash
+func (r *Repository) SetUserPasswordHash(ctx context.Context, userID string, hash string) error {
+	start := time.Now()
+	err := r.repo.SetUserPasswordHash(ctx, userID, hash)
+	r.observe("SetUserPasswordHash", start, err)
+	return err
+}
+
+// CreateDirectConversation implements repository.ConversationRepository.CreateDirectConversation
+func (r *Repository) CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, error) {
+	start := time.Now()
+	result, err := r.repo.CreateDirectConversation(ctx, userID1, userID2)
+	r.observe("CreateDirectConversation", start, err)
+	return result, err
+}
+
+// CreateGroupConversation implements repository.ConversationRepository.CreateGroupConversation
+func (r *Repository) CreateGroupConversation(ctx context.Context, name string, ownerID string, participants []string) (*models.Conversation, error) {
+	start := time.Now()
+	result, err := r.repo.CreateGroupConversation(ctx, name, ownerID, participants)
+	r.observe("CreateGroupConversation", start, err)
+	return result, err
+}
+
+// GetConversationByID implements repository.ConversationRepository.GetConversationByID
+func (r *Repository) GetConversationByID(ctx context.Context, id string, viewerID string) (*models.Conversation, error) {
+	start := time.Now()
+	result, err := r.repo.GetConversationByID(ctx, id, viewerID)
+	r.observe("GetConversationByID", start, err)
+	return result, err
+}
+
+// GetConversationsByUserID implements repository.ConversationRepository.GetConversationsByUserID
+func (r *Repository) GetConversationsByUserID(ctx context.Context, userID string) ([]models.Conversation, error) {
+	start := time.Now()
+	result, err := r.repo.GetConversationsByUserID(ctx, userID)
+	r.observe("GetConversationsByUserID", start, err)
+	return result, err
+}
+
+// AddUserToGroup implements repository.ConversationRepository.AddUserToGroup
+func (r *Repository) AddUserToGroup(ctx context.Context, groupID, userID string) error {
+	start := time.Now()
+	err := r.repo.AddUserToGroup(ctx, groupID, userID)
+	r.observe("AddUserToGroup", start, err)
+	return err
+}
+
+// RemoveUserFromGroup implements repository.ConversationRepository.RemoveUserFromGroup
+func (r *Repository) RemoveUserFromGroup(ctx context.Context, groupID, userID string) error {
+	start := time.Now()
+	err := r.repo.RemoveUserFromGroup(ctx, groupID, userID)
+	r.observe("RemoveUserFromGroup", start, err)
+	return err
+}
+
+// SetParticipantRole implements repository.ConversationRepository.SetParticipantRole
+func (r *Repository) SetParticipantRole(ctx context.Context, groupID, userID string, role models.ParticipantRole) error {
+	start := time.Now()
+	err := r.repo.SetParticipantRole(ctx, groupID, userID, role)
+	r.observe("SetParticipantRole", start, err)
+	return err
+}
+
+// UpdateGroupPolicy implements repository.ConversationRepository.UpdateGroupPolicy
+func (r *Repository) UpdateGroupPolicy(ctx context.Context, groupID string, policy models.GroupPolicy) error {
+	start := time.Now()
+	err := r.repo.UpdateGroupPolicy(ctx, groupID, policy)
+	r.observe("UpdateGroupPolicy", start, err)
+	return err
+}
+
+// UpdateGroupName implements repository.ConversationRepository.UpdateGroupName
+func (r *Repository) UpdateGroupName(ctx context.Context, groupID, name string) error {
+	start := time.Now()
+	err := r.repo.UpdateGroupName(ctx, groupID, name)
+	r.observe("UpdateGroupName", start, err)
+	return err
+}
+
+// SetGroupPhoto implements repository.ConversationRepository.SetGroupPhoto
+func (r *Repository) SetGroupPhoto(ctx context.Context, groupID string, key string) error {
+	start := time.Now()
+	err := r.repo.SetGroupPhoto(ctx, groupID, key)
+	r.observe("SetGroupPhoto", start, err)
+	return err
+}
+
+// CreateMessage implements repository.MessageRepository.CreateMessage
+func (r *Repository) CreateMessage(ctx context.Context, msg models.Message, conversationID string) (*models.Message, error) {
+	start := time.Now()
+	result, err := r.repo.CreateMessage(ctx, msg, conversationID)
+	r.observe("CreateMessage", start, err)
+	return result, err
+}
+
+// CreateMessages implements repository.MessageRepository.CreateMessages
+func (r *Repository) CreateMessages(ctx context.Context, messages []models.Message) ([]models.Message, error) {
+	start := time.Now()
+	result, err := r.repo.CreateMessages(ctx, messages)
+	r.observe("CreateMessages", start, err)
+	return result, err
+}
+
+// GetMessagesPage implements repository.MessageRepository.GetMessagesPage
+func (r *Repository) GetMessagesPage(ctx context.Context, conversationID, viewerID string, before *models.MessageCursor, limit int) ([]models.Message, error) {
+	start := time.Now()
+	result, err := r.repo.GetMessagesPage(ctx, conversationID, viewerID, before, limit)
+	r.observe("GetMessagesPage", start, err)
+	return result, err
+}
+
+// GetReplies implements repository.MessageRepository.GetReplies
+func (r *Repository) GetReplies(ctx context.Context, messageID, viewerID string, before *models.MessageCursor, limit int) ([]models.Message, error) {
+	start := time.Now()
+	result, err := r.repo.GetReplies(ctx, messageID, viewerID, before, limit)
+	r.observe("GetReplies", start, err)
+	return result, err
+}
+
+// GetMessageByID implements repository.MessageRepository.GetMessageByID
+func (r *Repository) GetMessageByID(ctx context.Context, id string) (*models.Message, error) {
+	start := time.Now()
+	result, err := r.repo.GetMessageByID(ctx, id)
+	r.observe("GetMessageByID", start, err)
+	return result, err
+}
+
+// DeleteMessage implements repository.MessageRepository.DeleteMessage
+func (r *Repository) DeleteMessage(ctx context.Context, id string) (string, error) {
+	start := time.Now()
+	result, err := r.repo.DeleteMessage(ctx, id)
+	r.observe("DeleteMessage", start, err)
+	return result, err
+}
+
+// HideMessage implements repository.MessageRepository.HideMessage
+func (r *Repository) HideMessage(ctx context.Context, messageID, userID string) error {
+	start := time.Now()
+	err := r.repo.HideMessage(ctx, messageID, userID)
+	r.observe("HideMessage", start, err)
+	return err
+}
+
+// MarkMessagesReceived implements repository.MessageRepository.MarkMessagesReceived
+func (r *Repository) MarkMessagesReceived(ctx context.Context, conversationID, userID string, upTo models.MessageCursor) error {
+	start := time.Now()
+	err := r.repo.MarkMessagesReceived(ctx, conversationID, userID, upTo)
+	r.observe("MarkMessagesReceived", start, err)
+	return err
+}
+
+// MarkMessagesRead implements repository.MessageRepository.MarkMessagesRead
+func (r *Repository) MarkMessagesRead(ctx context.Context, conversationID, userID string, upTo models.MessageCursor) error {
+	start := time.Now()
+	err := r.repo.MarkMessagesRead(ctx, conversationID, userID, upTo)
+	r.observe("MarkMessagesRead", start, err)
+	return err
+}
+
+// GetMessageReceipts implements repository.MessageRepository.GetMessageReceipts
+func (r *Repository) GetMessageReceipts(ctx context.Context, messageID string) ([]models.Receipt, error) {
+	start := time.Now()
+	result, err := r.repo.GetMessageReceipts(ctx, messageID)
+	r.observe("GetMessageReceipts", start, err)
+	return result, err
+}
+
+// UpdateMessageContent implements repository.MessageRepository.UpdateMessageContent
+func (r *Repository) UpdateMessageContent(ctx context.Context, id string, content string, editedAt time.Time) error {
+	start := time.Now()
+	err := r.repo.UpdateMessageContent(ctx, id, content, editedAt)
+	r.observe("UpdateMessageContent", start, err)
+	return err
+}
+
+// GetMessageRevisions implements repository.MessageRepository.GetMessageRevisions
+func (r *Repository) GetMessageRevisions(ctx context.Context, messageID string) ([]models.MessageRevision, error) {
+	start := time.Now()
+	result, err := r.repo.GetMessageRevisions(ctx, messageID)
+	r.observe("GetMessageRevisions", start, err)
+	return result, err
+}
+
+// SearchMessages implements repository.MessageRepository.SearchMessages
+func (r *Repository) SearchMessages(ctx context.Context, search models.MessageSearch) ([]models.SearchResult, error) {
+	start := time.Now()
+	result, err := r.repo.SearchMessages(ctx, search)
+	r.observe("SearchMessages", start, err)
+	return result, err
+}
+
+// AddReaction implements repository.ReactionRepository.AddReaction
+func (r *Repository) AddReaction(ctx context.Context, messageID, userID, emoji string) error {
+	start := time.Now()
+	err := r.repo.AddReaction(ctx, messageID, userID, emoji)
+	r.observe("AddReaction", start, err)
+	return err
+}
+
+// RemoveReaction implements repository.ReactionRepository.RemoveReaction
+func (r *Repository) RemoveReaction(ctx context.Context, messageID, userID string) error {
+	start := time.Now()
+	err := r.repo.RemoveReaction(ctx, messageID, userID)
+	r.observe("RemoveReaction", start, err)
+	return err
+}
+
+// GetReactionsByMessageID implements repository.ReactionRepository.GetReactionsByMessageID
+func (r *Repository) GetReactionsByMessageID(ctx context.Context, messageID string) ([]models.Reaction, error) {
+	start := time.Now()
+	result, err := r.repo.GetReactionsByMessageID(ctx, messageID)
+	r.observe("GetReactionsByMessageID", start, err)
+	return result, err
+}
+
+// CreateSession implements repository.SessionRepository.CreateSession
+func (r *Repository) CreateSession(ctx context.Context, session models.Session) error {
+	start := time.Now()
+	err := r.repo.CreateSession(ctx, session)
+	r.observe("CreateSession", start, err)
+	return err
+}
+
+// GetSessionByID implements repository.SessionRepository.GetSessionByID
+func (r *Repository) GetSessionByID(ctx context.Context, id string) (*models.Session, error) {
+	start := time.Now()
+	result, err := r.repo.GetSessionByID(ctx, id)
+	r.observe("GetSessionByID", start, err)
+	return result, err
+}
+
+// RevokeSession implements repository.SessionRepository.RevokeSession
+func (r *Repository) RevokeSession(ctx context.Context, id string) error {
+	start := time.Now()
+	err := r.repo.RevokeSession(ctx, id)
+	r.observe("RevokeSession", start, err)
+	return err
+}
@@ -0,0 +1,60 @@
+package instrumented_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fallenkarma/wasatext/internal/metrics"
+	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/repository/instrumented"
+	"github.com/fallenkarma/wasatext/internal/repository/memory"
+	"github.com/fallenkarma/wasatext/internal/repository/repositorytest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.Repository {
+		return instrumented.New(memory.NewMemoryRepository(), "memory")
+	})
+}
+
+func TestRecordsCalls(t *testing.T) {
+	ctx := context.Background()
+	repo := instrumented.New(memory.NewMemoryRepository(), "test")
+	creates, updates := calls(t, "CreateUser"), calls(t, "UpdateUsername")
+
+	alice, err := repo.CreateUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := repo.CreateUser(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A name that is taken is an answer, not a failure
+	if err := repo.UpdateUsername(ctx, bob.ID, alice.Name); err == nil {
+		t.Fatal("UpdateUsername accepted a taken name")
+	}
+
+	if got := calls(t, "CreateUser") - creates; got != 2 {
+		t.Errorf("CreateUser calls = %d, want 2", got)
+	}
+	if got := calls(t, "UpdateUsername") - updates; got != 1 {
+		t.Errorf("UpdateUsername calls = %d, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.RepositoryErrors.WithLabelValues("test", "UpdateUsername")); got != 0 {
+		t.Errorf("UpdateUsername errors = %v, want 0", got)
+	}
+}
+
+// calls returns the number of calls to a method of the "test" backend
+func calls(t *testing.T, method string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := metrics.RepositoryQueryDuration.WithLabelValues("test", method).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
@@ -0,0 +1,1033 @@
+// Package memory provides a Repository that keeps all data in process memory.
+// It is meant for tests and throwaway demo instances: nothing survives a restart.
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/search"
+	"github.com/google/uuid"
+)
+
+type user struct {
+	models.User
+	passwordHash string
+}
+
+type conversation struct {
+	id           string
+	name         string
+	convType     models.ConversationType
+	photoURL     string
+	lastActivity time.Time
+	policy       models.GroupPolicy
+	participants []participant // in joining order
+}
+
+type participant struct {
+	userID   string
+	joinedAt time.Time
+	role     models.ParticipantRole
+}
+
+type receipt struct {
+	receivedAt *time.Time
+	readAt     *time.Time
+}
+
+type message struct {
+	models.Message
+	receipts  map[string]*receipt      // by recipient ID
+	reactions []models.Reaction        // in insertion order
+	revisions []models.MessageRevision // previous versions, oldest first
+	hiddenBy  map[string]bool          // users who deleted the message for themselves
+}
+
+// MemoryRepository implements the Repository interface in memory
+type MemoryRepository struct {
+	mu            sync.RWMutex
+	users         map[string]*user
+	sessions      map[string]models.Session
+	conversations map[string]*conversation
+	messages      map[string]*message
+}
+
+// NewMemoryRepository creates an empty MemoryRepository
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		users:         make(map[string]*user),
+		sessions:      make(map[string]models.Session),
+		conversations: make(map[string]*conversation),
+		messages:      make(map[string]*message),
+	}
+}
+
+// Ping implements Repository.Ping; memory is always available
+func (r *MemoryRepository) Ping(ctx context.Context) error {
+	return nil
+}
+
+// CreateUser implements UserRepository.CreateUser
+func (r *MemoryRepository) CreateUser(ctx context.Context, name string) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Check if user with this name already exists
+	if existing := r.userByName(name); existing != nil {
+		u := existing.User
+		return &u, nil
+	}
+
+	u := &user{User: models.User{ID: uuid.New().String(), Name: name}}
+	r.users[u.ID] = u
+
+	created := u.User
+	return &created, nil
+}
+
+// CreateUserWithPasswordHash implements UserRepository.CreateUserWithPasswordHash
+func (r *MemoryRepository) CreateUserWithPasswordHash(ctx context.Context, name string, hash string) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.userByName(name) != nil {
+		return nil, models.NewError(models.ErrConflict, "username already in use")
+	}
+
+	u := &user{User: models.User{ID: uuid.New().String(), Name: name}, passwordHash: hash}
+	r.users[u.ID] = u
+
+	created := u.User
+	return &created, nil
+}
+
+// GetUserByID implements UserRepository.GetUserByID
+func (r *MemoryRepository) GetUserByID(ctx context.Context, id string) (*models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	u, ok := r.users[id]
+	if !ok {
+		return nil, nil
+	}
+
+	found := u.User
+	return &found, nil
+}
+
+// GetUserByName implements UserRepository.GetUserByName
+func (r *MemoryRepository) GetUserByName(ctx context.Context, name string) (*models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	u := r.userByName(name)
+	if u == nil {
+		return nil, nil
+	}
+
+	found := u.User
+	return &found, nil
+}
+
+// userByName looks a user up by name; the caller must hold the lock
+func (r *MemoryRepository) userByName(name string) *user {
+	for _, u := range r.users {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// UpdateUsername implements UserRepository.UpdateUsername
+func (r *MemoryRepository) UpdateUsername(ctx context.Context, userID string, newName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Check if name is already in use
+	if existing := r.userByName(newName); existing != nil && existing.ID != userID {
+		return models.NewError(models.ErrConflict, "username already in use")
+	}
+
+	if u, ok := r.users[userID]; ok {
+		u.Name = newName
+	}
+	return nil
+}
+
+// SetUserPhoto implements UserRepository.SetUserPhoto
+func (r *MemoryRepository) SetUserPhoto(ctx context.Context, userID string, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if u, ok := r.users[userID]; ok {
+		u.PhotoURL = key
+	}
+	return nil
+}
+
+// GetAllUsers implements UserRepository.GetAllUsers
+func (r *MemoryRepository) GetAllUsers(ctx context.Context) ([]models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var users []models.User
+	for _, u := range r.users {
+		users = append(users, u.User)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	return users, nil
+}
+
+// GetUserPasswordHash implements UserRepository.GetUserPasswordHash
+func (r *MemoryRepository) GetUserPasswordHash(ctx context.Context, userID string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	u, ok := r.users[userID]
+	if !ok {
+		return "", nil
+	}
+	return u.passwordHash, nil
+}
+
+// SetUserPasswordHash implements UserRepository.SetUserPasswordHash
+func (r *MemoryRepository) SetUserPasswordHash(ctx context.Context, userID string, hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[userID]
+	if !ok {
+		return models.NewError(models.ErrNotFound, "user not found")
+	}
+	u.passwordHash = hash
+	return nil
+}
+
+// CreateSession implements SessionRepository.CreateSession
+func (r *MemoryRepository) CreateSession(ctx context.Context, session models.Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.sessions[session.ID]; ok {
+		return models.NewError(models.ErrConflict, "session already exists")
+	}
+	r.sessions[session.ID] = session
+	return nil
+}
+
+// GetSessionByID implements SessionRepository.GetSessionByID
+func (r *MemoryRepository) GetSessionByID(ctx context.Context, id string) (*models.Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	session, ok := r.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+// RevokeSession implements SessionRepository.RevokeSession
+func (r *MemoryRepository) RevokeSession(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session, ok := r.sessions[id]
+	if !ok || session.RevokedAt != nil {
+		return nil
+	}
+	now := time.Now()
+	session.RevokedAt = &now
+	r.sessions[id] = session
+	return nil
+}
+
+// CreateDirectConversation implements ConversationRepository.CreateDirectConversation
+func (r *MemoryRepository) CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, error) {
+	r.mu.Lock()
+
+	// Check if a direct conversation already exists between these users
+	for _, conv := range r.conversations {
+		if conv.convType == models.DirectConversation && conv.hasParticipant(userID1) && conv.hasParticipant(userID2) {
+			r.mu.Unlock()
+			return r.GetConversationByID(ctx, conv.id, userID1)
+		}
+	}
+
+	id, err := r.createConversation("", models.DirectConversation, "", []string{userID1, userID2})
+	r.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.GetConversationByID(ctx, id, userID1)
+}
+
+// CreateGroupConversation implements ConversationRepository.CreateGroupConversation
+func (r *MemoryRepository) CreateGroupConversation(ctx context.Context, name string, ownerID string, participants []string) (*models.Conversation, error) {
+	r.mu.Lock()
+	id, err := r.createConversation(name, models.GroupConversation, ownerID, participants)
+	r.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.GetConversationByID(ctx, id, ownerID)
+}
+
+// createConversation stores a new conversation; the caller must hold the write lock
+func (r *MemoryRepository) createConversation(name string, convType models.ConversationType, ownerID string, participants []string) (string, error) {
+	now := time.Now()
+	conv := &conversation{
+		id:           uuid.New().String(),
+		name:         name,
+		convType:     convType,
+		lastActivity: now,
+		policy:       models.DefaultGroupPolicy(),
+	}
+
+	for _, userID := range participants {
+		// Mirror the foreign key and primary key constraints of the SQL backends
+		if _, ok := r.users[userID]; !ok {
+			return "", fmt.Errorf("user %s does not exist", userID)
+		}
+		if conv.hasParticipant(userID) {
+			return "", fmt.Errorf("user %s is listed twice", userID)
+		}
+		role := models.RoleMember
+		if userID == ownerID {
+			role = models.RoleOwner
+		}
+		conv.participants = append(conv.participants, participant{userID: userID, joinedAt: now, role: role})
+	}
+
+	r.conversations[conv.id] = conv
+	return conv.id, nil
+}
+
+// hasParticipant reports whether the user takes part in the conversation
+func (c *conversation) hasParticipant(userID string) bool {
+	for _, p := range c.participants {
+		if p.userID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// GetConversationByID implements ConversationRepository.GetConversationByID
+func (r *MemoryRepository) GetConversationByID(ctx context.Context, id string, viewerID string) (*models.Conversation, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	conv, ok := r.conversations[id]
+	if !ok {
+		return nil, nil
+	}
+
+	result := &models.Conversation{
+		ID:       conv.id,
+		Name:     conv.name,
+		Type:     conv.convType,
+		PhotoURL: conv.photoURL,
+	}
+	if conv.convType == models.GroupConversation {
+		policy := conv.policy
+		result.Policy = &policy
+	}
+
+	for _, p := range conv.participants {
+		u := r.users[p.userID]
+		result.Participants = append(result.Participants, models.Participant{
+			ID:       u.ID,
+			Name:     u.Name,
+			PhotoURL: u.PhotoURL,
+			Role:     p.role,
+		})
+	}
+
+	// Get the last message only; the history is paginated separately
+	if lastMessages := r.messagesPage(inConversation(id), viewerID, nil, 1); len(lastMessages) > 0 {
+		result.LastMessage = &lastMessages[0]
+	}
+
+	// If this is a direct conversation and has no name, set the name to the other user's name
+	if result.Type == models.DirectConversation && result.Name == "" && len(result.Participants) == 2 {
+		for _, p := range result.Participants {
+			if p.ID != viewerID {
+				result.Name = p.Name
+				break
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// GetConversationsByUserID implements ConversationRepository.GetConversationsByUserID
+func (r *MemoryRepository) GetConversationsByUserID(ctx context.Context, userID string) ([]models.Conversation, error) {
+	r.mu.RLock()
+	var convs []*conversation
+	for _, conv := range r.conversations {
+		if conv.hasParticipant(userID) {
+			convs = append(convs, conv)
+		}
+	}
+	sort.Slice(convs, func(i, j int) bool {
+		return convs[i].lastActivity.After(convs[j].lastActivity)
+	})
+	ids := make([]string, len(convs))
+	for i, conv := range convs {
+		ids[i] = conv.id
+	}
+	r.mu.RUnlock()
+
+	var conversations []models.Conversation
+	for _, id := range ids {
+		conv, err := r.GetConversationByID(ctx, id, userID)
+		if err != nil {
+			return nil, err
+		}
+		if conv != nil {
+			conversations = append(conversations, *conv)
+		}
+	}
+
+	return conversations, nil
+}
+
+// group looks up a group conversation; the caller must hold the lock
+func (r *MemoryRepository) group(groupID string) (*conversation, error) {
+	conv, ok := r.conversations[groupID]
+	if !ok {
+		return nil, models.NewError(models.ErrNotFound, "conversation not found")
+	}
+	if conv.convType != models.GroupConversation {
+		return nil, models.NewError(models.ErrValidation, "conversation is not a group")
+	}
+	return conv, nil
+}
+
+// AddUserToGroup implements ConversationRepository.AddUserToGroup
+func (r *MemoryRepository) AddUserToGroup(ctx context.Context, groupID, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conv, err := r.group(groupID)
+	if err != nil {
+		return err
+	}
+	if conv.hasParticipant(userID) {
+		return models.NewError(models.ErrConflict, "user is already in the group")
+	}
+	if _, ok := r.users[userID]; !ok {
+		return fmt.Errorf("user %s does not exist", userID)
+	}
+
+	conv.participants = append(conv.participants, participant{userID: userID, joinedAt: time.Now(), role: models.RoleMember})
+	return nil
+}
+
+// RemoveUserFromGroup implements ConversationRepository.RemoveUserFromGroup
+func (r *MemoryRepository) RemoveUserFromGroup(ctx context.Context, groupID, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conv, err := r.group(groupID)
+	if err != nil {
+		return err
+	}
+
+	for i, p := range conv.participants {
+		if p.userID == userID {
+			conv.participants = append(conv.participants[:i], conv.participants[i+1:]...)
+
+			// A group keeps an owner for as long as it has members
+			if p.role == models.RoleOwner && len(conv.participants) > 0 {
+				successor := 0
+				for j, candidate := range conv.participants {
+					if candidate.role == models.RoleAdmin {
+						successor = j
+						break
+					}
+				}
+				conv.participants[successor].role = models.RoleOwner
+			}
+
+			// A former member no longer holds back the read status of messages they never read
+			for _, msg := range r.messages {
+				if rec, ok := msg.receipts[userID]; ok && msg.ConversationID == groupID && rec.readAt == nil {
+					delete(msg.receipts, userID)
+				}
+			}
+			return nil
+		}
+	}
+
+	return models.NewError(models.ErrNotFound, "user is not in the group")
+}
+
+// UpdateGroupName implements ConversationRepository.UpdateGroupName
+func (r *MemoryRepository) UpdateGroupName(ctx context.Context, groupID, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conv, err := r.group(groupID)
+	if err != nil {
+		return err
+	}
+	conv.name = name
+	return nil
+}
+
+// SetParticipantRole implements ConversationRepository.SetParticipantRole
+func (r *MemoryRepository) SetParticipantRole(ctx context.Context, groupID, userID string, role models.ParticipantRole) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conv, err := r.group(groupID)
+	if err != nil {
+		return err
+	}
+	for i := range conv.participants {
+		if conv.participants[i].userID == userID {
+			conv.participants[i].role = role
+			return nil
+		}
+	}
+	return models.NewError(models.ErrNotFound, "user is not in the group")
+}
+
+// UpdateGroupPolicy implements ConversationRepository.UpdateGroupPolicy
+func (r *MemoryRepository) UpdateGroupPolicy(ctx context.Context, groupID string, policy models.GroupPolicy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conv, err := r.group(groupID)
+	if err != nil {
+		return err
+	}
+	conv.policy = policy
+	return nil
+}
+
+// SetGroupPhoto implements ConversationRepository.SetGroupPhoto
+func (r *MemoryRepository) SetGroupPhoto(ctx context.Context, groupID string, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conv, err := r.group(groupID)
+	if err != nil {
+		return err
+	}
+	conv.photoURL = key
+	return nil
+}
+
+// CreateMessage implements MessageRepository.CreateMessage
+func (r *MemoryRepository) CreateMessage(ctx context.Context, msg models.Message, conversationID string) (*models.Message, error) {
+	msg.ConversationID = conversationID
+	created, err := r.CreateMessages(ctx, []models.Message{msg})
+	if err != nil {
+		return nil, err
+	}
+	return &created[0], nil
+}
+
+// CreateMessages implements MessageRepository.CreateMessages
+func (r *MemoryRepository) CreateMessages(ctx context.Context, messages []models.Message) ([]models.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Check every message before storing any, so that a failure leaves nothing behind
+	created := make([]models.Message, len(messages))
+	ids := make(map[string]bool)
+	for i, msg := range messages {
+		if _, ok := r.conversations[msg.ConversationID]; !ok {
+			return nil, models.NewError(models.ErrNotFound, "conversation not found")
+		}
+
+		// If no ID provided, generate one
+		if msg.ID == "" {
+			msg.ID = uuid.New().String()
+		}
+		if _, exists := r.messages[msg.ID]; exists || ids[msg.ID] {
+			return nil, models.NewError(models.ErrConflict, "message already exists")
+		}
+		ids[msg.ID] = true
+
+		// Mirror the foreign key constraints of the SQL backends
+		if _, ok := r.users[msg.Sender.ID]; !ok {
+			return nil, fmt.Errorf("user %s does not exist", msg.Sender.ID)
+		}
+		if msg.ReplyTo != nil {
+			if _, ok := r.messages[*msg.ReplyTo]; !ok {
+				return nil, fmt.Errorf("message %s does not exist", *msg.ReplyTo)
+			}
+		}
+		if msg.ForwardedFrom != nil && msg.ForwardedFrom.MessageID != "" {
+			if _, ok := r.messages[msg.ForwardedFrom.MessageID]; !ok {
+				return nil, fmt.Errorf("message %s does not exist", msg.ForwardedFrom.MessageID)
+			}
+		}
+
+		// If no timestamp provided, use current time
+		if msg.Timestamp.IsZero() {
+			msg.Timestamp = time.Now()
+		}
+		created[i] = msg
+	}
+
+	for _, msg := range created {
+		conv := r.conversations[msg.ConversationID]
+
+		// Open a pending receipt for every other participant
+		stored := &message{Message: msg, receipts: make(map[string]*receipt)}
+		stored.Reactions = nil
+		stored.ReplyPreview = nil
+		if msg.ForwardedFrom != nil {
+			forwardedFrom := *msg.ForwardedFrom
+			stored.ForwardedFrom = &forwardedFrom
+		}
+		if msg.Attachment != nil {
+			attachment := *msg.Attachment
+			stored.Attachment = &attachment
+		}
+		for _, p := range conv.participants {
+			if p.userID != msg.Sender.ID {
+				stored.receipts[p.userID] = &receipt{}
+			}
+		}
+		r.messages[msg.ID] = stored
+
+		// Update the last activity timestamp of the conversation
+		conv.lastActivity = msg.Timestamp
+	}
+
+	return created, nil
+}
+
+// GetMessagesPage implements MessageRepository.GetMessagesPage
+func (r *MemoryRepository) GetMessagesPage(ctx context.Context, conversationID, viewerID string, before *models.MessageCursor, limit int) ([]models.Message, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.messagesPage(inConversation(conversationID), viewerID, before, limit), nil
+}
+
+// GetReplies implements MessageRepository.GetReplies
+func (r *MemoryRepository) GetReplies(ctx context.Context, messageID, viewerID string, before *models.MessageCursor, limit int) ([]models.Message, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.messagesPage(func(msg *message) bool {
+		return msg.ReplyTo != nil && *msg.ReplyTo == messageID
+	}, viewerID, before, limit), nil
+}
+
+// inConversation matches the messages of a conversation
+func inConversation(conversationID string) func(*message) bool {
+	return func(msg *message) bool {
+		return msg.ConversationID == conversationID
+	}
+}
+
+// messagesPage pages through the matching messages, newest first; the caller must hold the lock
+func (r *MemoryRepository) messagesPage(match func(*message) bool, viewerID string, before *models.MessageCursor, limit int) []models.Message {
+	var page []*message
+	for _, msg := range r.messages {
+		if !match(msg) || msg.hiddenBy[viewerID] {
+			continue
+		}
+		if before != nil && !isBefore(msg.Message, *before) {
+			continue
+		}
+		page = append(page, msg)
+	}
+
+	// Newest first, on the same (timestamp, id) key as the SQL backends
+	sort.Slice(page, func(i, j int) bool {
+		return !isBefore(page[i].Message, models.MessageCursor{Timestamp: page[j].Timestamp, ID: page[j].ID})
+	})
+	if len(page) > limit {
+		page = page[:limit]
+	}
+
+	var messages []models.Message
+	for _, msg := range page {
+		messages = append(messages, r.snapshot(msg))
+	}
+	return messages
+}
+
+// SearchMessages implements MessageRepository.SearchMessages.
+// Like the SQLite backend, it matches messages by substring: every term must appear, ignoring case.
+func (r *MemoryRepository) SearchMessages(ctx context.Context, s models.MessageSearch) ([]models.SearchResult, error) {
+	terms := search.Terms(s.Query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var matches []*message
+	for _, msg := range r.messages {
+		conv := r.conversations[msg.ConversationID]
+		switch {
+		case !conv.hasParticipant(s.UserID),
+			msg.Type != models.TextMessage || msg.DeletedAt != nil,
+			msg.hiddenBy[s.UserID],
+			s.ConversationID != "" && msg.ConversationID != s.ConversationID,
+			s.SenderID != "" && msg.Sender.ID != s.SenderID,
+			s.Before != nil && !isBefore(msg.Message, *s.Before),
+			!search.Matches(msg.Content, terms):
+			continue
+		}
+		matches = append(matches, msg)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return !isBefore(matches[i].Message, models.MessageCursor{Timestamp: matches[j].Timestamp, ID: matches[j].ID})
+	})
+	if len(matches) > s.Limit {
+		matches = matches[:s.Limit]
+	}
+
+	var results []models.SearchResult
+	for _, msg := range matches {
+		snapshot := r.snapshot(msg)
+		results = append(results, models.SearchResult{
+			MessageID:      snapshot.ID,
+			ConversationID: snapshot.ConversationID,
+			Sender:         snapshot.Sender,
+			Timestamp:      snapshot.Timestamp,
+			Snippet:        search.Snippet(snapshot.Content, terms),
+		})
+	}
+	return results, nil
+}
+
+// isBefore reports whether a message sorts strictly before the cursor position
+func isBefore(msg models.Message, cursor models.MessageCursor) bool {
+	if !msg.Timestamp.Equal(cursor.Timestamp) {
+		return msg.Timestamp.Before(cursor.Timestamp)
+	}
+	return msg.ID < cursor.ID
+}
+
+// snapshot copies a stored message, deriving its aggregate status from the receipts
+// the way the SQL backends do; the caller must hold the lock
+func (r *MemoryRepository) snapshot(msg *message) models.Message {
+	result := msg.Message
+
+	if u, ok := r.users[msg.Sender.ID]; ok {
+		result.Sender = u.User
+	}
+	if len(msg.receipts) > 0 {
+		result.Status = models.Read
+		for _, rec := range msg.receipts {
+			if rec.receivedAt == nil {
+				result.Status = models.Sent
+				break
+			}
+			if rec.readAt == nil {
+				result.Status = models.Received
+			}
+		}
+	}
+
+	if msg.ReplyTo != nil {
+		replyTo := *msg.ReplyTo
+		result.ReplyTo = &replyTo
+		if original, ok := r.messages[replyTo]; ok {
+			preview := original.Message
+			if u, ok := r.users[original.Sender.ID]; ok {
+				preview.Sender = u.User
+			}
+			result.ReplyPreview = models.NewReplyPreview(&preview)
+		}
+	}
+	if msg.ForwardedFrom != nil {
+		forwardedFrom := *msg.ForwardedFrom
+		if u, ok := r.users[forwardedFrom.Sender.ID]; ok {
+			forwardedFrom.Sender = u.User
+		}
+		result.ForwardedFrom = &forwardedFrom
+	}
+	if msg.Attachment != nil {
+		attachment := *msg.Attachment
+		result.Attachment = &attachment
+	}
+	if msg.EditedAt != nil {
+		editedAt := *msg.EditedAt
+		result.EditedAt = &editedAt
+	}
+	if msg.DeletedAt != nil {
+		deletedAt := *msg.DeletedAt
+		result.DeletedAt = &deletedAt
+	}
+	result.Reactions = append([]models.Reaction(nil), msg.reactions...)
+
+	return result
+}
+
+// GetMessageByID implements MessageRepository.GetMessageByID
+func (r *MemoryRepository) GetMessageByID(ctx context.Context, id string) (*models.Message, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	msg, ok := r.messages[id]
+	if !ok {
+		return nil, nil
+	}
+
+	// Like the SQL backends, single messages are returned without their reactions
+	result := r.snapshot(msg)
+	result.Reactions = nil
+	return &result, nil
+}
+
+// DeleteMessage implements MessageRepository.DeleteMessage
+func (r *MemoryRepository) DeleteMessage(ctx context.Context, id string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	msg, ok := r.messages[id]
+	if !ok || msg.DeletedAt != nil {
+		return "", nil
+	}
+
+	// Soft delete by setting the deleted_at timestamp, leaving a tombstone without content
+	now := time.Now()
+	msg.DeletedAt = &now
+	content := msg.Content
+	msg.Content = ""
+	msg.Caption = ""
+	msg.Attachment = nil
+	msg.revisions = nil
+
+	if msg.Type == models.TextMessage {
+		return "", nil
+	}
+	// Forwarded copies of a photo or file, and identical uploads, share its blob
+	for _, other := range r.messages {
+		if other.Type != models.TextMessage && other.Content == content && other.DeletedAt == nil {
+			return "", nil
+		}
+	}
+	return content, nil
+}
+
+// HideMessage implements MessageRepository.HideMessage
+func (r *MemoryRepository) HideMessage(ctx context.Context, messageID, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	msg, ok := r.messages[messageID]
+	if !ok {
+		return models.NewError(models.ErrNotFound, "message not found")
+	}
+	if msg.hiddenBy == nil {
+		msg.hiddenBy = make(map[string]bool)
+	}
+	msg.hiddenBy[userID] = true
+	return nil
+}
+
+// MarkMessagesReceived implements MessageRepository.MarkMessagesReceived
+func (r *MemoryRepository) MarkMessagesReceived(ctx context.Context, conversationID, userID string, upTo models.MessageCursor) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.forReceiptsUpTo(conversationID, userID, upTo, func(rec *receipt) {
+		if rec.receivedAt == nil {
+			rec.receivedAt = &now
+		}
+	})
+	return nil
+}
+
+// MarkMessagesRead implements MessageRepository.MarkMessagesRead
+func (r *MemoryRepository) MarkMessagesRead(ctx context.Context, conversationID, userID string, upTo models.MessageCursor) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.forReceiptsUpTo(conversationID, userID, upTo, func(rec *receipt) {
+		if rec.readAt == nil {
+			rec.readAt = &now
+		}
+		if rec.receivedAt == nil {
+			rec.receivedAt = &now
+		}
+	})
+	return nil
+}
+
+// forReceiptsUpTo applies fn to the user's receipts of the conversation's messages
+// up to and including the cursor; the caller must hold the write lock
+func (r *MemoryRepository) forReceiptsUpTo(conversationID, userID string, upTo models.MessageCursor, fn func(*receipt)) {
+	for _, msg := range r.messages {
+		if msg.ConversationID != conversationID {
+			continue
+		}
+		if msg.ID != upTo.ID && !isBefore(msg.Message, upTo) {
+			continue
+		}
+		if rec, ok := msg.receipts[userID]; ok {
+			fn(rec)
+		}
+	}
+}
+
+// GetMessageReceipts implements MessageRepository.GetMessageReceipts
+func (r *MemoryRepository) GetMessageReceipts(ctx context.Context, messageID string) ([]models.Receipt, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	msg, ok := r.messages[messageID]
+	if !ok {
+		return nil, nil
+	}
+
+	var receipts []models.Receipt
+	for userID, rec := range msg.receipts {
+		receipt := models.Receipt{MessageID: messageID, UserID: userID}
+		if u, ok := r.users[userID]; ok {
+			receipt.UserName = u.Name
+		}
+		if rec.receivedAt != nil {
+			receivedAt := *rec.receivedAt
+			receipt.ReceivedAt = &receivedAt
+		}
+		if rec.readAt != nil {
+			readAt := *rec.readAt
+			receipt.ReadAt = &readAt
+		}
+		receipts = append(receipts, receipt)
+	}
+
+	// Readers first, then recipients, then the rest; earliest first within each group
+	sort.Slice(receipts, func(i, j int) bool {
+		a, b := receipts[i], receipts[j]
+		if c := compareOptionalTimes(a.ReadAt, b.ReadAt); c != 0 {
+			return c < 0
+		}
+		if c := compareOptionalTimes(a.ReceivedAt, b.ReceivedAt); c != 0 {
+			return c < 0
+		}
+		return a.UserName < b.UserName
+	})
+
+	return receipts, nil
+}
+
+// compareOptionalTimes orders times ascending with missing ones last
+func compareOptionalTimes(a, b *time.Time) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	default:
+		return a.Compare(*b)
+	}
+}
+
+// UpdateMessageContent implements MessageRepository.UpdateMessageContent
+func (r *MemoryRepository) UpdateMessageContent(ctx context.Context, id string, content string, editedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if msg, ok := r.messages[id]; ok {
+		// Keep the current content, stamped with the time it was written, before replacing it
+		writtenAt := msg.Timestamp
+		if msg.EditedAt != nil {
+			writtenAt = *msg.EditedAt
+		}
+		msg.revisions = append(msg.revisions, models.MessageRevision{Content: msg.Content, Timestamp: writtenAt})
+
+		msg.Content = content
+		msg.EditedAt = &editedAt
+	}
+	return nil
+}
+
+// GetMessageRevisions implements MessageRepository.GetMessageRevisions
+func (r *MemoryRepository) GetMessageRevisions(ctx context.Context, messageID string) ([]models.MessageRevision, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	msg, ok := r.messages[messageID]
+	if !ok {
+		return nil, nil
+	}
+	return append([]models.MessageRevision(nil), msg.revisions...), nil
+}
+
+// AddReaction implements ReactionRepository.AddReaction
+func (r *MemoryRepository) AddReaction(ctx context.Context, messageID, userID, emoji string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	msg, ok := r.messages[messageID]
+	if !ok {
+		return models.NewError(models.ErrNotFound, "message not found")
+	}
+	if _, ok := r.users[userID]; !ok {
+		return fmt.Errorf("user %s does not exist", userID)
+	}
+
+	// Replace the emoji of the user's existing reaction, if any
+	for i, reaction := range msg.reactions {
+		if reaction.UserID == userID {
+			msg.reactions[i].Emoji = emoji
+			return nil
+		}
+	}
+
+	msg.reactions = append(msg.reactions, models.Reaction{MessageID: messageID, UserID: userID, Emoji: emoji})
+	return nil
+}
+
+// RemoveReaction implements ReactionRepository.RemoveReaction
+func (r *MemoryRepository) RemoveReaction(ctx context.Context, messageID, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if msg, ok := r.messages[messageID]; ok {
+		for i, reaction := range msg.reactions {
+			if reaction.UserID == userID {
+				msg.reactions = append(msg.reactions[:i], msg.reactions[i+1:]...)
+				return nil
+			}
+		}
+	}
+
+	return models.NewError(models.ErrNotFound, "reaction not found")
+}
+
+// GetReactionsByMessageID implements ReactionRepository.GetReactionsByMessageID
+func (r *MemoryRepository) GetReactionsByMessageID(ctx context.Context, messageID string) ([]models.Reaction, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	msg, ok := r.messages[messageID]
+	if !ok {
+		return nil, nil
+	}
+	return append([]models.Reaction(nil), msg.reactions...), nil
+}
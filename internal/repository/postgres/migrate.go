@@ -0,0 +1,37 @@
+package postgres
+
+import (
+	"database/sql"
+	"embed"
+	"io/fs"
+
+	"github.com/fallenkarma/wasatext/internal/migrate"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Open connects to the database without touching its schema
+func Open(connStr string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check connection
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// NewMigrator returns a Migrator for the embedded Postgres schema migrations
+func NewMigrator(db *sql.DB) (*migrate.Migrator, error) {
+	migrations, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return migrate.New(db, migrations, migrate.Postgres)
+}
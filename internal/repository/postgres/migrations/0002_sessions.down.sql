@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS sessions;
+ALTER TABLE users DROP COLUMN IF EXISTS password_hash;
@@ -0,0 +1,2 @@
+-- Keyset pagination of conversation history on (timestamp, id)
+CREATE INDEX IF NOT EXISTS idx_messages_conversation_page ON messages(conversation_id, timestamp DESC, id DESC);
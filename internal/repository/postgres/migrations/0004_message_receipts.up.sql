@@ -0,0 +1,10 @@
+-- Per-recipient delivery and read receipts
+CREATE TABLE IF NOT EXISTS message_receipts (
+    message_id VARCHAR(36) REFERENCES messages(id) ON DELETE CASCADE,
+    user_id VARCHAR(36) REFERENCES users(id) ON DELETE CASCADE,
+    received_at TIMESTAMP WITH TIME ZONE,
+    read_at TIMESTAMP WITH TIME ZONE,
+    PRIMARY KEY (message_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_receipts_user_id ON message_receipts(user_id);
@@ -0,0 +1,6 @@
+ALTER TABLE conversations
+    DROP COLUMN IF EXISTS add_members_permission,
+    DROP COLUMN IF EXISTS edit_info_permission,
+    DROP COLUMN IF EXISTS send_messages_permission;
+
+ALTER TABLE conversation_participants DROP COLUMN IF EXISTS role;
@@ -0,0 +1,24 @@
+-- Group roles and per-group permission policy
+ALTER TABLE conversation_participants
+    ADD COLUMN IF NOT EXISTS role VARCHAR(10) NOT NULL DEFAULT 'member'
+    CHECK (role IN ('owner', 'admin', 'member'));
+
+ALTER TABLE conversations
+    ADD COLUMN IF NOT EXISTS add_members_permission VARCHAR(10) NOT NULL DEFAULT 'everyone'
+        CHECK (add_members_permission IN ('everyone', 'admins')),
+    ADD COLUMN IF NOT EXISTS edit_info_permission VARCHAR(10) NOT NULL DEFAULT 'everyone'
+        CHECK (edit_info_permission IN ('everyone', 'admins')),
+    ADD COLUMN IF NOT EXISTS send_messages_permission VARCHAR(10) NOT NULL DEFAULT 'everyone'
+        CHECK (send_messages_permission IN ('everyone', 'admins'));
+
+-- Existing groups are owned by their longest-standing participant
+UPDATE conversation_participants cp
+SET role = 'owner'
+FROM (
+    SELECT DISTINCT ON (p.conversation_id) p.conversation_id, p.user_id
+    FROM conversation_participants p
+    JOIN conversations c ON c.id = p.conversation_id
+    WHERE c.type = 'group'
+    ORDER BY p.conversation_id, p.joined_at ASC, p.user_id ASC
+) first
+WHERE cp.conversation_id = first.conversation_id AND cp.user_id = first.user_id;
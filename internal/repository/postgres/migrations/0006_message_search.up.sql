@@ -0,0 +1,7 @@
+-- Full-text search over text messages. The 'simple' configuration does no stemming,
+-- so search behaves the same whatever language a conversation is held in.
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS search_vector tsvector
+    GENERATED ALWAYS AS (to_tsvector('simple', CASE WHEN type = 'text' THEN content ELSE '' END)) STORED;
+
+CREATE INDEX IF NOT EXISTS idx_messages_search ON messages USING GIN (search_vector);
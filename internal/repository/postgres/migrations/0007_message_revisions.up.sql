@@ -0,0 +1,12 @@
+-- Edit history: messages keep the time of their last edit, and every
+-- version replaced by an edit is kept as a revision
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE IF NOT EXISTS message_revisions (
+    id BIGSERIAL PRIMARY KEY,
+    message_id VARCHAR(36) NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    content TEXT NOT NULL,
+    written_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_revisions_message_id ON message_revisions(message_id, id);
@@ -0,0 +1,2 @@
+-- The content of deleted messages cannot be restored
+DROP TABLE IF EXISTS hidden_messages;
@@ -0,0 +1,11 @@
+-- Messages deleted for everyone keep no content: erase what earlier deletes left behind
+UPDATE messages SET content = '' WHERE deleted_at IS NOT NULL;
+DELETE FROM message_revisions WHERE message_id IN (SELECT id FROM messages WHERE deleted_at IS NOT NULL);
+
+-- Messages a user deleted for themselves only
+CREATE TABLE IF NOT EXISTS hidden_messages (
+    user_id VARCHAR(36) REFERENCES users(id) ON DELETE CASCADE,
+    message_id VARCHAR(36) REFERENCES messages(id) ON DELETE CASCADE,
+    hidden_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, message_id)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE messages DROP COLUMN IF EXISTS forward_count;
+ALTER TABLE messages DROP COLUMN IF EXISTS forwarded_from_sender;
+ALTER TABLE messages DROP COLUMN IF EXISTS forwarded_from;
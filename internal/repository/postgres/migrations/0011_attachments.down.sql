@@ -0,0 +1,13 @@
+-- Attachment messages cannot be represented before this migration
+DELETE FROM messages WHERE type IN ('file', 'audio', 'video');
+
+ALTER TABLE messages
+    DROP COLUMN attachment_thumbnail,
+    DROP COLUMN attachment_duration,
+    DROP COLUMN attachment_size,
+    DROP COLUMN attachment_type,
+    DROP COLUMN attachment_name,
+    DROP COLUMN caption;
+
+ALTER TABLE messages DROP CONSTRAINT messages_type_check;
+ALTER TABLE messages ADD CONSTRAINT messages_type_check CHECK (type IN ('text', 'photo'));
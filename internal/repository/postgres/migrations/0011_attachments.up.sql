@@ -0,0 +1,15 @@
+-- File, audio and video messages, and captions on media messages
+ALTER TABLE messages DROP CONSTRAINT messages_type_check;
+ALTER TABLE messages ADD CONSTRAINT messages_type_check
+    CHECK (type IN ('text', 'photo', 'file', 'audio', 'video'));
+
+ALTER TABLE messages ADD COLUMN caption TEXT NOT NULL DEFAULT '';
+
+-- Metadata of the file a file, audio or video message carries;
+-- the content column holds the key of the file itself
+ALTER TABLE messages
+    ADD COLUMN attachment_name TEXT,
+    ADD COLUMN attachment_type TEXT,
+    ADD COLUMN attachment_size BIGINT,
+    ADD COLUMN attachment_duration DOUBLE PRECISION,
+    ADD COLUMN attachment_thumbnail TEXT;
@@ -5,54 +5,52 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"io"
-	"log"
-	"mime/multipart"
-	"os"
-	"path/filepath"
+	"log/slog"
 	"time"
 
 	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/search"
 	"github.com/google/uuid"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+// messageStatusColumn derives a message's aggregate status from its receipts:
+// read once every recipient read it, received once every recipient received it.
+// Messages without receipts fall back to the stored status.
+const messageStatusColumn = `
+	CASE
+		WHEN NOT EXISTS (SELECT 1 FROM message_receipts mr WHERE mr.message_id = m.id) THEN m.status
+		WHEN NOT EXISTS (SELECT 1 FROM message_receipts mr WHERE mr.message_id = m.id AND mr.read_at IS NULL) THEN 'read'
+		WHEN NOT EXISTS (SELECT 1 FROM message_receipts mr WHERE mr.message_id = m.id AND mr.received_at IS NULL) THEN 'received'
+		ELSE 'sent'
+	END`
+
 // PostgresRepository implements the Repository interface
 type PostgresRepository struct {
 	db          *sql.DB
-	uploadPath  string
 }
 
-// NewPostgresRepository creates a new PostgresRepository
-func NewPostgresRepository(connStr string, uploadPath string) (*PostgresRepository, error) {
-	db, err := sql.Open("postgres", connStr)
+// NewPostgresRepository creates a new PostgresRepository, migrating the database to the latest schema
+func NewPostgresRepository(connStr string) (*PostgresRepository, error) {
+	db, err := Open(connStr)
 	if err != nil {
 		return nil, err
 	}
 
-	// Check connection
-	if err := db.Ping(); err != nil {
+	migrator, err := NewMigrator(db)
+	if err != nil {
 		return nil, err
 	}
-
-	ex, err := os.Executable()
-    if err != nil {
-        return nil, fmt.Errorf("failed to get executable path: %w", err)
-    }
-    exPath := filepath.Dir(ex) // This gives you C:\progettiPersonali\wasaProject\bin (if you build to bin)
-
-    // Define your desired uploads directory relative to the executable
-    // Example: Create an "uploads" folder next to your executable
-    uploadsDir := filepath.Join(exPath, "uploads")
-
-	// Create upload directory if it doesn't exist
-	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
-		return nil, err
+	applied, err := migrator.Up(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	if applied > 0 {
+		slog.Info("Applied schema migrations", "count", applied)
 	}
 
 	return &PostgresRepository{
 		db:          db,
-		uploadPath:  uploadsDir,
 	}, nil
 }
 
@@ -61,6 +59,11 @@ func (r *PostgresRepository) Close() error {
 	return r.db.Close()
 }
 
+// Ping implements Repository.Ping
+func (r *PostgresRepository) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
 // CreateUser implements UserRepository.CreateUser
 func (r *PostgresRepository) CreateUser(ctx context.Context, name string) (*models.User, error) {
 	// Check if user with this name already exists
@@ -85,6 +88,31 @@ func (r *PostgresRepository) CreateUser(ctx context.Context, name string) (*mode
 	}, nil
 }
 
+// CreateUserWithPasswordHash implements UserRepository.CreateUserWithPasswordHash
+func (r *PostgresRepository) CreateUserWithPasswordHash(ctx context.Context, name string, hash string) (*models.User, error) {
+	id := uuid.New().String()
+
+	// The unique name decides between concurrent sign-ups: only one insert goes through
+	query := "INSERT INTO users (id, name, password_hash) VALUES ($1, $2, $3) ON CONFLICT (name) DO NOTHING"
+	result, err := r.db.ExecContext(ctx, query, id, name, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, models.NewError(models.ErrConflict, "username already in use")
+	}
+
+	return &models.User{
+		ID:   id,
+		Name: name,
+	}, nil
+}
+
 // GetUserByID implements UserRepository.GetUserByID
 func (r *PostgresRepository) GetUserByID(ctx context.Context, id string) (*models.User, error) {
 	query := "SELECT id, name, photo_url FROM users WHERE id = $1"
@@ -134,7 +162,7 @@ func (r *PostgresRepository) UpdateUsername(ctx context.Context, userID string,
 	// Check if name is already in use
 	existingUser, _ := r.GetUserByName(ctx, newName)
 	if existingUser != nil && existingUser.ID != userID {
-		return errors.New("username already in use")
+		return models.NewError(models.ErrConflict, "username already in use")
 	}
 
 	query := "UPDATE users SET name = $1 WHERE id = $2"
@@ -142,39 +170,11 @@ func (r *PostgresRepository) UpdateUsername(ctx context.Context, userID string,
 	return err
 }
 
-// SaveUserPhoto implements UserRepository.SaveUserPhoto
-func (r *PostgresRepository) SaveUserPhoto(ctx context.Context, userID string, photo multipart.File) (string, error) {
-	// Create user photos directory if it doesn't exist
-	userPhotosDir := filepath.Join(r.uploadPath, "user_photos")
-	log.Println("User photos directory:", userPhotosDir)
-	if err := os.MkdirAll(userPhotosDir, 0755); err != nil {
-		return "", err
-	}
-
-	// Generate a unique filename
-	filename := fmt.Sprintf("%s_%d.jpg", userID, time.Now().Unix())
-	filepath := filepath.Join(userPhotosDir, filename)
-
-	// Save the file
-	dst, err := os.Create(filepath)
-	if err != nil {
-		return "", err
-	}
-	defer dst.Close()
-
-	if _, err = io.Copy(dst, photo); err != nil {
-		return "", err
-	}
-
-	// Update the user's photo URL in the database
-	relativePath := fmt.Sprintf("/uploads/user_photos/%s", filename)
+// SetUserPhoto implements UserRepository.SetUserPhoto
+func (r *PostgresRepository) SetUserPhoto(ctx context.Context, userID string, key string) error {
 	query := "UPDATE users SET photo_url = $1 WHERE id = $2"
-	_, err = r.db.ExecContext(ctx, query, relativePath, userID)
-	if err != nil {
-		return "", err
-	}
-
-	return relativePath, nil
+	_, err := r.db.ExecContext(ctx, query, key, userID)
+	return err
 }
 
 // GetAllUsers implements UserRepository.GetAllUsers
@@ -206,10 +206,76 @@ func (r *PostgresRepository) GetAllUsers(ctx context.Context) ([]models.User, er
 	return users, nil
 }
 
+// GetUserPasswordHash implements UserRepository.GetUserPasswordHash
+func (r *PostgresRepository) GetUserPasswordHash(ctx context.Context, userID string) (string, error) {
+	query := "SELECT password_hash FROM users WHERE id = $1"
+	row := r.db.QueryRowContext(ctx, query, userID)
+
+	var hash sql.NullString
+	if err := row.Scan(&hash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return hash.String, nil
+}
+
+// SetUserPasswordHash implements UserRepository.SetUserPasswordHash
+func (r *PostgresRepository) SetUserPasswordHash(ctx context.Context, userID string, hash string) error {
+	query := "UPDATE users SET password_hash = $1, updated_at = NOW() WHERE id = $2"
+	result, err := r.db.ExecContext(ctx, query, hash, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return models.NewError(models.ErrNotFound, "user not found")
+	}
+
+	return nil
+}
+
+// CreateSession implements SessionRepository.CreateSession
+func (r *PostgresRepository) CreateSession(ctx context.Context, session models.Session) error {
+	query := "INSERT INTO sessions (id, user_id, created_at, expires_at) VALUES ($1, $2, $3, $4)"
+	_, err := r.db.ExecContext(ctx, query, session.ID, session.UserID, session.CreatedAt, session.ExpiresAt)
+	return err
+}
+
+// GetSessionByID implements SessionRepository.GetSessionByID
+func (r *PostgresRepository) GetSessionByID(ctx context.Context, id string) (*models.Session, error) {
+	query := "SELECT id, user_id, created_at, expires_at, revoked_at FROM sessions WHERE id = $1"
+	row := r.db.QueryRowContext(ctx, query, id)
+
+	var session models.Session
+	err := row.Scan(&session.ID, &session.UserID, &session.CreatedAt, &session.ExpiresAt, &session.RevokedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// RevokeSession implements SessionRepository.RevokeSession
+func (r *PostgresRepository) RevokeSession(ctx context.Context, id string) error {
+	query := "UPDATE sessions SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL"
+	_, err := r.db.ExecContext(ctx, query, time.Now(), id)
+	return err
+}
+
 // CreateDirectConversation implements ConversationRepository.CreateDirectConversation
 func (r *PostgresRepository) CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, error) {
 	// Check if a direct conversation already exists between these users
-	log.Print("Users", userID1, userID2)
+	slog.DebugContext(ctx, "Looking up direct conversation", "user_id", userID1, "other_id", userID2)
 	query := `
 		    SELECT 
         		conversation_id
@@ -229,7 +295,7 @@ func (r *PostgresRepository) CreateDirectConversation(ctx context.Context, userI
 	err := row.Scan(&conversationID)
 	if err == nil {
 		// Conversation exists, return it
-		return r.GetConversationByID(ctx, conversationID)
+		return r.GetConversationByID(ctx, conversationID, userID1)
 	} else if !errors.Is(err, sql.ErrNoRows) {
 		// Unexpected error
 		return nil, err
@@ -265,11 +331,11 @@ func (r *PostgresRepository) CreateDirectConversation(ctx context.Context, userI
 		return nil, err
 	}
 
-	return r.GetConversationByID(ctx, id)
+	return r.GetConversationByID(ctx, id, userID1)
 }
 
 // CreateGroupConversation implements ConversationRepository.CreateGroupConversation
-func (r *PostgresRepository) CreateGroupConversation(ctx context.Context, name string, participants []string) (*models.Conversation, error) {
+func (r *PostgresRepository) CreateGroupConversation(ctx context.Context, name string, ownerID string, participants []string) (*models.Conversation, error) {
 	// Start a transaction
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
@@ -286,9 +352,13 @@ func (r *PostgresRepository) CreateGroupConversation(ctx context.Context, name s
 	}
 
 	// Add participants
-	insertPartQuery := "INSERT INTO conversation_participants (conversation_id, user_id) VALUES ($1, $2)"
+	insertPartQuery := "INSERT INTO conversation_participants (conversation_id, user_id, role) VALUES ($1, $2, $3)"
 	for _, userID := range participants {
-		_, err = tx.ExecContext(ctx, insertPartQuery, id, userID)
+		role := models.RoleMember
+		if userID == ownerID {
+			role = models.RoleOwner
+		}
+		_, err = tx.ExecContext(ctx, insertPartQuery, id, userID, role)
 		if err != nil {
 			return nil, err
 		}
@@ -298,19 +368,23 @@ func (r *PostgresRepository) CreateGroupConversation(ctx context.Context, name s
 		return nil, err
 	}
 
-	return r.GetConversationByID(ctx, id)
+	return r.GetConversationByID(ctx, id, ownerID)
 }
 
 // GetConversationByID implements ConversationRepository.GetConversationByID
-func (r *PostgresRepository) GetConversationByID(ctx context.Context, id string) (*models.Conversation, error) {
+func (r *PostgresRepository) GetConversationByID(ctx context.Context, id string, viewerID string) (*models.Conversation, error) {
 	// Get conversation details
-	convQuery := "SELECT id, name, type, photo_url FROM conversations WHERE id = $1"
+	convQuery := `
+		SELECT id, name, type, photo_url, add_members_permission, edit_info_permission, send_messages_permission
+		FROM conversations WHERE id = $1
+	`
 	convRow := r.db.QueryRowContext(ctx, convQuery, id)
 
 	var conv models.Conversation
 	var name, photoURL sql.NullString
 	var convType string
-	err := convRow.Scan(&conv.ID, &name, &convType, &photoURL)
+	var policy models.GroupPolicy
+	err := convRow.Scan(&conv.ID, &name, &convType, &photoURL, &policy.AddMembers, &policy.EditInfo, &policy.SendMessages)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -325,9 +399,18 @@ func (r *PostgresRepository) GetConversationByID(ctx context.Context, id string)
 		conv.PhotoURL = photoURL.String
 	}
 	conv.Type = models.ConversationType(convType)
+	if conv.Type == models.GroupConversation {
+		conv.Policy = &policy
+	}
 
 	// Get participants
-	partQuery := "SELECT cp.user_id, u.name, u.photo_url FROM conversation_participants cp JOIN users u ON u.id = cp.user_id  WHERE cp.conversation_id = $1"
+	partQuery := `
+		SELECT cp.user_id, u.name, u.photo_url, cp.role
+		FROM conversation_participants cp
+		JOIN users u ON u.id = cp.user_id
+		WHERE cp.conversation_id = $1
+		ORDER BY cp.joined_at ASC, cp.user_id ASC
+	`
 	partRows, err := r.db.QueryContext(ctx, partQuery, id)
 	if err != nil {
 		return nil, err
@@ -338,7 +421,8 @@ func (r *PostgresRepository) GetConversationByID(ctx context.Context, id string)
 		var userID string
 		var userName string
 		var photo_url sql.NullString
-		if err := partRows.Scan(&userID,&userName, &photo_url); err != nil {
+		var role models.ParticipantRole
+		if err := partRows.Scan(&userID,&userName, &photo_url, &role); err != nil {
 			return nil, err
 		}
 		
@@ -351,6 +435,7 @@ func (r *PostgresRepository) GetConversationByID(ctx context.Context, id string)
             ID:   userID,
             Name: userName,
 			PhotoURL: userPhotoUrl,
+			Role:     role,
         })
 
 	}
@@ -358,17 +443,13 @@ func (r *PostgresRepository) GetConversationByID(ctx context.Context, id string)
 		return nil, err
 	}
 
-	// Get messages
-	messages, err := r.GetMessagesByConversationID(ctx, id)
+	// Get the last message only; the history is paginated separately
+	lastMessages, err := r.GetMessagesPage(ctx, id, viewerID, nil, 1)
 	if err != nil {
 		return nil, err
 	}
-	conv.Messages = messages
-
-	// Set the last message if there are any messages
-	if len(messages) > 0 {
-		lastMsg := messages[len(messages)-1]  // Assuming messages are ordered by timestamp desc
-		conv.LastMessage = &lastMsg
+	if len(lastMessages) > 0 {
+		conv.LastMessage = &lastMessages[0]
 	}
 
 	// If this is a direct conversation and has no name, set the name to the other user's name
@@ -376,7 +457,7 @@ func (r *PostgresRepository) GetConversationByID(ctx context.Context, id string)
 		// Find the other user in the conversation
 		var otherUserID string
 		for _, participant := range conv.Participants {
-			if participant.ID != ctx.Value("userID").(string) {
+			if participant.ID != viewerID {
 				otherUserID = participant.ID
 				break
 			}
@@ -417,7 +498,7 @@ func (r *PostgresRepository) GetConversationsByUserID(ctx context.Context, userI
 			return nil, err
 		}
 
-		conv, err := r.GetConversationByID(ctx, convID)
+		conv, err := r.GetConversationByID(ctx, convID, userID)
 		if err != nil {
 			return nil, err
 		}
@@ -439,11 +520,14 @@ func (r *PostgresRepository) AddUserToGroup(ctx context.Context, groupID, userID
 	convQuery := "SELECT type FROM conversations WHERE id = $1"
 	var convType string
 	err := r.db.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.NewError(models.ErrNotFound, "conversation not found")
+	}
 	if err != nil {
 		return err
 	}
 	if convType != string(models.GroupConversation) {
-		return errors.New("conversation is not a group")
+		return models.NewError(models.ErrValidation, "conversation is not a group")
 	}
 
 	// Check if user is already in the group
@@ -454,7 +538,7 @@ func (r *PostgresRepository) AddUserToGroup(ctx context.Context, groupID, userID
 		return err
 	}
 	if count > 0 {
-		return errors.New("user is already in the group")
+		return models.NewError(models.ErrConflict, "user is already in the group")
 	}
 
 	// Add user to the group
@@ -469,98 +553,174 @@ func (r *PostgresRepository) RemoveUserFromGroup(ctx context.Context, groupID, u
 	convQuery := "SELECT type FROM conversations WHERE id = $1"
 	var convType string
 	err := r.db.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.NewError(models.ErrNotFound, "conversation not found")
+	}
 	if err != nil {
 		return err
 	}
 	if convType != string(models.GroupConversation) {
-		return errors.New("conversation is not a group")
+		return models.NewError(models.ErrValidation, "conversation is not a group")
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
 	// Remove user from the group
-	deleteQuery := "DELETE FROM conversation_participants WHERE conversation_id = $1 AND user_id = $2"
-	result, err := r.db.ExecContext(ctx, deleteQuery, groupID, userID)
+	var role models.ParticipantRole
+	deleteQuery := "DELETE FROM conversation_participants WHERE conversation_id = $1 AND user_id = $2 RETURNING role"
+	if err := tx.QueryRowContext(ctx, deleteQuery, groupID, userID).Scan(&role); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.NewError(models.ErrNotFound, "user is not in the group")
+		}
+		return err
+	}
+
+	// A group keeps an owner for as long as it has members
+	if role == models.RoleOwner {
+		successorQuery := `
+			UPDATE conversation_participants SET role = 'owner'
+			WHERE conversation_id = $1 AND user_id = (
+				SELECT user_id FROM conversation_participants
+				WHERE conversation_id = $1
+				ORDER BY CASE role WHEN 'admin' THEN 0 ELSE 1 END, joined_at ASC, user_id ASC
+				LIMIT 1
+			)
+		`
+		if _, err := tx.ExecContext(ctx, successorQuery, groupID); err != nil {
+			return err
+		}
+	}
+
+	// A former member no longer holds back the read status of messages they never read
+	receiptsQuery := `
+		DELETE FROM message_receipts
+		WHERE user_id = $1 AND read_at IS NULL
+		AND message_id IN (SELECT id FROM messages WHERE conversation_id = $2)
+	`
+	if _, err := tx.ExecContext(ctx, receiptsQuery, userID, groupID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetParticipantRole implements ConversationRepository.SetParticipantRole
+func (r *PostgresRepository) SetParticipantRole(ctx context.Context, groupID, userID string, role models.ParticipantRole) error {
+	// Check if the conversation is a group
+	convQuery := "SELECT type FROM conversations WHERE id = $1"
+	var convType string
+	err := r.db.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.NewError(models.ErrNotFound, "conversation not found")
+	}
+	if err != nil {
+		return err
+	}
+	if convType != string(models.GroupConversation) {
+		return models.NewError(models.ErrValidation, "conversation is not a group")
+	}
+
+	updateQuery := "UPDATE conversation_participants SET role = $1 WHERE conversation_id = $2 AND user_id = $3"
+	result, err := r.db.ExecContext(ctx, updateQuery, role, groupID, userID)
 	if err != nil {
 		return err
 	}
 
-	// Check if any rows were affected
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
 	if rowsAffected == 0 {
-		return errors.New("user is not in the group")
+		return models.NewError(models.ErrNotFound, "user is not in the group")
 	}
 
 	return nil
 }
 
-// UpdateGroupName implements ConversationRepository.UpdateGroupName
-func (r *PostgresRepository) UpdateGroupName(ctx context.Context, groupID, name string) error {
+// UpdateGroupPolicy implements ConversationRepository.UpdateGroupPolicy
+func (r *PostgresRepository) UpdateGroupPolicy(ctx context.Context, groupID string, policy models.GroupPolicy) error {
 	// Check if the conversation is a group
 	convQuery := "SELECT type FROM conversations WHERE id = $1"
 	var convType string
 	err := r.db.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.NewError(models.ErrNotFound, "conversation not found")
+	}
 	if err != nil {
 		return err
 	}
 	if convType != string(models.GroupConversation) {
-		return errors.New("conversation is not a group")
+		return models.NewError(models.ErrValidation, "conversation is not a group")
 	}
 
-	// Update the group name
-	updateQuery := "UPDATE conversations SET name = $1 WHERE id = $2"
-	_, err = r.db.ExecContext(ctx, updateQuery, name, groupID)
+	updateQuery := `
+		UPDATE conversations
+		SET add_members_permission = $1, edit_info_permission = $2, send_messages_permission = $3
+		WHERE id = $4
+	`
+	_, err = r.db.ExecContext(ctx, updateQuery, policy.AddMembers, policy.EditInfo, policy.SendMessages, groupID)
 	return err
 }
 
-// SaveGroupPhoto implements ConversationRepository.SaveGroupPhoto
-func (r *PostgresRepository) SaveGroupPhoto(ctx context.Context, groupID string, photo multipart.File) (string, error) {
+// UpdateGroupName implements ConversationRepository.UpdateGroupName
+func (r *PostgresRepository) UpdateGroupName(ctx context.Context, groupID, name string) error {
 	// Check if the conversation is a group
 	convQuery := "SELECT type FROM conversations WHERE id = $1"
 	var convType string
 	err := r.db.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.NewError(models.ErrNotFound, "conversation not found")
+	}
 	if err != nil {
-		return "", err
+		return err
 	}
 	if convType != string(models.GroupConversation) {
-		return "", errors.New("conversation is not a group")
+		return models.NewError(models.ErrValidation, "conversation is not a group")
 	}
 
-	// Create group photos directory if it doesn't exist
-	groupPhotosDir := filepath.Join(r.uploadPath, "group_photos")
-	if err := os.MkdirAll(groupPhotosDir, 0755); err != nil {
-		return "", err
-	}
-
-	// Generate a unique filename
-	filename := fmt.Sprintf("%s_%d.jpg", groupID, time.Now().Unix())
-	filepath := filepath.Join(groupPhotosDir, filename)
+	// Update the group name
+	updateQuery := "UPDATE conversations SET name = $1 WHERE id = $2"
+	_, err = r.db.ExecContext(ctx, updateQuery, name, groupID)
+	return err
+}
 
-	// Save the file
-	dst, err := os.Create(filepath)
+// SetGroupPhoto implements ConversationRepository.SetGroupPhoto
+func (r *PostgresRepository) SetGroupPhoto(ctx context.Context, groupID string, key string) error {
+	// Check if the conversation is a group
+	convQuery := "SELECT type FROM conversations WHERE id = $1"
+	var convType string
+	err := r.db.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.NewError(models.ErrNotFound, "conversation not found")
+	}
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer dst.Close()
-
-	if _, err = io.Copy(dst, photo); err != nil {
-		return "", err
+	if convType != string(models.GroupConversation) {
+		return models.NewError(models.ErrValidation, "conversation is not a group")
 	}
 
-	// Update the group's photo URL in the database
-	relativePath := fmt.Sprintf("/uploads/group_photos/%s", filename)
 	query := "UPDATE conversations SET photo_url = $1 WHERE id = $2"
-	_, err = r.db.ExecContext(ctx, query, relativePath, groupID)
-	if err != nil {
-		return "", err
-	}
-
-	return relativePath, nil
+	_, err = r.db.ExecContext(ctx, query, key, groupID)
+	return err
 }
 
 // CreateMessage implements MessageRepository.CreateMessage
 func (r *PostgresRepository) CreateMessage(ctx context.Context, msg models.Message, conversationID string) (*models.Message, error) {
+	msg.ConversationID = conversationID
+	created, err := r.CreateMessages(ctx, []models.Message{msg})
+	if err != nil {
+		return nil, err
+	}
+	return &created[0], nil
+}
+
+// CreateMessages implements MessageRepository.CreateMessages
+func (r *PostgresRepository) CreateMessages(ctx context.Context, messages []models.Message) ([]models.Message, error) {
 	// Start a transaction
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
@@ -568,9 +728,26 @@ func (r *PostgresRepository) CreateMessage(ctx context.Context, msg models.Messa
 	}
 	defer tx.Rollback()
 
+	created := make([]models.Message, len(messages))
+	for i, msg := range messages {
+		if err := insertMessage(ctx, tx, &msg); err != nil {
+			return nil, err
+		}
+		created[i] = msg
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+// insertMessage stores a message within a transaction, filling in its ID and timestamp if missing
+func insertMessage(ctx context.Context, tx *sql.Tx, msg *models.Message) error {
 	// If no ID provided, generate one
-	if msg.ConversationID == "" {
-		msg.ConversationID = uuid.New().String()
+	if msg.ID == "" {
+		msg.ID = uuid.New().String()
 	}
 
 	// If no timestamp provided, use current time
@@ -578,103 +755,322 @@ func (r *PostgresRepository) CreateMessage(ctx context.Context, msg models.Messa
 		msg.Timestamp = time.Now()
 	}
 
+	var forwardedFrom, forwardedFromSender *string
+	forwardCount := 0
+	if msg.ForwardedFrom != nil {
+		if msg.ForwardedFrom.MessageID != "" {
+			forwardedFrom = &msg.ForwardedFrom.MessageID
+		}
+		if msg.ForwardedFrom.Sender.ID != "" {
+			forwardedFromSender = &msg.ForwardedFrom.Sender.ID
+		}
+		forwardCount = msg.ForwardedFrom.ForwardCount
+	}
+
+	var attachmentName, attachmentType, attachmentThumbnail *string
+	var attachmentSize *int64
+	var attachmentDuration *float64
+	if a := msg.Attachment; a != nil {
+		attachmentName, attachmentType, attachmentSize = &a.FileName, &a.MimeType, &a.Size
+		if a.Duration > 0 {
+			attachmentDuration = &a.Duration
+		}
+		if a.Thumbnail != "" {
+			attachmentThumbnail = &a.Thumbnail
+		}
+	}
+
 	// Insert the message
 	msgQuery := `
-		INSERT INTO messages (id, sender_id, conversation_id, content, type, status, reply_to, timestamp)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		INSERT INTO messages (id, sender_id, conversation_id, content, type, status, reply_to, timestamp, forwarded_from, forwarded_from_sender, forward_count,
+			caption, attachment_name, attachment_type, attachment_size, attachment_duration, attachment_thumbnail)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
 	`
-	_, err = tx.ExecContext(ctx, msgQuery, msg.ConversationID, msg.Sender.ID, conversationID, msg.Content, msg.Type, msg.Status, msg.ReplyTo, msg.Timestamp)
+	_, err := tx.ExecContext(ctx, msgQuery, msg.ID, msg.Sender.ID, msg.ConversationID, msg.Content, msg.Type, msg.Status, msg.ReplyTo, msg.Timestamp,
+		forwardedFrom, forwardedFromSender, forwardCount,
+		msg.Caption, attachmentName, attachmentType, attachmentSize, attachmentDuration, attachmentThumbnail)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	// Open a pending receipt for every other participant
+	receiptsQuery := `
+		INSERT INTO message_receipts (message_id, user_id)
+		SELECT $1, user_id FROM conversation_participants
+		WHERE conversation_id = $2 AND user_id <> $3
+	`
+	_, err = tx.ExecContext(ctx, receiptsQuery, msg.ID, msg.ConversationID, msg.Sender.ID)
+	if err != nil {
+		return err
 	}
 
 	// Update the last activity timestamp of the conversation
 	updateConvQuery := "UPDATE conversations SET last_activity = $1 WHERE id = $2"
-	_, err = tx.ExecContext(ctx, updateConvQuery, msg.Timestamp, conversationID)
+	_, err = tx.ExecContext(ctx, updateConvQuery, msg.Timestamp, msg.ConversationID)
+	return err
+}
+
+// messageColumns selects a message with its sender, the message it replies to, the origin of a forward
+// and its attachment. Rows selected with it are read by scanMessage.
+const messageColumns = `
+	m.id, m.conversation_id, m.sender_id, u.name, u.photo_url, m.content, m.type, ` + messageStatusColumn + `,
+	m.reply_to, m.timestamp, m.edited_at, m.deleted_at,
+	rm.sender_id, ru.name, ru.photo_url, rm.type, rm.content, rm.deleted_at, rm.attachment_name,
+	m.forwarded_from, m.forwarded_from_sender, fu.name, fu.photo_url, m.forward_count,
+	m.caption, m.attachment_name, m.attachment_type, m.attachment_size, m.attachment_duration, m.attachment_thumbnail
+`
+
+// messageJoins are the tables messageColumns selects from
+const messageJoins = `
+	FROM messages m
+	INNER JOIN users u ON m.sender_id = u.id
+	LEFT JOIN messages rm ON rm.id = m.reply_to
+	LEFT JOIN users ru ON ru.id = rm.sender_id
+	LEFT JOIN users fu ON fu.id = m.forwarded_from_sender
+`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMessage reads a row selected with messageColumns
+func scanMessage(row rowScanner) (models.Message, error) {
+	var msg models.Message
+	var photoURL sql.NullString // Handle potential NULL photo_url
+	var replySenderID, replySenderName, replySenderPhotoURL, replyType, replyContent sql.NullString
+	var replyDeletedAt *time.Time
+	var replyAttachmentName sql.NullString
+	var forwardedFrom, forwardedSenderID, forwardedSenderName, forwardedSenderPhotoURL sql.NullString
+	var forwardCount int
+	var attachmentName, attachmentType, attachmentThumbnail sql.NullString
+	var attachmentSize sql.NullInt64
+	var attachmentDuration sql.NullFloat64
+
+	if err := row.Scan(
+		&msg.ID,                  // m.id
+		&msg.ConversationID,      // m.conversation_id
+		&msg.Sender.ID,           // m.sender_id (User.ID)
+		&msg.Sender.Name,         // u.name (User.Name)
+		&photoURL,                // u.photo_url (User.PhotoURL)
+		&msg.Content,             // m.content
+		&msg.Type,                // m.type
+		&msg.Status,              // m.status
+		&msg.ReplyTo,             // m.reply_to
+		&msg.Timestamp,           // m.timestamp
+		&msg.EditedAt,            // m.edited_at
+		&msg.DeletedAt,           // m.deleted_at
+		&replySenderID,           // rm.sender_id
+		&replySenderName,         // ru.name
+		&replySenderPhotoURL,     // ru.photo_url
+		&replyType,               // rm.type
+		&replyContent,            // rm.content
+		&replyDeletedAt,          // rm.deleted_at
+		&replyAttachmentName,     // rm.attachment_name
+		&forwardedFrom,           // m.forwarded_from
+		&forwardedSenderID,       // m.forwarded_from_sender
+		&forwardedSenderName,     // fu.name
+		&forwardedSenderPhotoURL, // fu.photo_url
+		&forwardCount,            // m.forward_count
+		&msg.Caption,             // m.caption
+		&attachmentName,          // m.attachment_name
+		&attachmentType,          // m.attachment_type
+		&attachmentSize,          // m.attachment_size
+		&attachmentDuration,      // m.attachment_duration
+		&attachmentThumbnail,     // m.attachment_thumbnail
+	); err != nil {
+		return msg, err
+	}
+
+	// Handle nullable photo URL
+	if photoURL.Valid {
+		msg.Sender.PhotoURL = photoURL.String
+	}
+
+	if attachmentName.Valid {
+		msg.Attachment = &models.Attachment{
+			FileName:  attachmentName.String,
+			MimeType:  attachmentType.String,
+			Size:      attachmentSize.Int64,
+			Duration:  attachmentDuration.Float64,
+			Thumbnail: attachmentThumbnail.String,
+		}
+	}
+
+	if msg.ReplyTo != nil && replyType.Valid {
+		replied := &models.Message{
+			ID:        *msg.ReplyTo,
+			Sender:    models.User{ID: replySenderID.String, Name: replySenderName.String, PhotoURL: replySenderPhotoURL.String},
+			Type:      models.MessageType(replyType.String),
+			Content:   replyContent.String,
+			DeletedAt: replyDeletedAt,
+		}
+		if replyAttachmentName.Valid {
+			replied.Attachment = &models.Attachment{FileName: replyAttachmentName.String}
+		}
+		msg.ReplyPreview = models.NewReplyPreview(replied)
+	}
+
+	if forwardCount > 0 {
+		msg.ForwardedFrom = &models.ForwardedFrom{
+			MessageID:    forwardedFrom.String,
+			Sender:       models.User{ID: forwardedSenderID.String, Name: forwardedSenderName.String, PhotoURL: forwardedSenderPhotoURL.String},
+			ForwardCount: forwardCount,
+		}
+	}
+
+	return msg, nil
+}
+
+// GetMessagesPage implements MessageRepository.GetMessagesPage
+func (r *PostgresRepository) GetMessagesPage(ctx context.Context, conversationID, viewerID string, before *models.MessageCursor, limit int) ([]models.Message, error) {
+	return r.messagesPage(ctx, "m.conversation_id = $1", conversationID, viewerID, before, limit)
+}
+
+// GetReplies implements MessageRepository.GetReplies
+func (r *PostgresRepository) GetReplies(ctx context.Context, messageID, viewerID string, before *models.MessageCursor, limit int) ([]models.Message, error) {
+	return r.messagesPage(ctx, "m.reply_to = $1", messageID, viewerID, before, limit)
+}
+
+// messagesPage pages through the messages matching a condition on $1, newest first
+func (r *PostgresRepository) messagesPage(ctx context.Context, condition string, arg interface{}, viewerID string, before *models.MessageCursor, limit int) ([]models.Message, error) {
+	// Keyset pagination on (timestamp, id) so that pages stay stable while new messages arrive
+	query := "SELECT " + messageColumns + messageJoins + " WHERE " + condition
+	args := []interface{}{arg}
+	if viewerID != "" {
+		args = append(args, viewerID)
+		query += fmt.Sprintf(" AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message_id = m.id AND h.user_id = $%d)", len(args))
+	}
+	if before != nil {
+		args = append(args, before.Timestamp, before.ID)
+		query += fmt.Sprintf(" AND (m.timestamp, m.id) < ($%d, $%d)", len(args)-1, len(args))
+	}
+	query += fmt.Sprintf(" ORDER BY m.timestamp DESC, m.id DESC LIMIT $%d", len(args)+1)
+	args = append(args, limit)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	if err := tx.Commit(); err != nil {
+	var messages []models.Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return &msg, nil
+	if err := r.attachReactions(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
 }
 
-// GetMessagesByConversationID implements MessageRepository.GetMessagesByConversationID
-func (r *PostgresRepository) GetMessagesByConversationID(ctx context.Context, conversationID string) ([]models.Message, error) {
-	// Get messages with user information
+// headlineOptions configures the snippets built by ts_headline, delimiting matches
+// so that they can be highlighted once the text has been escaped
+var headlineOptions = fmt.Sprintf(`StartSel="%s", StopSel="%s", MaxWords=30, MinWords=10, MaxFragments=2, FragmentDelimiter=" … "`,
+	search.StartSel, search.StopSel)
+
+// SearchMessages implements MessageRepository.SearchMessages
+func (r *PostgresRepository) SearchMessages(ctx context.Context, s models.MessageSearch) ([]models.SearchResult, error) {
 	query := `
-		SELECT m.id, m.conversation_id, m.sender_id, u.name, u.photo_url, m.content, m.type, m.status, m.reply_to, m.timestamp, m.deleted_at
+		SELECT m.id, m.conversation_id, m.sender_id, u.name, u.photo_url, m.timestamp,
+			ts_headline('simple', m.content, q.query, $3)
 		FROM messages m
+		INNER JOIN conversation_participants cp ON cp.conversation_id = m.conversation_id AND cp.user_id = $1
 		INNER JOIN users u ON m.sender_id = u.id
-		WHERE m.conversation_id = $1
-		ORDER BY m.timestamp ASC
+		CROSS JOIN websearch_to_tsquery('simple', $2) AS q(query)
+		WHERE m.search_vector @@ q.query AND m.deleted_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message_id = m.id AND h.user_id = $1)
 	`
-	
-	rows, err := r.db.QueryContext(ctx, query, conversationID)
+	args := []interface{}{s.UserID, s.Query, headlineOptions}
+	if s.ConversationID != "" {
+		args = append(args, s.ConversationID)
+		query += fmt.Sprintf(" AND m.conversation_id = $%d", len(args))
+	}
+	if s.SenderID != "" {
+		args = append(args, s.SenderID)
+		query += fmt.Sprintf(" AND m.sender_id = $%d", len(args))
+	}
+	if s.Before != nil {
+		args = append(args, s.Before.Timestamp, s.Before.ID)
+		query += fmt.Sprintf(" AND (m.timestamp, m.id) < ($%d, $%d)", len(args)-1, len(args))
+	}
+	args = append(args, s.Limit)
+	query += fmt.Sprintf(" ORDER BY m.timestamp DESC, m.id DESC LIMIT $%d", len(args))
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var messages []models.Message
+	var results []models.SearchResult
 	for rows.Next() {
-		var msg models.Message
-		var photoURL sql.NullString // Handle potential NULL photo_url
-
-		
-		if err := rows.Scan(   
-			&msg.ID,                    // m.id              
-			&msg.ConversationID,        // m.conversation_id
-			&msg.Sender.ID,             // m.sender_id (User.ID)
-			&msg.Sender.Name,           // u.name (User.Name)
-			&photoURL,                  // u.photo_url (User.PhotoURL)
-			&msg.Content,               // m.content
-			&msg.Type,                  // m.type
-			&msg.Status,                // m.status
-			&msg.ReplyTo,                   // m.reply_to
-			&msg.Timestamp,             // m.timestamp
-			&msg.DeletedAt,             // m.deleted_at
-		); err != nil {
+		var result models.SearchResult
+		var photoURL sql.NullString
+		var headline string
+		if err := rows.Scan(&result.MessageID, &result.ConversationID, &result.Sender.ID, &result.Sender.Name,
+			&photoURL, &result.Timestamp, &headline); err != nil {
 			return nil, err
 		}
+		result.Sender.PhotoURL = photoURL.String
+		result.Snippet = search.FromDelimited(headline)
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-		// Handle nullable photo URL
-		if photoURL.Valid {
-			msg.Sender.PhotoURL = photoURL.String
-		}
+	return results, nil
+}
 
-		reactions, err := r.GetReactionsByMessageID(ctx, msg.ID)
-		if err != nil {
-			return nil, err
-		}
-		msg.Reactions = reactions
+// attachReactions loads the reactions of a batch of messages with a single query
+func (r *PostgresRepository) attachReactions(ctx context.Context, messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
 
+	ids := make([]string, len(messages))
+	index := make(map[string]int, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+		index[msg.ID] = i
+	}
 
-		messages = append(messages, msg)
+	query := "SELECT message_id, user_id, emoji FROM reactions WHERE message_id = ANY($1)"
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return err
 	}
+	defer rows.Close()
 
-	if err := rows.Err(); err != nil {
-		return nil, err
+	for rows.Next() {
+		var reaction models.Reaction
+		if err := rows.Scan(&reaction.MessageID, &reaction.UserID, &reaction.Emoji); err != nil {
+			return err
+		}
+		i := index[reaction.MessageID]
+		messages[i].Reactions = append(messages[i].Reactions, reaction)
 	}
 
-	return messages, nil
+	return rows.Err()
 }
+
 // GetMessageByID implements MessageRepository.GetMessageByID
 func (r *PostgresRepository) GetMessageByID(ctx context.Context, id string) (*models.Message, error) {
-	query := `
-		SELECT m.id, m.sender_id, u.name, m.content, m.type, m.status, m.reply_to, m.timestamp, m.conversation_id
-		FROM messages m
-		INNER JOIN users u ON m.sender_id = u.id
-		WHERE m.id = $1 
-	`
+	query := "SELECT " + messageColumns + messageJoins + " WHERE m.id = $1"
 	row := r.db.QueryRowContext(ctx, query, id)
 
-	var msg models.Message
-	var conversationID sql.NullString
-	err := row.Scan(&msg.ConversationID, &msg.Sender.ID, &msg.Sender.Name, &msg.Content, &msg.Type, &msg.Status, &msg.ReplyTo, &msg.Timestamp, &conversationID)
+	msg, err := scanMessage(row)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -686,56 +1082,166 @@ func (r *PostgresRepository) GetMessageByID(ctx context.Context, id string) (*mo
 }
 
 // DeleteMessage implements MessageRepository.DeleteMessage
-func (r *PostgresRepository) DeleteMessage(ctx context.Context, id string) error {
-	// Soft delete by setting the deleted_at timestamp
-	query := "UPDATE messages SET deleted_at = $1 WHERE id = $2"
-	_, err := r.db.ExecContext(ctx, query, time.Now(), id)
+func (r *PostgresRepository) DeleteMessage(ctx context.Context, id string) (string, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var msgType models.MessageType
+	var content string
+	err = tx.QueryRowContext(ctx, "SELECT type, content FROM messages WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id).Scan(&msgType, &content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Soft delete by setting the deleted_at timestamp, leaving a tombstone without content
+	query := `
+		UPDATE messages SET deleted_at = $1, content = '', caption = '',
+			attachment_name = NULL, attachment_type = NULL, attachment_size = NULL, attachment_duration = NULL, attachment_thumbnail = NULL
+		WHERE id = $2
+	`
+	if _, err := tx.ExecContext(ctx, query, time.Now(), id); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM message_revisions WHERE message_id = $1", id); err != nil {
+		return "", err
+	}
+
+	// Forwarded copies of a photo or file, and identical uploads, share its blob
+	shared := false
+	if msgType != models.TextMessage {
+		sharedQuery := "SELECT EXISTS (SELECT 1 FROM messages WHERE type <> 'text' AND content = $1 AND deleted_at IS NULL)"
+		if err := tx.QueryRowContext(ctx, sharedQuery, content).Scan(&shared); err != nil {
+			return "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	if msgType == models.TextMessage || shared {
+		return "", nil
+	}
+	return content, nil
+}
+
+// HideMessage implements MessageRepository.HideMessage
+func (r *PostgresRepository) HideMessage(ctx context.Context, messageID, userID string) error {
+	query := "INSERT INTO hidden_messages (user_id, message_id, hidden_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
+	_, err := r.db.ExecContext(ctx, query, userID, messageID, time.Now())
 	return err
 }
 
-// UpdateMessageStatus implements MessageRepository.UpdateMessageStatus
-func (r *PostgresRepository) UpdateMessageStatus(ctx context.Context, id string, status models.MessageStatus) error {
-	query := "UPDATE messages SET status = $1 WHERE id = $2"
-	_, err := r.db.ExecContext(ctx, query, status, id)
+// MarkMessagesReceived implements MessageRepository.MarkMessagesReceived
+func (r *PostgresRepository) MarkMessagesReceived(ctx context.Context, conversationID, userID string, upTo models.MessageCursor) error {
+	query := `
+		UPDATE message_receipts SET received_at = $1
+		WHERE user_id = $2 AND received_at IS NULL AND message_id IN (
+			SELECT id FROM messages WHERE conversation_id = $3 AND (timestamp, id) <= ($4, $5)
+		)
+	`
+	_, err := r.db.ExecContext(ctx, query, time.Now(), userID, conversationID, upTo.Timestamp, upTo.ID)
 	return err
 }
 
-// UpdateMessageStatus implements MessageRepository.UpdateMessageStatus
-func (r *PostgresRepository) UpdateMessageContent(ctx context.Context, id string, content string) error {
-	query := "UPDATE messages SET content = $1 WHERE id = $2"
-	_, err := r.db.ExecContext(ctx, query, content, id)
+// MarkMessagesRead implements MessageRepository.MarkMessagesRead
+func (r *PostgresRepository) MarkMessagesRead(ctx context.Context, conversationID, userID string, upTo models.MessageCursor) error {
+	query := `
+		UPDATE message_receipts SET read_at = $1, received_at = COALESCE(received_at, $1)
+		WHERE user_id = $2 AND read_at IS NULL AND message_id IN (
+			SELECT id FROM messages WHERE conversation_id = $3 AND (timestamp, id) <= ($4, $5)
+		)
+	`
+	_, err := r.db.ExecContext(ctx, query, time.Now(), userID, conversationID, upTo.Timestamp, upTo.ID)
 	return err
 }
 
+// GetMessageReceipts implements MessageRepository.GetMessageReceipts
+func (r *PostgresRepository) GetMessageReceipts(ctx context.Context, messageID string) ([]models.Receipt, error) {
+	query := `
+		SELECT mr.message_id, mr.user_id, u.name, mr.received_at, mr.read_at
+		FROM message_receipts mr
+		INNER JOIN users u ON mr.user_id = u.id
+		WHERE mr.message_id = $1
+		ORDER BY mr.read_at ASC NULLS LAST, mr.received_at ASC NULLS LAST, u.name ASC
+	`
+	rows, err := r.db.QueryContext(ctx, query, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-// SaveMessagePhoto implements MessageRepository.SaveMessagePhoto
-func (r *PostgresRepository) SaveMessagePhoto(ctx context.Context, senderID string, photo multipart.File) (string, error) {
-	// Create message photos directory if it doesn't exist
-	msgPhotosDir := filepath.Join(r.uploadPath, "message_photos")
-	if err := os.MkdirAll(msgPhotosDir, 0755); err != nil {
-		return "", err
+	var receipts []models.Receipt
+	for rows.Next() {
+		var receipt models.Receipt
+		if err := rows.Scan(&receipt.MessageID, &receipt.UserID, &receipt.UserName, &receipt.ReceivedAt, &receipt.ReadAt); err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	// Generate a unique filename
-	filename := fmt.Sprintf("%s_%d.jpg", senderID, time.Now().Unix())
-	filepath := filepath.Join(msgPhotosDir, filename)
+	return receipts, nil
+}
 
-	// Save the file
-	dst, err := os.Create(filepath)
+// UpdateMessageContent implements MessageRepository.UpdateMessageContent
+func (r *PostgresRepository) UpdateMessageContent(ctx context.Context, id string, content string, editedAt time.Time) error {
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer dst.Close()
+	defer tx.Rollback()
 
-	if _, err = io.Copy(dst, photo); err != nil {
-		return "", err
+	// Keep the current content, stamped with the time it was written, before replacing it
+	revisionQuery := `
+		INSERT INTO message_revisions (message_id, content, written_at)
+		SELECT id, content, COALESCE(edited_at, timestamp) FROM messages WHERE id = $1
+	`
+	if _, err := tx.ExecContext(ctx, revisionQuery, id); err != nil {
+		return err
+	}
+
+	query := "UPDATE messages SET content = $1, edited_at = $2 WHERE id = $3"
+	if _, err := tx.ExecContext(ctx, query, content, editedAt, id); err != nil {
+		return err
 	}
 
-	// Return the relative path to the file
-	relativePath := fmt.Sprintf("/uploads/message_photos/%s", filename)
-	return relativePath, nil
+	return tx.Commit()
 }
 
+// GetMessageRevisions implements MessageRepository.GetMessageRevisions
+func (r *PostgresRepository) GetMessageRevisions(ctx context.Context, messageID string) ([]models.MessageRevision, error) {
+	query := "SELECT content, written_at FROM message_revisions WHERE message_id = $1 ORDER BY id ASC"
+	rows, err := r.db.QueryContext(ctx, query, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []models.MessageRevision
+	for rows.Next() {
+		var revision models.MessageRevision
+		if err := rows.Scan(&revision.Content, &revision.Timestamp); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+
 // AddReaction implements ReactionRepository.AddReaction
 func (r *PostgresRepository) AddReaction(ctx context.Context, messageID, userID, emoji string) error {
 	// Check if reaction already exists
@@ -773,7 +1279,7 @@ func (r *PostgresRepository) RemoveReaction(ctx context.Context, messageID, user
 		return err
 	}
 	if rowsAffected == 0 {
-		return errors.New("reaction not found")
+		return models.NewError(models.ErrNotFound, "reaction not found")
 	}
 
 	return nil
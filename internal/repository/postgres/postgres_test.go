@@ -0,0 +1,132 @@
+package postgres_test
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+
+	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/repository/postgres"
+	"github.com/fallenkarma/wasatext/internal/repository/repositorytest"
+)
+
+// dsnEnv names a server to test against instead of starting an embedded one.
+// Its user must be allowed to create databases.
+const dsnEnv = "WASATEXT_TEST_POSTGRES_DSN"
+
+var (
+	// serverDSN connects to the maintenance database of the test server
+	serverDSN string
+	// skipReason explains why no test server is available
+	skipReason string
+	databases  atomic.Int64
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	serverDSN = os.Getenv(dsnEnv)
+	if serverDSN == "" {
+		stop, err := startEmbedded()
+		if err != nil {
+			skipReason = fmt.Sprintf("embedded Postgres unavailable (set %s to use an existing server): %v", dsnEnv, err)
+		} else {
+			defer stop()
+		}
+	}
+	return m.Run()
+}
+
+// startEmbedded runs a throwaway Postgres server on a free port
+func startEmbedded() (func(), error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "wasatext-postgres")
+	if err != nil {
+		return nil, err
+	}
+
+	config := embeddedpostgres.DefaultConfig().
+		Port(port).
+		RuntimePath(filepath.Join(dir, "runtime")).
+		DataPath(filepath.Join(dir, "data")).
+		Logger(io.Discard)
+	server := embeddedpostgres.NewDatabase(config)
+	if err := server.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	serverDSN = config.GetConnectionURL() + "?sslmode=disable"
+	return func() {
+		if err := server.Stop(); err != nil {
+			log.Printf("Error stopping embedded Postgres: %v", err)
+		}
+		os.RemoveAll(dir)
+	}, nil
+}
+
+func freePort() (uint32, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return uint32(l.Addr().(*net.TCPAddr).Port), nil
+}
+
+// newDatabase creates an empty database that is dropped when the test ends
+func newDatabase(t *testing.T) string {
+	t.Helper()
+
+	admin, err := sql.Open("postgres", serverDSN)
+	if err != nil {
+		t.Fatalf("connecting to test server: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	name := fmt.Sprintf("wasatext_test_%d_%d", os.Getpid(), databases.Add(1))
+	if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+		t.Fatalf("creating test database: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP DATABASE IF EXISTS " + name + " WITH (FORCE)"); err != nil {
+			t.Errorf("dropping test database: %v", err)
+		}
+	})
+
+	dsn, err := url.Parse(serverDSN)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", dsnEnv, err)
+	}
+	dsn.Path = "/" + name
+	return dsn.String()
+}
+
+func TestConformance(t *testing.T) {
+	if skipReason != "" {
+		t.Skip(skipReason)
+	}
+
+	repositorytest.Run(t, func(t *testing.T) repository.Repository {
+		repo, err := postgres.NewPostgresRepository(newDatabase(t))
+		if err != nil {
+			t.Fatalf("NewPostgresRepository: %v", err)
+		}
+		t.Cleanup(func() { repo.Close() })
+		return repo
+	})
+}
@@ -2,7 +2,7 @@ package repository
 
 import (
 	"context"
-	"mime/multipart"
+	"time"
 
 	"github.com/fallenkarma/wasatext/internal/models"
 )
@@ -11,6 +11,10 @@ import (
 type UserRepository interface {
 	// CreateUser creates a new user with the given name
 	CreateUser(ctx context.Context, name string) (*models.User, error)
+
+	// CreateUserWithPasswordHash creates a new user with a password in a single step.
+	// Unlike CreateUser, it fails with ErrConflict if the name is taken.
+	CreateUserWithPasswordHash(ctx context.Context, name string, hash string) (*models.User, error)
 	
 	// GetUserByID retrieves a user by their ID
 	GetUserByID(ctx context.Context, id string) (*models.User, error)
@@ -21,61 +25,107 @@ type UserRepository interface {
 	// UpdateUsername updates a user's name
 	UpdateUsername(ctx context.Context, userID string, newName string) error
 	
-	// SaveUserPhoto saves a user's profile photo
-	SaveUserPhoto(ctx context.Context, userID string, photo multipart.File) (string, error)
+	// SetUserPhoto stores the blob key of a user's profile photo
+	SetUserPhoto(ctx context.Context, userID string, key string) error
 	
 	// GetAllUsers retrieves all users
 	GetAllUsers(ctx context.Context) ([]models.User, error)
+
+	// GetUserPasswordHash retrieves a user's encoded password hash, or "" if none is set
+	GetUserPasswordHash(ctx context.Context, userID string) (string, error)
+
+	// SetUserPasswordHash stores a user's encoded password hash
+	SetUserPasswordHash(ctx context.Context, userID string, hash string) error
 }
 
 // ConversationRepository defines operations for conversation management
 type ConversationRepository interface {
-	// CreateDirectConversation creates a new direct conversation between two users
+	// CreateDirectConversation creates a new direct conversation between two users,
+	// or returns theirs, as seen by userID1
 	CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, error)
 	
-	// CreateGroupConversation creates a new group conversation
-	CreateGroupConversation(ctx context.Context, name string, participants []string) (*models.Conversation, error)
+	// CreateGroupConversation creates a new group conversation with the default policy.
+	// ownerID must be one of the participants; everyone else joins as a member.
+	// The group is returned as seen by its owner.
+	CreateGroupConversation(ctx context.Context, name string, ownerID string, participants []string) (*models.Conversation, error)
 	
-	// GetConversationByID retrieves a conversation by its ID
-	GetConversationByID(ctx context.Context, id string) (*models.Conversation, error)
+	// GetConversationByID retrieves a conversation's metadata, participants and last message by its ID,
+	// as seen by viewerID: direct conversations are named after the other participant, and
+	// messages the viewer deleted for themselves are not the last message
+	GetConversationByID(ctx context.Context, id string, viewerID string) (*models.Conversation, error)
 	
-	// GetConversationsByUserID retrieves all conversations for a user
+	// GetConversationsByUserID retrieves the metadata of all conversations for a user, most recently active first,
+	// as seen by that user
 	GetConversationsByUserID(ctx context.Context, userID string) ([]models.Conversation, error)
 	
 	// AddUserToGroup adds a user to a group conversation
 	AddUserToGroup(ctx context.Context, groupID, userID string) error
 	
-	// RemoveUserFromGroup removes a user from a group conversation
+	// RemoveUserFromGroup removes a user from a group conversation.
+	// When the owner leaves, ownership passes to the longest-standing admin, or failing that
+	// to the longest-standing member.
 	RemoveUserFromGroup(ctx context.Context, groupID, userID string) error
+
+	// SetParticipantRole changes a group participant's role
+	SetParticipantRole(ctx context.Context, groupID, userID string, role models.ParticipantRole) error
+
+	// UpdateGroupPolicy replaces a group's policy
+	UpdateGroupPolicy(ctx context.Context, groupID string, policy models.GroupPolicy) error
 	
 	// UpdateGroupName updates a group's name
 	UpdateGroupName(ctx context.Context, groupID, name string) error
 	
-	// SaveGroupPhoto saves a group's photo
-	SaveGroupPhoto(ctx context.Context, groupID string, photo multipart.File) (string, error)
+	// SetGroupPhoto stores the blob key of a group's photo
+	SetGroupPhoto(ctx context.Context, groupID string, key string) error
 }
 
 // MessageRepository defines operations for message management
 type MessageRepository interface {
 	// CreateMessage creates a new message
 	CreateMessage(ctx context.Context, msg models.Message, conversationID string) (*models.Message, error)
-	
-	// GetMessagesByConversationID retrieves all messages for a conversation
-	GetMessagesByConversationID(ctx context.Context, conversationID string) ([]models.Message, error)
-	
+
+	// CreateMessages creates several messages, each in its own ConversationID, in a single transaction:
+	// either all of them are stored or none is
+	CreateMessages(ctx context.Context, messages []models.Message) ([]models.Message, error)
+	
+	// GetMessagesPage retrieves up to limit messages of a conversation sent before the cursor
+	// (or the most recent ones when before is nil), ordered from newest to oldest.
+	// Messages the viewer hid for themselves are left out; an empty viewerID hides nothing.
+	GetMessagesPage(ctx context.Context, conversationID, viewerID string, before *models.MessageCursor, limit int) ([]models.Message, error)
+	
+	// GetReplies retrieves up to limit direct replies to a message sent before the cursor,
+	// newest first, leaving out those the viewer hid for themselves
+	GetReplies(ctx context.Context, messageID, viewerID string, before *models.MessageCursor, limit int) ([]models.Message, error)
+
 	// GetMessageByID retrieves a message by its ID
 	GetMessageByID(ctx context.Context, id string) (*models.Message, error)
 	
-	// DeleteMessage marks a message as deleted
-	DeleteMessage(ctx context.Context, id string) error
-	
-	// UpdateMessageStatus updates the status of a message
-	UpdateMessageStatus(ctx context.Context, id string, status models.MessageStatus) error
+	// DeleteMessage deletes a message for everyone: it is marked deleted and its content and
+	// edit history are erased. For a photo, file, audio or video message it returns the blob key of
+	// its file when no other message still uses it, so the caller can remove it; otherwise "".
+	DeleteMessage(ctx context.Context, id string) (string, error)
 
-	UpdateMessageContent(ctx context.Context, id string, content string) error
+	// HideMessage hides a message from one user only
+	HideMessage(ctx context.Context, messageID, userID string) error
 	
-	// SaveMessagePhoto saves a photo message
-	SaveMessagePhoto(ctx context.Context, senderID string, photo multipart.File) (string, error)
+	// MarkMessagesReceived records that the user received every message of the conversation up to the cursor
+	MarkMessagesReceived(ctx context.Context, conversationID, userID string, upTo models.MessageCursor) error
+
+	// MarkMessagesRead records that the user read (and so received) every message of the conversation up to the cursor
+	MarkMessagesRead(ctx context.Context, conversationID, userID string, upTo models.MessageCursor) error
+
+	// GetMessageReceipts retrieves the per-recipient receipts of a message
+	GetMessageReceipts(ctx context.Context, messageID string) ([]models.Receipt, error)
+
+	// UpdateMessageContent replaces the content of a message, keeping the previous content as a revision
+	UpdateMessageContent(ctx context.Context, id string, content string, editedAt time.Time) error
+
+	// GetMessageRevisions retrieves the previous versions of a message's content, oldest first
+	GetMessageRevisions(ctx context.Context, messageID string) ([]models.MessageRevision, error)
+
+	// SearchMessages finds the text messages matching a search, newest first,
+	// leaving out deleted ones and those the user hid
+	SearchMessages(ctx context.Context, search models.MessageSearch) ([]models.SearchResult, error)
 }
 
 // ReactionRepository defines operations for reaction management
@@ -90,10 +140,26 @@ type ReactionRepository interface {
 	GetReactionsByMessageID(ctx context.Context, messageID string) ([]models.Reaction, error)
 }
 
+// SessionRepository defines operations for login session management
+type SessionRepository interface {
+	// CreateSession stores a new session
+	CreateSession(ctx context.Context, session models.Session) error
+
+	// GetSessionByID retrieves a session by its ID, returning nil if it does not exist
+	GetSessionByID(ctx context.Context, id string) (*models.Session, error)
+
+	// RevokeSession marks a session as revoked
+	RevokeSession(ctx context.Context, id string) error
+}
+
 // Repository combines all repository interfaces
 type Repository interface {
 	UserRepository
+	SessionRepository
 	ConversationRepository
 	MessageRepository
 	ReactionRepository
+
+	// Ping checks that the repository can serve requests, such as that its database is reachable
+	Ping(ctx context.Context) error
 }
\ No newline at end of file
@@ -0,0 +1,1416 @@
+// Package repositorytest provides a conformance suite that every
+// repository.Repository implementation must pass, so that storage backends
+// stay interchangeable.
+//
+// A backend runs the suite from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		repositorytest.Run(t, func(t *testing.T) repository.Repository {
+//			return newEmptyRepository(t)
+//		})
+//	}
+package repositorytest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/repository"
+)
+
+// Factory returns a new, empty repository for a single scenario.
+// It should register any cleanup with t.Cleanup.
+type Factory func(t *testing.T) repository.Repository
+
+// scenario is a single conformance check run against a fresh repository
+type scenario struct {
+	name string
+	run  func(t *testing.T, f *fixture)
+}
+
+var scenarios = []scenario{
+	{"Ping", testPing},
+	{"CreateUserIsIdempotentByName", testCreateUserIsIdempotentByName},
+	{"MissingUserIsNil", testMissingUserIsNil},
+	{"UpdateUsernameRejectsTakenName", testUpdateUsernameRejectsTakenName},
+	{"GetAllUsers", testGetAllUsers},
+	{"PasswordHash", testPasswordHash},
+	{"CreateUserWithPasswordHash", testCreateUserWithPasswordHash},
+	{"SetUserPhoto", testSetUserPhoto},
+	{"Sessions", testSessions},
+	{"CreateDirectConversationReturnsExisting", testCreateDirectConversationReturnsExisting},
+	{"DirectConversationIsNamedAfterOtherParticipant", testDirectConversationIsNamedAfterOtherParticipant},
+	{"CreateGroupConversation", testCreateGroupConversation},
+	{"MissingConversationIsNil", testMissingConversationIsNil},
+	{"ConversationsByMostRecentActivity", testConversationsByMostRecentActivity},
+	{"AddUserToGroupRejectsDuplicates", testAddUserToGroupRejectsDuplicates},
+	{"RemoveUserFromGroup", testRemoveUserFromGroup},
+	{"GroupOperationsRejectDirectConversations", testGroupOperationsRejectDirectConversations},
+	{"GroupRoles", testGroupRoles},
+	{"OwnershipPassesToAdminFirst", testOwnershipPassesToAdminFirst},
+	{"OwnershipPassesToLongestStandingMember", testOwnershipPassesToLongestStandingMember},
+	{"GroupPolicy", testGroupPolicy},
+	{"CreateMessage", testCreateMessage},
+	{"GetMessagesPage", testGetMessagesPage},
+	{"GetMessageByID", testGetMessageByID},
+	{"DeleteMessageIsSoft", testDeleteMessageIsSoft},
+	{"DeleteMessageReleasesUnusedPhoto", testDeleteMessageReleasesUnusedPhoto},
+	{"Attachments", testAttachments},
+	{"HideMessage", testHideMessage},
+	{"UpdateMessageContent", testUpdateMessageContent},
+	{"ReplyPreview", testReplyPreview},
+	{"GetReplies", testGetReplies},
+	{"CreateMessagesIsAtomic", testCreateMessagesIsAtomic},
+	{"ForwardedFrom", testForwardedFrom},
+	{"SearchMessages", testSearchMessages},
+	{"ReceiptsDriveStatus", testReceiptsDriveStatus},
+	{"LeavingGroupReleasesUnreadReceipts", testLeavingGroupReleasesUnreadReceipts},
+	{"AddReactionUpserts", testAddReactionUpserts},
+	{"RemoveReactionRequiresReaction", testRemoveReactionRequiresReaction},
+}
+
+// Run runs every conformance scenario against repositories returned by newRepo
+func Run(t *testing.T, newRepo Factory) {
+	for _, sc := range scenarios {
+		t.Run(sc.name, func(t *testing.T) {
+			f := &fixture{
+				t:    t,
+				ctx:  context.Background(),
+				repo: newRepo(t),
+				// Whole milliseconds in UTC survive every backend's timestamp precision
+				base: time.Now().UTC().Truncate(time.Millisecond),
+			}
+			sc.run(t, f)
+		})
+	}
+}
+
+// fixture bundles a fresh repository with helpers that fail the test on error
+type fixture struct {
+	t    *testing.T
+	ctx  context.Context
+	repo repository.Repository
+	base time.Time
+	sent int
+}
+
+func (f *fixture) user(name string) models.User {
+	f.t.Helper()
+
+	user, err := f.repo.CreateUser(f.ctx, name)
+	if err != nil {
+		f.t.Fatalf("CreateUser(%q): %v", name, err)
+	}
+	return *user
+}
+
+func (f *fixture) direct(a, b models.User) *models.Conversation {
+	f.t.Helper()
+
+	conv, err := f.repo.CreateDirectConversation(f.ctx, a.ID, b.ID)
+	if err != nil {
+		f.t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	return conv
+}
+
+// group creates a group owned by its first member
+func (f *fixture) group(name string, members ...models.User) *models.Conversation {
+	f.t.Helper()
+
+	var ids []string
+	for _, member := range members {
+		ids = append(ids, member.ID)
+	}
+	conv, err := f.repo.CreateGroupConversation(f.ctx, name, members[0].ID, ids)
+	if err != nil {
+		f.t.Fatalf("CreateGroupConversation: %v", err)
+	}
+	return conv
+}
+
+// send creates a text message, one second after the previous one
+func (f *fixture) send(sender models.User, conversationID, content string) *models.Message {
+	f.t.Helper()
+
+	return f.reply(sender, conversationID, "", content)
+}
+
+// reply creates a text message replying to another one, or to none when replyTo is empty
+func (f *fixture) reply(sender models.User, conversationID, replyTo, content string) *models.Message {
+	f.t.Helper()
+
+	f.sent++
+	msg := models.Message{
+		Sender:    sender,
+		Content:   content,
+		Type:      models.TextMessage,
+		Status:    models.Sent,
+		Timestamp: f.base.Add(time.Duration(f.sent) * time.Second),
+	}
+	if replyTo != "" {
+		msg.ReplyTo = &replyTo
+	}
+	created, err := f.repo.CreateMessage(f.ctx, msg, conversationID)
+	if err != nil {
+		f.t.Fatalf("CreateMessage: %v", err)
+	}
+	return created
+}
+
+func (f *fixture) conversation(id string) *models.Conversation {
+	f.t.Helper()
+
+	conv, err := f.repo.GetConversationByID(f.ctx, id, "")
+	if err != nil {
+		f.t.Fatalf("GetConversationByID: %v", err)
+	}
+	if conv == nil {
+		f.t.Fatalf("conversation %s not found", id)
+	}
+	return conv
+}
+
+func (f *fixture) page(conversationID string, before *models.MessageCursor, limit int) []models.Message {
+	f.t.Helper()
+
+	messages, err := f.repo.GetMessagesPage(f.ctx, conversationID, "", before, limit)
+	if err != nil {
+		f.t.Fatalf("GetMessagesPage: %v", err)
+	}
+	return messages
+}
+
+func (f *fixture) message(id string) *models.Message {
+	f.t.Helper()
+
+	msg, err := f.repo.GetMessageByID(f.ctx, id)
+	if err != nil {
+		f.t.Fatalf("GetMessageByID: %v", err)
+	}
+	if msg == nil {
+		f.t.Fatalf("message %s not found", id)
+	}
+	return msg
+}
+
+func cursorOf(msg *models.Message) models.MessageCursor {
+	return models.MessageCursor{Timestamp: msg.Timestamp, ID: msg.ID}
+}
+
+func roles(conv *models.Conversation) map[string]models.ParticipantRole {
+	roles := make(map[string]models.ParticipantRole)
+	for _, p := range conv.Participants {
+		roles[p.ID] = p.Role
+	}
+	return roles
+}
+
+func participantIDs(conv *models.Conversation) map[string]bool {
+	ids := make(map[string]bool)
+	for _, p := range conv.Participants {
+		ids[p.ID] = true
+	}
+	return ids
+}
+
+func messageIDs(messages []models.Message) []string {
+	var ids []string
+	for _, msg := range messages {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+func testPing(t *testing.T, f *fixture) {
+	if err := f.repo.Ping(f.ctx); err != nil {
+		t.Errorf("Ping = %v", err)
+	}
+}
+
+func testCreateUserIsIdempotentByName(t *testing.T, f *fixture) {
+	first := f.user("alice")
+	second := f.user("alice")
+
+	if first.ID == "" {
+		t.Fatal("CreateUser returned an empty ID")
+	}
+	if first.ID != second.ID {
+		t.Errorf("CreateUser with an existing name created a new user: %s != %s", first.ID, second.ID)
+	}
+
+	other := f.user("bob")
+	if other.ID == first.ID {
+		t.Error("different names share an ID")
+	}
+}
+
+func testMissingUserIsNil(t *testing.T, f *fixture) {
+	user, err := f.repo.GetUserByID(f.ctx, "00000000-0000-0000-0000-000000000000")
+	if err != nil || user != nil {
+		t.Errorf("GetUserByID(missing) = %+v, %v; want nil, nil", user, err)
+	}
+
+	user, err = f.repo.GetUserByName(f.ctx, "nobody")
+	if err != nil || user != nil {
+		t.Errorf("GetUserByName(missing) = %+v, %v; want nil, nil", user, err)
+	}
+}
+
+func testUpdateUsernameRejectsTakenName(t *testing.T, f *fixture) {
+	alice := f.user("alice")
+	f.user("bob")
+
+	if err := f.repo.UpdateUsername(f.ctx, alice.ID, "bob"); !errors.Is(err, models.ErrConflict) {
+		t.Errorf("UpdateUsername to a taken name: got %v, want a conflict", err)
+	}
+
+	// Keeping one's own name is not a conflict
+	if err := f.repo.UpdateUsername(f.ctx, alice.ID, "alice"); err != nil {
+		t.Errorf("UpdateUsername to the current name: %v", err)
+	}
+
+	if err := f.repo.UpdateUsername(f.ctx, alice.ID, "alicia"); err != nil {
+		t.Fatalf("UpdateUsername: %v", err)
+	}
+	user, err := f.repo.GetUserByName(f.ctx, "alicia")
+	if err != nil || user == nil || user.ID != alice.ID {
+		t.Errorf("GetUserByName(new name) = %+v, %v; want alice", user, err)
+	}
+	if user, _ := f.repo.GetUserByName(f.ctx, "alice"); user != nil {
+		t.Error("old name still resolves")
+	}
+}
+
+func testGetAllUsers(t *testing.T, f *fixture) {
+	users, err := f.repo.GetAllUsers(f.ctx)
+	if err != nil {
+		t.Fatalf("GetAllUsers: %v", err)
+	}
+	if len(users) != 0 {
+		t.Errorf("empty repository has %d users", len(users))
+	}
+
+	f.user("alice")
+	f.user("bob")
+
+	users, err = f.repo.GetAllUsers(f.ctx)
+	if err != nil {
+		t.Fatalf("GetAllUsers: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, user := range users {
+		names[user.Name] = true
+	}
+	if len(users) != 2 || !names["alice"] || !names["bob"] {
+		t.Errorf("GetAllUsers = %+v, want alice and bob", users)
+	}
+}
+
+func testPasswordHash(t *testing.T, f *fixture) {
+	alice := f.user("alice")
+
+	hash, err := f.repo.GetUserPasswordHash(f.ctx, alice.ID)
+	if err != nil || hash != "" {
+		t.Errorf("GetUserPasswordHash before setting = %q, %v; want empty", hash, err)
+	}
+
+	if err := f.repo.SetUserPasswordHash(f.ctx, alice.ID, "encoded-hash"); err != nil {
+		t.Fatalf("SetUserPasswordHash: %v", err)
+	}
+	hash, err = f.repo.GetUserPasswordHash(f.ctx, alice.ID)
+	if err != nil || hash != "encoded-hash" {
+		t.Errorf("GetUserPasswordHash = %q, %v; want encoded-hash", hash, err)
+	}
+
+	if err := f.repo.SetUserPasswordHash(f.ctx, "00000000-0000-0000-0000-000000000000", "hash"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("SetUserPasswordHash for a missing user: got %v, want not found", err)
+	}
+}
+
+func testCreateUserWithPasswordHash(t *testing.T, f *fixture) {
+	alice, err := f.repo.CreateUserWithPasswordHash(f.ctx, "alice", "encoded-hash")
+	if err != nil {
+		t.Fatalf("CreateUserWithPasswordHash: %v", err)
+	}
+	if stored, err := f.repo.GetUserByName(f.ctx, "alice"); err != nil || stored == nil || stored.ID != alice.ID {
+		t.Fatalf("GetUserByName = %+v, %v; want %s", stored, err, alice.ID)
+	}
+	hash, err := f.repo.GetUserPasswordHash(f.ctx, alice.ID)
+	if err != nil || hash != "encoded-hash" {
+		t.Errorf("GetUserPasswordHash = %q, %v; want encoded-hash", hash, err)
+	}
+
+	// A taken name is a conflict, and leaves the password of its owner alone
+	if _, err := f.repo.CreateUserWithPasswordHash(f.ctx, "alice", "other-hash"); !errors.Is(err, models.ErrConflict) {
+		t.Errorf("CreateUserWithPasswordHash with a taken name: got %v, want conflict", err)
+	}
+	if hash, _ := f.repo.GetUserPasswordHash(f.ctx, alice.ID); hash != "encoded-hash" {
+		t.Errorf("password hash after the conflict = %q, want encoded-hash", hash)
+	}
+}
+
+func testSetUserPhoto(t *testing.T, f *fixture) {
+	alice := f.user("alice")
+
+	key := "user_photos/alice.jpg"
+	if err := f.repo.SetUserPhoto(f.ctx, alice.ID, key); err != nil {
+		t.Fatalf("SetUserPhoto: %v", err)
+	}
+
+	user, err := f.repo.GetUserByID(f.ctx, alice.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	if user.PhotoURL != key {
+		t.Errorf("PhotoURL = %q, want %q", user.PhotoURL, key)
+	}
+}
+
+func testSessions(t *testing.T, f *fixture) {
+	alice := f.user("alice")
+
+	session := models.Session{
+		ID:        "session-hash",
+		UserID:    alice.ID,
+		CreatedAt: f.base,
+		ExpiresAt: f.base.Add(time.Hour),
+	}
+	if err := f.repo.CreateSession(f.ctx, session); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if err := f.repo.CreateSession(f.ctx, session); err == nil {
+		t.Error("CreateSession with a duplicate ID succeeded")
+	}
+
+	got, err := f.repo.GetSessionByID(f.ctx, session.ID)
+	if err != nil || got == nil {
+		t.Fatalf("GetSessionByID = %+v, %v", got, err)
+	}
+	if got.UserID != alice.ID || !got.ExpiresAt.Equal(session.ExpiresAt) || got.RevokedAt != nil {
+		t.Errorf("GetSessionByID = %+v, want %+v", got, session)
+	}
+
+	if err := f.repo.RevokeSession(f.ctx, session.ID); err != nil {
+		t.Fatalf("RevokeSession: %v", err)
+	}
+	got, err = f.repo.GetSessionByID(f.ctx, session.ID)
+	if err != nil || got == nil || got.RevokedAt == nil {
+		t.Errorf("revoked session = %+v, %v; want RevokedAt set", got, err)
+	}
+
+	got, err = f.repo.GetSessionByID(f.ctx, "missing")
+	if err != nil || got != nil {
+		t.Errorf("GetSessionByID(missing) = %+v, %v; want nil, nil", got, err)
+	}
+}
+
+func testCreateDirectConversationReturnsExisting(t *testing.T, f *fixture) {
+	alice, bob, carol := f.user("alice"), f.user("bob"), f.user("carol")
+
+	first := f.direct(alice, bob)
+	if first.Type != models.DirectConversation {
+		t.Errorf("Type = %s, want direct", first.Type)
+	}
+	if ids := participantIDs(first); len(ids) != 2 || !ids[alice.ID] || !ids[bob.ID] {
+		t.Errorf("participants = %+v", first.Participants)
+	}
+
+	if again := f.direct(bob, alice); again.ID != first.ID {
+		t.Errorf("CreateDirectConversation did not return the existing conversation: %s != %s", again.ID, first.ID)
+	}
+	if other := f.direct(alice, carol); other.ID == first.ID {
+		t.Error("different pairs share a direct conversation")
+	}
+
+	// A group with the same two members is not a direct conversation
+	group := f.group("pair", alice, bob)
+	if again := f.direct(alice, bob); again.ID != first.ID || again.ID == group.ID {
+		t.Errorf("CreateDirectConversation returned %s, want %s", again.ID, first.ID)
+	}
+}
+
+func testDirectConversationIsNamedAfterOtherParticipant(t *testing.T, f *fixture) {
+	alice, bob := f.user("alice"), f.user("bob")
+	conv := f.direct(alice, bob)
+
+	for viewer, want := range map[string]string{alice.ID: "bob", bob.ID: "alice"} {
+		got, err := f.repo.GetConversationByID(f.ctx, conv.ID, viewer)
+		if err != nil {
+			t.Fatalf("GetConversationByID: %v", err)
+		}
+		if got.Name != want {
+			t.Errorf("Name seen by %s = %q, want %s", viewer, got.Name, want)
+		}
+	}
+}
+
+func testCreateGroupConversation(t *testing.T, f *fixture) {
+	alice, bob, carol := f.user("alice"), f.user("bob"), f.user("carol")
+
+	group := f.group("friends", alice, bob, carol)
+	if group.ID == "" || group.Type != models.GroupConversation || group.Name != "friends" {
+		t.Errorf("group = %+v", group)
+	}
+	if ids := participantIDs(group); len(ids) != 3 || !ids[alice.ID] || !ids[bob.ID] || !ids[carol.ID] {
+		t.Errorf("participants = %+v", group.Participants)
+	}
+	if group.LastMessage != nil {
+		t.Errorf("new group has a last message: %+v", group.LastMessage)
+	}
+}
+
+func testMissingConversationIsNil(t *testing.T, f *fixture) {
+	conv, err := f.repo.GetConversationByID(f.ctx, "00000000-0000-0000-0000-000000000000", "")
+	if err != nil || conv != nil {
+		t.Errorf("GetConversationByID(missing) = %+v, %v; want nil, nil", conv, err)
+	}
+}
+
+func testConversationsByMostRecentActivity(t *testing.T, f *fixture) {
+	alice, bob, carol := f.user("alice"), f.user("bob"), f.user("carol")
+
+	withBob := f.direct(alice, bob)
+	withCarol := f.direct(alice, carol)
+	f.send(alice, withCarol.ID, "first")
+	f.send(alice, withBob.ID, "second")
+
+	convs, err := f.repo.GetConversationsByUserID(f.ctx, alice.ID)
+	if err != nil {
+		t.Fatalf("GetConversationsByUserID: %v", err)
+	}
+	if len(convs) != 2 || convs[0].ID != withBob.ID || convs[1].ID != withCarol.ID {
+		t.Errorf("conversations = %v, want [%s %s]", convs, withBob.ID, withCarol.ID)
+	}
+
+	convs, err = f.repo.GetConversationsByUserID(f.ctx, carol.ID)
+	if err != nil {
+		t.Fatalf("GetConversationsByUserID: %v", err)
+	}
+	if len(convs) != 1 || convs[0].ID != withCarol.ID {
+		t.Errorf("carol's conversations = %v, want [%s]", convs, withCarol.ID)
+	}
+}
+
+func testAddUserToGroupRejectsDuplicates(t *testing.T, f *fixture) {
+	alice, bob, carol := f.user("alice"), f.user("bob"), f.user("carol")
+	group := f.group("friends", alice, bob)
+
+	if err := f.repo.AddUserToGroup(f.ctx, group.ID, carol.ID); err != nil {
+		t.Fatalf("AddUserToGroup: %v", err)
+	}
+	if err := f.repo.AddUserToGroup(f.ctx, group.ID, carol.ID); !errors.Is(err, models.ErrConflict) {
+		t.Errorf("AddUserToGroup with an existing member: got %v, want a conflict", err)
+	}
+
+	if ids := participantIDs(f.conversation(group.ID)); len(ids) != 3 || !ids[carol.ID] {
+		t.Errorf("participants = %v", ids)
+	}
+}
+
+func testRemoveUserFromGroup(t *testing.T, f *fixture) {
+	alice, bob, carol := f.user("alice"), f.user("bob"), f.user("carol")
+	group := f.group("friends", alice, bob)
+
+	if err := f.repo.RemoveUserFromGroup(f.ctx, group.ID, carol.ID); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("RemoveUserFromGroup for a non-member: got %v, want not found", err)
+	}
+	if err := f.repo.RemoveUserFromGroup(f.ctx, group.ID, bob.ID); err != nil {
+		t.Fatalf("RemoveUserFromGroup: %v", err)
+	}
+
+	if ids := participantIDs(f.conversation(group.ID)); len(ids) != 1 || !ids[alice.ID] {
+		t.Errorf("participants = %v, want only alice", ids)
+	}
+	convs, err := f.repo.GetConversationsByUserID(f.ctx, bob.ID)
+	if err != nil {
+		t.Fatalf("GetConversationsByUserID: %v", err)
+	}
+	if len(convs) != 0 {
+		t.Errorf("former member still lists %d conversations", len(convs))
+	}
+}
+
+func testGroupOperationsRejectDirectConversations(t *testing.T, f *fixture) {
+	alice, bob, carol := f.user("alice"), f.user("bob"), f.user("carol")
+	direct := f.direct(alice, bob)
+
+	if err := f.repo.AddUserToGroup(f.ctx, direct.ID, carol.ID); err == nil {
+		t.Error("AddUserToGroup on a direct conversation succeeded")
+	}
+	if err := f.repo.RemoveUserFromGroup(f.ctx, direct.ID, bob.ID); err == nil {
+		t.Error("RemoveUserFromGroup on a direct conversation succeeded")
+	}
+	if err := f.repo.UpdateGroupName(f.ctx, direct.ID, "renamed"); err == nil {
+		t.Error("UpdateGroupName on a direct conversation succeeded")
+	}
+	if err := f.repo.UpdateGroupName(f.ctx, "00000000-0000-0000-0000-000000000000", "renamed"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("UpdateGroupName on a missing conversation: got %v, want not found", err)
+	}
+
+	group := f.group("friends", alice, bob)
+	if err := f.repo.UpdateGroupName(f.ctx, group.ID, "renamed"); err != nil {
+		t.Fatalf("UpdateGroupName: %v", err)
+	}
+	if name := f.conversation(group.ID).Name; name != "renamed" {
+		t.Errorf("Name = %q, want renamed", name)
+	}
+}
+
+func testGroupRoles(t *testing.T, f *fixture) {
+	alice, bob, carol, dave := f.user("alice"), f.user("bob"), f.user("carol"), f.user("dave")
+	group := f.group("friends", alice, bob, carol)
+
+	got := roles(group)
+	if got[alice.ID] != models.RoleOwner || got[bob.ID] != models.RoleMember || got[carol.ID] != models.RoleMember {
+		t.Errorf("roles of a new group = %v, want alice owner and the rest members", got)
+	}
+
+	if err := f.repo.AddUserToGroup(f.ctx, group.ID, dave.ID); err != nil {
+		t.Fatalf("AddUserToGroup: %v", err)
+	}
+	if err := f.repo.SetParticipantRole(f.ctx, group.ID, bob.ID, models.RoleAdmin); err != nil {
+		t.Fatalf("SetParticipantRole: %v", err)
+	}
+	got = roles(f.conversation(group.ID))
+	if got[bob.ID] != models.RoleAdmin || got[dave.ID] != models.RoleMember {
+		t.Errorf("roles = %v, want bob admin and dave member", got)
+	}
+
+	if err := f.repo.SetParticipantRole(f.ctx, group.ID, bob.ID, models.RoleMember); err != nil {
+		t.Fatalf("SetParticipantRole: %v", err)
+	}
+	if role := roles(f.conversation(group.ID))[bob.ID]; role != models.RoleMember {
+		t.Errorf("bob's role after demotion = %s, want member", role)
+	}
+
+	outsider := f.user("erin")
+	if err := f.repo.SetParticipantRole(f.ctx, group.ID, outsider.ID, models.RoleAdmin); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("SetParticipantRole for a non-member: got %v, want not found", err)
+	}
+
+	direct := f.direct(alice, bob)
+	for id, role := range roles(direct) {
+		if role != models.RoleMember {
+			t.Errorf("direct conversation participant %s has role %s, want member", id, role)
+		}
+	}
+	if err := f.repo.SetParticipantRole(f.ctx, direct.ID, bob.ID, models.RoleAdmin); err == nil {
+		t.Error("SetParticipantRole on a direct conversation succeeded")
+	}
+}
+
+func testOwnershipPassesToAdminFirst(t *testing.T, f *fixture) {
+	alice, bob, carol := f.user("alice"), f.user("bob"), f.user("carol")
+	group := f.group("friends", alice, bob, carol)
+
+	if err := f.repo.SetParticipantRole(f.ctx, group.ID, carol.ID, models.RoleAdmin); err != nil {
+		t.Fatalf("SetParticipantRole: %v", err)
+	}
+	if err := f.repo.RemoveUserFromGroup(f.ctx, group.ID, alice.ID); err != nil {
+		t.Fatalf("RemoveUserFromGroup: %v", err)
+	}
+
+	got := roles(f.conversation(group.ID))
+	if got[carol.ID] != models.RoleOwner || got[bob.ID] != models.RoleMember {
+		t.Errorf("roles after the owner left = %v, want the admin carol as owner", got)
+	}
+}
+
+func testOwnershipPassesToLongestStandingMember(t *testing.T, f *fixture) {
+	alice, bob, carol := f.user("alice"), f.user("bob"), f.user("carol")
+	group := f.group("friends", alice, bob)
+	if err := f.repo.AddUserToGroup(f.ctx, group.ID, carol.ID); err != nil {
+		t.Fatalf("AddUserToGroup: %v", err)
+	}
+
+	if err := f.repo.RemoveUserFromGroup(f.ctx, group.ID, alice.ID); err != nil {
+		t.Fatalf("RemoveUserFromGroup: %v", err)
+	}
+	got := roles(f.conversation(group.ID))
+	if got[bob.ID] != models.RoleOwner || got[carol.ID] != models.RoleMember {
+		t.Errorf("roles after the owner left = %v, want bob as owner", got)
+	}
+
+	// Members leaving does not touch ownership
+	if err := f.repo.RemoveUserFromGroup(f.ctx, group.ID, carol.ID); err != nil {
+		t.Fatalf("RemoveUserFromGroup: %v", err)
+	}
+	if role := roles(f.conversation(group.ID))[bob.ID]; role != models.RoleOwner {
+		t.Errorf("bob's role = %s, want owner", role)
+	}
+
+	// The last member leaving leaves an empty group behind
+	if err := f.repo.RemoveUserFromGroup(f.ctx, group.ID, bob.ID); err != nil {
+		t.Fatalf("RemoveUserFromGroup(last member): %v", err)
+	}
+	if n := len(f.conversation(group.ID).Participants); n != 0 {
+		t.Errorf("group has %d participants, want none", n)
+	}
+}
+
+func testGroupPolicy(t *testing.T, f *fixture) {
+	alice, bob := f.user("alice"), f.user("bob")
+	group := f.group("friends", alice, bob)
+
+	if group.Policy == nil || *group.Policy != models.DefaultGroupPolicy() {
+		t.Fatalf("policy of a new group = %+v, want the default", group.Policy)
+	}
+
+	policy := models.GroupPolicy{
+		AddMembers:   models.AdminsAllowed,
+		EditInfo:     models.EveryoneAllowed,
+		SendMessages: models.AdminsAllowed,
+	}
+	if err := f.repo.UpdateGroupPolicy(f.ctx, group.ID, policy); err != nil {
+		t.Fatalf("UpdateGroupPolicy: %v", err)
+	}
+	if got := f.conversation(group.ID).Policy; got == nil || *got != policy {
+		t.Errorf("policy = %+v, want %+v", got, policy)
+	}
+
+	direct := f.direct(alice, bob)
+	if direct.Policy != nil {
+		t.Errorf("direct conversation has a policy: %+v", direct.Policy)
+	}
+	if err := f.repo.UpdateGroupPolicy(f.ctx, direct.ID, policy); err == nil {
+		t.Error("UpdateGroupPolicy on a direct conversation succeeded")
+	}
+}
+
+func testCreateMessage(t *testing.T, f *fixture) {
+	alice, bob := f.user("alice"), f.user("bob")
+	conv := f.direct(alice, bob)
+
+	msg := f.send(alice, conv.ID, "hello")
+	if msg.ID == "" || msg.ConversationID != conv.ID {
+		t.Errorf("CreateMessage = %+v, want an ID in conversation %s", msg, conv.ID)
+	}
+
+	last := f.conversation(conv.ID).LastMessage
+	if last == nil || last.ID != msg.ID || last.Content != "hello" || last.Sender.ID != alice.ID {
+		t.Errorf("LastMessage = %+v, want %s", last, msg.ID)
+	}
+
+	reply := models.Message{
+		Sender:    bob,
+		Content:   "hi",
+		Type:      models.TextMessage,
+		Status:    models.Sent,
+		ReplyTo:   &msg.ID,
+		Timestamp: f.base.Add(time.Minute),
+	}
+	created, err := f.repo.CreateMessage(f.ctx, reply, conv.ID)
+	if err != nil {
+		t.Fatalf("CreateMessage(reply): %v", err)
+	}
+	if got := f.message(created.ID); got.ReplyTo == nil || *got.ReplyTo != msg.ID {
+		t.Errorf("ReplyTo = %v, want %s", got.ReplyTo, msg.ID)
+	}
+}
+
+func testGetMessagesPage(t *testing.T, f *fixture) {
+	alice, bob := f.user("alice"), f.user("bob")
+	conv := f.direct(alice, bob)
+	other := f.group("other", alice, bob)
+
+	var sent []*models.Message
+	for _, content := range []string{"1", "2", "3", "4", "5"} {
+		sent = append(sent, f.send(alice, conv.ID, content))
+	}
+	f.send(alice, other.ID, "elsewhere")
+
+	newest := f.page(conv.ID, nil, 2)
+	if got, want := messageIDs(newest), []string{sent[4].ID, sent[3].ID}; !equal(got, want) {
+		t.Errorf("first page = %v, want %v", got, want)
+	}
+
+	cursor := cursorOf(&newest[1])
+	older := f.page(conv.ID, &cursor, 10)
+	if got, want := messageIDs(older), []string{sent[2].ID, sent[1].ID, sent[0].ID}; !equal(got, want) {
+		t.Errorf("older page = %v, want %v", got, want)
+	}
+
+	cursor = cursorOf(sent[0])
+	if rest := f.page(conv.ID, &cursor, 10); len(rest) != 0 {
+		t.Errorf("page before the first message = %v, want empty", messageIDs(rest))
+	}
+
+	// Messages sharing a timestamp are ordered by ID, so none is skipped or repeated
+	same := f.base.Add(time.Hour)
+	var tied []string
+	for i := 0; i < 3; i++ {
+		msg := models.Message{Sender: bob, Content: "tie", Type: models.TextMessage, Status: models.Sent, Timestamp: same}
+		created, err := f.repo.CreateMessage(f.ctx, msg, conv.ID)
+		if err != nil {
+			t.Fatalf("CreateMessage: %v", err)
+		}
+		tied = append(tied, created.ID)
+	}
+	seen := make(map[string]bool)
+	var before *models.MessageCursor
+	for i := 0; i < 3; i++ {
+		page := f.page(conv.ID, before, 1)
+		if len(page) != 1 {
+			t.Fatalf("page %d has %d messages", i, len(page))
+		}
+		seen[page[0].ID] = true
+		before = &models.MessageCursor{Timestamp: page[0].Timestamp, ID: page[0].ID}
+	}
+	for _, id := range tied {
+		if !seen[id] {
+			t.Errorf("message %s with a tied timestamp was skipped", id)
+		}
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testGetMessageByID(t *testing.T, f *fixture) {
+	alice, bob := f.user("alice"), f.user("bob")
+	conv := f.direct(alice, bob)
+	sent := f.send(alice, conv.ID, "hello")
+
+	msg := f.message(sent.ID)
+	if msg.ID != sent.ID || msg.ConversationID != conv.ID || msg.Sender.ID != alice.ID || msg.Content != "hello" {
+		t.Errorf("GetMessageByID = %+v", msg)
+	}
+	if !msg.Timestamp.Equal(sent.Timestamp) {
+		t.Errorf("Timestamp = %v, want %v", msg.Timestamp, sent.Timestamp)
+	}
+
+	missing, err := f.repo.GetMessageByID(f.ctx, "00000000-0000-0000-0000-000000000000")
+	if err != nil || missing != nil {
+		t.Errorf("GetMessageByID(missing) = %+v, %v; want nil, nil", missing, err)
+	}
+}
+
+func testDeleteMessageIsSoft(t *testing.T, f *fixture) {
+	alice, bob := f.user("alice"), f.user("bob")
+	conv := f.direct(alice, bob)
+	msg := f.send(alice, conv.ID, "oops")
+	if err := f.repo.UpdateMessageContent(f.ctx, msg.ID, "oops!", f.base.Add(time.Minute)); err != nil {
+		t.Fatalf("UpdateMessageContent: %v", err)
+	}
+
+	if photo, err := f.repo.DeleteMessage(f.ctx, msg.ID); err != nil || photo != "" {
+		t.Fatalf("DeleteMessage = %q, %v; want no photo to release", photo, err)
+	}
+
+	// The message stays in the history as a tombstone, without its content
+	page := f.page(conv.ID, nil, 10)
+	if len(page) != 1 || page[0].ID != msg.ID || page[0].DeletedAt == nil || page[0].Content != "" {
+		t.Errorf("history after delete = %+v, want the message marked deleted without content", page)
+	}
+	if got := f.message(msg.ID); got.DeletedAt == nil || got.Content != "" {
+		t.Errorf("GetMessageByID after delete = %+v, want a tombstone", got)
+	}
+	if revisions, err := f.repo.GetMessageRevisions(f.ctx, msg.ID); err != nil || len(revisions) != 0 {
+		t.Errorf("revisions after delete = %+v, %v; want none", revisions, err)
+	}
+
+	// Deleting again keeps the original deletion time
+	deletedAt := *f.message(msg.ID).DeletedAt
+	if _, err := f.repo.DeleteMessage(f.ctx, msg.ID); err != nil {
+		t.Fatalf("DeleteMessage(again): %v", err)
+	}
+	if got := f.message(msg.ID).DeletedAt; got == nil || !got.Equal(deletedAt) {
+		t.Errorf("DeletedAt after deleting again = %v, want %v", got, deletedAt)
+	}
+}
+
+func testDeleteMessageReleasesUnusedPhoto(t *testing.T, f *fixture) {
+	alice, bob := f.user("alice"), f.user("bob")
+	conv := f.direct(alice, bob)
+
+	// Two messages sharing a photo, as a forwarded copy does
+	key := "message_photos/lunch.png"
+	var photos []*models.Message
+	for i := 0; i < 2; i++ {
+		f.sent++
+		msg, err := f.repo.CreateMessage(f.ctx, models.Message{
+			Sender:    alice,
+			Content:   key,
+			Type:      models.PhotoMessage,
+			Status:    models.Sent,
+			Timestamp: f.base.Add(time.Duration(f.sent) * time.Second),
+		}, conv.ID)
+		if err != nil {
+			t.Fatalf("CreateMessage(photo): %v", err)
+		}
+		photos = append(photos, msg)
+	}
+
+	if released, err := f.repo.DeleteMessage(f.ctx, photos[0].ID); err != nil || released != "" {
+		t.Errorf("DeleteMessage(first) = %q, %v; want the photo kept for the other message", released, err)
+	}
+	if released, err := f.repo.DeleteMessage(f.ctx, photos[1].ID); err != nil || released != key {
+		t.Errorf("DeleteMessage(last) = %q, %v; want %q", released, err, key)
+	}
+	if released, err := f.repo.DeleteMessage(f.ctx, photos[1].ID); err != nil || released != "" {
+		t.Errorf("DeleteMessage(again) = %q, %v; want nothing to release", released, err)
+	}
+}
+
+func testAttachments(t *testing.T, f *fixture) {
+	alice, bob := f.user("alice"), f.user("bob")
+	conv := f.direct(alice, bob)
+
+	attachment := models.Attachment{
+		FileName:  "holiday.mp4",
+		MimeType:  "video/mp4",
+		Size:      1 << 20,
+		Duration:  12.5,
+		Thumbnail: "message_files/abc_thumb.jpg",
+	}
+	f.sent++
+	video, err := f.repo.CreateMessage(f.ctx, models.Message{
+		Sender:     alice,
+		Content:    "message_files/abc.mp4",
+		Type:       models.VideoMessage,
+		Status:     models.Sent,
+		Timestamp:  f.base.Add(time.Duration(f.sent) * time.Second),
+		Caption:    "look at this",
+		Attachment: &attachment,
+	}, conv.ID)
+	if err != nil {
+		t.Fatalf("CreateMessage(video): %v", err)
+	}
+
+	got := f.message(video.ID)
+	if got.Type != models.VideoMessage || got.Content != "message_files/abc.mp4" || got.Caption != "look at this" {
+		t.Errorf("video = %s %q, caption %q", got.Type, got.Content, got.Caption)
+	}
+	if got.Attachment == nil || *got.Attachment != attachment {
+		t.Errorf("attachment = %+v, want %+v", got.Attachment, attachment)
+	}
+	if text := f.message(f.send(bob, conv.ID, "nice").ID); text.Attachment != nil || text.Caption != "" {
+		t.Errorf("text message has attachment %+v, caption %q", text.Attachment, text.Caption)
+	}
+
+	// Replies quote the file name
+	reply := f.reply(bob, conv.ID, video.ID, "where is that?")
+	if preview := f.message(reply.ID).ReplyPreview; preview == nil || preview.Type != models.VideoMessage || preview.Content != "holiday.mp4" {
+		t.Errorf("reply preview = %+v", preview)
+	}
+
+	// Deleting erases the metadata along with the content, and releases the file
+	if released, err := f.repo.DeleteMessage(f.ctx, video.ID); err != nil || released != "message_files/abc.mp4" {
+		t.Errorf("DeleteMessage = %q, %v", released, err)
+	}
+	if got := f.message(video.ID); got.Attachment != nil || got.Caption != "" {
+		t.Errorf("deleted video kept attachment %+v, caption %q", got.Attachment, got.Caption)
+	}
+}
+
+func testHideMessage(t *testing.T, f *fixture) {
+	alice, bob := f.user("alice"), f.user("bob")
+	conv := f.direct(alice, bob)
+	first := f.send(alice, conv.ID, "lunch?")
+	second := f.send(bob, conv.ID, "lunch!")
+
+	if err := f.repo.HideMessage(f.ctx, second.ID, bob.ID); err != nil {
+		t.Fatalf("HideMessage: %v", err)
+	}
+	if err := f.repo.HideMessage(f.ctx, second.ID, bob.ID); err != nil {
+		t.Fatalf("HideMessage(again): %v", err)
+	}
+
+	pageOf := func(viewerID string) []string {
+		messages, err := f.repo.GetMessagesPage(f.ctx, conv.ID, viewerID, nil, 10)
+		if err != nil {
+			t.Fatalf("GetMessagesPage: %v", err)
+		}
+		return messageIDs(messages)
+	}
+	if got, want := pageOf(bob.ID), []string{first.ID}; !equal(got, want) {
+		t.Errorf("bob's history = %v, want %v", got, want)
+	}
+	if got, want := pageOf(alice.ID), []string{second.ID, first.ID}; !equal(got, want) {
+		t.Errorf("alice's history = %v, want %v", got, want)
+	}
+	if got, want := pageOf(""), []string{second.ID, first.ID}; !equal(got, want) {
+		t.Errorf("history without a viewer = %v, want %v", got, want)
+	}
+
+	// The conversation's last message is the viewer's
+	conversation, err := f.repo.GetConversationByID(f.ctx, conv.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("GetConversationByID: %v", err)
+	}
+	if conversation.LastMessage == nil || conversation.LastMessage.ID != first.ID {
+		t.Errorf("bob's last message = %+v, want %s", conversation.LastMessage, first.ID)
+	}
+	conversations, err := f.repo.GetConversationsByUserID(f.ctx, bob.ID)
+	if err != nil {
+		t.Fatalf("GetConversationsByUserID: %v", err)
+	}
+	if len(conversations) != 1 || conversations[0].LastMessage == nil || conversations[0].LastMessage.ID != first.ID {
+		t.Errorf("bob's conversation list = %+v, want last message %s", conversations, first.ID)
+	}
+
+	bobResults := f.search(models.MessageSearch{UserID: bob.ID, Query: "lunch"})
+	if got, want := resultIDs(bobResults), []string{first.ID}; !equal(got, want) {
+		t.Errorf("bob's search = %v, want %v", got, want)
+	}
+	aliceResults := f.search(models.MessageSearch{UserID: alice.ID, Query: "lunch"})
+	if got, want := resultIDs(aliceResults), []string{second.ID, first.ID}; !equal(got, want) {
+		t.Errorf("alice's search = %v, want %v", got, want)
+	}
+}
+
+func testUpdateMessageContent(t *testing.T, f *fixture) {
+	alice, bob := f.user("alice"), f.user("bob")
+	conv := f.direct(alice, bob)
+	msg := f.send(alice, conv.ID, "helo")
+	if msg := f.message(msg.ID); msg.EditedAt != nil {
+		t.Errorf("EditedAt = %v before any edit, want nil", msg.EditedAt)
+	}
+	if revisions, err := f.repo.GetMessageRevisions(f.ctx, msg.ID); err != nil || len(revisions) != 0 {
+		t.Errorf("GetMessageRevisions before any edit = %+v, %v; want none", revisions, err)
+	}
+
+	firstEdit := f.base.Add(time.Minute)
+	if err := f.repo.UpdateMessageContent(f.ctx, msg.ID, "hello", firstEdit); err != nil {
+		t.Fatalf("UpdateMessageContent: %v", err)
+	}
+	secondEdit := f.base.Add(2 * time.Minute)
+	if err := f.repo.UpdateMessageContent(f.ctx, msg.ID, "hello!", secondEdit); err != nil {
+		t.Fatalf("UpdateMessageContent: %v", err)
+	}
+
+	got := f.message(msg.ID)
+	if got.Content != "hello!" {
+		t.Errorf("Content = %q, want hello!", got.Content)
+	}
+	if got.EditedAt == nil || !got.EditedAt.Equal(secondEdit) {
+		t.Errorf("EditedAt = %v, want %v", got.EditedAt, secondEdit)
+	}
+	if page := f.page(conv.ID, nil, 10); len(page) != 1 || page[0].EditedAt == nil || !page[0].EditedAt.Equal(secondEdit) {
+		t.Errorf("history = %+v, want the message marked edited at %v", page, secondEdit)
+	}
+
+	// Each revision is a replaced version, stamped with the time it was written
+	revisions, err := f.repo.GetMessageRevisions(f.ctx, msg.ID)
+	if err != nil {
+		t.Fatalf("GetMessageRevisions: %v", err)
+	}
+	want := []models.MessageRevision{{Content: "helo", Timestamp: msg.Timestamp}, {Content: "hello", Timestamp: firstEdit}}
+	if len(revisions) != len(want) {
+		t.Fatalf("revisions = %+v, want %+v", revisions, want)
+	}
+	for i := range want {
+		if revisions[i].Content != want[i].Content || !revisions[i].Timestamp.Equal(want[i].Timestamp) {
+			t.Errorf("revision %d = %+v, want %+v", i, revisions[i], want[i])
+		}
+	}
+}
+
+func testReplyPreview(t *testing.T, f *fixture) {
+	alice, bob := f.user("alice"), f.user("bob")
+	conv := f.direct(alice, bob)
+	long := strings.Repeat("é", 150)
+	original := f.send(alice, conv.ID, long)
+	reply := f.reply(bob, conv.ID, original.ID, "agreed")
+
+	if msg := f.message(original.ID); msg.ReplyPreview != nil {
+		t.Errorf("ReplyPreview = %+v on a message that is not a reply", msg.ReplyPreview)
+	}
+
+	check := func(preview *models.ReplyPreview, wantContent string, wantDeleted bool) {
+		t.Helper()
+		if preview == nil {
+			t.Fatal("ReplyPreview = nil, want a preview")
+		}
+		if preview.MessageID != original.ID || preview.Sender.ID != alice.ID || preview.Sender.Name != "alice" || preview.Type != models.TextMessage {
+			t.Errorf("ReplyPreview = %+v, want alice's text message %s", preview, original.ID)
+		}
+		if preview.Content != wantContent || preview.Deleted != wantDeleted {
+			t.Errorf("ReplyPreview content, deleted = %q, %v; want %q, %v", preview.Content, preview.Deleted, wantContent, wantDeleted)
+		}
+	}
+	truncated := strings.Repeat("é", 100) + "…"
+	check(f.message(reply.ID).ReplyPreview, truncated, false)
+	check(f.page(conv.ID, nil, 10)[0].ReplyPreview, truncated, false)
+
+	// The preview follows the sender's renames and the original's deletion
+	if err := f.repo.UpdateUsername(f.ctx, alice.ID, "alicia"); err != nil {
+		t.Fatalf("UpdateUsername: %v", err)
+	}
+	alice.Name = "alicia"
+	if _, err := f.repo.DeleteMessage(f.ctx, original.ID); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	preview := f.message(reply.ID).ReplyPreview
+	if preview == nil || preview.Sender.Name != "alicia" || preview.Content != "" || !preview.Deleted {
+		t.Errorf("ReplyPreview after rename and deletion = %+v, want an empty preview of alicia's deleted message", preview)
+	}
+}
+
+func testGetReplies(t *testing.T, f *fixture) {
+	alice, bob := f.user("alice"), f.user("bob")
+	conv := f.direct(alice, bob)
+	original := f.send(alice, conv.ID, "who's in?")
+	first := f.reply(bob, conv.ID, original.ID, "me")
+	f.send(alice, conv.ID, "unrelated")
+	second := f.reply(alice, conv.ID, original.ID, "me too")
+	third := f.reply(bob, conv.ID, original.ID, "great")
+	f.reply(bob, conv.ID, third.ID, "a reply to a reply")
+
+	replies := func(viewerID string, before *models.MessageCursor, limit int) []string {
+		t.Helper()
+		messages, err := f.repo.GetReplies(f.ctx, original.ID, viewerID, before, limit)
+		if err != nil {
+			t.Fatalf("GetReplies: %v", err)
+		}
+		return messageIDs(messages)
+	}
+
+	if got, want := replies("", nil, 2), []string{third.ID, second.ID}; !equal(got, want) {
+		t.Errorf("first page = %v, want %v", got, want)
+	}
+	if got, want := replies("", &models.MessageCursor{Timestamp: second.Timestamp, ID: second.ID}, 2), []string{first.ID}; !equal(got, want) {
+		t.Errorf("second page = %v, want %v", got, want)
+	}
+
+	if err := f.repo.HideMessage(f.ctx, second.ID, bob.ID); err != nil {
+		t.Fatalf("HideMessage: %v", err)
+	}
+	if got, want := replies(bob.ID, nil, 10), []string{third.ID, first.ID}; !equal(got, want) {
+		t.Errorf("bob's replies = %v, want %v", got, want)
+	}
+	if got, want := replies(alice.ID, nil, 10), []string{third.ID, second.ID, first.ID}; !equal(got, want) {
+		t.Errorf("alice's replies = %v, want only the direct replies %v", got, want)
+	}
+}
+
+func testCreateMessagesIsAtomic(t *testing.T, f *fixture) {
+	alice, bob, carol := f.user("alice"), f.user("bob"), f.user("carol")
+	withBob := f.direct(alice, bob)
+	withCarol := f.direct(alice, carol)
+
+	copyIn := func(conversationID string) models.Message {
+		return models.Message{ConversationID: conversationID, Sender: alice, Content: "hi all", Type: models.TextMessage, Status: models.Sent}
+	}
+
+	if _, err := f.repo.CreateMessages(f.ctx, []models.Message{copyIn(withBob.ID), copyIn("missing")}); err == nil {
+		t.Fatal("CreateMessages into a missing conversation succeeded")
+	}
+	if messages := f.page(withBob.ID, nil, 10); len(messages) != 0 {
+		t.Errorf("a failed CreateMessages left %d messages behind", len(messages))
+	}
+
+	created, err := f.repo.CreateMessages(f.ctx, []models.Message{copyIn(withBob.ID), copyIn(withCarol.ID)})
+	if err != nil {
+		t.Fatalf("CreateMessages: %v", err)
+	}
+	if len(created) != 2 || created[0].ID == "" || created[0].ID == created[1].ID {
+		t.Fatalf("created = %+v, want two messages with distinct IDs", created)
+	}
+	for i, conv := range []*models.Conversation{withBob, withCarol} {
+		if got := messageIDs(f.page(conv.ID, nil, 10)); !equal(got, []string{created[i].ID}) {
+			t.Errorf("messages of %s = %v, want %s", conv.Name, got, created[i].ID)
+		}
+	}
+
+	// Every copy opens receipts for the recipients of its own conversation
+	if msg := f.message(created[1].ID); msg.Status != models.Sent {
+		t.Errorf("status = %s, want %s", msg.Status, models.Sent)
+	}
+	receipts, err := f.repo.GetMessageReceipts(f.ctx, created[1].ID)
+	if err != nil {
+		t.Fatalf("GetMessageReceipts: %v", err)
+	}
+	if len(receipts) != 1 || receipts[0].UserID != carol.ID {
+		t.Errorf("receipts = %+v, want one for carol", receipts)
+	}
+}
+
+func testForwardedFrom(t *testing.T, f *fixture) {
+	alice, bob, carol := f.user("alice"), f.user("bob"), f.user("carol")
+	withBob := f.direct(alice, bob)
+	withCarol := f.direct(alice, carol)
+	original := f.send(bob, withBob.ID, "pass it on")
+
+	if msg := f.message(original.ID); msg.ForwardedFrom != nil {
+		t.Errorf("ForwardedFrom = %+v on an original message", msg.ForwardedFrom)
+	}
+
+	duplicate := models.Message{Sender: alice, Content: original.Content, Type: original.Type, Status: models.Sent, ForwardedFrom: original.Forwarded()}
+	forwarded, err := f.repo.CreateMessage(f.ctx, duplicate, withCarol.ID)
+	if err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+
+	check := func(got *models.ForwardedFrom, wantName string) {
+		t.Helper()
+		if got == nil || got.MessageID != original.ID || got.Sender.ID != bob.ID || got.Sender.Name != wantName || got.ForwardCount != 1 {
+			t.Errorf("ForwardedFrom = %+v, want %s's %s forwarded once", got, wantName, original.ID)
+		}
+	}
+	check(f.message(forwarded.ID).ForwardedFrom, "bob")
+	check(f.page(withCarol.ID, nil, 10)[0].ForwardedFrom, "bob")
+
+	// The original sender is resolved when reading, so renames show up
+	if err := f.repo.UpdateUsername(f.ctx, bob.ID, "robert"); err != nil {
+		t.Fatalf("UpdateUsername: %v", err)
+	}
+	check(f.message(forwarded.ID).ForwardedFrom, "robert")
+}
+
+func (f *fixture) search(search models.MessageSearch) []models.SearchResult {
+	f.t.Helper()
+
+	if search.Limit == 0 {
+		search.Limit = 10
+	}
+	results, err := f.repo.SearchMessages(f.ctx, search)
+	if err != nil {
+		f.t.Fatalf("SearchMessages(%q): %v", search.Query, err)
+	}
+	return results
+}
+
+func resultIDs(results []models.SearchResult) []string {
+	ids := make([]string, len(results))
+	for i, result := range results {
+		ids[i] = result.MessageID
+	}
+	return ids
+}
+
+func testSearchMessages(t *testing.T, f *fixture) {
+	alice, bob, carol := f.user("alice"), f.user("bob"), f.user("carol")
+	direct := f.direct(alice, bob)
+	group := f.group("friends", alice, bob, carol)
+	private := f.direct(bob, carol)
+
+	first := f.send(alice, direct.ID, "Lunch tomorrow at noon?")
+	second := f.send(bob, group.ID, "who wants lunch")
+	f.send(bob, private.ID, "lunch without alice")
+	deleted := f.send(alice, group.ID, "lunch is cancelled")
+	if _, err := f.repo.DeleteMessage(f.ctx, deleted.ID); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	photo := models.Message{Sender: alice, Content: "lunch.png", Type: models.PhotoMessage, Status: models.Sent, Timestamp: f.base.Add(time.Minute)}
+	if _, err := f.repo.CreateMessage(f.ctx, photo, group.ID); err != nil {
+		t.Fatalf("CreateMessage(photo): %v", err)
+	}
+	third := f.send(carol, group.ID, "lunch & coffee <3")
+
+	// Only live text messages of the user's own conversations match, newest first
+	results := f.search(models.MessageSearch{UserID: alice.ID, Query: "LUNCH"})
+	if got, want := resultIDs(results), []string{third.ID, second.ID, first.ID}; !equal(got, want) {
+		t.Fatalf("search = %v, want %v", got, want)
+	}
+	if r := results[0]; r.ConversationID != group.ID || r.Sender.ID != carol.ID || r.Sender.Name != "carol" || !r.Timestamp.Equal(third.Timestamp) {
+		t.Errorf("result = %+v, want carol's message in %s", r, group.ID)
+	}
+	snippet := strings.ToLower(results[0].Snippet)
+	if !strings.Contains(snippet, "<mark>lunch</mark>") || !strings.Contains(snippet, "&amp;") || strings.Contains(snippet, "<3") {
+		t.Errorf("snippet = %q, want an escaped snippet with the match highlighted", results[0].Snippet)
+	}
+
+	// Every word of the query must appear
+	if got := resultIDs(f.search(models.MessageSearch{UserID: alice.ID, Query: "lunch noon"})); !equal(got, []string{first.ID}) {
+		t.Errorf("search for two words = %v, want %v", got, []string{first.ID})
+	}
+	if got := f.search(models.MessageSearch{UserID: alice.ID, Query: "dinner"}); len(got) != 0 {
+		t.Errorf("search for a missing word = %v, want none", resultIDs(got))
+	}
+
+	// Filters
+	inGroup := f.search(models.MessageSearch{UserID: alice.ID, Query: "lunch", ConversationID: group.ID})
+	if got, want := resultIDs(inGroup), []string{third.ID, second.ID}; !equal(got, want) {
+		t.Errorf("search in group = %v, want %v", got, want)
+	}
+	fromBob := f.search(models.MessageSearch{UserID: alice.ID, Query: "lunch", SenderID: bob.ID})
+	if got, want := resultIDs(fromBob), []string{second.ID}; !equal(got, want) {
+		t.Errorf("search from bob = %v, want %v", got, want)
+	}
+
+	// Pages continue after the cursor
+	newest := f.search(models.MessageSearch{UserID: alice.ID, Query: "lunch", Limit: 1})
+	if got := resultIDs(newest); !equal(got, []string{third.ID}) {
+		t.Fatalf("first page = %v, want %v", got, []string{third.ID})
+	}
+	cursor := models.MessageCursor{Timestamp: newest[0].Timestamp, ID: newest[0].MessageID}
+	older := f.search(models.MessageSearch{UserID: alice.ID, Query: "lunch", Before: &cursor})
+	if got, want := resultIDs(older), []string{second.ID, first.ID}; !equal(got, want) {
+		t.Errorf("older page = %v, want %v", got, want)
+	}
+}
+
+func testReceiptsDriveStatus(t *testing.T, f *fixture) {
+	alice, bob, carol := f.user("alice"), f.user("bob"), f.user("carol")
+	group := f.group("friends", alice, bob, carol)
+	first := f.send(alice, group.ID, "first")
+	second := f.send(alice, group.ID, "second")
+
+	receipts, err := f.repo.GetMessageReceipts(f.ctx, first.ID)
+	if err != nil {
+		t.Fatalf("GetMessageReceipts: %v", err)
+	}
+	if len(receipts) != 2 {
+		t.Fatalf("receipts = %+v, want one per recipient", receipts)
+	}
+	for _, receipt := range receipts {
+		if receipt.UserID == alice.ID {
+			t.Error("the sender has a receipt for their own message")
+		}
+		if receipt.ReceivedAt != nil || receipt.ReadAt != nil {
+			t.Errorf("new receipt = %+v, want pending", receipt)
+		}
+	}
+
+	if err := f.repo.MarkMessagesReceived(f.ctx, group.ID, bob.ID, cursorOf(second)); err != nil {
+		t.Fatalf("MarkMessagesReceived: %v", err)
+	}
+	if status := f.message(second.ID).Status; status != models.Sent {
+		t.Errorf("status after one of two deliveries = %s, want sent", status)
+	}
+
+	if err := f.repo.MarkMessagesReceived(f.ctx, group.ID, carol.ID, cursorOf(first)); err != nil {
+		t.Fatalf("MarkMessagesReceived: %v", err)
+	}
+	if status := f.message(first.ID).Status; status != models.Received {
+		t.Errorf("status of first = %s, want received", status)
+	}
+	if status := f.message(second.ID).Status; status != models.Sent {
+		t.Errorf("status of second = %s, want sent: carol only received up to first", status)
+	}
+
+	// Reading implies receiving
+	if err := f.repo.MarkMessagesRead(f.ctx, group.ID, carol.ID, cursorOf(second)); err != nil {
+		t.Fatalf("MarkMessagesRead: %v", err)
+	}
+	if err := f.repo.MarkMessagesRead(f.ctx, group.ID, bob.ID, cursorOf(first)); err != nil {
+		t.Fatalf("MarkMessagesRead: %v", err)
+	}
+	if status := f.message(first.ID).Status; status != models.Read {
+		t.Errorf("status of first = %s, want read", status)
+	}
+	if status := f.message(second.ID).Status; status != models.Received {
+		t.Errorf("status of second = %s, want received", status)
+	}
+
+	receipts, err = f.repo.GetMessageReceipts(f.ctx, second.ID)
+	if err != nil {
+		t.Fatalf("GetMessageReceipts: %v", err)
+	}
+	if len(receipts) != 2 {
+		t.Fatalf("receipts = %+v", receipts)
+	}
+	// Readers are listed before those who only received the message
+	if receipts[0].UserID != carol.ID || receipts[0].ReadAt == nil || receipts[0].ReceivedAt == nil {
+		t.Errorf("first receipt = %+v, want carol's read receipt", receipts[0])
+	}
+	if receipts[1].UserID != bob.ID || receipts[1].ReadAt != nil || receipts[1].ReceivedAt == nil || receipts[1].UserName != "bob" {
+		t.Errorf("second receipt = %+v, want bob's delivery receipt", receipts[1])
+	}
+
+	// Messages paged from the history carry the same aggregate status
+	for _, msg := range f.page(group.ID, nil, 10) {
+		if want := f.message(msg.ID).Status; msg.Status != want {
+			t.Errorf("paged status of %s = %s, want %s", msg.Content, msg.Status, want)
+		}
+	}
+}
+
+func testLeavingGroupReleasesUnreadReceipts(t *testing.T, f *fixture) {
+	alice, bob, carol := f.user("alice"), f.user("bob"), f.user("carol")
+	group := f.group("friends", alice, bob, carol)
+	msg := f.send(alice, group.ID, "hello")
+
+	if err := f.repo.MarkMessagesRead(f.ctx, group.ID, bob.ID, cursorOf(msg)); err != nil {
+		t.Fatalf("MarkMessagesRead: %v", err)
+	}
+	if status := f.message(msg.ID).Status; status != models.Sent {
+		t.Fatalf("status = %s, want sent", status)
+	}
+
+	if err := f.repo.RemoveUserFromGroup(f.ctx, group.ID, carol.ID); err != nil {
+		t.Fatalf("RemoveUserFromGroup: %v", err)
+	}
+	if status := f.message(msg.ID).Status; status != models.Read {
+		t.Errorf("status after the only unread member left = %s, want read", status)
+	}
+}
+
+func testAddReactionUpserts(t *testing.T, f *fixture) {
+	alice, bob := f.user("alice"), f.user("bob")
+	conv := f.direct(alice, bob)
+	msg := f.send(alice, conv.ID, "hello")
+
+	if err := f.repo.AddReaction(f.ctx, msg.ID, bob.ID, "👍"); err != nil {
+		t.Fatalf("AddReaction: %v", err)
+	}
+	if err := f.repo.AddReaction(f.ctx, msg.ID, bob.ID, "❤️"); err != nil {
+		t.Fatalf("AddReaction (replace): %v", err)
+	}
+	if err := f.repo.AddReaction(f.ctx, msg.ID, alice.ID, "😂"); err != nil {
+		t.Fatalf("AddReaction: %v", err)
+	}
+
+	reactions, err := f.repo.GetReactionsByMessageID(f.ctx, msg.ID)
+	if err != nil {
+		t.Fatalf("GetReactionsByMessageID: %v", err)
+	}
+	byUser := make(map[string]string)
+	for _, reaction := range reactions {
+		if reaction.MessageID != msg.ID {
+			t.Errorf("reaction %+v belongs to another message", reaction)
+		}
+		byUser[reaction.UserID] = reaction.Emoji
+	}
+	if len(reactions) != 2 || byUser[bob.ID] != "❤️" || byUser[alice.ID] != "😂" {
+		t.Errorf("reactions = %+v, want bob ❤️ and alice 😂", reactions)
+	}
+
+	page := f.page(conv.ID, nil, 1)
+	if len(page) != 1 || len(page[0].Reactions) != 2 {
+		t.Errorf("paged message reactions = %+v, want 2", page)
+	}
+}
+
+func testRemoveReactionRequiresReaction(t *testing.T, f *fixture) {
+	alice, bob := f.user("alice"), f.user("bob")
+	conv := f.direct(alice, bob)
+	msg := f.send(alice, conv.ID, "hello")
+
+	if err := f.repo.RemoveReaction(f.ctx, msg.ID, bob.ID); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("RemoveReaction without a reaction: got %v, want not found", err)
+	}
+
+	if err := f.repo.AddReaction(f.ctx, msg.ID, bob.ID, "👍"); err != nil {
+		t.Fatalf("AddReaction: %v", err)
+	}
+	if err := f.repo.RemoveReaction(f.ctx, msg.ID, bob.ID); err != nil {
+		t.Fatalf("RemoveReaction: %v", err)
+	}
+	if err := f.repo.RemoveReaction(f.ctx, msg.ID, bob.ID); err == nil {
+		t.Error("RemoveReaction twice succeeded")
+	}
+
+	reactions, err := f.repo.GetReactionsByMessageID(f.ctx, msg.ID)
+	if err != nil {
+		t.Fatalf("GetReactionsByMessageID: %v", err)
+	}
+	if len(reactions) != 0 {
+		t.Errorf("reactions = %+v, want none", reactions)
+	}
+}
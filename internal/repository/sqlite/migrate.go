@@ -0,0 +1,41 @@
+package sqlite
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+
+	"github.com/fallenkarma/wasatext/internal/migrate"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Open opens (or creates) the database file at dbPath without touching its schema
+func Open(dbPath string) (*sql.DB, error) {
+	// Foreign keys are off by default in SQLite; immediate transactions avoid
+	// lock upgrade failures when concurrent writers start with a read
+	dsn := fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate", dbPath)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check connection
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// NewMigrator returns a Migrator for the embedded SQLite schema migrations
+func NewMigrator(db *sql.DB) (*migrate.Migrator, error) {
+	migrations, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return migrate.New(db, migrations, migrate.SQLite)
+}
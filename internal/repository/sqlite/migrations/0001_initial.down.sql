@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS reactions;
+DROP TABLE IF EXISTS message_receipts;
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS conversation_participants;
+DROP TABLE IF EXISTS conversations;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
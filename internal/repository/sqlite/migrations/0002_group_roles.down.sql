@@ -0,0 +1,5 @@
+ALTER TABLE conversations DROP COLUMN send_messages_permission;
+ALTER TABLE conversations DROP COLUMN edit_info_permission;
+ALTER TABLE conversations DROP COLUMN add_members_permission;
+
+ALTER TABLE conversation_participants DROP COLUMN role;
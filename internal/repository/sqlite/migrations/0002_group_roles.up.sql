@@ -0,0 +1,24 @@
+-- Group roles and per-group permission policy
+ALTER TABLE conversation_participants
+    ADD COLUMN role TEXT NOT NULL DEFAULT 'member' CHECK (role IN ('owner', 'admin', 'member'));
+
+ALTER TABLE conversations
+    ADD COLUMN add_members_permission TEXT NOT NULL DEFAULT 'everyone'
+    CHECK (add_members_permission IN ('everyone', 'admins'));
+ALTER TABLE conversations
+    ADD COLUMN edit_info_permission TEXT NOT NULL DEFAULT 'everyone'
+    CHECK (edit_info_permission IN ('everyone', 'admins'));
+ALTER TABLE conversations
+    ADD COLUMN send_messages_permission TEXT NOT NULL DEFAULT 'everyone'
+    CHECK (send_messages_permission IN ('everyone', 'admins'));
+
+-- Existing groups are owned by their longest-standing participant
+UPDATE conversation_participants
+SET role = 'owner'
+WHERE conversation_id IN (SELECT id FROM conversations WHERE type = 'group')
+AND user_id = (
+    SELECT p.user_id FROM conversation_participants p
+    WHERE p.conversation_id = conversation_participants.conversation_id
+    ORDER BY p.joined_at ASC, p.user_id ASC
+    LIMIT 1
+);
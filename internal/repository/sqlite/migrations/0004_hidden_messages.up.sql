@@ -0,0 +1,11 @@
+-- Messages deleted for everyone keep no content: erase what earlier deletes left behind
+UPDATE messages SET content = '' WHERE deleted_at IS NOT NULL;
+DELETE FROM message_revisions WHERE message_id IN (SELECT id FROM messages WHERE deleted_at IS NOT NULL);
+
+-- Messages a user deleted for themselves only
+CREATE TABLE IF NOT EXISTS hidden_messages (
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    message_id TEXT REFERENCES messages(id) ON DELETE CASCADE,
+    hidden_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, message_id)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE messages DROP COLUMN forward_count;
+ALTER TABLE messages DROP COLUMN forwarded_from_sender;
+ALTER TABLE messages DROP COLUMN forwarded_from;
@@ -0,0 +1,5 @@
+-- Forwarded messages keep a link to the message they were first forwarded from,
+-- its sender, and how many times it has been forwarded since
+ALTER TABLE messages ADD COLUMN forwarded_from TEXT REFERENCES messages(id) ON DELETE SET NULL;
+ALTER TABLE messages ADD COLUMN forwarded_from_sender TEXT REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE messages ADD COLUMN forward_count INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+UPDATE messages SET content = '/uploads/' || content WHERE type = 'photo' AND content <> '' AND content NOT LIKE '/%';
+UPDATE conversations SET photo_url = '/uploads/' || photo_url WHERE photo_url <> '' AND photo_url NOT LIKE '/%';
+UPDATE users SET photo_url = '/uploads/' || photo_url WHERE photo_url <> '' AND photo_url NOT LIKE '/%';
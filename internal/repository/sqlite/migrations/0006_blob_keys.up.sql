@@ -0,0 +1,5 @@
+-- Photos are stored as blob keys such as "user_photos/<name>.jpg" instead of
+-- URLs under /uploads, so the blob store decides where they are served from
+UPDATE users SET photo_url = substr(photo_url, 10) WHERE photo_url LIKE '/uploads/%';
+UPDATE conversations SET photo_url = substr(photo_url, 10) WHERE photo_url LIKE '/uploads/%';
+UPDATE messages SET content = substr(content, 10) WHERE type = 'photo' AND content LIKE '/uploads/%';
@@ -0,0 +1,17 @@
+-- Attachment messages cannot be represented before this migration
+DELETE FROM messages WHERE type IN ('file', 'audio', 'video');
+
+PRAGMA writable_schema = ON;
+UPDATE sqlite_master
+SET sql = replace(sql, 'CHECK (type IN (''text'', ''photo'', ''file'', ''audio'', ''video''))', 'CHECK (type IN (''text'', ''photo''))')
+WHERE type = 'table' AND name = 'messages';
+PRAGMA writable_schema = OFF;
+ALTER TABLE messages RENAME COLUMN caption TO caption_;
+ALTER TABLE messages RENAME COLUMN caption_ TO caption;
+
+ALTER TABLE messages DROP COLUMN attachment_thumbnail;
+ALTER TABLE messages DROP COLUMN attachment_duration;
+ALTER TABLE messages DROP COLUMN attachment_size;
+ALTER TABLE messages DROP COLUMN attachment_type;
+ALTER TABLE messages DROP COLUMN attachment_name;
+ALTER TABLE messages DROP COLUMN caption;
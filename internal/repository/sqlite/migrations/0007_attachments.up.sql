@@ -0,0 +1,21 @@
+-- File, audio and video messages, and captions on media messages
+ALTER TABLE messages ADD COLUMN caption TEXT NOT NULL DEFAULT '';
+
+-- Metadata of the file a file, audio or video message carries;
+-- the content column holds the key of the file itself
+ALTER TABLE messages ADD COLUMN attachment_name TEXT;
+ALTER TABLE messages ADD COLUMN attachment_type TEXT;
+ALTER TABLE messages ADD COLUMN attachment_size INTEGER;
+ALTER TABLE messages ADD COLUMN attachment_duration REAL;
+ALTER TABLE messages ADD COLUMN attachment_thumbnail TEXT;
+
+-- SQLite cannot alter a CHECK constraint, and rebuilding the messages table would
+-- cascade the drop to everything referencing it, so the constraint is rewritten
+-- in place. Renaming a column back and forth then makes SQLite parse the table again.
+PRAGMA writable_schema = ON;
+UPDATE sqlite_master
+SET sql = replace(sql, 'CHECK (type IN (''text'', ''photo''))', 'CHECK (type IN (''text'', ''photo'', ''file'', ''audio'', ''video''))')
+WHERE type = 'table' AND name = 'messages';
+PRAGMA writable_schema = OFF;
+ALTER TABLE messages RENAME COLUMN caption TO caption_;
+ALTER TABLE messages RENAME COLUMN caption_ TO caption;
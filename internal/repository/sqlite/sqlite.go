@@ -0,0 +1,1221 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/search"
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// messageStatusColumn derives a message's aggregate status from its receipts:
+// read once every recipient read it, received once every recipient received it.
+// Messages without receipts fall back to the stored status.
+const messageStatusColumn = `
+	CASE
+		WHEN NOT EXISTS (SELECT 1 FROM message_receipts mr WHERE mr.message_id = m.id) THEN m.status
+		WHEN NOT EXISTS (SELECT 1 FROM message_receipts mr WHERE mr.message_id = m.id AND mr.read_at IS NULL) THEN 'read'
+		WHEN NOT EXISTS (SELECT 1 FROM message_receipts mr WHERE mr.message_id = m.id AND mr.received_at IS NULL) THEN 'received'
+		ELSE 'sent'
+	END`
+
+// SqliteRepository implements the Repository interface on an embedded SQLite database
+type SqliteRepository struct {
+	db *sql.DB
+}
+
+// NewSqliteRepository opens (or creates) the database file at dbPath and migrates it
+// to the latest schema
+func NewSqliteRepository(dbPath string) (*SqliteRepository, error) {
+	db, err := Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := migrator.Up(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	if applied > 0 {
+		slog.Info("Applied schema migrations", "count", applied)
+	}
+
+	return &SqliteRepository{db: db}, nil
+}
+
+// Close closes the database connection
+func (r *SqliteRepository) Close() error {
+	return r.db.Close()
+}
+
+// Ping implements Repository.Ping
+func (r *SqliteRepository) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+// now returns the current time in UTC, the only zone written to the database,
+// so that textual timestamps compare in chronological order
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+// CreateUser implements UserRepository.CreateUser
+func (r *SqliteRepository) CreateUser(ctx context.Context, name string) (*models.User, error) {
+	// Check if user with this name already exists
+	existingUser, _ := r.GetUserByName(ctx, name)
+	if existingUser != nil {
+		return existingUser, nil
+	}
+
+	// Generate a unique ID
+	id := uuid.New().String()
+
+	// Insert the new user
+	query := "INSERT INTO users (id, name) VALUES (?, ?)"
+	_, err := r.db.ExecContext(ctx, query, id, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.User{
+		ID:   id,
+		Name: name,
+	}, nil
+}
+
+// CreateUserWithPasswordHash implements UserRepository.CreateUserWithPasswordHash
+func (r *SqliteRepository) CreateUserWithPasswordHash(ctx context.Context, name string, hash string) (*models.User, error) {
+	id := uuid.New().String()
+
+	// The unique name decides between concurrent sign-ups: only one insert goes through
+	query := "INSERT INTO users (id, name, password_hash) VALUES (?, ?, ?) ON CONFLICT (name) DO NOTHING"
+	result, err := r.db.ExecContext(ctx, query, id, name, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, models.NewError(models.ErrConflict, "username already in use")
+	}
+
+	return &models.User{
+		ID:   id,
+		Name: name,
+	}, nil
+}
+
+// GetUserByID implements UserRepository.GetUserByID
+func (r *SqliteRepository) GetUserByID(ctx context.Context, id string) (*models.User, error) {
+	query := "SELECT id, name, photo_url FROM users WHERE id = ?"
+	return r.scanUser(r.db.QueryRowContext(ctx, query, id))
+}
+
+// GetUserByName implements UserRepository.GetUserByName
+func (r *SqliteRepository) GetUserByName(ctx context.Context, name string) (*models.User, error) {
+	query := "SELECT id, name, photo_url FROM users WHERE name = ?"
+	return r.scanUser(r.db.QueryRowContext(ctx, query, name))
+}
+
+// scanUser reads a single user row, returning nil when there is none
+func (r *SqliteRepository) scanUser(row *sql.Row) (*models.User, error) {
+	var user models.User
+	var photoURL sql.NullString
+	err := row.Scan(&user.ID, &user.Name, &photoURL)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if photoURL.Valid {
+		user.PhotoURL = photoURL.String
+	}
+
+	return &user, nil
+}
+
+// UpdateUsername implements UserRepository.UpdateUsername
+func (r *SqliteRepository) UpdateUsername(ctx context.Context, userID string, newName string) error {
+	// Check if name is already in use
+	existingUser, _ := r.GetUserByName(ctx, newName)
+	if existingUser != nil && existingUser.ID != userID {
+		return models.NewError(models.ErrConflict, "username already in use")
+	}
+
+	query := "UPDATE users SET name = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, query, newName, userID)
+	return err
+}
+
+// SetUserPhoto implements UserRepository.SetUserPhoto
+func (r *SqliteRepository) SetUserPhoto(ctx context.Context, userID string, key string) error {
+	query := "UPDATE users SET photo_url = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, query, key, userID)
+	return err
+}
+
+// GetAllUsers implements UserRepository.GetAllUsers
+func (r *SqliteRepository) GetAllUsers(ctx context.Context) ([]models.User, error) {
+	query := "SELECT id, name, photo_url FROM users"
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []models.User
+	for rows.Next() {
+		var user models.User
+		var photoURL sql.NullString
+		if err := rows.Scan(&user.ID, &user.Name, &photoURL); err != nil {
+			return nil, err
+		}
+		if photoURL.Valid {
+			user.PhotoURL = photoURL.String
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// GetUserPasswordHash implements UserRepository.GetUserPasswordHash
+func (r *SqliteRepository) GetUserPasswordHash(ctx context.Context, userID string) (string, error) {
+	query := "SELECT password_hash FROM users WHERE id = ?"
+	row := r.db.QueryRowContext(ctx, query, userID)
+
+	var hash sql.NullString
+	if err := row.Scan(&hash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return hash.String, nil
+}
+
+// SetUserPasswordHash implements UserRepository.SetUserPasswordHash
+func (r *SqliteRepository) SetUserPasswordHash(ctx context.Context, userID string, hash string) error {
+	query := "UPDATE users SET password_hash = ?, updated_at = ? WHERE id = ?"
+	result, err := r.db.ExecContext(ctx, query, hash, now(), userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return models.NewError(models.ErrNotFound, "user not found")
+	}
+
+	return nil
+}
+
+// CreateSession implements SessionRepository.CreateSession
+func (r *SqliteRepository) CreateSession(ctx context.Context, session models.Session) error {
+	query := "INSERT INTO sessions (id, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)"
+	_, err := r.db.ExecContext(ctx, query, session.ID, session.UserID, session.CreatedAt.UTC(), session.ExpiresAt.UTC())
+	return err
+}
+
+// GetSessionByID implements SessionRepository.GetSessionByID
+func (r *SqliteRepository) GetSessionByID(ctx context.Context, id string) (*models.Session, error) {
+	query := "SELECT id, user_id, created_at, expires_at, revoked_at FROM sessions WHERE id = ?"
+	row := r.db.QueryRowContext(ctx, query, id)
+
+	var session models.Session
+	err := row.Scan(&session.ID, &session.UserID, &session.CreatedAt, &session.ExpiresAt, &session.RevokedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// RevokeSession implements SessionRepository.RevokeSession
+func (r *SqliteRepository) RevokeSession(ctx context.Context, id string) error {
+	query := "UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL"
+	_, err := r.db.ExecContext(ctx, query, now(), id)
+	return err
+}
+
+// CreateDirectConversation implements ConversationRepository.CreateDirectConversation
+func (r *SqliteRepository) CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, error) {
+	// Check if a direct conversation already exists between these users
+	query := `
+		SELECT conversation_id
+		FROM conversation_participants
+		JOIN conversations ON conversation_participants.conversation_id = conversations.id
+		WHERE user_id IN (?, ?) AND conversations.type = 'direct'
+		GROUP BY conversation_id
+		HAVING COUNT(DISTINCT user_id) = 2
+	`
+	row := r.db.QueryRowContext(ctx, query, userID1, userID2)
+
+	var conversationID string
+	err := row.Scan(&conversationID)
+	if err == nil {
+		// Conversation exists, return it
+		return r.GetConversationByID(ctx, conversationID, userID1)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		// Unexpected error
+		return nil, err
+	}
+
+	// Start a transaction
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Create a new conversation
+	id := uuid.New().String()
+	insertConvQuery := "INSERT INTO conversations (id, type, last_activity) VALUES (?, ?, ?)"
+	_, err = tx.ExecContext(ctx, insertConvQuery, id, models.DirectConversation, now())
+	if err != nil {
+		return nil, err
+	}
+
+	// Add participants
+	insertPartQuery := "INSERT INTO conversation_participants (conversation_id, user_id, joined_at) VALUES (?, ?, ?)"
+	for _, userID := range []string{userID1, userID2} {
+		if _, err := tx.ExecContext(ctx, insertPartQuery, id, userID, now()); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return r.GetConversationByID(ctx, id, userID1)
+}
+
+// CreateGroupConversation implements ConversationRepository.CreateGroupConversation
+func (r *SqliteRepository) CreateGroupConversation(ctx context.Context, name string, ownerID string, participants []string) (*models.Conversation, error) {
+	// Start a transaction
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Create a new conversation
+	id := uuid.New().String()
+	insertConvQuery := "INSERT INTO conversations (id, name, type, last_activity) VALUES (?, ?, ?, ?)"
+	_, err = tx.ExecContext(ctx, insertConvQuery, id, name, models.GroupConversation, now())
+	if err != nil {
+		return nil, err
+	}
+
+	// Add participants
+	insertPartQuery := "INSERT INTO conversation_participants (conversation_id, user_id, joined_at, role) VALUES (?, ?, ?, ?)"
+	for _, userID := range participants {
+		role := models.RoleMember
+		if userID == ownerID {
+			role = models.RoleOwner
+		}
+		if _, err := tx.ExecContext(ctx, insertPartQuery, id, userID, now(), role); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return r.GetConversationByID(ctx, id, ownerID)
+}
+
+// GetConversationByID implements ConversationRepository.GetConversationByID
+func (r *SqliteRepository) GetConversationByID(ctx context.Context, id string, viewerID string) (*models.Conversation, error) {
+	// Get conversation details
+	convQuery := `
+		SELECT id, name, type, photo_url, add_members_permission, edit_info_permission, send_messages_permission
+		FROM conversations WHERE id = ?
+	`
+	convRow := r.db.QueryRowContext(ctx, convQuery, id)
+
+	var conv models.Conversation
+	var name, photoURL sql.NullString
+	var convType string
+	var policy models.GroupPolicy
+	err := convRow.Scan(&conv.ID, &name, &convType, &photoURL, &policy.AddMembers, &policy.EditInfo, &policy.SendMessages)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if name.Valid {
+		conv.Name = name.String
+	}
+	if photoURL.Valid {
+		conv.PhotoURL = photoURL.String
+	}
+	conv.Type = models.ConversationType(convType)
+	if conv.Type == models.GroupConversation {
+		conv.Policy = &policy
+	}
+
+	// Get participants
+	partQuery := `
+		SELECT cp.user_id, u.name, u.photo_url, cp.role
+		FROM conversation_participants cp
+		JOIN users u ON u.id = cp.user_id
+		WHERE cp.conversation_id = ?
+		ORDER BY cp.joined_at ASC, cp.rowid ASC
+	`
+	partRows, err := r.db.QueryContext(ctx, partQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer partRows.Close()
+
+	for partRows.Next() {
+		var participant models.Participant
+		var userPhotoURL sql.NullString
+		if err := partRows.Scan(&participant.ID, &participant.Name, &userPhotoURL, &participant.Role); err != nil {
+			return nil, err
+		}
+		participant.PhotoURL = userPhotoURL.String
+		conv.Participants = append(conv.Participants, participant)
+	}
+	if err := partRows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Get the last message only; the history is paginated separately
+	lastMessages, err := r.GetMessagesPage(ctx, id, viewerID, nil, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(lastMessages) > 0 {
+		conv.LastMessage = &lastMessages[0]
+	}
+
+	// If this is a direct conversation and has no name, set the name to the other user's name
+	if conv.Type == models.DirectConversation && !name.Valid && len(conv.Participants) == 2 {
+		for _, participant := range conv.Participants {
+			if participant.ID != viewerID {
+				conv.Name = participant.Name
+				break
+			}
+		}
+	}
+
+	return &conv, nil
+}
+
+// GetConversationsByUserID implements ConversationRepository.GetConversationsByUserID
+func (r *SqliteRepository) GetConversationsByUserID(ctx context.Context, userID string) ([]models.Conversation, error) {
+	// Find all conversations where the user is a participant
+	query := `
+		SELECT c.id
+		FROM conversations c
+		JOIN conversation_participants cp ON c.id = cp.conversation_id
+		WHERE cp.user_id = ?
+		ORDER BY c.last_activity DESC
+	`
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect the IDs first: SQLite serializes access, so nested queries must not run while rows are open
+	var ids []string
+	for rows.Next() {
+		var convID string
+		if err := rows.Scan(&convID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, convID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var conversations []models.Conversation
+	for _, convID := range ids {
+		conv, err := r.GetConversationByID(ctx, convID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if conv != nil {
+			conversations = append(conversations, *conv)
+		}
+	}
+
+	return conversations, nil
+}
+
+// requireGroup checks that the conversation exists and is a group
+func (r *SqliteRepository) requireGroup(ctx context.Context, groupID string) error {
+	var convType string
+	err := r.db.QueryRowContext(ctx, "SELECT type FROM conversations WHERE id = ?", groupID).Scan(&convType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.NewError(models.ErrNotFound, "conversation not found")
+	}
+	if err != nil {
+		return err
+	}
+	if convType != string(models.GroupConversation) {
+		return models.NewError(models.ErrValidation, "conversation is not a group")
+	}
+	return nil
+}
+
+// AddUserToGroup implements ConversationRepository.AddUserToGroup
+func (r *SqliteRepository) AddUserToGroup(ctx context.Context, groupID, userID string) error {
+	if err := r.requireGroup(ctx, groupID); err != nil {
+		return err
+	}
+
+	// Check if user is already in the group
+	checkQuery := "SELECT COUNT(*) FROM conversation_participants WHERE conversation_id = ? AND user_id = ?"
+	var count int
+	if err := r.db.QueryRowContext(ctx, checkQuery, groupID, userID).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return models.NewError(models.ErrConflict, "user is already in the group")
+	}
+
+	// Add user to the group
+	insertQuery := "INSERT INTO conversation_participants (conversation_id, user_id, joined_at) VALUES (?, ?, ?)"
+	_, err := r.db.ExecContext(ctx, insertQuery, groupID, userID, now())
+	return err
+}
+
+// RemoveUserFromGroup implements ConversationRepository.RemoveUserFromGroup
+func (r *SqliteRepository) RemoveUserFromGroup(ctx context.Context, groupID, userID string) error {
+	if err := r.requireGroup(ctx, groupID); err != nil {
+		return err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Remove user from the group
+	var role models.ParticipantRole
+	deleteQuery := "DELETE FROM conversation_participants WHERE conversation_id = ? AND user_id = ? RETURNING role"
+	if err := tx.QueryRowContext(ctx, deleteQuery, groupID, userID).Scan(&role); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.NewError(models.ErrNotFound, "user is not in the group")
+		}
+		return err
+	}
+
+	// A group keeps an owner for as long as it has members
+	if role == models.RoleOwner {
+		successorQuery := `
+			UPDATE conversation_participants SET role = 'owner'
+			WHERE conversation_id = ? AND user_id = (
+				SELECT user_id FROM conversation_participants
+				WHERE conversation_id = ?
+				ORDER BY CASE role WHEN 'admin' THEN 0 ELSE 1 END, joined_at ASC, rowid ASC
+				LIMIT 1
+			)
+		`
+		if _, err := tx.ExecContext(ctx, successorQuery, groupID, groupID); err != nil {
+			return err
+		}
+	}
+
+	// A former member no longer holds back the read status of messages they never read
+	receiptsQuery := `
+		DELETE FROM message_receipts
+		WHERE user_id = ? AND read_at IS NULL
+		AND message_id IN (SELECT id FROM messages WHERE conversation_id = ?)
+	`
+	if _, err := tx.ExecContext(ctx, receiptsQuery, userID, groupID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetParticipantRole implements ConversationRepository.SetParticipantRole
+func (r *SqliteRepository) SetParticipantRole(ctx context.Context, groupID, userID string, role models.ParticipantRole) error {
+	if err := r.requireGroup(ctx, groupID); err != nil {
+		return err
+	}
+
+	updateQuery := "UPDATE conversation_participants SET role = ? WHERE conversation_id = ? AND user_id = ?"
+	result, err := r.db.ExecContext(ctx, updateQuery, role, groupID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return models.NewError(models.ErrNotFound, "user is not in the group")
+	}
+
+	return nil
+}
+
+// UpdateGroupPolicy implements ConversationRepository.UpdateGroupPolicy
+func (r *SqliteRepository) UpdateGroupPolicy(ctx context.Context, groupID string, policy models.GroupPolicy) error {
+	if err := r.requireGroup(ctx, groupID); err != nil {
+		return err
+	}
+
+	updateQuery := `
+		UPDATE conversations
+		SET add_members_permission = ?, edit_info_permission = ?, send_messages_permission = ?
+		WHERE id = ?
+	`
+	_, err := r.db.ExecContext(ctx, updateQuery, policy.AddMembers, policy.EditInfo, policy.SendMessages, groupID)
+	return err
+}
+
+// UpdateGroupName implements ConversationRepository.UpdateGroupName
+func (r *SqliteRepository) UpdateGroupName(ctx context.Context, groupID, name string) error {
+	if err := r.requireGroup(ctx, groupID); err != nil {
+		return err
+	}
+
+	updateQuery := "UPDATE conversations SET name = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, updateQuery, name, groupID)
+	return err
+}
+
+// SetGroupPhoto implements ConversationRepository.SetGroupPhoto
+func (r *SqliteRepository) SetGroupPhoto(ctx context.Context, groupID string, key string) error {
+	if err := r.requireGroup(ctx, groupID); err != nil {
+		return err
+	}
+
+	query := "UPDATE conversations SET photo_url = ? WHERE id = ?"
+	_, err := r.db.ExecContext(ctx, query, key, groupID)
+	return err
+}
+
+// CreateMessage implements MessageRepository.CreateMessage
+func (r *SqliteRepository) CreateMessage(ctx context.Context, msg models.Message, conversationID string) (*models.Message, error) {
+	msg.ConversationID = conversationID
+	created, err := r.CreateMessages(ctx, []models.Message{msg})
+	if err != nil {
+		return nil, err
+	}
+	return &created[0], nil
+}
+
+// CreateMessages implements MessageRepository.CreateMessages
+func (r *SqliteRepository) CreateMessages(ctx context.Context, messages []models.Message) ([]models.Message, error) {
+	// Start a transaction
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	created := make([]models.Message, len(messages))
+	for i, msg := range messages {
+		if err := insertMessage(ctx, tx, &msg); err != nil {
+			return nil, err
+		}
+		created[i] = msg
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+// insertMessage stores a message within a transaction, filling in its ID and timestamp if missing
+func insertMessage(ctx context.Context, tx *sql.Tx, msg *models.Message) error {
+	// If no ID provided, generate one
+	if msg.ID == "" {
+		msg.ID = uuid.New().String()
+	}
+
+	// If no timestamp provided, use current time
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = now()
+	}
+	msg.Timestamp = msg.Timestamp.UTC()
+
+	var forwardedFrom, forwardedFromSender *string
+	forwardCount := 0
+	if msg.ForwardedFrom != nil {
+		if msg.ForwardedFrom.MessageID != "" {
+			forwardedFrom = &msg.ForwardedFrom.MessageID
+		}
+		if msg.ForwardedFrom.Sender.ID != "" {
+			forwardedFromSender = &msg.ForwardedFrom.Sender.ID
+		}
+		forwardCount = msg.ForwardedFrom.ForwardCount
+	}
+
+	var attachmentName, attachmentType, attachmentThumbnail *string
+	var attachmentSize *int64
+	var attachmentDuration *float64
+	if a := msg.Attachment; a != nil {
+		attachmentName, attachmentType, attachmentSize = &a.FileName, &a.MimeType, &a.Size
+		if a.Duration > 0 {
+			attachmentDuration = &a.Duration
+		}
+		if a.Thumbnail != "" {
+			attachmentThumbnail = &a.Thumbnail
+		}
+	}
+
+	// Insert the message
+	msgQuery := `
+		INSERT INTO messages (id, sender_id, conversation_id, content, type, status, reply_to, timestamp, forwarded_from, forwarded_from_sender, forward_count,
+			caption, attachment_name, attachment_type, attachment_size, attachment_duration, attachment_thumbnail)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := tx.ExecContext(ctx, msgQuery, msg.ID, msg.Sender.ID, msg.ConversationID, msg.Content, msg.Type, msg.Status, msg.ReplyTo, msg.Timestamp,
+		forwardedFrom, forwardedFromSender, forwardCount,
+		msg.Caption, attachmentName, attachmentType, attachmentSize, attachmentDuration, attachmentThumbnail)
+	if err != nil {
+		return err
+	}
+
+	// Open a pending receipt for every other participant
+	receiptsQuery := `
+		INSERT INTO message_receipts (message_id, user_id)
+		SELECT ?, user_id FROM conversation_participants
+		WHERE conversation_id = ? AND user_id <> ?
+	`
+	_, err = tx.ExecContext(ctx, receiptsQuery, msg.ID, msg.ConversationID, msg.Sender.ID)
+	if err != nil {
+		return err
+	}
+
+	// Update the last activity timestamp of the conversation
+	updateConvQuery := "UPDATE conversations SET last_activity = ? WHERE id = ?"
+	_, err = tx.ExecContext(ctx, updateConvQuery, msg.Timestamp, msg.ConversationID)
+	return err
+}
+
+// messageColumns selects a message with its sender, the message it replies to, the origin of a forward
+// and its attachment. Rows selected with it are read by scanMessage.
+const messageColumns = `
+	m.id, m.conversation_id, m.sender_id, u.name, u.photo_url, m.content, m.type, ` + messageStatusColumn + `,
+	m.reply_to, m.timestamp, m.edited_at, m.deleted_at,
+	rm.sender_id, ru.name, ru.photo_url, rm.type, rm.content, rm.deleted_at, rm.attachment_name,
+	m.forwarded_from, m.forwarded_from_sender, fu.name, fu.photo_url, m.forward_count,
+	m.caption, m.attachment_name, m.attachment_type, m.attachment_size, m.attachment_duration, m.attachment_thumbnail
+`
+
+// messageJoins are the tables messageColumns selects from
+const messageJoins = `
+	FROM messages m
+	INNER JOIN users u ON m.sender_id = u.id
+	LEFT JOIN messages rm ON rm.id = m.reply_to
+	LEFT JOIN users ru ON ru.id = rm.sender_id
+	LEFT JOIN users fu ON fu.id = m.forwarded_from_sender
+`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMessage reads a row selected with messageColumns
+func scanMessage(row rowScanner) (models.Message, error) {
+	var msg models.Message
+	var photoURL sql.NullString
+	var replySenderID, replySenderName, replySenderPhotoURL, replyType, replyContent sql.NullString
+	var replyDeletedAt *time.Time
+	var replyAttachmentName sql.NullString
+	var forwardedFrom, forwardedSenderID, forwardedSenderName, forwardedSenderPhotoURL sql.NullString
+	var forwardCount int
+	var attachmentName, attachmentType, attachmentThumbnail sql.NullString
+	var attachmentSize sql.NullInt64
+	var attachmentDuration sql.NullFloat64
+	if err := row.Scan(
+		&msg.ID,
+		&msg.ConversationID,
+		&msg.Sender.ID,
+		&msg.Sender.Name,
+		&photoURL,
+		&msg.Content,
+		&msg.Type,
+		&msg.Status,
+		&msg.ReplyTo,
+		&msg.Timestamp,
+		&msg.EditedAt,
+		&msg.DeletedAt,
+		&replySenderID,
+		&replySenderName,
+		&replySenderPhotoURL,
+		&replyType,
+		&replyContent,
+		&replyDeletedAt,
+		&replyAttachmentName,
+		&forwardedFrom,
+		&forwardedSenderID,
+		&forwardedSenderName,
+		&forwardedSenderPhotoURL,
+		&forwardCount,
+		&msg.Caption,
+		&attachmentName,
+		&attachmentType,
+		&attachmentSize,
+		&attachmentDuration,
+		&attachmentThumbnail,
+	); err != nil {
+		return msg, err
+	}
+	msg.Sender.PhotoURL = photoURL.String
+
+	if attachmentName.Valid {
+		msg.Attachment = &models.Attachment{
+			FileName:  attachmentName.String,
+			MimeType:  attachmentType.String,
+			Size:      attachmentSize.Int64,
+			Duration:  attachmentDuration.Float64,
+			Thumbnail: attachmentThumbnail.String,
+		}
+	}
+
+	if msg.ReplyTo != nil && replyType.Valid {
+		replied := &models.Message{
+			ID:        *msg.ReplyTo,
+			Sender:    models.User{ID: replySenderID.String, Name: replySenderName.String, PhotoURL: replySenderPhotoURL.String},
+			Type:      models.MessageType(replyType.String),
+			Content:   replyContent.String,
+			DeletedAt: replyDeletedAt,
+		}
+		if replyAttachmentName.Valid {
+			replied.Attachment = &models.Attachment{FileName: replyAttachmentName.String}
+		}
+		msg.ReplyPreview = models.NewReplyPreview(replied)
+	}
+
+	if forwardCount > 0 {
+		msg.ForwardedFrom = &models.ForwardedFrom{
+			MessageID:    forwardedFrom.String,
+			Sender:       models.User{ID: forwardedSenderID.String, Name: forwardedSenderName.String, PhotoURL: forwardedSenderPhotoURL.String},
+			ForwardCount: forwardCount,
+		}
+	}
+
+	return msg, nil
+}
+
+// GetMessagesPage implements MessageRepository.GetMessagesPage
+func (r *SqliteRepository) GetMessagesPage(ctx context.Context, conversationID, viewerID string, before *models.MessageCursor, limit int) ([]models.Message, error) {
+	return r.messagesPage(ctx, "m.conversation_id = ?", conversationID, viewerID, before, limit)
+}
+
+// GetReplies implements MessageRepository.GetReplies
+func (r *SqliteRepository) GetReplies(ctx context.Context, messageID, viewerID string, before *models.MessageCursor, limit int) ([]models.Message, error) {
+	return r.messagesPage(ctx, "m.reply_to = ?", messageID, viewerID, before, limit)
+}
+
+// messagesPage pages through the messages matching a condition on one argument, newest first
+func (r *SqliteRepository) messagesPage(ctx context.Context, condition string, arg interface{}, viewerID string, before *models.MessageCursor, limit int) ([]models.Message, error) {
+	// Keyset pagination on (timestamp, id) so that pages stay stable while new messages arrive
+	query := "SELECT " + messageColumns + messageJoins + " WHERE " + condition
+	args := []interface{}{arg}
+	if viewerID != "" {
+		query += " AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message_id = m.id AND h.user_id = ?)"
+		args = append(args, viewerID)
+	}
+	if before != nil {
+		query += " AND (m.timestamp, m.id) < (?, ?)"
+		args = append(args, before.Timestamp.UTC(), before.ID)
+	}
+	query += " ORDER BY m.timestamp DESC, m.id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []models.Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := r.attachReactions(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// SearchMessages implements MessageRepository.SearchMessages.
+// Messages are matched by substring rather than through a full-text index:
+// every term must appear, ignoring ASCII case.
+func (r *SqliteRepository) SearchMessages(ctx context.Context, s models.MessageSearch) ([]models.SearchResult, error) {
+	terms := search.Terms(s.Query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	query := `
+		SELECT m.id, m.conversation_id, m.sender_id, u.name, u.photo_url, m.timestamp, m.content
+		FROM messages m
+		INNER JOIN conversation_participants cp ON cp.conversation_id = m.conversation_id AND cp.user_id = ?
+		INNER JOIN users u ON m.sender_id = u.id
+		WHERE m.type = 'text' AND m.deleted_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message_id = m.id AND h.user_id = cp.user_id)
+	`
+	args := []interface{}{s.UserID}
+	for _, term := range terms {
+		query += ` AND m.content LIKE ? ESCAPE '\'`
+		args = append(args, "%"+likeEscaper.Replace(term)+"%")
+	}
+	if s.ConversationID != "" {
+		query += " AND m.conversation_id = ?"
+		args = append(args, s.ConversationID)
+	}
+	if s.SenderID != "" {
+		query += " AND m.sender_id = ?"
+		args = append(args, s.SenderID)
+	}
+	if s.Before != nil {
+		query += " AND (m.timestamp, m.id) < (?, ?)"
+		args = append(args, s.Before.Timestamp.UTC(), s.Before.ID)
+	}
+	query += " ORDER BY m.timestamp DESC, m.id DESC LIMIT ?"
+	args = append(args, s.Limit)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []models.SearchResult
+	for rows.Next() {
+		var result models.SearchResult
+		var photoURL sql.NullString
+		var content string
+		if err := rows.Scan(&result.MessageID, &result.ConversationID, &result.Sender.ID, &result.Sender.Name,
+			&photoURL, &result.Timestamp, &content); err != nil {
+			return nil, err
+		}
+		result.Sender.PhotoURL = photoURL.String
+		result.Snippet = search.Snippet(content, terms)
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// attachReactions loads the reactions of a batch of messages with a single query
+func (r *SqliteRepository) attachReactions(ctx context.Context, messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, len(messages))
+	index := make(map[string]int, len(messages))
+	for i, msg := range messages {
+		args[i] = msg.ID
+		index[msg.ID] = i
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(messages)), ", ")
+	query := "SELECT message_id, user_id, emoji FROM reactions WHERE message_id IN (" + placeholders + ")"
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var reaction models.Reaction
+		if err := rows.Scan(&reaction.MessageID, &reaction.UserID, &reaction.Emoji); err != nil {
+			return err
+		}
+		i := index[reaction.MessageID]
+		messages[i].Reactions = append(messages[i].Reactions, reaction)
+	}
+
+	return rows.Err()
+}
+
+// GetMessageByID implements MessageRepository.GetMessageByID
+func (r *SqliteRepository) GetMessageByID(ctx context.Context, id string) (*models.Message, error) {
+	query := "SELECT " + messageColumns + messageJoins + " WHERE m.id = ?"
+	row := r.db.QueryRowContext(ctx, query, id)
+
+	msg, err := scanMessage(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// DeleteMessage implements MessageRepository.DeleteMessage
+func (r *SqliteRepository) DeleteMessage(ctx context.Context, id string) (string, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var msgType models.MessageType
+	var content string
+	err = tx.QueryRowContext(ctx, "SELECT type, content FROM messages WHERE id = ? AND deleted_at IS NULL", id).Scan(&msgType, &content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Soft delete by setting the deleted_at timestamp, leaving a tombstone without content
+	query := `
+		UPDATE messages SET deleted_at = ?, content = '', caption = '',
+			attachment_name = NULL, attachment_type = NULL, attachment_size = NULL, attachment_duration = NULL, attachment_thumbnail = NULL
+		WHERE id = ?
+	`
+	if _, err := tx.ExecContext(ctx, query, now(), id); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM message_revisions WHERE message_id = ?", id); err != nil {
+		return "", err
+	}
+
+	// Forwarded copies of a photo or file, and identical uploads, share its blob
+	shared := false
+	if msgType != models.TextMessage {
+		sharedQuery := "SELECT EXISTS (SELECT 1 FROM messages WHERE type <> 'text' AND content = ? AND deleted_at IS NULL)"
+		if err := tx.QueryRowContext(ctx, sharedQuery, content).Scan(&shared); err != nil {
+			return "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	if msgType == models.TextMessage || shared {
+		return "", nil
+	}
+	return content, nil
+}
+
+// HideMessage implements MessageRepository.HideMessage
+func (r *SqliteRepository) HideMessage(ctx context.Context, messageID, userID string) error {
+	query := "INSERT INTO hidden_messages (user_id, message_id, hidden_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING"
+	_, err := r.db.ExecContext(ctx, query, userID, messageID, now())
+	return err
+}
+
+// MarkMessagesReceived implements MessageRepository.MarkMessagesReceived
+func (r *SqliteRepository) MarkMessagesReceived(ctx context.Context, conversationID, userID string, upTo models.MessageCursor) error {
+	query := `
+		UPDATE message_receipts SET received_at = ?
+		WHERE user_id = ? AND received_at IS NULL AND message_id IN (
+			SELECT id FROM messages WHERE conversation_id = ? AND (timestamp, id) <= (?, ?)
+		)
+	`
+	_, err := r.db.ExecContext(ctx, query, now(), userID, conversationID, upTo.Timestamp.UTC(), upTo.ID)
+	return err
+}
+
+// MarkMessagesRead implements MessageRepository.MarkMessagesRead
+func (r *SqliteRepository) MarkMessagesRead(ctx context.Context, conversationID, userID string, upTo models.MessageCursor) error {
+	readAt := now()
+	query := `
+		UPDATE message_receipts SET read_at = ?, received_at = COALESCE(received_at, ?)
+		WHERE user_id = ? AND read_at IS NULL AND message_id IN (
+			SELECT id FROM messages WHERE conversation_id = ? AND (timestamp, id) <= (?, ?)
+		)
+	`
+	_, err := r.db.ExecContext(ctx, query, readAt, readAt, userID, conversationID, upTo.Timestamp.UTC(), upTo.ID)
+	return err
+}
+
+// GetMessageReceipts implements MessageRepository.GetMessageReceipts
+func (r *SqliteRepository) GetMessageReceipts(ctx context.Context, messageID string) ([]models.Receipt, error) {
+	query := `
+		SELECT mr.message_id, mr.user_id, u.name, mr.received_at, mr.read_at
+		FROM message_receipts mr
+		INNER JOIN users u ON mr.user_id = u.id
+		WHERE mr.message_id = ?
+		ORDER BY mr.read_at ASC NULLS LAST, mr.received_at ASC NULLS LAST, u.name ASC
+	`
+	rows, err := r.db.QueryContext(ctx, query, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var receipts []models.Receipt
+	for rows.Next() {
+		var receipt models.Receipt
+		if err := rows.Scan(&receipt.MessageID, &receipt.UserID, &receipt.UserName, &receipt.ReceivedAt, &receipt.ReadAt); err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return receipts, nil
+}
+
+// UpdateMessageContent implements MessageRepository.UpdateMessageContent
+func (r *SqliteRepository) UpdateMessageContent(ctx context.Context, id string, content string, editedAt time.Time) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Keep the current content, stamped with the time it was written, before replacing it
+	revisionQuery := `
+		INSERT INTO message_revisions (message_id, content, written_at)
+		SELECT id, content, COALESCE(edited_at, timestamp) FROM messages WHERE id = ?
+	`
+	if _, err := tx.ExecContext(ctx, revisionQuery, id); err != nil {
+		return err
+	}
+
+	query := "UPDATE messages SET content = ?, edited_at = ? WHERE id = ?"
+	if _, err := tx.ExecContext(ctx, query, content, editedAt.UTC(), id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetMessageRevisions implements MessageRepository.GetMessageRevisions
+func (r *SqliteRepository) GetMessageRevisions(ctx context.Context, messageID string) ([]models.MessageRevision, error) {
+	query := "SELECT content, written_at FROM message_revisions WHERE message_id = ? ORDER BY id ASC"
+	rows, err := r.db.QueryContext(ctx, query, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []models.MessageRevision
+	for rows.Next() {
+		var revision models.MessageRevision
+		if err := rows.Scan(&revision.Content, &revision.Timestamp); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+// AddReaction implements ReactionRepository.AddReaction
+func (r *SqliteRepository) AddReaction(ctx context.Context, messageID, userID, emoji string) error {
+	// Insert the reaction, or replace the emoji of the user's existing one
+	query := `
+		INSERT INTO reactions (message_id, user_id, emoji) VALUES (?, ?, ?)
+		ON CONFLICT (message_id, user_id) DO UPDATE SET emoji = excluded.emoji
+	`
+	_, err := r.db.ExecContext(ctx, query, messageID, userID, emoji)
+	return err
+}
+
+// RemoveReaction implements ReactionRepository.RemoveReaction
+func (r *SqliteRepository) RemoveReaction(ctx context.Context, messageID, userID string) error {
+	deleteQuery := "DELETE FROM reactions WHERE message_id = ? AND user_id = ?"
+	result, err := r.db.ExecContext(ctx, deleteQuery, messageID, userID)
+	if err != nil {
+		return err
+	}
+
+	// Check if any rows were affected
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return models.NewError(models.ErrNotFound, "reaction not found")
+	}
+
+	return nil
+}
+
+// GetReactionsByMessageID implements ReactionRepository.GetReactionsByMessageID
+func (r *SqliteRepository) GetReactionsByMessageID(ctx context.Context, messageID string) ([]models.Reaction, error) {
+	query := "SELECT message_id, user_id, emoji FROM reactions WHERE message_id = ?"
+	rows, err := r.db.QueryContext(ctx, query, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reactions []models.Reaction
+	for rows.Next() {
+		var reaction models.Reaction
+		if err := rows.Scan(&reaction.MessageID, &reaction.UserID, &reaction.Emoji); err != nil {
+			return nil, err
+		}
+		reactions = append(reactions, reaction)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reactions, nil
+}
@@ -0,0 +1,21 @@
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/repository/repositorytest"
+	"github.com/fallenkarma/wasatext/internal/repository/sqlite"
+)
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.Repository {
+		repo, err := sqlite.NewSqliteRepository(filepath.Join(t.TempDir(), "wasatext.db"))
+		if err != nil {
+			t.Fatalf("NewSqliteRepository: %v", err)
+		}
+		t.Cleanup(func() { repo.Close() })
+		return repo
+	})
+}
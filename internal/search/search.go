@@ -0,0 +1,139 @@
+// Package search holds the text matching and snippet rendering shared by the
+// repository backends that implement message search.
+//
+// Snippets are HTML: the message text is escaped and every match is wrapped in
+// <mark></mark>, so clients can render them as is.
+package search
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+const (
+	// StartSel and StopSel delimit matches in text highlighted by the database.
+	// They are control characters that do not occur in chat messages.
+	StartSel = "\x02"
+	StopSel  = "\x03"
+
+	// snippetLength is the number of characters of context a snippet keeps
+	snippetLength = 160
+
+	ellipsis = "…"
+)
+
+// Terms splits a query into the lowercase terms a message must all contain
+func Terms(query string) []string {
+	var terms []string
+	for _, field := range strings.Fields(query) {
+		term := strings.Trim(field, `"'`)
+		if term == "" {
+			continue
+		}
+		terms = append(terms, string(lower([]rune(term))))
+	}
+	return terms
+}
+
+// Matches reports whether content contains every term, ignoring case
+func Matches(content string, terms []string) bool {
+	text := string(lower([]rune(content)))
+	for _, term := range terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return len(terms) > 0
+}
+
+// Snippet returns an HTML excerpt of content around its first match, with every match highlighted
+func Snippet(content string, terms []string) string {
+	text := []rune(content)
+	folded := lower(text)
+
+	// Mark which characters belong to a match
+	marked := make([]bool, len(text))
+	first := -1
+	for _, term := range terms {
+		needle := []rune(term)
+		for i := 0; i+len(needle) <= len(folded); i++ {
+			if equalRunes(folded[i:i+len(needle)], needle) {
+				for j := i; j < i+len(needle); j++ {
+					marked[j] = true
+				}
+				if first < 0 || i < first {
+					first = i
+				}
+			}
+		}
+	}
+
+	// Keep a window of context around the first match
+	start, end := 0, len(text)
+	if len(text) > snippetLength {
+		start = max(first-snippetLength/4, 0)
+		end = min(start+snippetLength, len(text))
+		start = max(end-snippetLength, 0)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString(ellipsis)
+	}
+	inMark := false
+	for i := start; i < end; i++ {
+		if marked[i] != inMark {
+			if marked[i] {
+				b.WriteString("<mark>")
+			} else {
+				b.WriteString("</mark>")
+			}
+			inMark = marked[i]
+		}
+		b.WriteString(html.EscapeString(string(text[i])))
+	}
+	if inMark {
+		b.WriteString("</mark>")
+	}
+	if end < len(text) {
+		b.WriteString(ellipsis)
+	}
+	return b.String()
+}
+
+// FromDelimited turns text whose matches are wrapped in StartSel and StopSel into an HTML snippet
+func FromDelimited(s string) string {
+	var b strings.Builder
+	for s != "" {
+		before, rest, found := strings.Cut(s, StartSel)
+		b.WriteString(html.EscapeString(before))
+		if !found {
+			break
+		}
+		match, after, _ := strings.Cut(rest, StopSel)
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(match))
+		b.WriteString("</mark>")
+		s = after
+	}
+	return b.String()
+}
+
+// lower folds each rune on its own so that indexes in the result match the input
+func lower(text []rune) []rune {
+	folded := make([]rune, len(text))
+	for i, r := range text {
+		folded[i] = unicode.ToLower(r)
+	}
+	return folded
+}
+
+func equalRunes(a, b []rune) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package search
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTerms(t *testing.T) {
+	got := Terms(`  Hello "World" '' ÀB `)
+	want := []string{"hello", "world", "àb"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Terms = %q, want %q", got, want)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		content string
+		query   string
+		want    bool
+	}{
+		{"Lunch at noon", "lunch", true},
+		{"Lunch at noon", "NOON lunch", true},
+		{"Lunch at noon", "lunch dinner", false},
+		{"Lunch at noon", "", false},
+	}
+	for _, tt := range tests {
+		if got := Matches(tt.content, Terms(tt.query)); got != tt.want {
+			t.Errorf("Matches(%q, %q) = %v, want %v", tt.content, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	tests := []struct {
+		content string
+		query   string
+		want    string
+	}{
+		{"Lunch at noon", "lunch", "<mark>Lunch</mark> at noon"},
+		{"lunch & <b>coffee</b>", "coffee", "lunch &amp; &lt;b&gt;<mark>coffee</mark>&lt;/b&gt;"},
+		{"ice-cream icecream", "ice", "<mark>ice</mark>-cream <mark>ice</mark>cream"},
+		{"nothing here", "lunch", "nothing here"},
+	}
+	for _, tt := range tests {
+		if got := Snippet(tt.content, Terms(tt.query)); got != tt.want {
+			t.Errorf("Snippet(%q, %q) = %q, want %q", tt.content, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSnippetKeepsContextAroundFirstMatch(t *testing.T) {
+	content := strings.Repeat("a ", 200) + "needle" + strings.Repeat(" b", 200)
+
+	got := Snippet(content, Terms("needle"))
+	if !strings.Contains(got, "<mark>needle</mark>") {
+		t.Fatalf("Snippet = %q, want the match", got)
+	}
+	if !strings.HasPrefix(got, ellipsis) || !strings.HasSuffix(got, ellipsis) {
+		t.Errorf("Snippet = %q, want ellipses on both sides", got)
+	}
+	text := strings.NewReplacer("<mark>", "", "</mark>", "", ellipsis, "").Replace(got)
+	if n := len([]rune(text)); n != snippetLength {
+		t.Errorf("snippet keeps %d characters, want %d", n, snippetLength)
+	}
+}
+
+func TestFromDelimited(t *testing.T) {
+	in := "fish " + StartSel + "&" + StopSel + " " + StartSel + "chips" + StopSel + " <3"
+	want := "fish <mark>&amp;</mark> <mark>chips</mark> &lt;3"
+	if got := FromDelimited(in); got != want {
+		t.Errorf("FromDelimited = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+)
+
+var (
+	// ErrAttachmentTooLarge is returned for files over the size limit of their message type
+	ErrAttachmentTooLarge = errors.New("attachment is too large")
+
+	// ErrInvalidAttachment is returned for empty files, audio or video messages whose
+	// file is not audio or video, and metadata out of range
+	ErrInvalidAttachment = invalid("invalid attachment")
+)
+
+// maxDuration bounds the duration clients report for audio and video
+const maxDuration = 24 * time.Hour
+
+// maxFileNameLength is the number of characters of a file name that are kept
+const maxFileNameLength = 255
+
+// maxCaptionLength caps the text sent along with media, in characters
+const maxCaptionLength = 1024
+
+// Upload is the media a client sends along with a message
+type Upload struct {
+	Type     models.MessageType // Photo, file, audio or video
+	File     io.ReadSeeker
+	FileName string
+	Caption  string
+
+	// Duration is the length of audio and video in seconds, as measured by the client
+	Duration float64
+
+	// Thumbnail is an optional image showing a still of a video
+	Thumbnail io.Reader
+}
+
+// UploadLimit returns the size in bytes of the largest media message the service accepts,
+// including a video's still
+func (s *Service) UploadLimit() int64 {
+	limit := s.config.Media.MaxBytes
+	for _, size := range s.config.AttachmentLimits {
+		limit = max(limit, size+s.config.Media.MaxBytes)
+	}
+	return limit
+}
+
+// storeAttachment checks the file of a file, audio or video message and writes it,
+// with the still of a video, to the blob store. It returns the key of the file and
+// the attachment describing it.
+func (s *Service) storeAttachment(ctx context.Context, upload Upload) (string, *models.Attachment, error) {
+	limit := s.config.AttachmentLimits[upload.Type]
+	if limit <= 0 {
+		return "", nil, fmt.Errorf("%w: %s messages are not accepted", ErrInvalidAttachment, upload.Type)
+	}
+
+	// Hash the file to name it, reading one byte past the limit to detect oversized files
+	hash := sha256.New()
+	var head bytes.Buffer
+	size, err := io.Copy(io.MultiWriter(hash, &limitedBuffer{buf: &head, max: 512}), io.LimitReader(upload.File, limit+1))
+	if err != nil {
+		return "", nil, err
+	}
+	if size > limit {
+		return "", nil, fmt.Errorf("%w: %s messages are limited to %d bytes", ErrAttachmentTooLarge, upload.Type, limit)
+	}
+	if size == 0 {
+		return "", nil, fmt.Errorf("%w: the file is empty", ErrInvalidAttachment)
+	}
+
+	mimeType, err := attachmentType(upload.Type, http.DetectContentType(head.Bytes()))
+	if err != nil {
+		return "", nil, err
+	}
+	attachment := &models.Attachment{
+		FileName: cleanFileName(upload.FileName),
+		MimeType: mimeType,
+		Size:     size,
+	}
+	if upload.Type == models.AudioMessage || upload.Type == models.VideoMessage {
+		// Written so that NaN, which ParseFloat accepts, fails the check too
+		if !(upload.Duration >= 0 && upload.Duration <= maxDuration.Seconds()) {
+			return "", nil, fmt.Errorf("%w: duration must be between 0 and %s", ErrInvalidAttachment, maxDuration)
+		}
+		attachment.Duration = upload.Duration
+	}
+
+	base := messageFilesDir + "/" + hex.EncodeToString(hash.Sum(nil))
+	key := base + fileExt(attachment.FileName)
+
+	// Check the still before storing anything
+	var still *file
+	if upload.Type == models.VideoMessage && upload.Thumbnail != nil {
+		img, err := s.media.Process(upload.Thumbnail)
+		if err != nil {
+			return "", nil, err
+		}
+		f := img.Original
+		if large, ok := img.Thumbnails["large"]; ok {
+			f = large
+		}
+		still = &file{key: base + "_thumb" + path.Ext(f.Name), data: f.Data, contentType: f.ContentType}
+	}
+
+	if _, err := upload.File.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	if err := s.blobs.Put(ctx, key, upload.File, mimeType); err != nil {
+		return "", nil, err
+	}
+	if still != nil {
+		if err := s.blobs.Put(ctx, still.key, bytes.NewReader(still.data), still.contentType); err != nil {
+			return "", nil, err
+		}
+		attachment.Thumbnail = still.key
+	}
+	return key, attachment, nil
+}
+
+// removeAttachment deletes the file of a message, and the still of a video, from the blob store.
+// Nothing references them anymore, so failures are only logged.
+func (s *Service) removeAttachment(ctx context.Context, key string, attachment *models.Attachment) {
+	keys := []string{key}
+	if attachment != nil && attachment.Thumbnail != "" {
+		keys = append(keys, attachment.Thumbnail)
+	}
+	for _, key := range keys {
+		if err := s.blobs.Delete(ctx, key); err != nil {
+			slog.WarnContext(ctx, "Failed to remove attachment", "key", key, "error", err)
+		}
+	}
+}
+
+// file is a blob waiting to be stored
+type file struct {
+	key         string
+	data        []byte
+	contentType string
+}
+
+// limitedBuffer keeps the first max bytes written to it and discards the rest
+type limitedBuffer struct {
+	buf *bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// attachmentType checks the sniffed content type of a file against its message type
+// and returns the MIME type it is stored and served as. Browsers record voice notes
+// in containers that are sniffed as video, or as a generic Ogg stream.
+func attachmentType(msgType models.MessageType, sniffed string) (string, error) {
+	switch msgType {
+	case models.AudioMessage:
+		switch {
+		case strings.HasPrefix(sniffed, "audio/"):
+			return sniffed, nil
+		case sniffed == "application/ogg":
+			return "audio/ogg", nil
+		case sniffed == "video/webm", sniffed == "video/mp4":
+			return "audio/" + strings.TrimPrefix(sniffed, "video/"), nil
+		}
+		return "", fmt.Errorf("%w: %s is not an audio file", ErrInvalidAttachment, sniffed)
+	case models.VideoMessage:
+		if strings.HasPrefix(sniffed, "video/") {
+			return sniffed, nil
+		}
+		return "", fmt.Errorf("%w: %s is not a video", ErrInvalidAttachment, sniffed)
+	}
+	return sniffed, nil
+}
+
+// cleanFileName keeps the base name of an uploaded file, without control characters
+func cleanFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	if runes := []rune(name); len(runes) > maxFileNameLength {
+		name = string(runes[:maxFileNameLength])
+	}
+	return name
+}
+
+// fileExt returns the extension a file is stored with: the lowercased extension of
+// its name, if short and alphanumeric
+func fileExt(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if len(ext) < 2 || len(ext) > 10 {
+		return ""
+	}
+	for _, c := range ext[1:] {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return ""
+		}
+	}
+	return ext
+}
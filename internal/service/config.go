@@ -0,0 +1,72 @@
+package service
+
+import (
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/media"
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/storage"
+)
+
+// Config holds the tunable settings of the service layer
+type Config struct {
+	// SessionTTL is how long a session token stays valid after login
+	SessionTTL time.Duration
+
+	// AllowPasswordlessLogin lets accounts without a password log in by name alone.
+	// When false, new accounts must pick a password and passwordless accounts are locked out.
+	AllowPasswordlessLogin bool
+
+	// MinPasswordLength is the minimum number of characters in a password
+	MinPasswordLength int
+
+	// PasswordHasher hashes and verifies user passwords
+	PasswordHasher PasswordHasher
+
+	// EditWindow is how long after sending a message its sender may still edit it.
+	// Zero lets messages be edited at any time.
+	EditWindow time.Duration
+
+	// DeleteWindow is how long after sending a message its sender may still delete it for everyone.
+	// Zero lets messages be deleted at any time.
+	DeleteWindow time.Duration
+
+	// Media bounds the images users upload
+	Media media.Config
+
+	// AttachmentLimits caps the size in bytes of the files of file, audio and video messages.
+	// Message types without a limit are not accepted.
+	AttachmentLimits map[models.MessageType]int64
+
+	// Blobs stores uploaded media; the repository only keeps their keys
+	Blobs storage.BlobStore
+
+	// MediaURL is where this server serves the blob store from.
+	// Message photos are always fetched there, on URLs signed by MediaSigner.
+	MediaURL string
+
+	// MediaSigner signs the URLs of message photos, so only the members of a
+	// conversation, who receive them with its messages, can fetch its photos
+	MediaSigner *storage.URLSigner
+}
+
+// DefaultConfig returns the settings used when none are provided
+func DefaultConfig() Config {
+	return Config{
+		SessionTTL:             30 * 24 * time.Hour,
+		AllowPasswordlessLogin: true,
+		MinPasswordLength:      8,
+		PasswordHasher:         NewPBKDF2Hasher(),
+		EditWindow:             15 * time.Minute,
+		DeleteWindow:           48 * time.Hour,
+		Media:                  media.DefaultConfig(),
+		Blobs:                  storage.NewLocalStore("uploads", "/uploads"),
+		MediaURL:               "/uploads",
+		MediaSigner:            storage.NewURLSigner(nil, time.Hour),
+		AttachmentLimits: map[models.MessageType]int64{
+			models.FileMessage:  25 << 20,
+			models.AudioMessage: 16 << 20,
+			models.VideoMessage: 64 << 20,
+		},
+	}
+}
@@ -0,0 +1,33 @@
+package service
+
+import "github.com/fallenkarma/wasatext/internal/models"
+
+// Kinds of errors the service returns; see the models package.
+// Use errors.Is to tell them apart.
+var (
+	ErrValidation   = models.ErrValidation
+	ErrUnauthorized = models.ErrUnauthorized
+	ErrForbidden    = models.ErrForbidden
+	ErrNotFound     = models.ErrNotFound
+	ErrConflict     = models.ErrConflict
+)
+
+func invalid(format string, args ...any) error {
+	return models.NewError(ErrValidation, format, args...)
+}
+
+func unauthorized(format string, args ...any) error {
+	return models.NewError(ErrUnauthorized, format, args...)
+}
+
+func forbidden(format string, args ...any) error {
+	return models.NewError(ErrForbidden, format, args...)
+}
+
+func notFound(format string, args ...any) error {
+	return models.NewError(ErrNotFound, format, args...)
+}
+
+func conflict(format string, args ...any) error {
+	return models.NewError(ErrConflict, format, args...)
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fallenkarma/wasatext/internal/events"
+	"github.com/fallenkarma/wasatext/internal/models"
+)
+
+// ErrNotAllowed is returned when a group's roles or policy forbid an action.
+// It is an ErrForbidden.
+var ErrNotAllowed = forbidden("not allowed in this group")
+
+// isAdmin reports whether a role carries admin rights; the owner is always an admin
+func isAdmin(role models.ParticipantRole) bool {
+	return role == models.RoleOwner || role == models.RoleAdmin
+}
+
+// participantRole returns the user's role in the conversation, and whether they take part in it
+func participantRole(conv *models.Conversation, userID string) (models.ParticipantRole, bool) {
+	for _, participant := range conv.Participants {
+		if participant.ID == userID {
+			return participant.Role, true
+		}
+	}
+	return "", false
+}
+
+// requireGroupMember loads a group and returns the user's role in it
+func (s *Service) requireGroupMember(ctx context.Context, groupID, userID string) (*models.Conversation, models.ParticipantRole, error) {
+	conv, err := s.requireParticipant(ctx, groupID, userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if conv.Type != models.GroupConversation {
+		return nil, "", invalid("conversation is not a group")
+	}
+
+	role, _ := participantRole(conv, userID)
+	return conv, role, nil
+}
+
+// checkPermission checks that a participant with the given role is granted a group permission
+func checkPermission(role models.ParticipantRole, permission models.GroupPermission, action string) error {
+	if permission == models.AdminsAllowed && !isAdmin(role) {
+		return fmt.Errorf("%w: only admins can %s", ErrNotAllowed, action)
+	}
+	return nil
+}
+
+// checkCanPost checks that a participant may send messages to the conversation
+func checkCanPost(conv *models.Conversation, userID string) error {
+	if conv.Type != models.GroupConversation || conv.Policy == nil {
+		return nil
+	}
+	role, _ := participantRole(conv, userID)
+	return checkPermission(role, conv.Policy.SendMessages, "send messages")
+}
+
+// PromoteMember makes a member of a group an admin. Only admins can promote members.
+func (s *Service) PromoteMember(ctx context.Context, requesterID, groupID, userID string) error {
+	conv, requesterRole, err := s.requireGroupMember(ctx, groupID, requesterID)
+	if err != nil {
+		return err
+	}
+	if !isAdmin(requesterRole) {
+		return fmt.Errorf("%w: only admins can promote members", ErrNotAllowed)
+	}
+
+	role, ok := participantRole(conv, userID)
+	if !ok {
+		return notFound("user is not in the group")
+	}
+	if role != models.RoleMember {
+		return conflict("user is already an %s", role)
+	}
+
+	return s.setRole(ctx, groupID, userID, models.RoleAdmin)
+}
+
+// DemoteAdmin makes an admin of a group a regular member again.
+// Only the owner can demote admins, though admins may step down themselves.
+func (s *Service) DemoteAdmin(ctx context.Context, requesterID, groupID, userID string) error {
+	conv, requesterRole, err := s.requireGroupMember(ctx, groupID, requesterID)
+	if err != nil {
+		return err
+	}
+	if requesterRole != models.RoleOwner && requesterID != userID {
+		return fmt.Errorf("%w: only the owner can demote admins", ErrNotAllowed)
+	}
+
+	role, ok := participantRole(conv, userID)
+	if !ok {
+		return notFound("user is not in the group")
+	}
+	if role != models.RoleAdmin {
+		return conflict("user is not an admin")
+	}
+
+	return s.setRole(ctx, groupID, userID, models.RoleMember)
+}
+
+func (s *Service) setRole(ctx context.Context, groupID, userID string, role models.ParticipantRole) error {
+	if err := s.repo.SetParticipantRole(ctx, groupID, userID, role); err != nil {
+		return err
+	}
+
+	s.publish(ctx, events.ParticipantRole, groupID, events.RoleChange{UserID: userID, Role: role})
+	return nil
+}
+
+// RemoveFromGroup removes another participant from a group. The owner can remove anyone,
+// admins can remove regular members, and the owner cannot be removed.
+func (s *Service) RemoveFromGroup(ctx context.Context, requesterID, groupID, userID string) error {
+	if requesterID == userID {
+		return invalid("use LeaveGroup to leave a group")
+	}
+
+	conv, requesterRole, err := s.requireGroupMember(ctx, groupID, requesterID)
+	if err != nil {
+		return err
+	}
+
+	role, ok := participantRole(conv, userID)
+	if !ok {
+		return notFound("user is not in the group")
+	}
+	switch {
+	case role == models.RoleOwner:
+		return fmt.Errorf("%w: the owner cannot be removed", ErrNotAllowed)
+	case role == models.RoleAdmin && requesterRole != models.RoleOwner:
+		return fmt.Errorf("%w: only the owner can remove admins", ErrNotAllowed)
+	case !isAdmin(requesterRole):
+		return fmt.Errorf("%w: only admins can remove members", ErrNotAllowed)
+	}
+
+	if err := s.repo.RemoveUserFromGroup(ctx, groupID, userID); err != nil {
+		return err
+	}
+
+	// The removed user is no longer a participant but still learns about their removal
+	s.publish(ctx, events.ParticipantLeft, groupID, events.ParticipantChange{UserID: userID, RemovedBy: requesterID}, userID)
+	return nil
+}
+
+// SetGroupPolicy changes who may add members, edit the group and post in it.
+// Only admins can change the policy; fields left empty in the request are not changed.
+func (s *Service) SetGroupPolicy(ctx context.Context, requesterID, groupID string, req models.SetGroupPolicyRequest) (*models.GroupPolicy, error) {
+	conv, requesterRole, err := s.requireGroupMember(ctx, groupID, requesterID)
+	if err != nil {
+		return nil, err
+	}
+	if !isAdmin(requesterRole) {
+		return nil, fmt.Errorf("%w: only admins can change the group's permissions", ErrNotAllowed)
+	}
+
+	policy := models.DefaultGroupPolicy()
+	if conv.Policy != nil {
+		policy = *conv.Policy
+	}
+	for _, change := range []struct {
+		value  models.GroupPermission
+		target *models.GroupPermission
+	}{
+		{req.AddMembers, &policy.AddMembers},
+		{req.EditInfo, &policy.EditInfo},
+		{req.SendMessages, &policy.SendMessages},
+	} {
+		switch change.value {
+		case "":
+		case models.EveryoneAllowed, models.AdminsAllowed:
+			*change.target = change.value
+		default:
+			return nil, invalid("invalid permission %q: must be %q or %q", change.value, models.EveryoneAllowed, models.AdminsAllowed)
+		}
+	}
+
+	if err := s.repo.UpdateGroupPolicy(ctx, groupID, policy); err != nil {
+		return nil, err
+	}
+
+	s.publish(ctx, events.GroupPolicyChanged, groupID, policy)
+	return &policy, nil
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"context"
+	"mime/multipart"
+
+	"github.com/fallenkarma/wasatext/internal/events"
+	"github.com/fallenkarma/wasatext/internal/models"
+)
+
+// UserService covers accounts, sessions and profiles
+type UserService interface {
+	Login(ctx context.Context, username string, password string) (*models.LoginResponse, error)
+	Authenticate(ctx context.Context, token string) (*models.User, error)
+	Logout(ctx context.Context, token string) error
+	SetPassword(ctx context.Context, userID string, currentPassword string, newPassword string) error
+	UpdateUsername(ctx context.Context, userID string, newUsername string) error
+	SetUserPhoto(ctx context.Context, userID string, photo multipart.File) (*models.Photo, error)
+	PhotoLimit() int64
+	GetUser(ctx context.Context, userID string) (*models.User, error)
+	GetAllUsers(ctx context.Context) ([]models.User, error)
+}
+
+// ConversationService covers conversations, group membership and the events of a user's
+// conversations. Every method that acts for a user checks that the user may do so.
+type ConversationService interface {
+	GetConversations(ctx context.Context, userID string) ([]models.Conversation, error)
+	GetConversation(ctx context.Context, userID, conversationID string) (*models.Conversation, error)
+	CreateConversation(ctx context.Context, creatorID string, participantIDs []string, convType models.ConversationType, name string) (*models.Conversation, error)
+	AddToGroup(ctx context.Context, requesterID, groupID, userID string) error
+	LeaveGroup(ctx context.Context, groupID, userID string) error
+	SetGroupName(ctx context.Context, requesterID, groupID, name string) error
+	SetGroupPhoto(ctx context.Context, requesterID, groupID string, photo multipart.File) (*models.Photo, error)
+	PhotoLimit() int64
+	PromoteMember(ctx context.Context, requesterID, groupID, userID string) error
+	DemoteAdmin(ctx context.Context, requesterID, groupID, userID string) error
+	RemoveFromGroup(ctx context.Context, requesterID, groupID, userID string) error
+	SetGroupPolicy(ctx context.Context, requesterID, groupID string, req models.SetGroupPolicyRequest) (*models.GroupPolicy, error)
+	SubscribeEvents(userID string) *events.Subscription
+}
+
+// MessageService covers messages, their reactions and receipts.
+// Every method checks that the user takes part in the conversation of the message.
+type MessageService interface {
+	GetConversationMessages(ctx context.Context, userID, conversationID, cursor string, limit int) (*models.MessagePage, error)
+	GetReplies(ctx context.Context, userID, messageID, cursor string, limit int) (*models.MessagePage, error)
+	SearchMessages(ctx context.Context, userID, query, conversationID, senderID, cursor string, limit int) (*models.SearchResultPage, error)
+	SendTextMessage(ctx context.Context, senderID, conversationID, content string, replyToID *string) (*models.Message, error)
+	SendMediaMessage(ctx context.Context, senderID, conversationID string, upload Upload, replyToID string) (*models.Message, error)
+	UploadLimit() int64
+	ForwardMessage(ctx context.Context, userID, messageID string, targetConversationIDs []string) ([]models.Message, error)
+	DeleteMessage(ctx context.Context, userID, messageID string, scope models.DeleteScope) error
+	UpdateMessage(ctx context.Context, userID, messageID string, content string) error
+	GetMessageHistory(ctx context.Context, userID, messageID string) ([]models.MessageRevision, error)
+	AddReaction(ctx context.Context, userID, messageID, emoji string) error
+	RemoveReaction(ctx context.Context, userID, messageID string) error
+	MarkMessagesReceived(ctx context.Context, userID, conversationID, messageID string) error
+	MarkMessagesRead(ctx context.Context, userID, conversationID, messageID string) error
+	GetMessageReceipts(ctx context.Context, userID, messageID string) ([]models.Receipt, error)
+}
+
+var (
+	_ UserService         = (*Service)(nil)
+	_ ConversationService = (*Service)(nil)
+	_ MessageService      = (*Service)(nil)
+)
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/fallenkarma/wasatext/internal/media"
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/storage"
+)
+
+// Directories of the blob store media is kept in
+const (
+	userPhotosDir    = "user_photos"
+	groupPhotosDir   = "group_photos"
+	messagePhotosDir = "message_photos"
+	messageFilesDir  = "message_files" // Files of file, audio and video messages
+)
+
+// PrivateMedia reports whether the blob stored under key may only be fetched
+// on a signed URL. Message media is private; profile and group photos are public.
+func PrivateMedia(key string) bool {
+	return strings.HasPrefix(key, messagePhotosDir+"/") || strings.HasPrefix(key, messageFilesDir+"/")
+}
+
+// PhotoLimit returns the size in bytes of the largest profile or group photo the service accepts
+func (s *Service) PhotoLimit() int64 {
+	return s.config.Media.MaxBytes
+}
+
+// storePhoto writes a processed photo and its thumbnails to the blob store
+// and returns the key of the original, which is what the repository keeps
+func storePhoto(ctx context.Context, blobs storage.BlobStore, dir string, img *media.Image) (string, error) {
+	for _, f := range img.Files() {
+		if err := blobs.Put(ctx, dir+"/"+f.Name, bytes.NewReader(f.Data), f.ContentType); err != nil {
+			return "", err
+		}
+	}
+	return dir + "/" + img.Original.Name, nil
+}
+
+// removePhoto deletes a photo and its thumbnails from the blob store.
+// Nothing references the photo anymore, so failures are only logged.
+func (s *Service) removePhoto(ctx context.Context, key string) {
+	for _, variant := range media.VariantKeys(key) {
+		if err := s.blobs.Delete(ctx, variant); err != nil {
+			slog.WarnContext(ctx, "Failed to remove photo", "key", variant, "error", err)
+		}
+	}
+}
+
+// mediaURL returns the URL clients fetch a blob from, signed if the blob is private
+func (s *Service) mediaURL(key string) string {
+	if !PrivateMedia(key) {
+		return s.blobs.URL(key)
+	}
+	return s.config.MediaSigner.Sign(strings.TrimSuffix(s.config.MediaURL, "/")+"/"+key, key)
+}
+
+// photo returns the URLs of a stored photo and its thumbnails
+func (s *Service) photo(key string) *models.Photo {
+	if key == "" {
+		return &models.Photo{}
+	}
+	variants := media.Variants(key)
+	for name, variant := range variants {
+		variants[name] = s.mediaURL(variant)
+	}
+	return &models.Photo{URL: s.mediaURL(key), Variants: variants}
+}
+
+// presentUser turns the key of a user's photo into the URLs of the photo and its thumbnails
+func (s *Service) presentUser(user *models.User) {
+	photo := s.photo(user.PhotoURL)
+	user.PhotoURL, user.PhotoVariants = photo.URL, photo.Variants
+}
+
+// presentConversation fills in the photo URLs of a conversation, its participants and messages
+func (s *Service) presentConversation(conv *models.Conversation) {
+	photo := s.photo(conv.PhotoURL)
+	conv.PhotoURL, conv.PhotoVariants = photo.URL, photo.Variants
+	for i := range conv.Participants {
+		photo := s.photo(conv.Participants[i].PhotoURL)
+		conv.Participants[i].PhotoURL, conv.Participants[i].PhotoVariants = photo.URL, photo.Variants
+	}
+	if conv.LastMessage != nil {
+		s.presentMessage(conv.LastMessage)
+	}
+	for i := range conv.Messages {
+		s.presentMessage(&conv.Messages[i])
+	}
+}
+
+// presentMessage fills in the media URLs of a message and the photo URLs of the users it mentions
+func (s *Service) presentMessage(msg *models.Message) {
+	s.presentUser(&msg.Sender)
+	if msg.Type == models.PhotoMessage && msg.DeletedAt == nil && msg.Content != "" {
+		photo := s.photo(msg.Content)
+		msg.Content, msg.Variants = photo.URL, photo.Variants
+	}
+	if msg.Type.HasAttachment() && msg.DeletedAt == nil && msg.Content != "" {
+		msg.Content = s.mediaURL(msg.Content)
+		if msg.Attachment != nil && msg.Attachment.Thumbnail != "" {
+			attachment := *msg.Attachment
+			attachment.Thumbnail = s.mediaURL(attachment.Thumbnail)
+			msg.Attachment = &attachment
+		}
+	}
+	if msg.ReplyPreview != nil {
+		s.presentUser(&msg.ReplyPreview.Sender)
+		if msg.ReplyPreview.Type == models.PhotoMessage && msg.ReplyPreview.Content != "" {
+			msg.ReplyPreview.Content = s.mediaURL(msg.ReplyPreview.Content)
+		}
+	}
+	if msg.ForwardedFrom != nil {
+		s.presentUser(&msg.ForwardedFrom.Sender)
+	}
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PasswordHasher hashes and verifies user passwords.
+// Encoded hashes must carry everything needed to verify them (algorithm, cost, salt).
+type PasswordHasher interface {
+	// Hash returns the encoded hash of a password
+	Hash(password string) (string, error)
+
+	// Verify reports whether the password matches the encoded hash
+	Verify(password, encoded string) (bool, error)
+}
+
+// PBKDF2Hasher is the default PasswordHasher, using salted PBKDF2-HMAC-SHA256.
+// Hashes are encoded as "pbkdf2-sha256$<iterations>$<salt>$<key>".
+type PBKDF2Hasher struct {
+	Iterations int
+}
+
+const (
+	pbkdf2Prefix     = "pbkdf2-sha256"
+	pbkdf2SaltLength = 16
+	pbkdf2KeyLength  = 32
+)
+
+// NewPBKDF2Hasher creates a PBKDF2Hasher with the recommended iteration count
+func NewPBKDF2Hasher() *PBKDF2Hasher {
+	return &PBKDF2Hasher{
+		Iterations: 600000,
+	}
+}
+
+// Hash implements PasswordHasher.Hash
+func (h *PBKDF2Hasher) Hash(password string) (string, error) {
+	salt := make([]byte, pbkdf2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, h.Iterations, pbkdf2KeyLength)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s$%d$%s$%s",
+		pbkdf2Prefix,
+		h.Iterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify implements PasswordHasher.Verify
+func (h *PBKDF2Hasher) Verify(password, encoded string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != pbkdf2Prefix {
+		return false, errors.New("unsupported password hash format")
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false, fmt.Errorf("invalid password hash iterations: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, fmt.Errorf("invalid password hash salt: %w", err)
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false, fmt.Errorf("invalid password hash key: %w", err)
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
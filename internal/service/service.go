@@ -2,97 +2,557 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"mime/multipart"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/fallenkarma/wasatext/internal/events"
+	"github.com/fallenkarma/wasatext/internal/media"
+	"github.com/fallenkarma/wasatext/internal/metrics"
 	"github.com/fallenkarma/wasatext/internal/models"
 	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/storage"
 )
 
-// Service defines the business logic for the WASAText application
+// Service defines the business logic for the WASAText application.
+// It implements UserService, ConversationService and MessageService.
 type Service struct {
-	repo repository.Repository
+	repo   repository.Repository
+	config Config
+	events *events.Bus
+	media  *media.Processor
+	blobs  storage.BlobStore
 }
 
-// New creates a new service
+// New creates a new service with the default configuration
 func New(repo repository.Repository) *Service {
+	return NewWithConfig(repo, DefaultConfig())
+}
+
+// NewWithConfig creates a new service with the given configuration
+func NewWithConfig(repo repository.Repository, config Config) *Service {
 	return &Service{
-		repo: repo,
+		repo:   repo,
+		config: config,
+		events: events.NewBus(),
+		media:  media.NewProcessor(config.Media),
+		blobs:  config.Blobs,
+	}
+}
+
+// SubscribeEvents registers a subscription to the events of the user's conversations
+func (s *Service) SubscribeEvents(userID string) *events.Subscription {
+	return s.events.Subscribe(userID)
+}
+
+// publish notifies the current participants of a conversation, plus any extra recipients, of a change.
+// It is called after the change has been written, so failures to resolve the participants are ignored.
+func (s *Service) publish(ctx context.Context, eventType events.Type, conversationID string, payload interface{}, extraRecipients ...string) {
+	recipients := append([]string{}, extraRecipients...)
+	conv, err := s.repo.GetConversationByID(ctx, conversationID, "")
+	if err == nil && conv != nil {
+		for _, participant := range conv.Participants {
+			recipients = append(recipients, participant.ID)
+		}
 	}
+
+	s.events.Publish(events.Event{
+		Type:           eventType,
+		ConversationID: conversationID,
+		Timestamp:      time.Now(),
+		Payload:        payload,
+		Recipients:     recipients,
+	})
 }
 
-// Login authenticates a user or creates a new user if the username doesn't exist
-func (s *Service) Login(ctx context.Context, username string) (*models.LoginResponse, error) {
+// Login authenticates a user or creates a new user if the username doesn't exist,
+// and opens a new session for them.
+// Accounts with a password set must supply it; accounts without one log in by name
+// unless passwordless login is disabled in the configuration.
+func (s *Service) Login(ctx context.Context, username string, password string) (*models.LoginResponse, error) {
 	if len(username) < 3 || len(username) > 16 {
-		return nil, errors.New("username must be between 3 and 16 characters")
+		return nil, invalid("username must be between 3 and 16 characters")
 	}
 
-	user, err := s.repo.CreateUser(ctx, username)
+	user, err := s.repo.GetUserByName(ctx, username)
 	if err != nil {
 		return nil, err
 	}
 
+	if user == nil {
+		// New account: a password is mandatory when passwordless login is disabled
+		if password == "" && !s.config.AllowPasswordlessLogin {
+			return nil, invalid("a password is required to create an account")
+		}
+		if password != "" {
+			if err := s.validatePassword(password); err != nil {
+				return nil, err
+			}
+		}
+
+		if password != "" {
+			user, err = s.createUserWithPassword(ctx, username, password)
+		} else {
+			user, err = s.repo.CreateUser(ctx, username)
+		}
+		if errors.Is(err, ErrConflict) {
+			// Someone signed up with the name in the meantime: this is now a
+			// login to their account, which must not take their password over
+			return s.Login(ctx, username, password)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		hash, err := s.repo.GetUserPasswordHash(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if hash != "" {
+			ok, err := s.config.PasswordHasher.Verify(password, hash)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, unauthorized("invalid username or password")
+			}
+		} else if !s.config.AllowPasswordlessLogin {
+			return nil, unauthorized("passwordless login is disabled for this account")
+		}
+	}
+
+	token, session, err := s.newSession(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.CreateSession(ctx, *session); err != nil {
+		return nil, err
+	}
+
 	return &models.LoginResponse{
-		Id: user.ID,
+		Id:        user.ID,
+		Token:     token,
+		ExpiresAt: session.ExpiresAt,
 	}, nil
 }
 
+// SetPassword sets or changes a user's password.
+// Changing an existing password requires the current one.
+func (s *Service) SetPassword(ctx context.Context, userID string, currentPassword string, newPassword string) error {
+	if err := s.validatePassword(newPassword); err != nil {
+		return err
+	}
+
+	hash, err := s.repo.GetUserPasswordHash(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if hash != "" {
+		ok, err := s.config.PasswordHasher.Verify(currentPassword, hash)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return forbidden("current password is incorrect")
+		}
+	}
+
+	return s.storePassword(ctx, userID, newPassword)
+}
+
+// validatePassword checks a new password against the configured policy
+func (s *Service) validatePassword(password string) error {
+	if len(password) < s.config.MinPasswordLength {
+		return invalid("password must be at least %d characters", s.config.MinPasswordLength)
+	}
+	if len(password) > 128 {
+		return invalid("password must be at most 128 characters")
+	}
+	return nil
+}
+
+// storePassword hashes and saves a user's password
+func (s *Service) storePassword(ctx context.Context, userID string, password string) error {
+	hash, err := s.config.PasswordHasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	return s.repo.SetUserPasswordHash(ctx, userID, hash)
+}
+
+// createUserWithPassword creates an account along with its password, failing
+// with ErrConflict if the name was taken since it was looked up
+func (s *Service) createUserWithPassword(ctx context.Context, username string, password string) (*models.User, error) {
+	hash, err := s.config.PasswordHasher.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	return s.repo.CreateUserWithPasswordHash(ctx, username, hash)
+}
+
+// Authenticate resolves a session token to its user.
+// It fails if the token is unknown, expired or revoked.
+func (s *Service) Authenticate(ctx context.Context, token string) (*models.User, error) {
+	session, err := s.repo.GetSessionByID(ctx, hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, unauthorized("invalid session token")
+	}
+	if session.RevokedAt != nil {
+		return nil, unauthorized("session has been revoked")
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, unauthorized("session has expired")
+	}
+
+	user, err := s.repo.GetUserByID(ctx, session.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, unauthorized("user not found")
+	}
+
+	return user, nil
+}
+
+// Logout revokes the session identified by the given token
+func (s *Service) Logout(ctx context.Context, token string) error {
+	return s.repo.RevokeSession(ctx, hashToken(token))
+}
+
+// newSession generates a random token and the session that stores its hash
+func (s *Service) newSession(userID string) (string, *models.Session, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	session := &models.Session{
+		ID:        hashToken(token),
+		UserID:    userID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.config.SessionTTL),
+	}
+
+	return token, session, nil
+}
+
+// hashToken derives the stored session ID from a bearer token,
+// so a leaked sessions table cannot be replayed
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 // UpdateUsername updates a user's username
 func (s *Service) UpdateUsername(ctx context.Context, userID string, newUsername string) error {
 	if len(newUsername) < 3 || len(newUsername) > 16 {
-		return errors.New("username must be between 3 and 16 characters")
+		return invalid("username must be between 3 and 16 characters")
 	}
 
 	return s.repo.UpdateUsername(ctx, userID, newUsername)
 }
 
 // SetUserPhoto sets a user's profile photo
-func (s *Service) SetUserPhoto(ctx context.Context, userID string, photo multipart.File) (string, error) {
-	return s.repo.SaveUserPhoto(ctx, userID, photo)
+func (s *Service) SetUserPhoto(ctx context.Context, userID string, photo multipart.File) (*models.Photo, error) {
+	img, err := s.media.Process(photo)
+	if err != nil {
+		return nil, err
+	}
+	key, err := storePhoto(ctx, s.blobs, userPhotosDir, img)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.SetUserPhoto(ctx, userID, key); err != nil {
+		return nil, err
+	}
+	return s.photo(key), nil
 }
 
 // GetUser gets a user by ID
 func (s *Service) GetUser(ctx context.Context, userID string) (*models.User, error) {
-	return s.repo.GetUserByID(ctx, userID)
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil || user == nil {
+		return user, err
+	}
+	s.presentUser(user)
+	return user, nil
 }
 
 // GetUserByName gets a user by username
 func (s *Service) GetUserByName(ctx context.Context, username string) (*models.User, error) {
-	return s.repo.GetUserByName(ctx, username)
+	user, err := s.repo.GetUserByName(ctx, username)
+	if err != nil || user == nil {
+		return user, err
+	}
+	s.presentUser(user)
+	return user, nil
 }
 
 // GetAllUsers gets all users
 func (s *Service) GetAllUsers(ctx context.Context) ([]models.User, error) {
-	return s.repo.GetAllUsers(ctx)
+	users, err := s.repo.GetAllUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		s.presentUser(&users[i])
+	}
+	return users, nil
 }
 
 // GetConversations gets all conversations for a user
 func (s *Service) GetConversations(ctx context.Context, userID string) ([]models.Conversation, error) {
-	return s.repo.GetConversationsByUserID(ctx, userID)
+	convs, err := s.repo.GetConversationsByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range convs {
+		s.presentConversation(&convs[i])
+	}
+	return convs, nil
 }
 
-// GetConversation gets a specific conversation
-func (s *Service) GetConversation(ctx context.Context, conversationID string) (*models.Conversation, error) {
-	return s.repo.GetConversationByID(ctx, conversationID)
+// GetConversation gets a conversation the user takes part in
+func (s *Service) GetConversation(ctx context.Context, userID, conversationID string) (*models.Conversation, error) {
+	conv, err := s.requireParticipant(ctx, conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	s.presentConversation(conv)
+	return conv, nil
 }
 
-// CreateDirectConversation creates a new direct conversation between two users
-func (s *Service) CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, error) {
-	// Validate users exist
-	_, err := s.repo.GetUserByID(ctx, userID1)
+const (
+	// defaultPageSize is the number of messages returned when the client does not ask for a limit
+	defaultPageSize = 50
+
+	// maxPageSize caps the number of messages returned in a single page
+	maxPageSize = 100
+)
+
+// GetConversationMessages gets a page of a conversation's history, oldest message first.
+// An empty cursor starts from the most recent message; limit defaults to defaultPageSize.
+func (s *Service) GetConversationMessages(ctx context.Context, userID, conversationID, cursor string, limit int) (*models.MessagePage, error) {
+	if _, err := s.requireParticipant(ctx, conversationID, userID); err != nil {
+		return nil, err
+	}
+
+	return s.messagePage(cursor, limit, func(before *models.MessageCursor, limit int) ([]models.Message, error) {
+		return s.repo.GetMessagesPage(ctx, conversationID, userID, before, limit)
+	})
+}
+
+// GetReplies gets a page of the direct replies to a message, oldest reply first.
+// An empty cursor starts from the most recent reply; limit defaults to defaultPageSize.
+func (s *Service) GetReplies(ctx context.Context, userID, messageID, cursor string, limit int) (*models.MessagePage, error) {
+	msg, err := s.repo.GetMessageByID(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, notFound("message not found")
+	}
+
+	if _, err := s.requireParticipant(ctx, msg.ConversationID, userID); err != nil {
+		return nil, err
+	}
+
+	return s.messagePage(cursor, limit, func(before *models.MessageCursor, limit int) ([]models.Message, error) {
+		return s.repo.GetReplies(ctx, messageID, userID, before, limit)
+	})
+}
+
+// messagePage turns a newest-first repository listing into a page presented oldest first
+func (s *Service) messagePage(cursor string, limit int, list func(before *models.MessageCursor, limit int) ([]models.Message, error)) (*models.MessagePage, error) {
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	var before *models.MessageCursor
+	if cursor != "" {
+		var err error
+		before, err = models.DecodeMessageCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Fetch one extra message to know whether an older page exists
+	messages, err := list(before, limit+1)
 	if err != nil {
 		return nil, err
 	}
-	_, err = s.repo.GetUserByID(ctx, userID2)
+
+	page := &models.MessagePage{}
+	if len(messages) > limit {
+		messages = messages[:limit]
+		oldest := messages[len(messages)-1]
+		page.NextCursor = models.MessageCursor{Timestamp: oldest.Timestamp, ID: oldest.ID}.Encode()
+	}
+
+	// The repository returns newest first; pages are presented oldest first
+	page.Messages = make([]models.Message, len(messages))
+	for i, msg := range messages {
+		s.presentMessage(&msg)
+		page.Messages[len(messages)-1-i] = msg
+	}
+
+	return page, nil
+}
+
+// maxSearchQueryLength caps the length of search queries, in characters
+const maxSearchQueryLength = 200
+
+// SearchMessages searches the text messages of the conversations the user takes part in,
+// newest first, optionally within one conversation or from one sender.
+// An empty cursor starts from the most recent match; limit defaults to defaultPageSize.
+func (s *Service) SearchMessages(ctx context.Context, userID, query, conversationID, senderID, cursor string, limit int) (*models.SearchResultPage, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, invalid("search query cannot be empty")
+	}
+	if utf8.RuneCountInString(query) > maxSearchQueryLength {
+		return nil, invalid("search query cannot be longer than %d characters", maxSearchQueryLength)
+	}
+
+	if conversationID != "" {
+		if _, err := s.requireParticipant(ctx, conversationID, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	search := models.MessageSearch{
+		UserID:         userID,
+		Query:          query,
+		ConversationID: conversationID,
+		SenderID:       senderID,
+		Limit:          limit + 1, // One extra result tells whether an older page exists
+	}
+	if cursor != "" {
+		before, err := models.DecodeMessageCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		search.Before = before
+	}
+
+	results, err := s.repo.SearchMessages(ctx, search)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		s.presentUser(&results[i].Sender)
+	}
+
+	page := &models.SearchResultPage{Results: results}
+	if len(results) > limit {
+		page.Results = results[:limit]
+		oldest := page.Results[limit-1]
+		page.NextCursor = models.MessageCursor{Timestamp: oldest.Timestamp, ID: oldest.MessageID}.Encode()
+	}
+	if page.Results == nil {
+		page.Results = []models.SearchResult{}
+	}
+
+	return page, nil
+}
+
+// CreateConversation creates a direct conversation between the creator and the one
+// participant given, or a group of the creator and the participants
+func (s *Service) CreateConversation(ctx context.Context, creatorID string, participantIDs []string, convType models.ConversationType, name string) (*models.Conversation, error) {
+	var conv *models.Conversation
+	var err error
+	switch convType {
+	case models.DirectConversation:
+		if len(participantIDs) != 1 {
+			return nil, invalid("a direct conversation needs exactly one other participant")
+		}
+		conv, err = s.CreateDirectConversation(ctx, creatorID, participantIDs[0])
+	case models.GroupConversation:
+		conv, err = s.CreateGroupConversation(ctx, name, creatorID, participantIDs)
+	default:
+		return nil, invalid("invalid conversation type %q: must be %q or %q", convType, models.DirectConversation, models.GroupConversation)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return s.repo.CreateDirectConversation(ctx, userID1, userID2)
+	s.publishConversationCreated(ctx, conv)
+	return conv, nil
+}
+
+// publishConversationCreated announces a new conversation to each participant as
+// they see it, so that a direct conversation is named after the other person
+func (s *Service) publishConversationCreated(ctx context.Context, conv *models.Conversation) {
+	now := time.Now()
+	for _, participant := range conv.Participants {
+		seen, err := s.repo.GetConversationByID(ctx, conv.ID, participant.ID)
+		if err != nil || seen == nil {
+			continue
+		}
+		s.presentConversation(seen)
+
+		s.events.Publish(events.Event{
+			Type:           events.ConversationCreated,
+			ConversationID: conv.ID,
+			Timestamp:      now,
+			Payload:        seen,
+			Recipients:     []string{participant.ID},
+		})
+	}
+}
+
+// CreateDirectConversation creates a direct conversation between two users,
+// or returns the one they already have
+func (s *Service) CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, error) {
+	if userID1 == userID2 {
+		return nil, invalid("cannot start a conversation with yourself")
+	}
+	if err := s.requireUsers(ctx, userID1, userID2); err != nil {
+		return nil, err
+	}
+
+	conv, err := s.repo.CreateDirectConversation(ctx, userID1, userID2)
+	if err != nil {
+		return nil, err
+	}
+	s.presentConversation(conv)
+	return conv, nil
 }
 
 // CreateGroupConversation creates a new group conversation
 func (s *Service) CreateGroupConversation(ctx context.Context, name string, creatorID string, participants []string) (*models.Conversation, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, invalid("group name cannot be empty")
+	}
+
 	// Make sure the creator is included in participants
 	hasCreator := false
 	for _, id := range participants {
@@ -105,59 +565,150 @@ func (s *Service) CreateGroupConversation(ctx context.Context, name string, crea
 		participants = append(participants, creatorID)
 	}
 
-	// Validate all participants exist
-	for _, id := range participants {
-		_, err := s.repo.GetUserByID(ctx, id)
+	if err := s.requireUsers(ctx, participants...); err != nil {
+		return nil, err
+	}
+
+	conv, err := s.repo.CreateGroupConversation(ctx, name, creatorID, participants)
+	if err != nil {
+		return nil, err
+	}
+	s.presentConversation(conv)
+	return conv, nil
+}
+
+// requireUsers checks that every user exists
+func (s *Service) requireUsers(ctx context.Context, userIDs ...string) error {
+	for _, id := range userIDs {
+		user, err := s.repo.GetUserByID(ctx, id)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if user == nil {
+			return notFound("user %s not found", id)
 		}
 	}
-
-	return s.repo.CreateGroupConversation(ctx, name, participants)
+	return nil
 }
 
-// AddToGroup adds a user to a group
-func (s *Service) AddToGroup(ctx context.Context, groupID, userID string) error {
+// AddToGroup adds a user to a group, if the group's policy lets the requester add members
+func (s *Service) AddToGroup(ctx context.Context, requesterID, groupID, userID string) error {
+	conv, role, err := s.requireGroupMember(ctx, groupID, requesterID)
+	if err != nil {
+		return err
+	}
+	if err := checkPermission(role, conv.Policy.AddMembers, "add members"); err != nil {
+		return err
+	}
+
 	// Check if the user exists
-	_, err := s.repo.GetUserByID(ctx, userID)
+	user, err := s.repo.GetUserByID(ctx, userID)
 	if err != nil {
 		return err
 	}
+	if user == nil {
+		return notFound("user not found")
+	}
 
-	return s.repo.AddUserToGroup(ctx, groupID, userID)
+	if err := s.repo.AddUserToGroup(ctx, groupID, userID); err != nil {
+		return err
+	}
+
+	s.publish(ctx, events.ParticipantJoined, groupID, events.ParticipantChange{UserID: userID})
+	return nil
 }
 
-// LeaveGroup removes a user from a group
+// LeaveGroup removes a user from a group. When the owner leaves, ownership passes to
+// the longest-standing admin, or failing that to the longest-standing member.
 func (s *Service) LeaveGroup(ctx context.Context, groupID, userID string) error {
-	return s.repo.RemoveUserFromGroup(ctx, groupID, userID)
+	_, role, err := s.requireGroupMember(ctx, groupID, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.repo.RemoveUserFromGroup(ctx, groupID, userID); err != nil {
+		return err
+	}
+
+	// The leaver is no longer a participant but still learns about their own departure
+	s.publish(ctx, events.ParticipantLeft, groupID, events.ParticipantChange{UserID: userID}, userID)
+
+	if role == models.RoleOwner {
+		conv, err := s.repo.GetConversationByID(ctx, groupID, userID)
+		if err == nil && conv != nil {
+			for _, participant := range conv.Participants {
+				if participant.Role == models.RoleOwner {
+					s.publish(ctx, events.ParticipantRole, groupID, events.RoleChange{UserID: participant.ID, Role: models.RoleOwner})
+				}
+			}
+		}
+	}
+	return nil
 }
 
-// SetGroupName sets a group's name
-func (s *Service) SetGroupName(ctx context.Context, groupID, name string) error {
-	return s.repo.UpdateGroupName(ctx, groupID, name)
+// SetGroupName sets a group's name, if the group's policy lets the requester edit it
+func (s *Service) SetGroupName(ctx context.Context, requesterID, groupID, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return invalid("group name cannot be empty")
+	}
+
+	conv, role, err := s.requireGroupMember(ctx, groupID, requesterID)
+	if err != nil {
+		return err
+	}
+	if err := checkPermission(role, conv.Policy.EditInfo, "edit the group"); err != nil {
+		return err
+	}
+
+	if err := s.repo.UpdateGroupName(ctx, groupID, name); err != nil {
+		return err
+	}
+
+	s.publish(ctx, events.GroupRenamed, groupID, events.GroupRename{Name: name})
+	return nil
 }
 
-// SetGroupPhoto sets a group's photo
-func (s *Service) SetGroupPhoto(ctx context.Context, groupID string, photo multipart.File) (string, error) {
-	return s.repo.SaveGroupPhoto(ctx, groupID, photo)
+// SetGroupPhoto sets a group's photo, if the group's policy lets the requester edit it
+func (s *Service) SetGroupPhoto(ctx context.Context, requesterID, groupID string, photo multipart.File) (*models.Photo, error) {
+	conv, role, err := s.requireGroupMember(ctx, groupID, requesterID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPermission(role, conv.Policy.EditInfo, "edit the group"); err != nil {
+		return nil, err
+	}
+
+	img, err := s.media.Process(photo)
+	if err != nil {
+		return nil, err
+	}
+	key, err := storePhoto(ctx, s.blobs, groupPhotosDir, img)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.SetGroupPhoto(ctx, groupID, key); err != nil {
+		return nil, err
+	}
+	return s.photo(key), nil
 }
 
 // SendTextMessage sends a new text message
 func (s *Service) SendTextMessage(ctx context.Context, senderID, conversationID, content string, replyToID *string) (*models.Message, error) {
 	// Verify the conversation exists and the user is a participant
-	conv, err := s.repo.GetConversationByID(ctx, conversationID)
+	conv, err := s.repo.GetConversationByID(ctx, conversationID, senderID)
 	if err != nil {
 		return nil, err
 	}
 	if conv == nil {
-		return nil, errors.New("conversation not found")
+		return nil, notFound("conversation not found")
 	}
 	sender, err := s.repo.GetUserByID(ctx, senderID)
 	if err != nil {
 		return nil, err
 	}
 	if sender == nil {
-		return nil, errors.New("sender not found")
+		return nil, notFound("sender not found")
 	}
 
 	// Check if the user is a participant in the conversation
@@ -169,7 +720,18 @@ func (s *Service) SendTextMessage(ctx context.Context, senderID, conversationID,
 		}
 	}
 	if !isParticipant {
-		return nil, errors.New("user is not a participant in the conversation")
+		return nil, forbidden("user is not a participant in the conversation")
+	}
+	if err := checkCanPost(conv, senderID); err != nil {
+		return nil, err
+	}
+
+	var replyTo *models.Message
+	if replyToID != nil && *replyToID != "" {
+		replyTo, err = s.replyTarget(ctx, conversationID, *replyToID)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Create the message
@@ -180,29 +742,52 @@ func (s *Service) SendTextMessage(ctx context.Context, senderID, conversationID,
 		Status:    models.Sent,
 	}
 
-    if replyToID != nil && *replyToID != "" {
-        msg.ReplyTo = replyToID
-    }
+	if replyTo != nil {
+		msg.ReplyTo = &replyTo.ID
+	}
+
+	created, err := s.repo.CreateMessage(ctx, msg, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if replyTo != nil {
+		created.ReplyPreview = models.NewReplyPreview(replyTo)
+	}
+	s.presentMessage(created)
+	metrics.MessagesSent.WithLabelValues(string(created.Type)).Inc()
 
-	return s.repo.CreateMessage(ctx, msg, conversationID)
+	s.publish(ctx, events.MessageCreated, conversationID, created)
+	return created, nil
 }
 
 // SendPhotoMessage sends a new photo message
 func (s *Service) SendPhotoMessage(ctx context.Context, senderID, conversationID string, photo multipart.File, replyToID string) (*models.Message, error) {
+	return s.SendMediaMessage(ctx, senderID, conversationID, Upload{Type: models.PhotoMessage, File: photo}, replyToID)
+}
+
+// SendMediaMessage sends a new photo, file, audio or video message, with an optional caption
+func (s *Service) SendMediaMessage(ctx context.Context, senderID, conversationID string, upload Upload, replyToID string) (*models.Message, error) {
+	if upload.Type != models.PhotoMessage && !upload.Type.HasAttachment() {
+		return nil, fmt.Errorf("%w: %q is not a media message type", ErrInvalidAttachment, upload.Type)
+	}
+	if utf8.RuneCountInString(upload.Caption) > maxCaptionLength {
+		return nil, invalid("caption cannot be longer than %d characters", maxCaptionLength)
+	}
+
 	// Verify the conversation exists and the user is a participant
-	conv, err := s.repo.GetConversationByID(ctx, conversationID)
+	conv, err := s.repo.GetConversationByID(ctx, conversationID, senderID)
 	if err != nil {
 		return nil, err
 	}
 	if conv == nil {
-		return nil, errors.New("conversation not found")
+		return nil, notFound("conversation not found")
 	}
 	sender, err := s.repo.GetUserByID(ctx, senderID)
 	if err != nil {
 		return nil, err
 	}
 	if sender == nil {
-		return nil, errors.New("sender not found")
+		return nil, notFound("sender not found")
 	}
 
 	// Check if the user is a participant in the conversation
@@ -214,99 +799,225 @@ func (s *Service) SendPhotoMessage(ctx context.Context, senderID, conversationID
 		}
 	}
 	if !isParticipant {
-		return nil, errors.New("user is not a participant in the conversation")
+		return nil, forbidden("user is not a participant in the conversation")
 	}
-
-	// Save the photo and get the path
-	photoPath, err := s.repo.SaveMessagePhoto(ctx, senderID, photo)
-	if err != nil {
+	if err := checkCanPost(conv, senderID); err != nil {
 		return nil, err
 	}
 
+	// Validate the reply before storing anything
+	var replyTo *models.Message
+	if replyToID != "" {
+		replyTo, err = s.replyTarget(ctx, conversationID, replyToID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Store the media; the message keeps its key
+	var key string
+	var attachment *models.Attachment
+	if upload.Type == models.PhotoMessage {
+		img, err := s.media.Process(upload.File)
+		if err != nil {
+			return nil, err
+		}
+		key, err = storePhoto(ctx, s.blobs, messagePhotosDir, img)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		key, attachment, err = s.storeAttachment(ctx, upload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Create the message
 	msg := models.Message{
-		Sender:    *sender,
-		Content:   photoPath,
-		Type:      models.PhotoMessage,
-		Status:    models.Sent,
+		Sender:     *sender,
+		Content:    key,
+		Type:       upload.Type,
+		Status:     models.Sent,
+		Caption:    upload.Caption,
+		Attachment: attachment,
 	}
 
+	if replyTo != nil {
+		msg.ReplyTo = &replyTo.ID
+	}
 
-	if replyToID != "" {
-		msg.ReplyTo = &replyToID
+	created, err := s.repo.CreateMessage(ctx, msg, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if replyTo != nil {
+		created.ReplyPreview = models.NewReplyPreview(replyTo)
 	}
-	return s.repo.CreateMessage(ctx, msg, conversationID)
+	s.presentMessage(created)
+	metrics.MessagesSent.WithLabelValues(string(created.Type)).Inc()
+
+	s.publish(ctx, events.MessageCreated, conversationID, created)
+	return created, nil
 }
 
-// ForwardMessage forwards a message to another conversation
-func (s *Service) ForwardMessage(ctx context.Context, userID, messageID, targetConversationID string) error {
+// maxForwardTargets caps the number of conversations a message can be forwarded to at once
+const maxForwardTargets = 20
+
+// ForwardMessage forwards a message the user can see to one or more conversations they can post in.
+// The copies record where the message was forwarded from and are created all together or not at all.
+func (s *Service) ForwardMessage(ctx context.Context, userID, messageID string, targetConversationIDs []string) ([]models.Message, error) {
+	if len(targetConversationIDs) == 0 {
+		return nil, invalid("no target conversation")
+	}
+	if len(targetConversationIDs) > maxForwardTargets {
+		return nil, invalid("cannot forward to more than %d conversations at once", maxForwardTargets)
+	}
+
 	// Get the original message
 	msg, err := s.repo.GetMessageByID(ctx, messageID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if msg == nil {
-		return errors.New("message not found")
+		return nil, notFound("message not found")
 	}
 
-	// Verify the target conversation exists and the user is a participant
-	targetConv, err := s.repo.GetConversationByID(ctx, targetConversationID)
-	if err != nil {
-		return err
+	// Only participants of the source conversation can see the message
+	if _, err := s.requireParticipant(ctx, msg.ConversationID, userID); err != nil {
+		return nil, err
 	}
-	if targetConv == nil {
-		return errors.New("target conversation not found")
+	if msg.DeletedAt != nil {
+		return nil, conflict("cannot forward a deleted message")
 	}
+
 	sender, err := s.repo.GetUserByID(ctx, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if sender == nil {
-		return errors.New("sender not found")
+		return nil, notFound("sender not found")
 	}
 
-	// Check if the user is a participant in the target conversation
-	isParticipant := false
-	for _, participant := range targetConv.Participants {
-		if participant.ID == userID {
-			isParticipant = true
-			break
+	// Check every target before creating anything
+	copies := make([]models.Message, 0, len(targetConversationIDs))
+	seen := make(map[string]bool)
+	for _, targetConversationID := range targetConversationIDs {
+		if seen[targetConversationID] {
+			continue
 		}
-	}
-	if !isParticipant {
-		return errors.New("user is not a participant in the target conversation")
+		seen[targetConversationID] = true
+
+		targetConv, err := s.repo.GetConversationByID(ctx, targetConversationID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if targetConv == nil {
+			return nil, notFound("target conversation %s not found", targetConversationID)
+		}
+
+		isParticipant := false
+		for _, participant := range targetConv.Participants {
+			if participant.ID == userID {
+				isParticipant = true
+				break
+			}
+		}
+		if !isParticipant {
+			return nil, forbidden("user is not a participant in the target conversation %s", targetConversationID)
+		}
+		if err := checkCanPost(targetConv, userID); err != nil {
+			return nil, err
+		}
+
+		// Create a new message in the target conversation with the same content
+		copies = append(copies, models.Message{
+			ConversationID: targetConversationID,
+			Sender:         *sender,
+			Content:        msg.Content,
+			Type:           msg.Type,
+			Status:         models.Sent,
+			ForwardedFrom:  msg.Forwarded(),
+			Caption:        msg.Caption,
+			Attachment:     msg.Attachment,
+		})
 	}
 
-	// Create a new message in the target conversation with the same content
-	newMsg := models.Message{
-		Sender:    *sender,
-		Content:   msg.Content,
-		Type:      msg.Type,
-		Status:    models.Sent,
+	created, err := s.repo.CreateMessages(ctx, copies)
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = s.repo.CreateMessage(ctx, newMsg, targetConversationID)
-	return err
+	for i := range created {
+		s.presentMessage(&created[i])
+		metrics.MessagesSent.WithLabelValues(string(created[i].Type)).Inc()
+		s.publish(ctx, events.MessageCreated, created[i].ConversationID, &created[i])
+	}
+	return created, nil
 }
 
-// DeleteMessage deletes a message
-func (s *Service) DeleteMessage(ctx context.Context, userID, messageID string) error {
+// DeleteMessage deletes a message, either for everyone or for the requesting user only.
+// Deleting for everyone is reserved to the sender, within the configured window after sending;
+// any participant can delete a message for themselves.
+func (s *Service) DeleteMessage(ctx context.Context, userID, messageID string, scope models.DeleteScope) error {
 	// Get the message
 	msg, err := s.repo.GetMessageByID(ctx, messageID)
 	if err != nil {
 		return err
 	}
 	if msg == nil {
-		return errors.New("message not found")
+		return notFound("message not found")
 	}
-	
 
-	// Check if the user is the sender of the message
-	if msg.Sender.ID != userID {
-		return errors.New("only the sender can delete a message")
-	}
+	switch scope {
+	case models.DeleteForMe:
+		if _, err := s.requireParticipant(ctx, msg.ConversationID, userID); err != nil {
+			return err
+		}
+		if err := s.repo.HideMessage(ctx, messageID, userID); err != nil {
+			return err
+		}
+
+		// Only the user's own sessions drop the message
+		s.events.Publish(events.Event{
+			Type:           events.MessageHidden,
+			ConversationID: msg.ConversationID,
+			Timestamp:      time.Now(),
+			Payload:        events.MessageRef{MessageID: messageID},
+			Recipients:     []string{userID},
+		})
+		return nil
 
-	return s.repo.DeleteMessage(ctx, messageID)
+	case models.DeleteForEveryone:
+		// Check if the user is the sender of the message
+		if msg.Sender.ID != userID {
+			return forbidden("only the sender can delete a message for everyone")
+		}
+		if msg.DeletedAt != nil {
+			return conflict("message already deleted")
+		}
+		if s.config.DeleteWindow > 0 && time.Since(msg.Timestamp) > s.config.DeleteWindow {
+			return forbidden("messages can only be deleted for everyone within %s of sending", s.config.DeleteWindow)
+		}
+
+		released, err := s.repo.DeleteMessage(ctx, messageID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case released == "":
+		case msg.Type == models.PhotoMessage:
+			s.removePhoto(ctx, released)
+		default:
+			s.removeAttachment(ctx, released, msg.Attachment)
+		}
+
+		s.publish(ctx, events.MessageDeleted, msg.ConversationID, events.MessageRef{MessageID: messageID})
+		return nil
+
+	default:
+		return invalid("invalid delete scope %q: must be %q or %q", scope, models.DeleteForEveryone, models.DeleteForMe)
+	}
 }
 
 // UpdateMessage updates a message
@@ -317,38 +1028,209 @@ func (s *Service) UpdateMessage(ctx context.Context, userID, messageID string, c
 		return err
 	}
 	if msg == nil {
-		return errors.New("message not found")
+		return notFound("message not found")
 	}
 	
 
 	// Check if the user is the sender of the message
 	if msg.Sender.ID != userID {
-		return errors.New("only the sender can update a message")
+		return forbidden("only the sender can update a message")
+	}
+	if msg.DeletedAt != nil {
+		return conflict("cannot edit a deleted message")
+	}
+	if msg.Type != models.TextMessage {
+		return invalid("only text messages can be edited")
+	}
+
+	now := time.Now()
+	if s.config.EditWindow > 0 && now.Sub(msg.Timestamp) > s.config.EditWindow {
+		return forbidden("messages can only be edited within %s of sending", s.config.EditWindow)
 	}
 
-	return s.repo.UpdateMessageContent(ctx, messageID, content)
+	if strings.TrimSpace(content) == "" {
+		return invalid("message content cannot be empty")
+	}
+	if content == msg.Content {
+		return nil
+	}
+
+	if err := s.repo.UpdateMessageContent(ctx, messageID, content, now); err != nil {
+		return err
+	}
+
+	s.publish(ctx, events.MessageEdited, msg.ConversationID, events.MessageEdit{MessageID: messageID, Content: content, EditedAt: now})
+	return nil
 }
 
+// GetMessageHistory returns every version of a message's content, oldest first, ending with the current one
+func (s *Service) GetMessageHistory(ctx context.Context, userID, messageID string) ([]models.MessageRevision, error) {
+	msg, err := s.repo.GetMessageByID(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, notFound("message not found")
+	}
+
+	if _, err := s.requireParticipant(ctx, msg.ConversationID, userID); err != nil {
+		return nil, err
+	}
+	if msg.DeletedAt != nil {
+		return nil, notFound("message was deleted")
+	}
+
+	revisions, err := s.repo.GetMessageRevisions(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	current := models.MessageRevision{Content: msg.Content, Timestamp: msg.Timestamp}
+	if msg.EditedAt != nil {
+		current.Timestamp = *msg.EditedAt
+	}
+	return append(revisions, current), nil
+}
+
+// maxEmojiLength caps the length of reactions, in bytes; the longest emoji
+// sequences, such as subdivision flags, take 28
+const maxEmojiLength = 32
+
 // AddReaction adds a reaction to a message
 func (s *Service) AddReaction(ctx context.Context, userID, messageID, emoji string) error {
+	if emoji == "" {
+		return invalid("reaction cannot be empty")
+	}
+	if len(emoji) > maxEmojiLength {
+		return invalid("reaction cannot be longer than %d bytes", maxEmojiLength)
+	}
+
 	// Get the message
 	msg, err := s.repo.GetMessageByID(ctx, messageID)
 	if err != nil {
 		return err
 	}
 	if msg == nil {
-		return errors.New("message not found")
+		return notFound("message not found")
+	}
+	if _, err := s.requireParticipant(ctx, msg.ConversationID, userID); err != nil {
+		return err
 	}
 
-	return s.repo.AddReaction(ctx, messageID, userID, emoji)
+	if err := s.repo.AddReaction(ctx, messageID, userID, emoji); err != nil {
+		return err
+	}
+
+	s.publish(ctx, events.ReactionAdded, msg.ConversationID, models.Reaction{MessageID: messageID, UserID: userID, Emoji: emoji})
+	return nil
 }
 
 // RemoveReaction removes a reaction from a message
 func (s *Service) RemoveReaction(ctx context.Context, userID, messageID string) error {
-	return s.repo.RemoveReaction(ctx, messageID, userID)
+	msg, err := s.repo.GetMessageByID(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if msg == nil {
+		return notFound("message not found")
+	}
+	if _, err := s.requireParticipant(ctx, msg.ConversationID, userID); err != nil {
+		return err
+	}
+
+	if err := s.repo.RemoveReaction(ctx, messageID, userID); err != nil {
+		return err
+	}
+
+	s.publish(ctx, events.ReactionRemoved, msg.ConversationID, events.ReactionRemoval{MessageID: messageID, UserID: userID})
+	return nil
+}
+
+// MarkMessagesReceived acknowledges delivery of every message of a conversation up to and including the given one
+func (s *Service) MarkMessagesReceived(ctx context.Context, userID, conversationID, messageID string) error {
+	return s.acknowledgeMessages(ctx, userID, conversationID, messageID, false)
+}
+
+// MarkMessagesRead acknowledges reading every message of a conversation up to and including the given one
+func (s *Service) MarkMessagesRead(ctx context.Context, userID, conversationID, messageID string) error {
+	return s.acknowledgeMessages(ctx, userID, conversationID, messageID, true)
+}
+
+// acknowledgeMessages records the user's receipts up to a message and notifies the conversation
+func (s *Service) acknowledgeMessages(ctx context.Context, userID, conversationID, messageID string, read bool) error {
+	if _, err := s.requireParticipant(ctx, conversationID, userID); err != nil {
+		return err
+	}
+
+	msg, err := s.repo.GetMessageByID(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if msg == nil || msg.ConversationID != conversationID {
+		return notFound("message not found")
+	}
+
+	upTo := models.MessageCursor{Timestamp: msg.Timestamp, ID: msg.ID}
+	if read {
+		err = s.repo.MarkMessagesRead(ctx, conversationID, userID, upTo)
+	} else {
+		err = s.repo.MarkMessagesReceived(ctx, conversationID, userID, upTo)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.publish(ctx, events.ReceiptsUpdated, conversationID, events.ReceiptUpdate{UserID: userID, MessageID: messageID, Read: read})
+	return nil
+}
+
+// GetMessageReceipts lists who received and read a message
+func (s *Service) GetMessageReceipts(ctx context.Context, userID, messageID string) ([]models.Receipt, error) {
+	msg, err := s.repo.GetMessageByID(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, notFound("message not found")
+	}
+
+	if _, err := s.requireParticipant(ctx, msg.ConversationID, userID); err != nil {
+		return nil, err
+	}
+
+	return s.repo.GetMessageReceipts(ctx, messageID)
 }
 
-// UpdateMessageStatus updates the status of a message
-func (s *Service) UpdateMessageStatus(ctx context.Context, messageID string, status models.MessageStatus) error {
-	return s.repo.UpdateMessageStatus(ctx, messageID, status)
+// replyTarget loads the message a new message replies to, which must be a live message of the same conversation
+func (s *Service) replyTarget(ctx context.Context, conversationID, replyToID string) (*models.Message, error) {
+	target, err := s.repo.GetMessageByID(ctx, replyToID)
+	if err != nil {
+		return nil, err
+	}
+	if target == nil || target.ConversationID != conversationID {
+		return nil, notFound("replied message not found in the conversation")
+	}
+	if target.DeletedAt != nil {
+		return nil, conflict("cannot reply to a deleted message")
+	}
+	return target, nil
+}
+
+// requireParticipant loads a conversation and checks that the user takes part in it
+func (s *Service) requireParticipant(ctx context.Context, conversationID, userID string) (*models.Conversation, error) {
+	conv, err := s.repo.GetConversationByID(ctx, conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if conv == nil {
+		return nil, notFound("conversation not found")
+	}
+
+	for _, participant := range conv.Participants {
+		if participant.ID == userID {
+			return conv, nil
+		}
+	}
+
+	return nil, forbidden("user is not a participant in the conversation")
 }
\ No newline at end of file
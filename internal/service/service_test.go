@@ -0,0 +1,1670 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/events"
+	"github.com/fallenkarma/wasatext/internal/media"
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/repository/memory"
+	"github.com/fallenkarma/wasatext/internal/service"
+	"github.com/fallenkarma/wasatext/internal/storage"
+)
+
+// newTestService returns a service backed by an empty in-memory repository
+// and a blob store in a temporary directory.
+// The password hasher is cheapened so the suite stays fast.
+func newTestService(t *testing.T, configure ...func(*service.Config)) *service.Service {
+	t.Helper()
+
+	config := service.DefaultConfig()
+	config.PasswordHasher = &service.PBKDF2Hasher{Iterations: 1000}
+	config.Blobs = storage.NewLocalStore(t.TempDir(), "/uploads")
+	for _, fn := range configure {
+		fn(&config)
+	}
+
+	return service.NewWithConfig(memory.NewMemoryRepository(), config)
+}
+
+// photoFile returns an open PNG file to upload
+func photoFile(t *testing.T) *os.File {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	path := filepath.Join(t.TempDir(), "photo.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if err := png.Encode(f, img); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	return f
+}
+
+// login logs a user in by name and returns their ID
+func login(t *testing.T, svc *service.Service, name string) string {
+	t.Helper()
+
+	resp, err := svc.Login(context.Background(), name, "")
+	if err != nil {
+		t.Fatalf("Login(%q): %v", name, err)
+	}
+	return resp.Id
+}
+
+// sendText sends a text message and fails the test on error
+func sendText(t *testing.T, svc *service.Service, senderID, conversationID, content string) *models.Message {
+	t.Helper()
+
+	msg, err := svc.SendTextMessage(context.Background(), senderID, conversationID, content, nil)
+	if err != nil {
+		t.Fatalf("SendTextMessage: %v", err)
+	}
+	// Keep timestamps distinct so the history has a well-defined order
+	time.Sleep(time.Millisecond)
+	return msg
+}
+
+func TestLoginCreatesUserOnce(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+
+	first, err := svc.Login(ctx, "alice", "")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	second, err := svc.Login(ctx, "alice", "")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	if first.Id != second.Id {
+		t.Errorf("second login created a new user: %s != %s", first.Id, second.Id)
+	}
+	if first.Token == second.Token {
+		t.Error("second login reused the session token")
+	}
+}
+
+func TestLoginValidatesUsername(t *testing.T) {
+	svc := newTestService(t)
+
+	for _, name := range []string{"", "ab", "abcdefghijklmnopq"} {
+		if _, err := svc.Login(context.Background(), name, ""); !errors.Is(err, service.ErrValidation) {
+			t.Errorf("Login(%q) = %v, want a validation error", name, err)
+		}
+	}
+}
+
+func TestLoginWithPassword(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+
+	if _, err := svc.Login(ctx, "alice", "short"); err == nil {
+		t.Error("account created with a password below the minimum length")
+	}
+	if _, err := svc.Login(ctx, "alice", "correct horse"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	if _, err := svc.Login(ctx, "alice", ""); err == nil {
+		t.Error("login without password succeeded for an account with one")
+	}
+	if _, err := svc.Login(ctx, "alice", "wrong password"); !errors.Is(err, service.ErrUnauthorized) {
+		t.Errorf("login with the wrong password = %v, want unauthorized", err)
+	}
+	if _, err := svc.Login(ctx, "alice", "correct horse"); err != nil {
+		t.Errorf("login with the right password failed: %v", err)
+	}
+}
+
+// staleLookup is a repository whose first GetUserByName runs signUp and then
+// misses, as when another request takes the name between lookup and creation
+type staleLookup struct {
+	*memory.MemoryRepository
+	signUp func()
+	once   sync.Once
+}
+
+func (r *staleLookup) GetUserByName(ctx context.Context, name string) (*models.User, error) {
+	stale := false
+	r.once.Do(func() {
+		r.signUp()
+		stale = true
+	})
+	if stale {
+		return nil, nil
+	}
+	return r.MemoryRepository.GetUserByName(ctx, name)
+}
+
+func TestLoginRacingSignUpKeepsFirstPassword(t *testing.T) {
+	ctx := context.Background()
+	config := service.DefaultConfig()
+	config.PasswordHasher = &service.PBKDF2Hasher{Iterations: 1000}
+
+	repo := memory.NewMemoryRepository()
+	first := service.NewWithConfig(repo, config)
+	second := service.NewWithConfig(&staleLookup{
+		MemoryRepository: repo,
+		signUp: func() {
+			if _, err := first.Login(ctx, "alice", "first password"); err != nil {
+				t.Errorf("first Login: %v", err)
+			}
+		},
+	}, config)
+
+	// The second sign-up loses the race and is checked against the first password
+	if _, err := second.Login(ctx, "alice", "second password"); !errors.Is(err, service.ErrUnauthorized) {
+		t.Errorf("racing sign-up = %v, want unauthorized", err)
+	}
+	if _, err := first.Login(ctx, "alice", "first password"); err != nil {
+		t.Errorf("login with the first password: %v", err)
+	}
+	if _, err := first.Login(ctx, "alice", "second password"); !errors.Is(err, service.ErrUnauthorized) {
+		t.Errorf("login with the second password = %v, want unauthorized", err)
+	}
+}
+
+func TestLoginPasswordlessDisabled(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+
+	// Created while passwordless login was allowed
+	login(t, svc, "alice")
+
+	strict := newTestService(t, func(c *service.Config) { c.AllowPasswordlessLogin = false })
+	if _, err := strict.Login(ctx, "bob", ""); err == nil {
+		t.Error("account created without password while passwords are required")
+	}
+	if _, err := strict.Login(ctx, "bob", "correct horse"); err != nil {
+		t.Errorf("Login: %v", err)
+	}
+}
+
+func TestAuthenticateAndLogout(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+
+	resp, err := svc.Login(ctx, "alice", "")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	user, err := svc.Authenticate(ctx, resp.Token)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if user.ID != resp.Id || user.Name != "alice" {
+		t.Errorf("Authenticate returned %+v, want alice", user)
+	}
+
+	if _, err := svc.Authenticate(ctx, "not-a-token"); err == nil {
+		t.Error("unknown token authenticated")
+	}
+
+	if err := svc.Logout(ctx, resp.Token); err != nil {
+		t.Fatalf("Logout: %v", err)
+	}
+	if _, err := svc.Authenticate(ctx, resp.Token); err == nil {
+		t.Error("revoked token still authenticates")
+	}
+}
+
+func TestAuthenticateExpiredSession(t *testing.T) {
+	svc := newTestService(t, func(c *service.Config) { c.SessionTTL = -time.Minute })
+
+	resp, err := svc.Login(context.Background(), "alice", "")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if _, err := svc.Authenticate(context.Background(), resp.Token); err == nil {
+		t.Error("expired token authenticated")
+	}
+}
+
+func TestSetPassword(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+
+	if err := svc.SetPassword(ctx, alice, "", "first password"); err != nil {
+		t.Fatalf("SetPassword: %v", err)
+	}
+	if err := svc.SetPassword(ctx, alice, "wrong password", "second password"); err == nil {
+		t.Error("password changed without the current one")
+	}
+	if err := svc.SetPassword(ctx, alice, "first password", "second password"); err != nil {
+		t.Fatalf("SetPassword: %v", err)
+	}
+	if _, err := svc.Login(ctx, "alice", "second password"); err != nil {
+		t.Errorf("login with the new password failed: %v", err)
+	}
+}
+
+func TestUpdateUsername(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	login(t, svc, "bob")
+
+	if err := svc.UpdateUsername(ctx, alice, "bob"); err == nil {
+		t.Error("renamed to a name already in use")
+	}
+	if err := svc.UpdateUsername(ctx, alice, "al"); err == nil {
+		t.Error("renamed to a name that is too short")
+	}
+	if err := svc.UpdateUsername(ctx, alice, "alicia"); err != nil {
+		t.Fatalf("UpdateUsername: %v", err)
+	}
+
+	user, err := svc.GetUser(ctx, alice)
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if user.Name != "alicia" {
+		t.Errorf("name = %q, want alicia", user.Name)
+	}
+}
+
+func TestCreateDirectConversationIsDeduplicated(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+
+	first, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	second, err := svc.CreateDirectConversation(ctx, bob, alice)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+
+	if first.ID != second.ID {
+		t.Errorf("second direct conversation created: %s != %s", first.ID, second.ID)
+	}
+	if len(first.Participants) != 2 {
+		t.Errorf("participants = %d, want 2", len(first.Participants))
+	}
+}
+
+func TestCreateGroupConversationIncludesCreator(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+
+	group, err := svc.CreateGroupConversation(ctx, "friends", alice, []string{bob})
+	if err != nil {
+		t.Fatalf("CreateGroupConversation: %v", err)
+	}
+
+	if group.Type != models.GroupConversation || group.Name != "friends" {
+		t.Errorf("group = %+v", group)
+	}
+	if len(group.Participants) != 2 {
+		t.Errorf("participants = %d, want 2 including the creator", len(group.Participants))
+	}
+
+	convs, err := svc.GetConversations(ctx, alice)
+	if err != nil {
+		t.Fatalf("GetConversations: %v", err)
+	}
+	if len(convs) != 1 || convs[0].ID != group.ID {
+		t.Errorf("creator's conversations = %+v", convs)
+	}
+}
+
+func TestCreateConversationValidates(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	carol := login(t, svc, "carol")
+	missing := "00000000-0000-0000-0000-000000000000"
+
+	tests := []struct {
+		name         string
+		participants []string
+		convType     models.ConversationType
+		groupName    string
+		want         error
+	}{
+		{"direct with yourself", []string{alice}, models.DirectConversation, "", service.ErrValidation},
+		{"direct with two users", []string{bob, carol}, models.DirectConversation, "", service.ErrValidation},
+		{"direct with a missing user", []string{missing}, models.DirectConversation, "", service.ErrNotFound},
+		{"group without a name", []string{bob}, models.GroupConversation, "  ", service.ErrValidation},
+		{"group with a missing user", []string{bob, missing}, models.GroupConversation, "friends", service.ErrNotFound},
+		{"unknown type", []string{bob}, "channel", "friends", service.ErrValidation},
+	}
+	for _, tt := range tests {
+		if _, err := svc.CreateConversation(ctx, alice, tt.participants, tt.convType, tt.groupName); !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	conv, err := svc.CreateConversation(ctx, alice, []string{bob}, models.DirectConversation, "")
+	if err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	if _, err := svc.GetConversation(ctx, bob, conv.ID); err != nil {
+		t.Errorf("GetConversation as a participant: %v", err)
+	}
+	if _, err := svc.GetConversation(ctx, carol, conv.ID); !errors.Is(err, service.ErrForbidden) {
+		t.Errorf("GetConversation as an outsider = %v, want forbidden", err)
+	}
+}
+
+func TestGroupMembership(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	carol := login(t, svc, "carol")
+
+	group, err := svc.CreateGroupConversation(ctx, "friends", alice, []string{bob})
+	if err != nil {
+		t.Fatalf("CreateGroupConversation: %v", err)
+	}
+
+	if err := svc.AddToGroup(ctx, alice, group.ID, carol); err != nil {
+		t.Fatalf("AddToGroup: %v", err)
+	}
+	if err := svc.AddToGroup(ctx, alice, group.ID, carol); err == nil {
+		t.Error("user added to a group twice")
+	}
+
+	if err := svc.LeaveGroup(ctx, group.ID, bob); err != nil {
+		t.Fatalf("LeaveGroup: %v", err)
+	}
+	if err := svc.LeaveGroup(ctx, group.ID, bob); err == nil {
+		t.Error("user left a group they are not in")
+	}
+
+	if err := svc.SetGroupName(ctx, alice, group.ID, "best friends"); err != nil {
+		t.Fatalf("SetGroupName: %v", err)
+	}
+
+	conv, err := svc.GetConversation(ctx, alice, group.ID)
+	if err != nil {
+		t.Fatalf("GetConversation: %v", err)
+	}
+	if conv.Name != "best friends" {
+		t.Errorf("name = %q, want best friends", conv.Name)
+	}
+	var ids []string
+	for _, p := range conv.Participants {
+		ids = append(ids, p.ID)
+	}
+	if len(ids) != 2 || ids[0] != alice || ids[1] != carol {
+		t.Errorf("participants = %v, want [alice carol]", ids)
+	}
+}
+
+func TestGroupOperationsRejectDirectConversations(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	carol := login(t, svc, "carol")
+
+	direct, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+
+	if err := svc.AddToGroup(ctx, alice, direct.ID, carol); err == nil {
+		t.Error("user added to a direct conversation")
+	}
+	if err := svc.SetGroupName(ctx, alice, direct.ID, "renamed"); err == nil {
+		t.Error("direct conversation renamed")
+	}
+	if err := svc.LeaveGroup(ctx, direct.ID, bob); err == nil {
+		t.Error("user left a direct conversation")
+	}
+}
+
+// roleOf returns the user's role in a conversation, as seen by one of its participants
+func roleOf(t *testing.T, svc *service.Service, viewerID, conversationID, userID string) models.ParticipantRole {
+	t.Helper()
+
+	conv, err := svc.GetConversation(context.Background(), viewerID, conversationID)
+	if err != nil || conv == nil {
+		t.Fatalf("GetConversation = %v, %v", conv, err)
+	}
+	for _, p := range conv.Participants {
+		if p.ID == userID {
+			return p.Role
+		}
+	}
+	return ""
+}
+
+func TestGroupRoles(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	carol := login(t, svc, "carol")
+	dave := login(t, svc, "dave")
+
+	group, err := svc.CreateGroupConversation(ctx, "friends", alice, []string{bob, carol, dave})
+	if err != nil {
+		t.Fatalf("CreateGroupConversation: %v", err)
+	}
+	if role := roleOf(t, svc, alice, group.ID, alice); role != models.RoleOwner {
+		t.Errorf("creator's role = %s, want owner", role)
+	}
+
+	if err := svc.PromoteMember(ctx, bob, group.ID, carol); !errors.Is(err, service.ErrNotAllowed) {
+		t.Errorf("member promoting = %v, want ErrNotAllowed", err)
+	}
+	if err := svc.PromoteMember(ctx, alice, group.ID, bob); err != nil {
+		t.Fatalf("PromoteMember: %v", err)
+	}
+	if err := svc.PromoteMember(ctx, alice, group.ID, bob); err == nil {
+		t.Error("admin promoted twice")
+	}
+	// Admins can promote members too, but only the owner demotes admins
+	if err := svc.PromoteMember(ctx, bob, group.ID, carol); err != nil {
+		t.Fatalf("PromoteMember by admin: %v", err)
+	}
+	if err := svc.DemoteAdmin(ctx, bob, group.ID, carol); !errors.Is(err, service.ErrNotAllowed) {
+		t.Errorf("admin demoting another admin = %v, want ErrNotAllowed", err)
+	}
+	if err := svc.DemoteAdmin(ctx, alice, group.ID, carol); err != nil {
+		t.Fatalf("DemoteAdmin: %v", err)
+	}
+	if role := roleOf(t, svc, alice, group.ID, carol); role != models.RoleMember {
+		t.Errorf("carol's role = %s, want member", role)
+	}
+	if err := svc.DemoteAdmin(ctx, alice, group.ID, alice); err == nil {
+		t.Error("owner demoted")
+	}
+
+	// Removing members
+	if err := svc.RemoveFromGroup(ctx, carol, group.ID, dave); !errors.Is(err, service.ErrNotAllowed) {
+		t.Errorf("member removing = %v, want ErrNotAllowed", err)
+	}
+	if err := svc.RemoveFromGroup(ctx, bob, group.ID, alice); !errors.Is(err, service.ErrNotAllowed) {
+		t.Errorf("admin removing the owner = %v, want ErrNotAllowed", err)
+	}
+	if err := svc.RemoveFromGroup(ctx, bob, group.ID, dave); err != nil {
+		t.Fatalf("RemoveFromGroup: %v", err)
+	}
+	if role := roleOf(t, svc, alice, group.ID, dave); role != "" {
+		t.Errorf("removed member still has role %s", role)
+	}
+	if err := svc.RemoveFromGroup(ctx, alice, group.ID, bob); err != nil {
+		t.Fatalf("owner removing an admin: %v", err)
+	}
+}
+
+func TestGroupPolicy(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	carol := login(t, svc, "carol")
+
+	group, err := svc.CreateGroupConversation(ctx, "friends", alice, []string{bob})
+	if err != nil {
+		t.Fatalf("CreateGroupConversation: %v", err)
+	}
+
+	if _, err := svc.SetGroupPolicy(ctx, bob, group.ID, models.SetGroupPolicyRequest{AddMembers: models.AdminsAllowed}); !errors.Is(err, service.ErrNotAllowed) {
+		t.Errorf("member changing the policy = %v, want ErrNotAllowed", err)
+	}
+	if _, err := svc.SetGroupPolicy(ctx, alice, group.ID, models.SetGroupPolicyRequest{EditInfo: "nobody"}); err == nil {
+		t.Error("invalid permission accepted")
+	}
+
+	policy, err := svc.SetGroupPolicy(ctx, alice, group.ID, models.SetGroupPolicyRequest{
+		AddMembers:   models.AdminsAllowed,
+		SendMessages: models.AdminsAllowed,
+	})
+	if err != nil {
+		t.Fatalf("SetGroupPolicy: %v", err)
+	}
+	want := models.GroupPolicy{AddMembers: models.AdminsAllowed, EditInfo: models.EveryoneAllowed, SendMessages: models.AdminsAllowed}
+	if *policy != want {
+		t.Errorf("policy = %+v, want %+v", *policy, want)
+	}
+
+	if err := svc.AddToGroup(ctx, bob, group.ID, carol); !errors.Is(err, service.ErrNotAllowed) {
+		t.Errorf("member adding with an admins-only policy = %v, want ErrNotAllowed", err)
+	}
+	if _, err := svc.SendTextMessage(ctx, bob, group.ID, "hi", nil); !errors.Is(err, service.ErrNotAllowed) {
+		t.Errorf("member posting with an admins-only policy = %v, want ErrNotAllowed", err)
+	}
+	if err := svc.SetGroupName(ctx, bob, group.ID, "renamed"); err != nil {
+		t.Errorf("member renaming while everyone may edit: %v", err)
+	}
+
+	sendText(t, svc, alice, group.ID, "announcement")
+	if err := svc.AddToGroup(ctx, alice, group.ID, carol); err != nil {
+		t.Errorf("owner adding: %v", err)
+	}
+
+	if err := svc.PromoteMember(ctx, alice, group.ID, bob); err != nil {
+		t.Fatalf("PromoteMember: %v", err)
+	}
+	sendText(t, svc, bob, group.ID, "now I can post")
+}
+
+func TestOwnerLeavingHandsOverOwnership(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	carol := login(t, svc, "carol")
+
+	group, err := svc.CreateGroupConversation(ctx, "friends", alice, []string{bob, carol})
+	if err != nil {
+		t.Fatalf("CreateGroupConversation: %v", err)
+	}
+	if err := svc.PromoteMember(ctx, alice, group.ID, carol); err != nil {
+		t.Fatalf("PromoteMember: %v", err)
+	}
+
+	bobEvents := svc.SubscribeEvents(bob)
+	defer bobEvents.Close()
+
+	if err := svc.LeaveGroup(ctx, group.ID, alice); err != nil {
+		t.Fatalf("LeaveGroup: %v", err)
+	}
+	if role := roleOf(t, svc, carol, group.ID, carol); role != models.RoleOwner {
+		t.Errorf("admin's role after the owner left = %s, want owner", role)
+	}
+
+	var sawHandover bool
+	for !sawHandover {
+		select {
+		case event := <-bobEvents.Events():
+			if change, ok := event.Payload.(events.RoleChange); ok && event.Type == events.ParticipantRole {
+				sawHandover = change.UserID == carol && change.Role == models.RoleOwner
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no event announced the new owner")
+		}
+	}
+}
+
+func TestSendTextMessageRequiresParticipant(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	mallory := login(t, svc, "mallory")
+
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+
+	if _, err := svc.SendTextMessage(ctx, mallory, conv.ID, "hi", nil); err == nil {
+		t.Error("outsider sent a message")
+	}
+	if _, err := svc.SendTextMessage(ctx, alice, "missing", "hi", nil); err == nil {
+		t.Error("message sent to a missing conversation")
+	}
+
+	msg := sendText(t, svc, alice, conv.ID, "hi")
+	if msg.ConversationID != conv.ID || msg.Sender.ID != alice || msg.Status != models.Sent {
+		t.Errorf("message = %+v", msg)
+	}
+
+	conv, err = svc.GetConversation(ctx, alice, conv.ID)
+	if err != nil {
+		t.Fatalf("GetConversation: %v", err)
+	}
+	if conv.LastMessage == nil || conv.LastMessage.ID != msg.ID {
+		t.Errorf("last message = %+v, want %s", conv.LastMessage, msg.ID)
+	}
+}
+
+func TestGetConversationMessagesPaginates(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	mallory := login(t, svc, "mallory")
+
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+
+	var sent []string
+	for _, content := range []string{"1", "2", "3", "4", "5"} {
+		sent = append(sent, sendText(t, svc, alice, conv.ID, content).ID)
+	}
+
+	if _, err := svc.GetConversationMessages(ctx, mallory, conv.ID, "", 2); err == nil {
+		t.Error("outsider read the history")
+	}
+
+	// Walk the history backwards, two messages at a time
+	var got []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("pagination did not terminate")
+		}
+		page, err := svc.GetConversationMessages(ctx, bob, conv.ID, cursor, 2)
+		if err != nil {
+			t.Fatalf("GetConversationMessages: %v", err)
+		}
+		var ids []string
+		for _, msg := range page.Messages {
+			ids = append(ids, msg.ID)
+		}
+		got = append(ids, got...)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if len(got) != len(sent) {
+		t.Fatalf("got %d messages, want %d", len(got), len(sent))
+	}
+	for i := range sent {
+		if got[i] != sent[i] {
+			t.Errorf("message %d = %s, want %s", i, got[i], sent[i])
+		}
+	}
+
+	if _, err := svc.GetConversationMessages(ctx, bob, conv.ID, "garbage", 2); !errors.Is(err, service.ErrValidation) {
+		t.Errorf("invalid cursor: error = %v, want ErrValidation", err)
+	}
+}
+
+func TestReplies(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	carol := login(t, svc, "carol")
+
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	other, err := svc.CreateDirectConversation(ctx, alice, carol)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	original := sendText(t, svc, alice, conv.ID, "pizza tonight?")
+	elsewhere := sendText(t, svc, alice, other.ID, "hi carol")
+
+	reply, err := svc.SendTextMessage(ctx, bob, conv.ID, "yes!", &original.ID)
+	if err != nil {
+		t.Fatalf("SendTextMessage(reply): %v", err)
+	}
+	if reply.ReplyTo == nil || *reply.ReplyTo != original.ID {
+		t.Errorf("ReplyTo = %v, want %s", reply.ReplyTo, original.ID)
+	}
+	if p := reply.ReplyPreview; p == nil || p.MessageID != original.ID || p.Sender.ID != alice || p.Content != "pizza tonight?" {
+		t.Errorf("ReplyPreview = %+v, want a preview of %s", p, original.ID)
+	}
+	time.Sleep(time.Millisecond)
+
+	missing := "missing"
+	for name, replyTo := range map[string]*string{
+		"a missing message":              &missing,
+		"another conversation's message": &elsewhere.ID,
+	} {
+		if _, err := svc.SendTextMessage(ctx, bob, conv.ID, "hm", replyTo); err == nil {
+			t.Errorf("replied to %s", name)
+		}
+	}
+
+	second, err := svc.SendTextMessage(ctx, alice, conv.ID, "great", &original.ID)
+	if err != nil {
+		t.Fatalf("SendTextMessage(reply): %v", err)
+	}
+
+	page, err := svc.GetReplies(ctx, bob, original.ID, "", 1)
+	if err != nil {
+		t.Fatalf("GetReplies: %v", err)
+	}
+	if len(page.Messages) != 1 || page.Messages[0].ID != second.ID || page.NextCursor == "" {
+		t.Fatalf("first page = %+v, want %s and a cursor", page, second.ID)
+	}
+	page, err = svc.GetReplies(ctx, bob, original.ID, page.NextCursor, 1)
+	if err != nil {
+		t.Fatalf("GetReplies: %v", err)
+	}
+	if len(page.Messages) != 1 || page.Messages[0].ID != reply.ID || page.NextCursor != "" {
+		t.Errorf("second page = %+v, want only %s", page, reply.ID)
+	}
+	if _, err := svc.GetReplies(ctx, carol, original.ID, "", 10); err == nil {
+		t.Error("outsider read the replies")
+	}
+
+	if err := svc.DeleteMessage(ctx, alice, original.ID, models.DeleteForEveryone); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	if _, err := svc.SendTextMessage(ctx, bob, conv.ID, "too late", &original.ID); err == nil {
+		t.Error("replied to a deleted message")
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	mallory := login(t, svc, "mallory")
+
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	other, err := svc.CreateDirectConversation(ctx, bob, mallory)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+
+	var sent []string
+	for _, content := range []string{"pizza tonight?", "sure, pizza", "or sushi", "pizza it is"} {
+		sent = append(sent, sendText(t, svc, alice, conv.ID, content).ID)
+	}
+	sendText(t, svc, bob, other.ID, "alice wants pizza")
+
+	// Walk the results backwards, two at a time
+	var got []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 2 {
+			t.Fatal("pagination did not terminate")
+		}
+		page, err := svc.SearchMessages(ctx, alice, "  pizza ", "", "", cursor, 2)
+		if err != nil {
+			t.Fatalf("SearchMessages: %v", err)
+		}
+		for _, result := range page.Results {
+			got = append(got, result.MessageID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if want := []string{sent[3], sent[1], sent[0]}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("results = %v, want %v", got, want)
+	}
+
+	page, err := svc.SearchMessages(ctx, mallory, "sushi", "", "", "", 0)
+	if err != nil {
+		t.Fatalf("SearchMessages: %v", err)
+	}
+	if page.Results == nil || len(page.Results) != 0 {
+		t.Errorf("outsider results = %+v, want an empty list", page.Results)
+	}
+
+	if _, err := svc.SearchMessages(ctx, mallory, "pizza", conv.ID, "", "", 0); err == nil {
+		t.Error("outsider searched a conversation they are not in")
+	}
+	if _, err := svc.SearchMessages(ctx, alice, "   ", "", "", "", 0); err == nil {
+		t.Error("empty query accepted")
+	}
+	if _, err := svc.SearchMessages(ctx, alice, "pizza", "", "", "garbage", 0); !errors.Is(err, service.ErrValidation) {
+		t.Errorf("invalid cursor: error = %v, want ErrValidation", err)
+	}
+}
+
+func TestMessageStatusFollowsReceipts(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	carol := login(t, svc, "carol")
+
+	group, err := svc.CreateGroupConversation(ctx, "friends", alice, []string{bob, carol})
+	if err != nil {
+		t.Fatalf("CreateGroupConversation: %v", err)
+	}
+	first := sendText(t, svc, alice, group.ID, "first")
+	second := sendText(t, svc, alice, group.ID, "second")
+
+	status := func(messageID string) models.MessageStatus {
+		t.Helper()
+		page, err := svc.GetConversationMessages(ctx, alice, group.ID, "", 10)
+		if err != nil {
+			t.Fatalf("GetConversationMessages: %v", err)
+		}
+		for _, msg := range page.Messages {
+			if msg.ID == messageID {
+				return msg.Status
+			}
+		}
+		t.Fatalf("message %s not found", messageID)
+		return ""
+	}
+
+	if err := svc.MarkMessagesReceived(ctx, bob, group.ID, second.ID); err != nil {
+		t.Fatalf("MarkMessagesReceived: %v", err)
+	}
+	if got := status(second.ID); got != models.Sent {
+		t.Errorf("status after one delivery = %s, want sent", got)
+	}
+
+	if err := svc.MarkMessagesReceived(ctx, carol, group.ID, second.ID); err != nil {
+		t.Fatalf("MarkMessagesReceived: %v", err)
+	}
+	if got := status(second.ID); got != models.Received {
+		t.Errorf("status after every delivery = %s, want received", got)
+	}
+
+	// Reading up to the first message leaves the second one unread
+	if err := svc.MarkMessagesRead(ctx, bob, group.ID, first.ID); err != nil {
+		t.Fatalf("MarkMessagesRead: %v", err)
+	}
+	if err := svc.MarkMessagesRead(ctx, carol, group.ID, first.ID); err != nil {
+		t.Fatalf("MarkMessagesRead: %v", err)
+	}
+	if got := status(first.ID); got != models.Read {
+		t.Errorf("status of first = %s, want read", got)
+	}
+	if got := status(second.ID); got != models.Received {
+		t.Errorf("status of second = %s, want received", got)
+	}
+
+	receipts, err := svc.GetMessageReceipts(ctx, alice, first.ID)
+	if err != nil {
+		t.Fatalf("GetMessageReceipts: %v", err)
+	}
+	if len(receipts) != 2 {
+		t.Fatalf("receipts = %d, want 2", len(receipts))
+	}
+	for _, receipt := range receipts {
+		if receipt.ReceivedAt == nil || receipt.ReadAt == nil {
+			t.Errorf("receipt of %s = %+v, want received and read", receipt.UserName, receipt)
+		}
+	}
+
+	if err := svc.MarkMessagesRead(ctx, bob, "missing", first.ID); err == nil {
+		t.Error("acknowledged messages of a missing conversation")
+	}
+}
+
+func TestLeaveGroupReleasesUnreadReceipts(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	carol := login(t, svc, "carol")
+
+	group, err := svc.CreateGroupConversation(ctx, "friends", alice, []string{bob, carol})
+	if err != nil {
+		t.Fatalf("CreateGroupConversation: %v", err)
+	}
+	msg := sendText(t, svc, alice, group.ID, "hi")
+
+	if err := svc.MarkMessagesRead(ctx, bob, group.ID, msg.ID); err != nil {
+		t.Fatalf("MarkMessagesRead: %v", err)
+	}
+	if err := svc.LeaveGroup(ctx, group.ID, carol); err != nil {
+		t.Fatalf("LeaveGroup: %v", err)
+	}
+
+	page, err := svc.GetConversationMessages(ctx, alice, group.ID, "", 10)
+	if err != nil {
+		t.Fatalf("GetConversationMessages: %v", err)
+	}
+	if got := page.Messages[0].Status; got != models.Read {
+		t.Errorf("status = %s, want read once the only unread member left", got)
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	msg := sendText(t, svc, alice, conv.ID, "oops")
+
+	if err := svc.DeleteMessage(ctx, bob, msg.ID, models.DeleteForEveryone); err == nil {
+		t.Error("message deleted by someone other than its sender")
+	}
+	if err := svc.DeleteMessage(ctx, alice, "missing", models.DeleteForEveryone); err == nil {
+		t.Error("missing message deleted")
+	}
+	if err := svc.DeleteMessage(ctx, alice, msg.ID, "everything"); err == nil {
+		t.Error("invalid scope accepted")
+	}
+	if err := svc.DeleteMessage(ctx, alice, msg.ID, models.DeleteForEveryone); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+
+	// Deletion is soft: the message stays in the history as a tombstone without its content
+	page, err := svc.GetConversationMessages(ctx, bob, conv.ID, "", 10)
+	if err != nil {
+		t.Fatalf("GetConversationMessages: %v", err)
+	}
+	if len(page.Messages) != 1 || page.Messages[0].DeletedAt == nil || page.Messages[0].Content != "" {
+		t.Errorf("history = %+v, want one deleted message without content", page.Messages)
+	}
+
+	if err := svc.DeleteMessage(ctx, alice, msg.ID, models.DeleteForEveryone); err == nil {
+		t.Error("message deleted twice")
+	}
+	if _, err := svc.ForwardMessage(ctx, bob, msg.ID, []string{conv.ID}); err == nil {
+		t.Error("deleted message forwarded")
+	}
+}
+
+func TestMessageErrorKinds(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	carol := login(t, svc, "carol")
+
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	msg := sendText(t, svc, alice, conv.ID, "hello")
+
+	if err := svc.DeleteMessage(ctx, alice, "missing", models.DeleteForEveryone); !errors.Is(err, service.ErrNotFound) {
+		t.Errorf("deleting a missing message = %v, want not found", err)
+	}
+	if err := svc.DeleteMessage(ctx, bob, msg.ID, models.DeleteForEveryone); !errors.Is(err, service.ErrForbidden) {
+		t.Errorf("deleting another user's message = %v, want forbidden", err)
+	}
+	if _, err := svc.SendTextMessage(ctx, carol, conv.ID, "hi", nil); !errors.Is(err, service.ErrForbidden) {
+		t.Errorf("sending to a foreign conversation = %v, want forbidden", err)
+	}
+	if err := svc.DeleteMessage(ctx, alice, msg.ID, "sometimes"); !errors.Is(err, service.ErrValidation) {
+		t.Errorf("deleting with an invalid scope = %v, want a validation error", err)
+	}
+
+	if err := svc.DeleteMessage(ctx, alice, msg.ID, models.DeleteForEveryone); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	if err := svc.DeleteMessage(ctx, alice, msg.ID, models.DeleteForEveryone); !errors.Is(err, service.ErrConflict) {
+		t.Errorf("deleting a message twice = %v, want a conflict", err)
+	}
+}
+
+func TestDeleteMessageForMe(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	mallory := login(t, svc, "mallory")
+
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	first := sendText(t, svc, alice, conv.ID, "hi")
+	second := sendText(t, svc, alice, conv.ID, "embarrassing")
+
+	if err := svc.DeleteMessage(ctx, mallory, second.ID, models.DeleteForMe); err == nil {
+		t.Error("outsider hid a message")
+	}
+	// Anyone in the conversation can delete a message for themselves
+	if err := svc.DeleteMessage(ctx, bob, second.ID, models.DeleteForMe); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+
+	historyOf := func(userID string) []string {
+		page, err := svc.GetConversationMessages(ctx, userID, conv.ID, "", 10)
+		if err != nil {
+			t.Fatalf("GetConversationMessages: %v", err)
+		}
+		var ids []string
+		for _, msg := range page.Messages {
+			if msg.DeletedAt != nil {
+				t.Errorf("message %s marked deleted", msg.ID)
+			}
+			ids = append(ids, msg.ID)
+		}
+		return ids
+	}
+	if got := historyOf(bob); len(got) != 1 || got[0] != first.ID {
+		t.Errorf("bob's history = %v, want [%s]", got, first.ID)
+	}
+	if got := historyOf(alice); len(got) != 2 {
+		t.Errorf("alice's history = %v, want both messages", got)
+	}
+}
+
+func TestDeleteMessageForEveryoneWindow(t *testing.T) {
+	svc := newTestService(t, func(c *service.Config) { c.DeleteWindow = 50 * time.Millisecond })
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	msg := sendText(t, svc, alice, conv.ID, "old news")
+	time.Sleep(60 * time.Millisecond)
+
+	if err := svc.DeleteMessage(ctx, alice, msg.ID, models.DeleteForEveryone); err == nil {
+		t.Error("message deleted for everyone after the delete window")
+	}
+	// Deleting it for oneself is still possible
+	if err := svc.DeleteMessage(ctx, alice, msg.ID, models.DeleteForMe); err != nil {
+		t.Errorf("DeleteMessage for me after the delete window: %v", err)
+	}
+}
+
+func TestDeletingPhotoRemovesFile(t *testing.T) {
+	uploads := t.TempDir()
+	svc := newTestService(t, func(c *service.Config) { c.Blobs = storage.NewLocalStore(uploads, "/uploads") })
+
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+
+	photo := photoFile(t)
+	msg, err := svc.SendPhotoMessage(ctx, alice, conv.ID, photo, "")
+	if err != nil {
+		t.Fatalf("SendPhotoMessage: %v", err)
+	}
+	var paths []string
+	for _, url := range msg.Variants {
+		// Message photos are on signed URLs: the key is the path without the signature
+		key, _, _ := strings.Cut(strings.TrimPrefix(url, "/uploads/"), "?")
+		paths = append(paths, filepath.Join(uploads, key))
+	}
+	if len(paths) != 1+len(media.Thumbnails) {
+		t.Fatalf("variants = %v", msg.Variants)
+	}
+
+	// A forwarded copy keeps the file alive
+	if _, err := svc.ForwardMessage(ctx, bob, msg.ID, []string{conv.ID}); err != nil {
+		t.Fatalf("ForwardMessage: %v", err)
+	}
+	if err := svc.DeleteMessage(ctx, alice, msg.ID, models.DeleteForEveryone); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("photo shared with a forwarded copy was removed: %v", err)
+		}
+	}
+
+	page, err := svc.GetConversationMessages(ctx, bob, conv.ID, "", 10)
+	if err != nil {
+		t.Fatalf("GetConversationMessages: %v", err)
+	}
+	var copyID string
+	for _, m := range page.Messages {
+		if m.ID != msg.ID {
+			copyID = m.ID
+		}
+	}
+	if err := svc.DeleteMessage(ctx, bob, copyID, models.DeleteForEveryone); err != nil {
+		t.Fatalf("DeleteMessage(forwarded copy): %v", err)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s still on disk after every message using it was deleted: %v", path, err)
+		}
+	}
+}
+
+// mp4Header is the start of an MP4 file, enough to be sniffed as a video
+const mp4Header = "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"
+
+func TestAttachmentMessages(t *testing.T) {
+	uploads := t.TempDir()
+	svc := newTestService(t, func(c *service.Config) {
+		c.Blobs = storage.NewLocalStore(uploads, "/uploads")
+		c.AttachmentLimits[models.AudioMessage] = 64
+	})
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+
+	doc, err := svc.SendMediaMessage(ctx, alice, conv.ID, service.Upload{
+		Type:     models.FileMessage,
+		File:     strings.NewReader("%PDF-1.4 quarterly numbers"),
+		FileName: "../../Q3 report.pdf",
+		Caption:  "the numbers",
+	}, "")
+	if err != nil {
+		t.Fatalf("SendMediaMessage(file): %v", err)
+	}
+	want := models.Attachment{FileName: "Q3 report.pdf", MimeType: "application/pdf", Size: int64(len("%PDF-1.4 quarterly numbers"))}
+	if doc.Attachment == nil || *doc.Attachment != want || doc.Caption != "the numbers" {
+		t.Errorf("file message attachment = %+v, caption %q; want %+v", doc.Attachment, doc.Caption, want)
+	}
+	if !strings.HasPrefix(doc.Content, "/uploads/message_files/") || !strings.Contains(doc.Content, "sig=") {
+		t.Errorf("file URL = %q, want a signed URL", doc.Content)
+	}
+
+	// Audio must be audio, and within its limit
+	for name, upload := range map[string]service.Upload{
+		"text as audio":  {Type: models.AudioMessage, File: strings.NewReader("just text"), FileName: "voice.ogg"},
+		"empty file":     {Type: models.FileMessage, File: strings.NewReader(""), FileName: "empty.txt"},
+		"negative times": {Type: models.AudioMessage, File: strings.NewReader("OggS\x00voice"), Duration: -1},
+		"NaN duration":   {Type: models.AudioMessage, File: strings.NewReader("OggS\x00voice"), Duration: math.NaN()},
+		"endless video":  {Type: models.VideoMessage, File: strings.NewReader(mp4Header), Duration: math.Inf(1)},
+		"unknown type":   {Type: "sticker", File: strings.NewReader("x")},
+	} {
+		if _, err := svc.SendMediaMessage(ctx, alice, conv.ID, upload, ""); !errors.Is(err, service.ErrInvalidAttachment) {
+			t.Errorf("%s: error = %v, want ErrInvalidAttachment", name, err)
+		}
+	}
+	wordy := service.Upload{Type: models.FileMessage, File: strings.NewReader("%PDF-1.4"), FileName: "a.pdf", Caption: strings.Repeat("é", 1025)}
+	if _, err := svc.SendMediaMessage(ctx, alice, conv.ID, wordy, ""); !errors.Is(err, service.ErrValidation) {
+		t.Errorf("1025-character caption: error = %v, want ErrValidation", err)
+	}
+	wordy = service.Upload{Type: models.FileMessage, File: strings.NewReader("%PDF-1.4"), FileName: "a.pdf", Caption: strings.Repeat("é", 1024)}
+	if _, err := svc.SendMediaMessage(ctx, alice, conv.ID, wordy, ""); err != nil {
+		t.Errorf("1024-character caption: %v", err)
+	}
+	long := service.Upload{Type: models.AudioMessage, File: strings.NewReader("OggS" + strings.Repeat("x", 64)), FileName: "voice.ogg"}
+	if _, err := svc.SendMediaMessage(ctx, alice, conv.ID, long, ""); !errors.Is(err, service.ErrAttachmentTooLarge) {
+		t.Errorf("oversized audio: error = %v, want ErrAttachmentTooLarge", err)
+	}
+	voice, err := svc.SendMediaMessage(ctx, alice, conv.ID, service.Upload{
+		Type: models.AudioMessage, File: strings.NewReader("OggS\x00voice"), FileName: "voice.ogg", Duration: 2.5,
+	}, "")
+	if err != nil {
+		t.Fatalf("SendMediaMessage(audio): %v", err)
+	}
+	if voice.Attachment.MimeType != "audio/ogg" || voice.Attachment.Duration != 2.5 {
+		t.Errorf("voice note attachment = %+v", voice.Attachment)
+	}
+
+	// A video with a still, shared by a forwarded copy
+	video, err := svc.SendMediaMessage(ctx, alice, conv.ID, service.Upload{
+		Type: models.VideoMessage, File: strings.NewReader(mp4Header), FileName: "clip.mp4", Duration: 3, Thumbnail: photoFile(t),
+	}, "")
+	if err != nil {
+		t.Fatalf("SendMediaMessage(video): %v", err)
+	}
+	if video.Attachment.MimeType != "video/mp4" || !strings.Contains(video.Attachment.Thumbnail, "_thumb") {
+		t.Errorf("video attachment = %+v", video.Attachment)
+	}
+	copies, err := svc.ForwardMessage(ctx, bob, video.ID, []string{conv.ID})
+	if err != nil {
+		t.Fatalf("ForwardMessage: %v", err)
+	}
+	if copies[0].Attachment == nil || copies[0].Attachment.FileName != "clip.mp4" {
+		t.Errorf("forwarded copy attachment = %+v", copies[0].Attachment)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(uploads, "message_files", "*"))
+	if err := svc.DeleteMessage(ctx, alice, video.ID, models.DeleteForEveryone); err != nil {
+		t.Fatalf("DeleteMessage(video): %v", err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(uploads, "message_files", "*")); len(left) != len(files) {
+		t.Errorf("files removed while a forwarded copy still uses them: %v", left)
+	}
+	if err := svc.DeleteMessage(ctx, bob, copies[0].ID, models.DeleteForEveryone); err != nil {
+		t.Fatalf("DeleteMessage(copy): %v", err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(uploads, "message_files", "*")); len(left) != len(files)-2 {
+		t.Errorf("files left after deleting the video: %v, before %v", left, files)
+	}
+}
+
+func TestPhotoUploads(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+
+	msg, err := svc.SendPhotoMessage(ctx, alice, conv.ID, photoFile(t), "")
+	if err != nil {
+		t.Fatalf("SendPhotoMessage: %v", err)
+	}
+	if msg.Variants["original"] != msg.Content {
+		t.Errorf("original variant = %q, want %q", msg.Variants["original"], msg.Content)
+	}
+	for _, thumb := range media.Thumbnails {
+		if msg.Variants[thumb.Name] == "" {
+			t.Errorf("no %s thumbnail in %v", thumb.Name, msg.Variants)
+		}
+	}
+
+	// The same picture is stored once
+	again, err := svc.SendPhotoMessage(ctx, alice, conv.ID, photoFile(t), "")
+	if err != nil {
+		t.Fatalf("SendPhotoMessage: %v", err)
+	}
+	if again.Content != msg.Content {
+		t.Errorf("same photo stored as %q and %q", msg.Content, again.Content)
+	}
+
+	photo, err := svc.SetUserPhoto(ctx, alice, photoFile(t))
+	if err != nil {
+		t.Fatalf("SetUserPhoto: %v", err)
+	}
+	if !strings.HasPrefix(photo.URL, "/uploads/user_photos/") {
+		t.Errorf("photo URL = %q", photo.URL)
+	}
+	user, err := svc.GetUser(ctx, alice)
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if user.PhotoURL != photo.URL || user.PhotoVariants["original"] != photo.URL || user.PhotoVariants["small"] == "" {
+		t.Errorf("user photo = %q, variants = %v", user.PhotoURL, user.PhotoVariants)
+	}
+
+	// Anything that is not an image is refused before it is stored
+	text, err := os.CreateTemp(t.TempDir(), "notes.jpg")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	defer text.Close()
+	text.WriteString("definitely not a picture")
+	text.Seek(0, io.SeekStart)
+	if _, err := svc.SendPhotoMessage(ctx, alice, conv.ID, text, ""); !errors.Is(err, media.ErrUnsupportedFormat) {
+		t.Errorf("SendPhotoMessage(text) error = %v, want ErrUnsupportedFormat", err)
+	}
+}
+
+func TestUpdateMessage(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	msg := sendText(t, svc, alice, conv.ID, "helo")
+
+	if err := svc.UpdateMessage(ctx, bob, msg.ID, "hijacked"); err == nil {
+		t.Error("message edited by someone other than its sender")
+	}
+	if err := svc.UpdateMessage(ctx, alice, msg.ID, "hello"); err != nil {
+		t.Fatalf("UpdateMessage: %v", err)
+	}
+
+	page, err := svc.GetConversationMessages(ctx, bob, conv.ID, "", 10)
+	if err != nil {
+		t.Fatalf("GetConversationMessages: %v", err)
+	}
+	if page.Messages[0].Content != "hello" || page.Messages[0].EditedAt == nil {
+		t.Errorf("message = %+v, want hello marked edited", page.Messages[0])
+	}
+
+	if err := svc.UpdateMessage(ctx, alice, msg.ID, "  "); err == nil {
+		t.Error("message emptied by an edit")
+	}
+	if err := svc.UpdateMessage(ctx, alice, msg.ID, "hello!"); err != nil {
+		t.Fatalf("UpdateMessage: %v", err)
+	}
+
+	history, err := svc.GetMessageHistory(ctx, bob, msg.ID)
+	if err != nil {
+		t.Fatalf("GetMessageHistory: %v", err)
+	}
+	var contents []string
+	for _, revision := range history {
+		contents = append(contents, revision.Content)
+	}
+	if len(contents) != 3 || contents[0] != "helo" || contents[1] != "hello" || contents[2] != "hello!" {
+		t.Errorf("history = %q, want every version oldest first", contents)
+	}
+	if !history[0].Timestamp.Equal(msg.Timestamp) {
+		t.Errorf("first version written at %v, want the send time %v", history[0].Timestamp, msg.Timestamp)
+	}
+
+	mallory := login(t, svc, "mallory")
+	if _, err := svc.GetMessageHistory(ctx, mallory, msg.ID); err == nil {
+		t.Error("outsider read the edit history")
+	}
+
+	if err := svc.DeleteMessage(ctx, alice, msg.ID, models.DeleteForEveryone); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	if err := svc.UpdateMessage(ctx, alice, msg.ID, "back"); err == nil {
+		t.Error("deleted message edited")
+	}
+}
+
+func TestUpdateMessageRestrictions(t *testing.T) {
+	svc := newTestService(t, func(c *service.Config) { c.EditWindow = 50 * time.Millisecond })
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+
+	photo := photoFile(t)
+	photoMsg, err := svc.SendPhotoMessage(ctx, alice, conv.ID, photo, "")
+	if err != nil {
+		t.Fatalf("SendPhotoMessage: %v", err)
+	}
+	if err := svc.UpdateMessage(ctx, alice, photoMsg.ID, "caption"); err == nil {
+		t.Error("photo message edited")
+	}
+
+	msg := sendText(t, svc, alice, conv.ID, "helo")
+	if err := svc.UpdateMessage(ctx, alice, msg.ID, "hello"); err != nil {
+		t.Fatalf("UpdateMessage within the edit window: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := svc.UpdateMessage(ctx, alice, msg.ID, "hello!"); err == nil {
+		t.Error("message edited after the edit window")
+	}
+}
+
+func TestReactions(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	msg := sendText(t, svc, alice, conv.ID, "hi")
+
+	// A second reaction from the same user replaces the first
+	if err := svc.AddReaction(ctx, bob, msg.ID, "👍"); err != nil {
+		t.Fatalf("AddReaction: %v", err)
+	}
+	if err := svc.AddReaction(ctx, bob, msg.ID, "❤️"); err != nil {
+		t.Fatalf("AddReaction: %v", err)
+	}
+	if err := svc.AddReaction(ctx, bob, "missing", "👍"); err == nil {
+		t.Error("reacted to a missing message")
+	}
+
+	page, err := svc.GetConversationMessages(ctx, alice, conv.ID, "", 10)
+	if err != nil {
+		t.Fatalf("GetConversationMessages: %v", err)
+	}
+	reactions := page.Messages[0].Reactions
+	if len(reactions) != 1 || reactions[0].UserID != bob || reactions[0].Emoji != "❤️" {
+		t.Errorf("reactions = %+v, want a single ❤️ from bob", reactions)
+	}
+
+	if err := svc.RemoveReaction(ctx, bob, msg.ID); err != nil {
+		t.Fatalf("RemoveReaction: %v", err)
+	}
+	if err := svc.RemoveReaction(ctx, bob, msg.ID); err == nil {
+		t.Error("removed a reaction twice")
+	}
+
+	for name, emoji := range map[string]string{"empty": "", "overlong": strings.Repeat("👍", 9)} {
+		if err := svc.AddReaction(ctx, bob, msg.ID, emoji); !errors.Is(err, service.ErrValidation) {
+			t.Errorf("%s reaction: error = %v, want ErrValidation", name, err)
+		}
+	}
+}
+
+func TestReactionsRequireParticipant(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	mallory := login(t, svc, "mallory")
+
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	msg := sendText(t, svc, alice, conv.ID, "hi")
+
+	if err := svc.AddReaction(ctx, mallory, msg.ID, "👍"); !errors.Is(err, service.ErrForbidden) {
+		t.Errorf("outsider reacting: error = %v, want ErrForbidden", err)
+	}
+
+	// Nor can they clear reactions on a message they cannot see
+	if err := svc.AddReaction(ctx, bob, msg.ID, "👍"); err != nil {
+		t.Fatalf("AddReaction: %v", err)
+	}
+	if err := svc.RemoveReaction(ctx, mallory, msg.ID); !errors.Is(err, service.ErrForbidden) {
+		t.Errorf("outsider removing a reaction: error = %v, want ErrForbidden", err)
+	}
+
+	page, err := svc.GetConversationMessages(ctx, alice, conv.ID, "", 10)
+	if err != nil {
+		t.Fatalf("GetConversationMessages: %v", err)
+	}
+	if reactions := page.Messages[0].Reactions; len(reactions) != 1 || reactions[0].UserID != bob {
+		t.Errorf("reactions = %+v, want bob's only", reactions)
+	}
+}
+
+func TestForwardMessage(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	carol := login(t, svc, "carol")
+
+	withBob, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	withCarol, err := svc.CreateDirectConversation(ctx, alice, carol)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	msg := sendText(t, svc, bob, withBob.ID, "pass it on")
+
+	if _, err := svc.ForwardMessage(ctx, bob, msg.ID, []string{withCarol.ID}); err == nil {
+		t.Error("forwarded into a conversation the user is not in")
+	}
+	if _, err := svc.ForwardMessage(ctx, carol, msg.ID, []string{withCarol.ID}); err == nil {
+		t.Error("forwarded a message from a conversation the user is not in")
+	}
+	if _, err := svc.ForwardMessage(ctx, alice, msg.ID, nil); err == nil {
+		t.Error("forwarded to no conversation")
+	}
+	copies, err := svc.ForwardMessage(ctx, alice, msg.ID, []string{withCarol.ID})
+	if err != nil {
+		t.Fatalf("ForwardMessage: %v", err)
+	}
+	if len(copies) != 1 || copies[0].ConversationID != withCarol.ID {
+		t.Fatalf("copies = %+v, want one in %s", copies, withCarol.ID)
+	}
+
+	page, err := svc.GetConversationMessages(ctx, carol, withCarol.ID, "", 10)
+	if err != nil {
+		t.Fatalf("GetConversationMessages: %v", err)
+	}
+	if len(page.Messages) != 1 {
+		t.Fatalf("messages = %d, want 1", len(page.Messages))
+	}
+	forwarded := page.Messages[0]
+	if forwarded.Content != "pass it on" || forwarded.Sender.ID != alice {
+		t.Errorf("forwarded message = %+v", forwarded)
+	}
+	if f := forwarded.ForwardedFrom; f == nil || f.MessageID != msg.ID || f.Sender.ID != bob || f.Sender.Name != "bob" || f.ForwardCount != 1 {
+		t.Errorf("ForwardedFrom = %+v, want bob's %s forwarded once", f, msg.ID)
+	}
+
+	// Forwarding a forward keeps pointing at the original
+	again, err := svc.ForwardMessage(ctx, carol, forwarded.ID, []string{withCarol.ID})
+	if err != nil {
+		t.Fatalf("ForwardMessage(forward): %v", err)
+	}
+	if f := again[0].ForwardedFrom; f == nil || f.MessageID != msg.ID || f.Sender.ID != bob || f.ForwardCount != 2 {
+		t.Errorf("ForwardedFrom = %+v, want bob's %s forwarded twice", f, msg.ID)
+	}
+}
+
+func TestForwardMessageToSeveralConversations(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	carol := login(t, svc, "carol")
+	dave := login(t, svc, "dave")
+
+	withBob, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	withCarol, err := svc.CreateDirectConversation(ctx, alice, carol)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	group, err := svc.CreateGroupConversation(ctx, "friends", alice, []string{bob, carol})
+	if err != nil {
+		t.Fatalf("CreateGroupConversation: %v", err)
+	}
+	notAlices, err := svc.CreateDirectConversation(ctx, bob, dave)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+	msg := sendText(t, svc, bob, withBob.ID, "news")
+
+	countIn := func(conversationID, userID string) int {
+		t.Helper()
+		page, err := svc.GetConversationMessages(ctx, userID, conversationID, "", 10)
+		if err != nil {
+			t.Fatalf("GetConversationMessages: %v", err)
+		}
+		return len(page.Messages)
+	}
+
+	// One target the user cannot post in aborts the whole forward
+	if _, err := svc.ForwardMessage(ctx, alice, msg.ID, []string{withCarol.ID, notAlices.ID}); err == nil {
+		t.Fatal("forwarded into a conversation the user is not in")
+	}
+	if n := countIn(withCarol.ID, carol); n != 0 {
+		t.Errorf("%d messages reached carol after a failed forward, want 0", n)
+	}
+
+	copies, err := svc.ForwardMessage(ctx, alice, msg.ID, []string{withCarol.ID, group.ID, withCarol.ID})
+	if err != nil {
+		t.Fatalf("ForwardMessage: %v", err)
+	}
+	if len(copies) != 2 || copies[0].ConversationID != withCarol.ID || copies[1].ConversationID != group.ID {
+		t.Errorf("copies = %+v, want one in each distinct target", copies)
+	}
+	if countIn(withCarol.ID, carol) != 1 || countIn(group.ID, bob) != 1 {
+		t.Error("forwarded copies missing")
+	}
+}
+
+func TestEventsReachParticipantsOnly(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+	mallory := login(t, svc, "mallory")
+
+	conv, err := svc.CreateDirectConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation: %v", err)
+	}
+
+	bobEvents := svc.SubscribeEvents(bob)
+	defer bobEvents.Close()
+	malloryEvents := svc.SubscribeEvents(mallory)
+	defer malloryEvents.Close()
+
+	msg := sendText(t, svc, alice, conv.ID, "hi")
+
+	select {
+	case event := <-bobEvents.Events():
+		if event.Type != events.MessageCreated || event.ConversationID != conv.ID {
+			t.Errorf("event = %+v", event)
+		}
+		if payload, ok := event.Payload.(*models.Message); !ok || payload.ID != msg.ID {
+			t.Errorf("payload = %#v, want message %s", event.Payload, msg.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("participant received no event")
+	}
+
+	select {
+	case event := <-malloryEvents.Events():
+		t.Errorf("outsider received %+v", event)
+	default:
+	}
+}
+
+func TestConversationCreatedIsSeenByEachParticipant(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	alice := login(t, svc, "alice")
+	bob := login(t, svc, "bob")
+
+	aliceEvents := svc.SubscribeEvents(alice)
+	defer aliceEvents.Close()
+	bobEvents := svc.SubscribeEvents(bob)
+	defer bobEvents.Close()
+
+	if _, err := svc.CreateConversation(ctx, alice, []string{bob}, models.DirectConversation, ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+
+	// Each side sees the direct conversation named after the other
+	for _, tc := range []struct {
+		events *events.Subscription
+		want   string
+	}{{aliceEvents, "bob"}, {bobEvents, "alice"}} {
+		select {
+		case event := <-tc.events.Events():
+			conv, ok := event.Payload.(*models.Conversation)
+			if event.Type != events.ConversationCreated || !ok {
+				t.Fatalf("event = %+v", event)
+			}
+			if conv.Name != tc.want {
+				t.Errorf("conversation name = %q, want %q", conv.Name, tc.want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("participant received no event")
+		}
+		select {
+		case event := <-tc.events.Events():
+			t.Errorf("participant received a second event: %+v", event)
+		default:
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// URLSigner signs the URLs of private blobs so that whoever holds one can fetch
+// the blob until the URL expires, without sending credentials along
+type URLSigner struct {
+	secret []byte
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// NewURLSigner returns a signer whose URLs stay valid for between ttl/2 and ttl.
+// An empty secret is replaced by a random one, so URLs do not survive a restart.
+func NewURLSigner(secret []byte, ttl time.Duration) *URLSigner {
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	return &URLSigner{secret: secret, ttl: ttl, now: time.Now}
+}
+
+// Sign appends an expiry time and a signature for key to rawURL.
+// Expiry times are rounded so that a blob keeps the same URL for a while,
+// which lets clients cache it.
+func (s *URLSigner) Sign(rawURL, key string) string {
+	expires := s.now().Truncate(s.ttl / 2).Add(s.ttl).Unix()
+	query := url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {s.signature(key, expires)},
+	}
+
+	separator := "?"
+	if strings.Contains(rawURL, "?") {
+		separator = "&"
+	}
+	return rawURL + separator + query.Encode()
+}
+
+// Verify checks the signature the query of a signed URL carries for key
+// and returns when the URL expires
+func (s *URLSigner) Verify(key string, query url.Values) (time.Time, bool) {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	expiresAt := time.Unix(expires, 0)
+	if !s.now().Before(expiresAt) {
+		return time.Time{}, false
+	}
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(s.signature(key, expires))) {
+		return time.Time{}, false
+	}
+	return expiresAt, true
+}
+
+func (s *URLSigner) signature(key string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(key + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
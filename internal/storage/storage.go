@@ -0,0 +1,215 @@
+// Package storage keeps uploaded media out of the database.
+//
+// Blobs are addressed by keys such as "message_photos/<hash>.jpg": the
+// repositories only store those keys, and a BlobStore holds the bytes, either
+// on the local disk or in an S3-compatible bucket.
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when no blob is stored under a key
+var ErrNotFound = errors.New("blob not found")
+
+// ErrInvalidKey is returned for keys that are empty, absolute or escape the store
+var ErrInvalidKey = errors.New("invalid blob key")
+
+// Object is a stored blob being read. The caller must close Body.
+// Size is the size of the whole blob, even when Body starts past its beginning.
+type Object struct {
+	Body        io.ReadCloser
+	ContentType string
+	Size        int64
+	ModTime     time.Time
+}
+
+// BlobStore stores uploaded media by key
+type BlobStore interface {
+	// Put stores the content of r under key, replacing any previous blob
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+
+	// Get opens the blob stored under key, returning ErrNotFound if there is none
+	Get(ctx context.Context, key string) (*Object, error)
+
+	// GetFrom opens the blob stored under key like Get, with Body starting at offset
+	GetFrom(ctx context.Context, key string, offset int64) (*Object, error)
+
+	// Delete removes the blob stored under key; deleting a missing blob is not an error
+	Delete(ctx context.Context, key string) error
+
+	// URL returns the URL clients fetch the blob stored under key from
+	URL(key string) string
+}
+
+// ValidKey reports whether key is a relative, slash-separated path that stays inside the store
+func ValidKey(key string) bool {
+	return key != "" && fs.ValidPath(key) && !strings.Contains(key, "\\")
+}
+
+// probeDir is where Probe writes its blobs
+const probeDir = "healthcheck"
+
+// Probe checks that store accepts writes by storing a small blob and removing it
+func Probe(ctx context.Context, store BlobStore) error {
+	b := make([]byte, 8)
+	rand.Read(b)
+	key := probeDir + "/" + hex.EncodeToString(b)
+	if err := store.Put(ctx, key, strings.NewReader("ok"), "text/plain"); err != nil {
+		return fmt.Errorf("blob store is not writable: %w", err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		return fmt.Errorf("blob store cannot delete: %w", err)
+	}
+	return nil
+}
+
+// Handler serves blobs by key, taken from the request path, with support for
+// range and conditional requests. It is mounted behind http.StripPrefix for
+// stores whose URLs point back at the server.
+//
+// Keys for which private returns true are only served on URLs signed by signer;
+// the others are public. A nil private function makes every blob public.
+func Handler(store BlobStore, signer *URLSigner, private func(key string) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		if !ValidKey(key) {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Blob names change with their content, so public blobs can be cached for good.
+		// Private ones are cached by the client alone, and no longer than the URL is valid.
+		cacheControl := "public, max-age=31536000, immutable"
+		if private != nil && private(key) {
+			if signer == nil {
+				http.NotFound(w, r)
+				return
+			}
+			expires, ok := signer.Verify(key, r.URL.Query())
+			if !ok {
+				http.Error(w, "invalid or expired link", http.StatusForbidden)
+				return
+			}
+			cacheControl = fmt.Sprintf("private, max-age=%d", int(time.Until(expires).Seconds()))
+		}
+
+		obj, err := store.Get(r.Context(), key)
+		if errors.Is(err, ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to read blob", "key", key, "error", err)
+			http.Error(w, "failed to read file", http.StatusInternalServerError)
+			return
+		}
+		defer obj.Body.Close()
+
+		// Range requests need to seek: blobs of remote stores are reopened at the
+		// requested offset rather than buffered
+		content, ok := obj.Body.(io.ReadSeeker)
+		if !ok {
+			seeker := &blobSeeker{ctx: r.Context(), store: store, key: key, size: obj.Size, body: obj.Body}
+			defer seeker.Close()
+			content = seeker
+		}
+
+		// Only media is shown inline: any other file, such as an HTML page a user
+		// attached to a message, is downloaded rather than rendered on this origin
+		contentType := obj.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		if !inline(contentType) {
+			w.Header().Set("Content-Disposition", "attachment")
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Header().Set("ETag", `"`+path.Base(key)+`"`)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeContent(w, r, key, obj.ModTime, content)
+	})
+}
+
+// blobSeeker lets http.ServeContent seek in a blob whose body cannot seek.
+// Reads go on from the open body; after a seek elsewhere, the next read opens
+// the blob again at the new offset.
+type blobSeeker struct {
+	ctx    context.Context
+	store  BlobStore
+	key    string
+	size   int64
+	body   io.ReadCloser // Nil until the next read once closed
+	bodyAt int64         // Offset the next byte of body is at
+	offset int64         // Offset the next read starts at
+}
+
+func (s *blobSeeker) Read(p []byte) (int, error) {
+	if s.body != nil && s.bodyAt != s.offset {
+		s.body.Close()
+		s.body = nil
+	}
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+	if s.body == nil {
+		obj, err := s.store.GetFrom(s.ctx, s.key, s.offset)
+		if err != nil {
+			return 0, err
+		}
+		s.body, s.bodyAt = obj.Body, s.offset
+	}
+	n, err := s.body.Read(p)
+	s.bodyAt += int64(n)
+	s.offset = s.bodyAt
+	return n, err
+}
+
+func (s *blobSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the blob")
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+func (s *blobSeeker) Close() error {
+	if s.body == nil {
+		return nil
+	}
+	return s.body.Close()
+}
+
+// inline reports whether blobs of a content type are safe to display in the browser
+func inline(contentType string) bool {
+	for _, prefix := range []string{"image/", "audio/", "video/"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return contentType != "image/svg+xml"
+		}
+	}
+	return false
+}
@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBlobStore checks the behaviour every BlobStore shares
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+	key := "message_photos/abc.png"
+
+	if err := store.Put(ctx, key, strings.NewReader("first"), "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := store.Put(ctx, key, strings.NewReader("second"), "image/png"); err != nil {
+		t.Fatalf("Put again: %v", err)
+	}
+
+	obj, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, err := io.ReadAll(obj.Body)
+	obj.Body.Close()
+	if err != nil {
+		t.Fatalf("reading blob: %v", err)
+	}
+	if string(data) != "second" {
+		t.Errorf("content = %q, want the latest Put", data)
+	}
+	if obj.ContentType != "image/png" || obj.Size != int64(len("second")) {
+		t.Errorf("object = %s, %d bytes", obj.ContentType, obj.Size)
+	}
+
+	obj, err = store.GetFrom(ctx, key, 2)
+	if err != nil {
+		t.Fatalf("GetFrom: %v", err)
+	}
+	data, err = io.ReadAll(obj.Body)
+	obj.Body.Close()
+	if err != nil {
+		t.Fatalf("reading blob: %v", err)
+	}
+	if string(data) != "cond" || obj.Size != int64(len("second")) {
+		t.Errorf("GetFrom(2) = %q of %d bytes, want the tail of the blob and its full size", data, obj.Size)
+	}
+
+	if _, err := store.Get(ctx, "message_photos/missing.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(missing) error = %v, want ErrNotFound", err)
+	}
+	if _, err := store.GetFrom(ctx, "message_photos/missing.png", 2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetFrom(missing) error = %v, want ErrNotFound", err)
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete error = %v, want ErrNotFound", err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Errorf("Delete(missing): %v", err)
+	}
+
+	for _, bad := range []string{"", "/etc/passwd", "../secret", "a/../../b", "a//b"} {
+		if err := store.Put(ctx, bad, strings.NewReader("x"), "text/plain"); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q) error = %v, want ErrInvalidKey", bad, err)
+		}
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	store := NewLocalStore(t.TempDir(), "/uploads/")
+	testBlobStore(t, store)
+
+	if got := store.URL("user_photos/a.jpg"); got != "/uploads/user_photos/a.jpg" {
+		t.Errorf("URL = %q", got)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	dir := t.TempDir()
+	if err := Probe(context.Background(), NewLocalStore(dir, "/uploads")); err != nil {
+		t.Fatalf("Probe = %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, probeDir)); len(entries) != 0 {
+		t.Errorf("Probe left %d blobs behind", len(entries))
+	}
+
+	// A store that cannot be written to fails the probe
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Probe(context.Background(), NewLocalStore(file, "/uploads")); err == nil {
+		t.Error("Probe succeeded on a store rooted at a file")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	store := NewLocalStore(t.TempDir(), "/uploads")
+	if err := store.Put(context.Background(), "group_photos/g.png", strings.NewReader("png data"), "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	srv := httptest.NewServer(http.StripPrefix("/uploads/", Handler(store, nil, nil)))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/uploads/group_photos/g.png")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "png data" {
+		t.Errorf("GET = %d %q", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if cc := resp.Header.Get("Cache-Control"); !strings.HasPrefix(cc, "public") {
+		t.Errorf("Cache-Control = %q", cc)
+	}
+
+	for _, path := range []string{"/uploads/group_photos/missing.png", "/uploads/group_photos", "/uploads/..%2f..%2fetc/passwd"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestURLSigner(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 10, 0, 0, time.UTC)
+	signer := NewURLSigner([]byte("secret"), time.Hour)
+	signer.now = func() time.Time { return now }
+
+	signed := signer.Sign("/uploads/message_photos/a.png", "message_photos/a.png")
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("signed URL %q: %v", signed, err)
+	}
+	if u.Path != "/uploads/message_photos/a.png" {
+		t.Errorf("signed URL path = %q", u.Path)
+	}
+
+	// The same URL is handed out for a while, so clients can cache the blob
+	now = now.Add(10 * time.Minute)
+	if again := signer.Sign("/uploads/message_photos/a.png", "message_photos/a.png"); again != signed {
+		t.Errorf("URL changed within the same period: %q, then %q", signed, again)
+	}
+
+	expires, ok := signer.Verify("message_photos/a.png", u.Query())
+	if !ok || expires.Sub(now) < 30*time.Minute {
+		t.Errorf("Verify = %v, %v: want valid for at least half the TTL", expires, ok)
+	}
+	if _, ok := signer.Verify("message_photos/b.png", u.Query()); ok {
+		t.Error("signature accepted for another key")
+	}
+	if _, ok := NewURLSigner([]byte("other"), time.Hour).Verify("message_photos/a.png", u.Query()); ok {
+		t.Error("signature accepted with another secret")
+	}
+
+	now = expires
+	if _, ok := signer.Verify("message_photos/a.png", u.Query()); ok {
+		t.Error("expired URL accepted")
+	}
+}
+
+func TestHandlerServesPrivateBlobsOnSignedURLs(t *testing.T) {
+	store := NewLocalStore(t.TempDir(), "/uploads")
+	if err := store.Put(context.Background(), "private/p.txt", strings.NewReader("0123456789"), "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	signer := NewURLSigner(nil, time.Hour)
+	private := func(key string) bool { return strings.HasPrefix(key, "private/") }
+	srv := httptest.NewServer(http.StripPrefix("/uploads/", Handler(store, signer, private)))
+	defer srv.Close()
+
+	get := func(path, rangeHeader string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	if resp, _ := get("/uploads/private/p.txt", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("unsigned GET = %d, want 403", resp.StatusCode)
+	}
+	signed := signer.Sign("/uploads/private/p.txt", "private/p.txt")
+	if resp, body := get(signed, "bytes=2-4"); resp.StatusCode != http.StatusPartialContent || body != "234" {
+		t.Errorf("signed range GET = %d %q", resp.StatusCode, body)
+	}
+	resp, _ := get(signed, "")
+	if cc := resp.Header.Get("Cache-Control"); !strings.HasPrefix(cc, "private, max-age=") {
+		t.Errorf("Cache-Control = %q", cc)
+	}
+}
+
+func TestHandlerDownloadsNonMedia(t *testing.T) {
+	store := NewLocalStore(t.TempDir(), "/uploads")
+	ctx := context.Background()
+	for key, data := range map[string]string{
+		"files/page.html": "<script>alert(1)</script>",
+		"files/notes":     "no extension",
+		"files/voice.ogg": "OggS",
+	} {
+		if err := store.Put(ctx, key, strings.NewReader(data), ""); err != nil {
+			t.Fatalf("Put(%s): %v", key, err)
+		}
+	}
+	srv := httptest.NewServer(http.StripPrefix("/uploads/", Handler(store, nil, nil)))
+	defer srv.Close()
+
+	for key, disposition := range map[string]string{
+		"files/page.html": "attachment",
+		"files/notes":     "attachment",
+		"files/voice.ogg": "",
+	} {
+		resp, err := http.Get(srv.URL + "/uploads/" + key)
+		if err != nil {
+			t.Fatalf("GET %s: %v", key, err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Content-Disposition"); got != disposition {
+			t.Errorf("GET %s: Content-Disposition = %q, want %q (Content-Type %s)", key, got, disposition, resp.Header.Get("Content-Type"))
+		}
+	}
+}
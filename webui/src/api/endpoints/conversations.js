@@ -10,6 +10,14 @@ const conversationsApi = {
     return apiClient.get(`/conversations/${id}`)
   },
 
+  getMessages(id, { before, limit } = {}) {
+    return apiClient.get(`/conversations/${id}/messages`, { params: { before, limit } })
+  },
+
+  markRead(id, messageId) {
+    return apiClient.post(`/conversations/${id}/read`, { messageId })
+  },
+
   create(conversationData) {
     return apiClient.post('/conversations', conversationData)
   },
@@ -5,10 +5,10 @@ export const messagesApi = {
     return apiClient.post('/messages', messageData)
   },
 
-  forward(messageId, targetConversationId) {
+  forward(messageId, targetConversationIds) {
     return apiClient.post('/messages/forward', {
       messageId,
-      targetConversationId,
+      targetConversationIds: [].concat(targetConversationIds),
     })
   },
 
@@ -20,7 +20,15 @@ export const messagesApi = {
     return apiClient.delete(`/messages/${messageId}/reaction`)
   },
 
-  delete(messageId) {
-    return apiClient.delete(`/messages/${messageId}`)
+  delete(messageId, scope = 'everyone') {
+    return apiClient.delete(`/messages/${messageId}`, { params: { scope } })
+  },
+
+  getHistory(messageId) {
+    return apiClient.get(`/messages/${messageId}/history`)
+  },
+
+  getReplies(messageId, params = {}) {
+    return apiClient.get(`/messages/${messageId}/replies`, { params })
   },
 }
@@ -13,6 +13,10 @@ const usersApi = {
     return apiClient.put('/users/me/username', { name })
   },
 
+  setPassword(currentPassword, newPassword) {
+    return apiClient.put('/users/me/password', { currentPassword, newPassword })
+  },
+
   uploadPhoto(photoFile) {
     const formData = new FormData()
     formData.append('photo', photoFile)
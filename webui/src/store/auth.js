@@ -53,7 +53,7 @@ export const useAuthStore = defineStore('auth', {
     currentUser: (state) => state.user,
     authToken: (state) => state.token,
     name: (state) => state.user?.name || '',
-    userId: (state) => state.user?.id || state.token,
+    userId: (state) => state.user?.id || null,
   },
 
   actions: {
@@ -82,14 +82,18 @@ export const useAuthStore = defineStore('auth', {
       this.isLoading = isLoading
     },
 
-    // Log in user or create a new account with just a username
-    async login({ username, rememberMe = false }) {
+    // Log in user or create a new account with a username and optional password
+    async login({ username, password = '', rememberMe = false }) {
       this.setLoading(true)
 
       try {
-        const response = await apiClient.post('/session', { name: username })
+        const payload = { name: username }
+        if (password) {
+          payload.password = password
+        }
+        const response = await apiClient.post('/session', payload)
 
-        const { id } = response.data
+        const { id, token } = response.data
 
         // Create user object that includes all data from response
         const user = {
@@ -97,9 +101,6 @@ export const useAuthStore = defineStore('auth', {
           name: username,
         }
 
-        // The user ID serves as the authentication token in this system
-        const token = id
-
         // Set token in API client for future requests
         apiClient.defaults.headers.common['Authorization'] = `Bearer ${token}`
 
@@ -121,6 +122,13 @@ export const useAuthStore = defineStore('auth', {
 
     // Log out user
     async logout() {
+      // Revoke the session on the server, ignoring failures for already expired tokens
+      try {
+        await apiClient.delete('/session')
+      } catch (error) {
+        console.warn('Failed to revoke session:', error)
+      }
+
       // Remove token from API client
       delete apiClient.defaults.headers.common['Authorization']
 
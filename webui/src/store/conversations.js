@@ -43,6 +43,14 @@ export const useConversationStore = defineStore('conversations', {
       try {
         const response = await conversationsApi.getById(conversationId)
         this.currentConversation = response.data
+
+        // Opening the conversation reads everything up to its last message
+        const lastMessage = response.data.lastMessage
+        if (lastMessage) {
+          conversationsApi.markRead(conversationId, lastMessage.id).catch((error) => {
+            console.warn('Failed to mark messages as read:', error)
+          })
+        }
         return response.data
       } catch (error) {
         this.error = error.message || 'Failed to fetch conversation'
@@ -3,6 +3,14 @@ import apiClient from '@/api/client'
 import { messagesApi } from '@/api/endpoints/messages'
 import { useAuthStore } from '@/store/auth'
 
+// The message type a file is sent as
+const mediaType = (file) => {
+  if (file.type.startsWith('image/')) return 'photo'
+  if (file.type.startsWith('audio/')) return 'audio'
+  if (file.type.startsWith('video/')) return 'video'
+  return 'file'
+}
+
 export const useMessageStore = defineStore('messages', {
   state: () => ({
     messages: [],
@@ -51,13 +59,17 @@ export const useMessageStore = defineStore('messages', {
       }
     },
 
-    // Action to send a photo message
-    async sendPhotoMessage(conversationId, photoFile, replyToId = '') {
+    // Action to send a photo, file, audio or video message, with an optional caption
+    async sendMediaMessage(conversationId, file, replyToId = '', caption = '') {
       this.isLoading = true
       try {
         const formData = new FormData()
         formData.append('conversationId', conversationId)
-        formData.append('photo', photoFile) // 'photo' matches the backend's expected field name
+        formData.append('type', mediaType(file))
+        formData.append('file', file) // 'file' matches the backend's expected field name
+        if (caption) {
+          formData.append('caption', caption)
+        }
         if (replyToId) {
           formData.append('replyTo', replyToId)
         }
@@ -72,13 +84,18 @@ export const useMessageStore = defineStore('messages', {
         this.messages.push(newMessage)
         return newMessage
       } catch (error) {
-        console.error('Error sending photo message:', error)
+        console.error('Error sending media message:', error)
         throw error
       } finally {
         this.isLoading = false
       }
     },
 
+    // Action to send a photo message
+    async sendPhotoMessage(conversationId, photoFile, replyToId = '') {
+      return this.sendMediaMessage(conversationId, photoFile, replyToId)
+    },
+
     // Add a message locally (for optimistic updates)
     addMessage(message) {
       this.messages = [message, ...this.messages]
@@ -106,14 +123,22 @@ export const useMessageStore = defineStore('messages', {
       }
     },
 
-    // Delete a message
-    async deleteMessage(messageId) {
+    // Delete a message for everyone, leaving a tombstone, or for the current user only
+    async deleteMessage(messageId, scope = 'everyone') {
       this.isLoading = true
       this.error = null
 
       try {
-        await messagesApi.delete(messageId)
-        this.messages = this.messages.filter((m) => m.id !== messageId)
+        await messagesApi.delete(messageId, scope)
+        if (scope === 'me') {
+          this.messages = this.messages.filter((m) => m.id !== messageId)
+        } else {
+          const message = this.messages.find((m) => m.id === messageId)
+          if (message) {
+            message.content = ''
+            message.deletedAt = new Date().toISOString()
+          }
+        }
         return true
       } catch (error) {
         this.error = error.message || 'Failed to delete message'
@@ -1,7 +1,17 @@
 export function getFullPhotoUrl(relativePath) {
+  // Media kept in a public bucket already has an absolute URL
+  if (/^https?:\/\//.test(relativePath || '')) {
+    return relativePath
+  }
   const backendBaseUrl = import.meta.env.VITE_PHOTO_SERVER_URL
   if (relativePath && !relativePath.startsWith('/')) {
     relativePath = '/' + relativePath
   }
   return `${backendBaseUrl}${relativePath}`
 }
+
+// getPhotoVariantUrl returns the full URL of a photo's thumbnail of the given size,
+// falling back to the original for photos that have no thumbnails
+export function getPhotoVariantUrl(variants, size, original) {
+  return getFullPhotoUrl(variants?.[size] || variants?.original || original)
+}